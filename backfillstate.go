@@ -17,6 +17,8 @@ package main
 import (
 	"fmt"
 	"math"
+	"slices"
+	"sort"
 )
 
 type osdBackfillState struct {
@@ -30,12 +32,12 @@ type osdBackfillState struct {
 	// the default in backfillState is used.
 	maxBackfillReservations int
 
-	// The number of backfills in which this OSD is a source.
-	// TODO: We don't account for degraded backfills today, where EC PGs
-	// will use multiple OSDs to reconstruct the data instead of reading
-	// the chunk from a single source OSD. There may be other cases where
-	// this occurs as well (e.g., what happens when there are multiple
-	// backfill targets?).
+	// The number of backfills in which this OSD is a source. For degraded
+	// EC backfills, where the missing shard is reconstructed instead of
+	// being read from a single source OSD, every surviving shard's OSD is
+	// a source.
+	// TODO: There may be other cases where multiple OSDs are read from
+	// (e.g., what happens when there are multiple backfill targets?).
 	backfillsFrom int
 }
 
@@ -44,9 +46,20 @@ type backfillState struct {
 	pgbs map[string]*pgBriefItem
 
 	maxBackfillsFrom int
+	// The total number of backfills in the cluster, and the configured
+	// maximum for that total.
+	backfills           int
+	maxClusterBackfills int
 	// The configured default max backfill reservations when not specified
 	// for an OSD.
 	maxBackfillReservations int
+	// Max backfill reservations, by pool, for OSDs taking on backfill for
+	// that pool's PGs.
+	poolMaxBackfillReservations map[int]int
+	// The up set of each remapped PG before its first remap, so that the
+	// backfill targets added by the remaps can be told apart from those
+	// that were already there.
+	originalUps map[string][]int
 }
 
 func mustGetCurrentBackfillState() *backfillState {
@@ -57,15 +70,45 @@ func mustGetCurrentBackfillState() *backfillState {
 		bs.pgbs[pgb.PgID] = pgb
 		bs.addReservations(pgb)
 	}
+	if reservationsFromCeph {
+		bs.loadMaxBackfillReservations()
+	}
 	return bs
 }
 
+// loadMaxBackfillReservations sets the max backfill reservations of each 'up'
+// OSD to its osd_max_backfills setting. OSDs whose setting can't be read are
+// left with the default.
+func (bs *backfillState) loadMaxBackfillReservations() {
+	var osds []int
+	for _, o := range osdDump().Osds {
+		if o.Up != 0 {
+			osds = append(osds, o.Osd)
+		}
+	}
+
+	maxs, err := getOsdsMaxBackfills(osds)
+	if err != nil {
+		logf(logWarn, "%v; using the default max backfill reservations", err)
+		return
+	}
+	if n := len(osds) - len(maxs); n > 0 {
+		logf(logWarn, "osd_max_backfills isn't set in the mon config database for %d OSD(s); using the default max backfill reservations for them", n)
+	}
+	for osd, max := range maxs {
+		bs.osd(osd).maxBackfillReservations = max
+	}
+}
+
 func makeBackfillState() *backfillState {
 	return &backfillState{
 		osds: make(map[int]*osdBackfillState),
 		pgbs: make(map[string]*pgBriefItem),
 
+		originalUps: make(map[string][]int),
+
 		maxBackfillsFrom:        math.MaxInt32,
+		maxClusterBackfills:     math.MaxInt32,
 		maxBackfillReservations: math.MaxInt32,
 	}
 }
@@ -80,6 +123,9 @@ func (bs *backfillState) accountForRemap(pgid string, from, to int) {
 
 	for i, osd := range pgb.Up {
 		if osd == from {
+			if _, ok := bs.originalUps[pgid]; !ok {
+				bs.originalUps[pgid] = slices.Clone(pgb.Up)
+			}
 			bs.removeReservations(pgb)
 			pgb.Up[i] = to
 			// Do not use the upmap here as we don't need to strictly re-order the
@@ -93,25 +139,26 @@ func (bs *backfillState) accountForRemap(pgid string, from, to int) {
 	// We can get here if a remap has been requested where the 'from' OSD
 	// is currently down. As noted in the osdBackfillState type TODO, we
 	// don't handle degraded backfill today.
-	fmt.Printf("pg %s: osd %d not in up set, unable to compute effect of remap on backfill state\n", pgid, from)
+	warnf("pg %s: osd %d not in up set, unable to compute effect of remap on backfill state", pgid, from)
 }
 
 func (bs *backfillState) addReservations(pgb *pgBriefItem) {
-	srcs, tgts := computeBackfillSrcsTgts(pgb)
-	for _, osd := range srcs {
+	_, tgts := computeBackfillSrcsTgts(pgb)
+	for _, osd := range computeBackfillReadSrcs(pgb) {
 		bs.osd(osd).backfillsFrom++
 	}
 	for _, osd := range tgts {
 		bs.osd(osd).remoteReservations++
 	}
+	bs.backfills += len(tgts)
 	if len(tgts) != 0 {
 		bs.osd(pgb.primaryOsd()).localReservations++
 	}
 }
 
 func (bs *backfillState) removeReservations(pgb *pgBriefItem) {
-	srcs, tgts := computeBackfillSrcsTgts(pgb)
-	for _, osd := range srcs {
+	_, tgts := computeBackfillSrcsTgts(pgb)
+	for _, osd := range computeBackfillReadSrcs(pgb) {
 		obs := bs.osd(osd)
 		if obs.backfillsFrom == 0 {
 			panic(fmt.Sprintf("no backfills from remaining on %d", osd))
@@ -125,6 +172,7 @@ func (bs *backfillState) removeReservations(pgb *pgBriefItem) {
 		}
 		obs.remoteReservations--
 	}
+	bs.backfills -= len(tgts)
 	if len(tgts) != 0 {
 		obs := bs.osd(pgb.primaryOsd())
 		if obs.localReservations == 0 {
@@ -160,15 +208,19 @@ func (bs *backfillState) hasRoomForRemap(pgid string, from, to int) bool {
 	// single-threaded it's correct.
 	bs.accountForRemap(pgid, from, to)
 
+	if bs.backfills > bs.maxClusterBackfills {
+		hasRoom = false
+	}
+
 	pgb := bs.pgbs[pgid]
 	primary := pgb.primaryOsd()
-	if bs.osd(primary).localReservations > bs.getMaxBackfillReservations(primary) {
+	if bs.osd(primary).localReservations > bs.getMaxBackfillReservationsForPg(primary, pgid) {
 		hasRoom = false
 	}
 
 	_, tgts := computeBackfillSrcsTgts(pgb)
 	for _, osd := range tgts {
-		if bs.osd(osd).remoteReservations > bs.getMaxBackfillReservations(osd) {
+		if bs.osd(osd).remoteReservations > bs.getMaxBackfillReservationsForPg(osd, pgid) {
 			hasRoom = false
 		}
 	}
@@ -185,6 +237,86 @@ func (bs *backfillState) getMaxBackfillReservations(osd int) int {
 	return bs.maxBackfillReservations
 }
 
+// getMaxBackfillReservationsForPg is getMaxBackfillReservations when taking on
+// backfill for the given PG: if its pool has a limit that is more restrictive
+// than the OSD's, the pool's limit applies.
+func (bs *backfillState) getMaxBackfillReservationsForPg(osd int, pgid string) int {
+	return bs.getMaxBackfillReservationsForPool(osd, pgPoolID(pgid))
+}
+
+// getMaxBackfillReservationsForPool is getMaxBackfillReservationsForPg for
+// any PG in the given pool.
+func (bs *backfillState) getMaxBackfillReservationsForPool(osd int, pool int) int {
+	max := bs.getMaxBackfillReservations(osd)
+	if poolMax, ok := bs.poolMaxBackfillReservations[pool]; ok && poolMax < max {
+		return poolMax
+	}
+	return max
+}
+
+// osdBackfillCounts is a point-in-time count of the backfills that an OSD is
+// involved in.
+type osdBackfillCounts struct {
+	sources int
+	targets int
+	// Local (primary) reservations; targets are the remote ones.
+	locals int
+}
+
+// snapshotCounts returns a copy of the current per-OSD backfill counts.
+func (bs *backfillState) snapshotCounts() map[int]osdBackfillCounts {
+	counts := make(map[int]osdBackfillCounts, len(bs.osds))
+	for osd, obs := range bs.osds {
+		counts[osd] = osdBackfillCounts{
+			sources: obs.backfillsFrom,
+			targets: obs.remoteReservations,
+			locals:  obs.localReservations,
+		}
+	}
+	return counts
+}
+
+// addedBackfillTargets returns the number of backfill targets that the remaps
+// accounted for so far have added, not counting those they have canceled.
+func (bs *backfillState) addedBackfillTargets() int {
+	added := 0
+	for pgid, up := range bs.originalUps {
+		pgb := bs.pgbs[pgid]
+		_, before := computeBackfillSrcsTgts(&pgBriefItem{PgID: pgid, Up: up, Acting: pgb.Acting})
+		_, after := computeBackfillSrcsTgts(pgb)
+		for _, osd := range after {
+			if !slices.Contains(before, osd) {
+				added++
+			}
+		}
+	}
+	return added
+}
+
+// saturatedOsds returns the OSDs that are at or above their limit for
+// backfills as a source, for remote (target) reservations, and for local
+// (primary) reservations, respectively, when taking on backfill for a PG in
+// the given pool. Pass -1 for the limits that apply to every pool.
+func (bs *backfillState) saturatedOsds(pool int) ([]int, []int, []int) {
+	var srcs, tgts, primaries []int
+	for osd, obs := range bs.osds {
+		if obs.backfillsFrom >= bs.maxBackfillsFrom {
+			srcs = append(srcs, osd)
+		}
+		max := bs.getMaxBackfillReservationsForPool(osd, pool)
+		if obs.remoteReservations >= max {
+			tgts = append(tgts, osd)
+		}
+		if obs.localReservations >= max {
+			primaries = append(primaries, osd)
+		}
+	}
+	sort.Ints(srcs)
+	sort.Ints(tgts)
+	sort.Ints(primaries)
+	return srcs, tgts, primaries
+}
+
 func computeBackfillSrcsTgts(pgb *pgBriefItem) ([]int, []int) {
 	srcs := []int{}
 	tgts := []int{}
@@ -199,3 +331,40 @@ func computeBackfillSrcsTgts(pgb *pgBriefItem) ([]int, []int) {
 	}
 	return srcs, tgts
 }
+
+// computeBackfillReadSrcs returns the OSDs that backfill of the given PG reads
+// from, each once. A missing shard of a degraded EC PG has no source of its
+// own; it is reconstructed from the surviving shards, all of which are
+// counted.
+func computeBackfillReadSrcs(pgb *pgBriefItem) []int {
+	srcs, _ := computeBackfillSrcsTgts(pgb)
+	if !slices.Contains(srcs, invalidOSD) || !osdPoolDetails().PgUsesEC(pgb.PgID) {
+		return srcs
+	}
+
+	readSrcs := []int{}
+	for _, osd := range append(srcs, pgb.Acting...) {
+		if osd != invalidOSD && !slices.Contains(readSrcs, osd) {
+			readSrcs = append(readSrcs, osd)
+		}
+	}
+	return readSrcs
+}
+
+// estimateBackfillBytes estimates the number of bytes that will be written to
+// backfill targets for the given PGs. For EC pools, only a single shard's
+// worth of data is written per target.
+func (bs *backfillState) estimateBackfillBytes(pgids []string, bytes map[string]int64) float64 {
+	pools := osdPoolDetails()
+
+	total := 0.0
+	for _, pgid := range pgids {
+		pgb, ok := bs.pgbs[pgid]
+		if !ok {
+			continue
+		}
+		_, tgts := computeBackfillSrcsTgts(pgb)
+		total += float64(len(tgts)) * float64(bytes[pgid]) * pools.PgShardFraction(pgid)
+	}
+	return total
+}
@@ -15,6 +15,8 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -103,3 +105,261 @@ func TestBackfillState(t *testing.T) {
 	require.Equal(t, 1, bs.osd(77).remoteReservations)
 	require.Equal(t, 1, bs.osd(77).backfillsFrom)
 }
+
+func TestBackfillStateDegradedEC(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdPoolDetailOut := `
+[
+ { "pool_id": 1, "pool_name": "replicated", "erasure_code_profile": "" },
+ { "pool_id": 2, "pool_name": "ec", "erasure_code_profile": "ec21" }
+]
+`
+	// 2.01's third shard is missing, and must be reconstructed from the
+	// other two; 2.02 is an ordinary EC backfill; 1.01 is a degraded
+	// replicated backfill, which is accounted as before.
+	pgDumpOut := `
+[
+ { "pgid": "1.01", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 2147483647 ] },
+ { "pgid": "2.01", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 2147483647 ] },
+ { "pgid": "2.02", "up": [ 4, 5, 6 ], "acting": [ 4, 5, 7 ] }
+]
+`
+	runOsdPoolLs = func() (string, error) { return osdPoolDetailOut, nil }
+	runECProfileGet = func(string) (string, error) { return `{ "k": "2", "m": "1" }`, nil }
+	runOsdDump = func() (string, error) { return "{}", nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	bs := mustGetCurrentBackfillState()
+
+	// Check initial state.
+	require.Equal(t, 2, bs.osd(1).localReservations)
+	require.Equal(t, 1, bs.osd(1).backfillsFrom)
+	require.Equal(t, 0, bs.osd(2).localReservations)
+	require.Equal(t, 1, bs.osd(2).backfillsFrom)
+	require.Equal(t, 1, bs.osd(3).remoteReservations)
+	require.Equal(t, 0, bs.osd(3).backfillsFrom)
+	require.Equal(t, 1, bs.osd(4).localReservations)
+	require.Equal(t, 0, bs.osd(4).backfillsFrom)
+	require.Equal(t, 0, bs.osd(5).backfillsFrom)
+	require.Equal(t, 2, bs.osd(6).remoteReservations)
+	require.Equal(t, 1, bs.osd(7).backfillsFrom)
+	require.Equal(t, 1, bs.osd(invalidOSD).backfillsFrom)
+
+	// Moving 2.01's missing shard elsewhere doesn't change its sources.
+	bs.accountForRemap("2.01", 3, 8)
+
+	require.Equal(t, 1, bs.osd(1).backfillsFrom)
+	require.Equal(t, 1, bs.osd(2).backfillsFrom)
+	require.Equal(t, 0, bs.osd(3).remoteReservations)
+	require.Equal(t, 1, bs.osd(8).remoteReservations)
+
+	// Moving an intact shard adds a reservation, but 2 is already a
+	// source for the reconstruction.
+	bs.accountForRemap("2.01", 2, 9)
+
+	require.Equal(t, 1, bs.osd(1).backfillsFrom)
+	require.Equal(t, 1, bs.osd(2).backfillsFrom)
+	require.Equal(t, 1, bs.osd(9).remoteReservations)
+
+	// Undo both.
+	bs.accountForRemap("2.01", 9, 2)
+	bs.accountForRemap("2.01", 8, 3)
+
+	require.Equal(t, 1, bs.osd(1).backfillsFrom)
+	require.Equal(t, 1, bs.osd(2).backfillsFrom)
+	require.Equal(t, 1, bs.osd(3).remoteReservations)
+	require.Equal(t, 0, bs.osd(8).remoteReservations)
+	require.Equal(t, 0, bs.osd(9).remoteReservations)
+}
+
+func TestMaxClusterBackfills(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.01", "up": [ 77, 1, 2 ], "acting": [ 77, 1, 2 ] },
+ { "pgid": "1.02", "up": [ 77, 3, 4 ], "acting": [ 77, 3, 5 ] },
+ { "pgid": "1.03", "up": [ 77, 5, 6 ], "acting": [ 3, 5, 7 ] }
+]
+`
+	runOsdDump = func() (string, error) { return "{}", nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	bs := mustGetCurrentBackfillState()
+	require.Equal(t, 3, bs.backfills)
+
+	// No limit by default.
+	require.True(t, bs.hasRoomForRemap("1.01", 1, 6))
+
+	bs.maxClusterBackfills = 4
+	require.True(t, bs.hasRoomForRemap("1.01", 1, 6))
+	bs.accountForRemap("1.01", 1, 6)
+	require.Equal(t, 4, bs.backfills)
+	require.False(t, bs.hasRoomForRemap("1.01", 2, 8))
+
+	// Canceling a backfill frees up room.
+	bs.accountForRemap("1.02", 4, 5)
+	require.Equal(t, 3, bs.backfills)
+	require.True(t, bs.hasRoomForRemap("1.01", 2, 8))
+}
+
+func TestPoolMaxBackfillReservations(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.01", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "2.01", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.02", "up": [ 4, 6 ], "acting": [ 4, 5 ] }
+]
+`
+	runOsdDump = func() (string, error) { return "{}", nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	bs := mustGetCurrentBackfillState()
+	bs.maxBackfillReservations = 10
+	bs.poolMaxBackfillReservations = map[int]int{2: 1}
+
+	// osd.6 already has a remote reservation, so it can take on more
+	// backfill for pool 1, but not for pool 2.
+	require.Equal(t, 1, bs.getMaxBackfillReservationsForPg(6, "2.01"))
+	require.False(t, bs.hasRoomForRemap("2.01", 3, 6))
+	require.Equal(t, 10, bs.getMaxBackfillReservationsForPg(6, "1.01"))
+	require.True(t, bs.hasRoomForRemap("1.01", 3, 6))
+
+	// The more restrictive of the OSD and pool limits applies.
+	bs.osd(6).maxBackfillReservations = 1
+	bs.poolMaxBackfillReservations[1] = 5
+	require.Equal(t, 1, bs.getMaxBackfillReservationsForPg(6, "1.01"))
+	require.False(t, bs.hasRoomForRemap("1.01", 3, 6))
+
+	bs.osd(6).maxBackfillReservations = 8
+	bs.poolMaxBackfillReservations[2] = 3
+	require.Equal(t, 3, bs.getMaxBackfillReservationsForPg(6, "2.01"))
+	require.Equal(t, 5, bs.getMaxBackfillReservationsForPg(6, "1.01"))
+	require.True(t, bs.hasRoomForRemap("2.01", 3, 6))
+}
+
+func TestReservationsFromCeph(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func() { reservationsFromCeph = false }()
+	osdDumpOut := `
+{
+  "osds": [
+    { "osd": 1, "in": 1, "up": 1 },
+    { "osd": 2, "in": 1, "up": 1 },
+    { "osd": 3, "in": 1, "up": 1 },
+    { "osd": 4, "in": 1, "up": 1 },
+    { "osd": 5, "in": 1, "up": 1 },
+    { "osd": 6, "in": 0, "up": 0 }
+  ]
+}
+`
+	osdTreeOut := `
+{
+  "nodes": [
+    { "children": [ 1, 2, 3 ], "type": "host", "name": "host1", "id": -1 },
+    { "children": [ 4, 5 ], "type": "host", "name": "host2", "id": -2 },
+    { "type": "osd", "name": "osd.1", "id": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.2", "id": 2, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.3", "id": 3, "device_class": "ssd" },
+    { "type": "osd", "name": "osd.4", "id": 4, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.5", "id": 5, "device_class": "hdd" }
+  ]
+}
+`
+	// osd.1 has its own setting; osd.3 gets the ssd one; osd.4 and osd.5
+	// get the host2 one; and osd.2 gets the osd one, which overrides
+	// global.
+	configDumpOut := `
+[
+  { "section": "global", "name": "osd_max_backfills", "value": "1", "mask": "" },
+  { "section": "osd", "name": "osd_max_backfills", "value": "2", "mask": "" },
+  { "section": "osd", "name": "osd_max_backfills", "value": "6", "mask": "class:ssd" },
+  { "section": "osd", "name": "osd_max_backfills", "value": "7", "mask": "host:host2" },
+  { "section": "osd", "name": "osd_recovery_max_active", "value": "9", "mask": "" },
+  { "section": "osd.1", "name": "osd_max_backfills", "value": "3", "mask": "" },
+  { "section": "osd.3", "name": "osd_recovery_max_active", "value": "9", "mask": "" },
+  { "section": "mon", "name": "osd_max_backfills", "value": "9", "mask": "" }
+]
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return "[]", nil }
+	dumps := 0
+	runConfigDump = func() (string, error) {
+		dumps++
+		return configDumpOut, nil
+	}
+
+	// Not queried by default.
+	bs := mustGetCurrentBackfillState()
+	require.Zero(t, dumps)
+	require.Equal(t, math.MaxInt32, bs.getMaxBackfillReservations(1))
+
+	reservationsFromCeph = true
+	bs = mustGetCurrentBackfillState()
+	require.Equal(t, 1, dumps)
+	require.Equal(t, 3, bs.getMaxBackfillReservations(1))
+	require.Equal(t, 2, bs.getMaxBackfillReservations(2))
+	require.Equal(t, 6, bs.getMaxBackfillReservations(3))
+	require.Equal(t, 7, bs.getMaxBackfillReservations(4))
+	require.Equal(t, 7, bs.getMaxBackfillReservations(5))
+
+	// The default is used when no setting applies or the dump fails.
+	configDumpOut = `[ { "section": "osd.1", "name": "osd_max_backfills", "value": "3", "mask": "" } ]`
+	bs = mustGetCurrentBackfillState()
+	bs.maxBackfillReservations = 2
+	require.Equal(t, 3, bs.getMaxBackfillReservations(1))
+	require.Equal(t, 2, bs.getMaxBackfillReservations(2))
+
+	runConfigDump = func() (string, error) { return "", fmt.Errorf("Error EACCES: access denied") }
+	bs = mustGetCurrentBackfillState()
+	bs.maxBackfillReservations = 2
+	require.Equal(t, 2, bs.getMaxBackfillReservations(1))
+}
+
+func TestEstimateBackfillBytes(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdPoolDetailOut := `
+[
+ { "pool_id": 1, "pool_name": "replicated", "erasure_code_profile": "" },
+ { "pool_id": 3, "pool_name": "ec", "erasure_code_profile": "ec42" }
+]
+`
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "3.1", "up": [ 1, 2, 3, 4, 5, 9 ], "acting": [ 1, 2, 3, 4, 7, 8 ] }
+]
+`
+	runOsdPoolLs = func() (string, error) { return osdPoolDetailOut, nil }
+	runECProfileGet = func(name string) (string, error) {
+		require.Equal(t, "ec42", name)
+		return `{ "k": "4", "m": "2", "plugin": "jerasure" }`, nil
+	}
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	bs := mustGetCurrentBackfillState()
+	bytes := map[string]int64{"1.1": 1000, "1.2": 1000, "3.1": 4000}
+
+	require.Equal(t, 4, osdPoolDetails().Pools[3].ECK)
+	require.Equal(t, 2, osdPoolDetails().Pools[3].ECM)
+
+	// Replicated: one full replica is written.
+	require.Equal(t, 1000.0, bs.estimateBackfillBytes([]string{"1.1"}, bytes))
+	// No backfill, nothing written.
+	require.Equal(t, 0.0, bs.estimateBackfillBytes([]string{"1.2"}, bytes))
+	// EC 4+2: two shards of 1/4 the PG size each are written.
+	require.Equal(t, 2000.0, bs.estimateBackfillBytes([]string{"3.1"}, bytes))
+
+	// If the profile can't be read, shards are counted as whole PGs.
+	savedOsdPoolsDetails = nil
+	runECProfileGet = func(string) (string, error) { return "", fmt.Errorf("Error ENOENT") }
+	require.Equal(t, 0, osdPoolDetails().Pools[3].ECK)
+	require.Equal(t, 8000.0, bs.estimateBackfillBytes([]string{"3.1"}, bytes))
+}
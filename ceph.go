@@ -20,10 +20,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
@@ -34,17 +38,112 @@ const (
 )
 
 var (
-	runOsdDump        = func() (string, error) { return run("ceph", "osd", "dump", "-f", "json") }
-	runOsdTree        = func() (string, error) { return run("ceph", "osd", "tree", "-f", "json") }
-	runOsdPoolLs      = func() (string, error) { return run("ceph", "osd", "pool", "ls", "detail", "-f", "json") }
-	runPgDumpPgsBrief = func() (string, error) { return run("ceph", "pg", "dump", "pgs_brief", "-f", "json") }
-	runPgQuery        = func(pgid string) (string, error) { return run("ceph", "pg", pgid, "query", "-f", "json") }
+	runOsdDump        = func() (string, error) { return run(cephReadCmd("osd", "dump", "-f", "json")...) }
+	runOsdTree        = func() (string, error) { return run(cephReadCmd("osd", "tree", "-f", "json")...) }
+	runOsdPoolLs      = func() (string, error) { return run(cephReadCmd("osd", "pool", "ls", "detail", "-f", "json")...) }
+	runPgDumpPgsBrief = func() (string, error) { return run(cephReadCmd("pg", "dump", "pgs_brief", "-f", "json")...) }
+	runPgQuery        = func(pgid string) (string, error) { return run(cephReadCmd("pg", pgid, "query", "-f", "json")...) }
 	runCrushCmp       = func(path string) (string, error) { return runCombined("crushdiff", "compare", path, "--verbose") }
+	runCrushExport    = func(path string) (string, error) { return runCombined("crushdiff", "export", path) }
+	runCrushDecompile = func(in, out string) (string, error) { return runCombined("crushtool", "-d", in, "-o", out) }
+	runPgDumpPgs      = func() (string, error) { return run(cephReadCmd("pg", "dump", "pgs", "-f", "json")...) }
+	runOsdDf          = func() (string, error) { return run(cephReadCmd("osd", "df", "-f", "json")...) }
+	runStatus         = func() (string, error) { return run(cephReadCmd("status", "-f", "json")...) }
+	runPgUpmapItems   = func(args ...string) (string, error) {
+		return run(append([]string{"ceph", "osd", "pg-upmap-items"}, args...)...)
+	}
+	runRmPgUpmapItems = func(pgid string) (string, error) { return run("ceph", "osd", "rm-pg-upmap-items", pgid) }
+	runOsdUnset       = func(flag string) (string, error) { return run("ceph", "osd", "unset", flag) }
+	runBalancerOn     = func() (string, error) { return run("ceph", "balancer", "on") }
+	runConfigKeyGet   = func(key string) (string, error) { return run(cephReadCmd("config-key", "get", key)...) }
+	runConfigKeySet   = func(key, path string) (string, error) { return run("ceph", "config-key", "set", key, "-i", path) }
+	runECProfileGet   = func(name string) (string, error) {
+		return run(cephReadCmd("osd", "erasure-code-profile", "get", name, "-f", "json")...)
+	}
+	runConfigDump    = func() (string, error) { return run(cephReadCmd("config", "dump", "-f", "json")...) }
+	runOsdGetmap     = func(path string) (string, error) { return run(cephReadCmd("osd", "getmap", "-o", path)...) }
+	runCrushRuleDump = func(rule string) (string, error) {
+		return run(cephReadCmd("osd", "crush", "rule", "dump", rule, "-f", "json")...)
+	}
+	// runOsdmaptoolTestMapPgs prints where each PG in the given osdmap
+	// would be placed once the given OSDs are marked out.
+	runOsdmaptoolTestMapPgs = func(path string, markOut []int) (string, error) {
+		args := []string{"osdmaptool", path}
+		for _, osd := range markOut {
+			args = append(args, "--mark-out", strconv.Itoa(osd))
+		}
+		return run(append(args, "--test-map-pgs-dump")...)
+	}
 
 	pgQueryPeerRegexp = regexp.MustCompile(`(?P<osd>[0-9]+)(?:\((?P<index>[0-9]+)\))?`)
-	pgIdRegexp        = regexp.MustCompile(`(?P<pool>[0-9]+)\.(?P<id>[0-9a-f]+)`)
+	pgIdRegexp        = regexp.MustCompile(`^(?P<pool>[0-9]+)\.(?P<id>[0-9a-f]+)$`)
+	osdRangeRegexp    = regexp.MustCompile(`^([0-9]+)-([0-9]+)$`)
 )
 
+// useInputDir makes all Ceph queries read from files in the given directory
+// (a captured snapshot of a cluster's state) rather than running ceph, and
+// makes commands that would modify the cluster print themselves instead.
+func useInputDir(dir string) {
+	read := func(name string) (string, error) {
+		out, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", errors.Wrapf(err, "--input-dir: unable to read %s", name)
+		}
+		return string(out), nil
+	}
+	wouldRun := func(command ...string) (string, error) {
+		fmt.Printf("Would run: %s\n", strings.Join(command, " "))
+		return "", nil
+	}
+
+	runOsdDump = func() (string, error) { return read("osd-dump.json") }
+	runOsdTree = func() (string, error) { return read("osd-tree.json") }
+	runOsdPoolLs = func() (string, error) { return read("osd-pool-ls.json") }
+	runPgDumpPgsBrief = func() (string, error) { return read("pg-dump-pgs-brief.json") }
+	runPgQuery = func(pgid string) (string, error) { return read(fmt.Sprintf("pg-query-%s.json", pgid)) }
+	runPgDumpPgs = func() (string, error) { return read("pg-dump-pgs.json") }
+	runOsdDf = func() (string, error) { return read("osd-df.json") }
+	runStatus = func() (string, error) { return read("status.json") }
+	runCrushRuleDump = func(rule string) (string, error) { return read(fmt.Sprintf("crush-rule-%s.json", rule)) }
+	runECProfileGet = func(name string) (string, error) {
+		return read(fmt.Sprintf("erasure-code-profile-%s.json", name))
+	}
+	runConfigDump = func() (string, error) { return read("config-dump.json") }
+	runOsdGetmap = func(path string) (string, error) {
+		out, err := read("osdmap")
+		if err != nil {
+			return "", err
+		}
+		return "", os.WriteFile(path, []byte(out), 0644)
+	}
+	runConfigKeyGet = func(key string) (string, error) {
+		// Treat a missing file like a missing key.
+		out, err := os.ReadFile(filepath.Join(dir, "config-key-"+strings.ReplaceAll(key, "/", "-")))
+		if err != nil {
+			return "", errors.Errorf("Error ENOENT: --input-dir: no saved value for config-key '%s'", key)
+		}
+		return string(out), nil
+	}
+
+	runPgUpmapItems = func(args ...string) (string, error) {
+		return wouldRun(append([]string{"ceph", "osd", "pg-upmap-items"}, args...)...)
+	}
+	runRmPgUpmapItems = func(pgid string) (string, error) { return wouldRun("ceph", "osd", "rm-pg-upmap-items", pgid) }
+	runOsdUnset = func(flag string) (string, error) { return wouldRun("ceph", "osd", "unset", flag) }
+	runBalancerOn = func() (string, error) { return wouldRun("ceph", "balancer", "on") }
+}
+
+// cephReadCmd builds a read-only ceph command line, directed at the mon given
+// by --mon-host if there is one. Commands that modify the cluster should not
+// use this.
+func cephReadCmd(args ...string) []string {
+	cmd := []string{"ceph"}
+	if monHost != "" {
+		cmd = append(cmd, "-m", monHost)
+	}
+	return append(cmd, args...)
+}
+
 type pgUpmapItem struct {
 	PgID     string    `json:"pgid"`
 	Mappings []mapping `json:"mappings"`
@@ -61,6 +160,20 @@ type osdDumpOut struct {
 		Osd int `json:"osd"`
 	} `json:"osds"`
 	PgUpmapItems []*pgUpmapItem `json:"pg_upmap_items"`
+	PgTemp       []*pgTempItem  `json:"pg_temp"`
+	// The cluster-wide OSD flags, comma-separated.
+	Flags string `json:"flags"`
+}
+
+func (o *osdDumpOut) hasFlag(flag string) bool {
+	return slices.Contains(strings.Split(o.Flags, ","), flag)
+}
+
+// pgTempItem is an entry in the pg_temp table, which Ceph uses to temporarily
+// override a PG's acting set, e.g. while backfill is in progress.
+type pgTempItem struct {
+	PgID string `json:"pgid"`
+	Osds []int  `json:"osds"`
 }
 
 type osdTreeOutNode struct {
@@ -87,10 +200,35 @@ type osdTreeNode struct {
 	Children []*osdTreeNode
 }
 
+type osdDfNode struct {
+	ID          int     `json:"id"`
+	Reweight    float64 `json:"reweight"`
+	KB          int64   `json:"kb"`
+	KBUsed      int64   `json:"kb_used"`
+	Utilization float64 `json:"utilization"`
+	PGs         int     `json:"pgs"`
+}
+
+type osdDfOut struct {
+	Nodes []*osdDfNode `json:"nodes"`
+}
+
 type osdPoolDetail struct {
 	ID        int    `json:"pool_id"`
 	Name      string `json:"pool_name"`
 	ECProfile string `json:"erasure_code_profile"`
+	CrushRule int    `json:"crush_rule"`
+	MinSize   int    `json:"min_size"`
+
+	// Data and coding chunk counts, filled in from the erasure code
+	// profile for EC pools; 0 if the profile couldn't be read.
+	ECK int `json:"-"`
+	ECM int `json:"-"`
+}
+
+type ecProfileOut struct {
+	K string `json:"k"`
+	M string `json:"m"`
 }
 
 type poolsDetails struct {
@@ -104,8 +242,8 @@ type parsedOsdTree struct {
 }
 
 type mapping struct {
-	From int `json:"from"`
-	To   int `json:"to"`
+	From int `json:"from" yaml:"from"`
+	To   int `json:"to" yaml:"to"`
 
 	dirty bool
 }
@@ -121,6 +259,17 @@ type pgBriefNautilus struct {
 	PgStats []*pgBriefItem `json:"pg_stats"`
 }
 
+type pgStatsItem struct {
+	PgID    string `json:"pgid"`
+	StatSum struct {
+		NumBytes int64 `json:"num_bytes"`
+	} `json:"stat_sum"`
+}
+
+type pgStatsNautilus struct {
+	PgStats []*pgStatsItem `json:"pg_stats"`
+}
+
 type pgQueryOut struct {
 	Acting []int `json:"acting"`
 	Info   struct {
@@ -218,6 +367,11 @@ func (pqo *pgQueryOut) getCompletePeers() []int {
 	return peers
 }
 
+// isScrubbing returns true if the PG is undergoing a scrub or deep-scrub.
+func (pgb *pgBriefItem) isScrubbing() bool {
+	return strings.Contains(pgb.State, "scrubbing")
+}
+
 func (pgb *pgBriefItem) primaryOsd() int {
 	for _, osd := range pgb.Acting {
 		if osd != invalidOSD {
@@ -281,33 +435,47 @@ func (pui *pgUpmapItem) String() string {
 	return str
 }
 
-func (pui *pgUpmapItem) do() {
+// do sets the upmap item in Ceph. All of the PG's mappings are always set in
+// a single command, so that there are never partial updates.
+func (pui *pgUpmapItem) do() error {
 	if len(pui.Mappings) == 0 {
-		_ = runOrDie("ceph", "osd", "rm-pg-upmap-items", pui.PgID)
-		return
+		if _, err := runRmPgUpmapItems(pui.PgID); err != nil {
+			return errors.Wrapf(err, "pg %s: failed to remove upmap item", pui.PgID)
+		}
+		return nil
 	}
 
-	cmd := []string{"ceph", "osd", "pg-upmap-items", pui.PgID}
+	args := []string{pui.PgID}
 	for _, m := range pui.Mappings {
-		cmd = append(cmd, fmt.Sprintf("%d", m.From), fmt.Sprintf("%d", m.To))
+		args = append(args, fmt.Sprintf("%d", m.From), fmt.Sprintf("%d", m.To))
+	}
+	if _, err := runPgUpmapItems(args...); err != nil {
+		return errors.Wrapf(err, "pg %s: failed to set upmap item", pui.PgID)
 	}
-	_ = runOrDie(cmd...)
+	return nil
+}
+
+func (pd *poolsDetails) poolForPg(pgid string) *osdPoolDetail {
+	if pool, ok := pd.Pools[pgPoolID(pgid)]; ok {
+		return pool
+	}
+	panic(fmt.Sprintf("could not find pool data for PG %s", pgid))
 }
 
 // Detect whether a given PG belongs to an erasure-coded pool
 func (pd *poolsDetails) PgUsesEC(pgid string) bool {
-	m := pgIdRegexp.FindStringSubmatch(pgid)
-	if len(m) != 3 {
-		panic(fmt.Sprintf("can't parse PGID %s", pgid))
-	}
-	poolId, err := strconv.Atoi(m[1])
-	if err != nil {
-		panic(fmt.Sprintf("can't parse pool in PGID %s", pgid))
-	}
-	if pool, ok := pd.Pools[poolId]; ok {
-		return pool.ECProfile != ""
+	return pd.poolForPg(pgid).ECProfile != ""
+}
+
+// PgShardFraction returns the fraction of a PG's bytes that is stored in each
+// of its shards (EC) or replicas (replicated), i.e. the fraction of the PG's
+// bytes that moves when a single OSD in its up set changes.
+func (pd *poolsDetails) PgShardFraction(pgid string) float64 {
+	pool := pd.poolForPg(pgid)
+	if pool.ECProfile == "" || pool.ECK == 0 {
+		return 1
 	}
-	panic(fmt.Sprintf("could not find pool data for PG %s", pgid))
+	return 1 / float64(pool.ECK)
 }
 
 func (r mapping) String() string {
@@ -354,6 +522,39 @@ func getOsdsForBucket(bucket string, deviceClass string) ([]int, error) {
 	return osds, nil
 }
 
+// getOsdsForDeviceClass returns all OSDs in the tree with the given device
+// class.
+func getOsdsForDeviceClass(deviceClass string) []int {
+	tree := osdTree()
+
+	osds := []int{}
+	for id, node := range tree.IDToNode {
+		if node.Type == "osd" && node.DeviceClass == deviceClass {
+			osds = append(osds, id)
+		}
+	}
+	sort.Ints(osds)
+	return osds
+}
+
+// getOsdsByReweight returns all 'in' OSDs in the tree whose reweight is below
+// (op '<') or above (op '>') the given threshold.
+func getOsdsByReweight(op byte, threshold float64) []int {
+	tree := osdTree()
+
+	osds := []int{}
+	for id, node := range tree.IDToNode {
+		if node.Type != "osd" || node.Reweight == 0 {
+			continue
+		}
+		if (op == '<' && node.Reweight < threshold) || (op == '>' && node.Reweight > threshold) {
+			osds = append(osds, id)
+		}
+	}
+	sort.Ints(osds)
+	return osds
+}
+
 func countCurrentBackfills() (map[int]int, map[int]int) {
 	sourceBackfillCounts := make(map[int]int)
 	targetBackfillCounts := make(map[int]int)
@@ -372,11 +573,18 @@ func countCurrentBackfills() (map[int]int, map[int]int) {
 	return sourceBackfillCounts, targetBackfillCounts
 }
 
-var savedPgDumpPgsBrief []*pgBriefItem
+var (
+	savedRawPgDumpPgsBrief []*pgBriefItem
+	savedPgDumpPgsBrief    []*pgBriefItem
+)
 
-func pgDumpPgsBrief() []*pgBriefItem {
-	if len(savedPgDumpPgsBrief) > 0 {
-		return savedPgDumpPgsBrief
+// rawPgDumpPgsBrief returns every PG in the PG dump as reported by Ceph,
+// without the sanitization and up set reordering done by pgDumpPgsBrief. This
+// is for checks that must not overlook PGs that the rest of pgremapper
+// ignores. The returned PGs must not be modified.
+func rawPgDumpPgsBrief() []*pgBriefItem {
+	if len(savedRawPgDumpPgsBrief) > 0 {
+		return savedRawPgDumpPgsBrief
 	}
 
 	out, err := runPgDumpPgsBrief()
@@ -394,6 +602,26 @@ func pgDumpPgsBrief() []*pgBriefItem {
 		}
 		pgBriefs = pgBriefNautilusOut.PgStats
 	}
+
+	savedRawPgDumpPgsBrief = pgBriefs
+	return pgBriefs
+}
+
+func pgDumpPgsBrief() []*pgBriefItem {
+	if len(savedPgDumpPgsBrief) > 0 {
+		return savedPgDumpPgsBrief
+	}
+
+	raw := rawPgDumpPgsBrief()
+	pgBriefs := make([]*pgBriefItem, 0, len(raw))
+	for _, pgb := range raw {
+		pgBriefs = append(pgBriefs, &pgBriefItem{
+			PgID:   pgb.PgID,
+			State:  pgb.State,
+			Up:     slices.Clone(pgb.Up),
+			Acting: slices.Clone(pgb.Acting),
+		})
+	}
 	pgBriefs = sanitizePgBriefs(pgBriefs)
 
 	for _, pgb := range pgBriefs {
@@ -405,22 +633,22 @@ func pgDumpPgsBrief() []*pgBriefItem {
 }
 
 func sanitizePgBriefs(pgBriefs []*pgBriefItem) []*pgBriefItem {
-	duplicateMessage := "WARNING: PG %s's %s set has one or more duplicated OSD IDs; this PG will be excluded from operations and reservation calculations. Please check your CRUSH rules and map.\n"
+	duplicateMessage := "PG %s's %s set has one or more duplicated OSD IDs; this PG will be excluded from operations and reservation calculations. Please check your CRUSH rules and map."
 	sanitized := make([]*pgBriefItem, 0, len(pgBriefs))
 
 	for _, pgBrief := range pgBriefs {
 		if len(pgBrief.Up) != len(pgBrief.Acting) {
-			fmt.Printf("WARNING: PG %s's up and acting sets have mismatched lengths (%d vs. %d), perhaps due to a change in CRUSH rules; this PG will be excluded from operations and reservation calculations.\n", pgBrief.PgID, len(pgBrief.Up), len(pgBrief.Acting))
+			warnf("PG %s's up and acting sets have mismatched lengths (%d vs. %d), perhaps due to a change in CRUSH rules; this PG will be excluded from operations and reservation calculations.", pgBrief.PgID, len(pgBrief.Up), len(pgBrief.Acting))
 			continue
 		}
 
 		if hasDuplicateOSDID(pgBrief.Acting) {
-			fmt.Printf(duplicateMessage, pgBrief.PgID, "acting")
+			warnf(duplicateMessage, pgBrief.PgID, "acting")
 			continue
 		}
 
 		if hasDuplicateOSDID(pgBrief.Up) {
-			fmt.Printf(duplicateMessage, pgBrief.PgID, "up")
+			warnf(duplicateMessage, pgBrief.PgID, "up")
 			continue
 		}
 
@@ -532,6 +760,17 @@ func pgUpmapItemMap() map[string]*pgUpmapItem {
 	return puis
 }
 
+func pgTempMap() map[string]*pgTempItem {
+	osdDumpOut := osdDump()
+
+	pgTemps := make(map[string]*pgTempItem)
+	for _, pt := range osdDumpOut.PgTemp {
+		pgTemps[pt.PgID] = pt
+	}
+
+	return pgTemps
+}
+
 var savedParsedOsdTree *parsedOsdTree
 
 func osdTree() *parsedOsdTree {
@@ -577,6 +816,207 @@ func osdTree() *parsedOsdTree {
 	return tree
 }
 
+const deniedOsdsConfigKey = "pgremapper/denied-osds"
+
+// getDeniedOsds returns the cluster-wide OSD denylist, stored in the mon
+// config-key store as a list of osdspecs separated by commas or whitespace.
+// A missing key means that no OSDs are denied.
+func getDeniedOsds() map[int]struct{} {
+	out, err := runConfigKeyGet(deniedOsdsConfigKey)
+	if err != nil {
+		if strings.Contains(err.Error(), "ENOENT") {
+			return map[int]struct{}{}
+		}
+		panic(errors.Wrapf(err, "failed to get config-key %s", deniedOsdsConfigKey))
+	}
+
+	denied := make(map[int]struct{})
+	for _, spec := range strings.FieldsFunc(out, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		osds, err := parseOsdSpec(spec)
+		if err != nil {
+			panic(errors.Wrapf(err, "invalid entry in config-key %s", deniedOsdsConfigKey))
+		}
+		for _, osd := range osds {
+			denied[osd] = struct{}{}
+		}
+	}
+	return denied
+}
+
+// configDumpEntry is an option set in the mon config database, for the given
+// section (global, a daemon type, or a daemon), optionally restricted by a
+// mask such as class:hdd or host:node1.
+type configDumpEntry struct {
+	Section string `json:"section"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Mask    string `json:"mask"`
+}
+
+// getOsdsMaxBackfills returns the osd_max_backfills setting of each of the
+// given OSDs, per the mon config database, using a single 'ceph config dump'.
+// As in Ceph, an OSD's own section takes precedence over the osd section,
+// which takes precedence over global, and within a section, masked entries
+// take precedence. OSDs with no applicable setting are left out.
+func getOsdsMaxBackfills(osds []int) (map[int]int, error) {
+	var entries []configDumpEntry
+	out, err := runConfigDump()
+	if err := parseCephCommand(out, err, &entries); err != nil {
+		return nil, errors.Wrap(err, "failed to get osd_max_backfills")
+	}
+
+	var tree *parsedOsdTree
+	matchesMask := func(osd int, mask string) bool {
+		if mask == "" {
+			return true
+		}
+		if tree == nil {
+			tree = osdTree()
+		}
+		n, ok := tree.IDToNode[osd]
+		if !ok {
+			return false
+		}
+		t, name, _ := strings.Cut(mask, ":")
+		if t == "class" {
+			return n.DeviceClass == name
+		}
+		p := n.getNearestParentOfType(t)
+		return p != nil && p.Name == name
+	}
+
+	maxs := make(map[int]int, len(osds))
+	for _, osd := range osds {
+		self := fmt.Sprintf("osd.%d", osd)
+		best := -1
+		for _, e := range entries {
+			if e.Name != "osd_max_backfills" {
+				continue
+			}
+			var rank int
+			switch e.Section {
+			case "global":
+				rank = 0
+			case "osd":
+				rank = 2
+			case self:
+				rank = 4
+			default:
+				continue
+			}
+			if e.Mask != "" {
+				rank++
+			}
+			if rank < best || !matchesMask(osd, e.Mask) {
+				continue
+			}
+			max, err := strconv.Atoi(e.Value)
+			if err != nil {
+				return nil, errors.Errorf("invalid osd_max_backfills '%s' for %s", e.Value, e.Section)
+			}
+			best, maxs[osd] = rank, max
+		}
+	}
+	return maxs, nil
+}
+
+var savedOsdDf map[int]*osdDfNode
+
+// osdDf returns the usage of each OSD, by ID.
+func osdDf() map[int]*osdDfNode {
+	df, err := tryOsdDf()
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	return df
+}
+
+// tryOsdDf is osdDf, but returns an error rather than panicking, for callers
+// that can do without OSD usage.
+func tryOsdDf() (map[int]*osdDfNode, error) {
+	if savedOsdDf != nil {
+		return savedOsdDf, nil
+	}
+
+	var out osdDfOut
+
+	jsonOut, err := runOsdDf()
+	if err := parseCephCommand(jsonOut, err, &out); err != nil {
+		return nil, err
+	}
+
+	savedOsdDf = make(map[int]*osdDfNode)
+	for _, n := range out.Nodes {
+		savedOsdDf[n.ID] = n
+	}
+	return savedOsdDf, nil
+}
+
+type crushRuleStep struct {
+	Op       string `json:"op"`
+	ItemName string `json:"item_name"`
+	Type     string `json:"type"`
+}
+
+type crushRule struct {
+	RuleID   int              `json:"rule_id"`
+	RuleName string           `json:"rule_name"`
+	Steps    []*crushRuleStep `json:"steps"`
+}
+
+func mustGetCrushRule(name string) *crushRule {
+	var out crushRule
+
+	jsonOut, err := runCrushRuleDump(name)
+	mustParseCephCommand(jsonOut, err, &out)
+	return &out
+}
+
+// mustGetCrushRuleCandidates returns the OSDs that the given CRUSH rule can
+// place data on, i.e. the in OSDs under the buckets it takes (restricted to a
+// device class for shadow buckets such as 'default~hdd'), along with the
+// bucket type of its failure domain, i.e. the type of its last choose or
+// chooseleaf step, and the rule's ID.
+func mustGetCrushRuleCandidates(name string) (map[int]struct{}, string, int) {
+	rule := mustGetCrushRule(name)
+
+	osds := make(map[int]struct{})
+	failureDomain := ""
+	for _, step := range rule.Steps {
+		switch {
+		case step.Op == "take":
+			bucket, class, _ := strings.Cut(step.ItemName, "~")
+			for _, osd := range mustGetOsdsForBucket(bucket, class) {
+				osds[osd] = struct{}{}
+			}
+		case strings.HasPrefix(step.Op, "choose"):
+			failureDomain = step.Type
+		}
+	}
+	if len(osds) == 0 {
+		panic(errors.Errorf("CRUSH rule '%s' doesn't take any OSDs", name))
+	}
+	return osds, failureDomain, rule.RuleID
+}
+
+type statusOut struct {
+	PgMap struct {
+		MisplacedRatio float64 `json:"misplaced_ratio"`
+	} `json:"pgmap"`
+}
+
+// misplacedRatio returns the fraction of objects in the cluster that are
+// misplaced, per 'ceph status'.
+func misplacedRatio() (float64, error) {
+	var out statusOut
+
+	jsonOut, err := runStatus()
+	if err := parseCephCommand(jsonOut, err, &out); err != nil {
+		return 0, err
+	}
+	return out.PgMap.MisplacedRatio, nil
+}
+
 var savedOsdPoolsDetails *poolsDetails
 
 // query and parse the full Ceph pool details
@@ -592,21 +1032,95 @@ func osdPoolDetails() *poolsDetails {
 	mustParseCephCommand(jsonOut, err, &pools)
 
 	poolsMap = make(map[int]*osdPoolDetail)
+	profiles := make(map[string]*ecProfileOut)
 	for _, pool := range pools {
 		poolsMap[pool.ID] = pool
+
+		if pool.ECProfile == "" {
+			continue
+		}
+		profile, ok := profiles[pool.ECProfile]
+		if !ok {
+			var err error
+			profile, err = getECProfile(pool.ECProfile)
+			if err != nil {
+				// Shard sizes are only used for estimates, so
+				// carry on, treating shards as whole PGs.
+				logf(logWarn, "pool %s: %v; its shard size is unknown", pool.Name, err)
+				profile = &ecProfileOut{}
+			}
+			profiles[pool.ECProfile] = profile
+		}
+		pool.ECK, _ = strconv.Atoi(profile.K)
+		pool.ECM, _ = strconv.Atoi(profile.M)
 	}
 
 	savedOsdPoolsDetails = &poolsDetails{Pools: poolsMap}
 	return savedOsdPoolsDetails
 }
 
+func getECProfile(name string) (*ecProfileOut, error) {
+	var out ecProfileOut
+
+	jsonOut, err := runECProfileGet(name)
+	if err := parseCephCommand(jsonOut, err, &out); err != nil {
+		return nil, errors.Wrapf(err, "failed to get erasure code profile %s", name)
+	}
+
+	return &out, nil
+}
+
+var savedPgBytes map[string]int64
+
+// pgBytes returns the number of bytes stored in each PG. Unlike most other
+// queries, errors are returned rather than causing a panic, as the
+// information is only used for estimates.
+func pgBytes() (map[string]int64, error) {
+	if savedPgBytes != nil {
+		return savedPgBytes, nil
+	}
+
+	out, err := runPgDumpPgs()
+	if err != nil {
+		return nil, err
+	}
+
+	var pgStats []*pgStatsItem
+	if err := json.Unmarshal(handleCephInf([]byte(out)), &pgStats); err != nil {
+		// Newer versions of Ceph have a slightly different structure.
+		var pgStatsNautilusOut pgStatsNautilus
+		if err := json.Unmarshal(handleCephInf([]byte(out)), &pgStatsNautilusOut); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		pgStats = pgStatsNautilusOut.PgStats
+	}
+
+	savedPgBytes = make(map[string]int64, len(pgStats))
+	for _, pgs := range pgStats {
+		savedPgBytes[pgs.PgID] = pgs.StatSum.NumBytes
+	}
+	return savedPgBytes, nil
+}
+
 func pgQuery(pgid string) *pgQueryOut {
+	out, err := tryPgQuery(pgid)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	return out
+}
+
+// tryPgQuery is pgQuery for callers that can carry on without the result,
+// e.g. when the query times out on a PG that is stuck peering.
+func tryPgQuery(pgid string) (*pgQueryOut, error) {
 	var out pgQueryOut
 
 	jsonOut, err := runPgQuery(pgid)
-	mustParseCephCommand(jsonOut, err, &out)
+	if err := parseCephCommand(jsonOut, err, &out); err != nil {
+		return nil, errors.Wrapf(err, "failed to query pg %s", pgid)
+	}
 
-	return &out
+	return &out, nil
 }
 
 func crushCmp(fp string) ([]pgMapping, error) {
@@ -640,6 +1154,224 @@ func crushCmp(fp string) ([]pgMapping, error) {
 	return mappings, nil
 }
 
+// osdOutMappings returns the mappings that marking the given OSDs out would
+// cause, computed by osdmaptool against the cluster's current osdmap. For EC
+// PGs, only the shard positions that held an out OSD are mapped, since the
+// position determines each OSD's shard; a position whose new OSD already
+// holds another shard of the PG can't be expressed as a mapping and is
+// skipped. Up sets of replicated PGs are diffed as sets, since CRUSH may also
+// reorder the OSDs that don't move.
+func osdOutMappings(osds []int) ([]pgMapping, error) {
+	dir, err := os.MkdirTemp("", "pgremapper")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "osdmap")
+	if _, err := runOsdGetmap(path); err != nil {
+		return nil, errors.Wrap(err, "failed to get the osdmap")
+	}
+
+	out, err := runOsdmaptoolTestMapPgs(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	before, err := parseTestMapPgsDump(out)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err = runOsdmaptoolTestMapPgs(path, osds)
+	if err != nil {
+		return nil, err
+	}
+	after, err := parseTestMapPgsDump(out)
+	if err != nil {
+		return nil, err
+	}
+
+	pgids := make([]string, 0, len(before))
+	for pgid := range before {
+		pgids = append(pgids, pgid)
+	}
+	sort.Strings(pgids)
+
+	markedOut := make(map[int]struct{}, len(osds))
+	for _, osd := range osds {
+		markedOut[osd] = struct{}{}
+	}
+
+	pools := osdPoolDetails()
+	mappings := []pgMapping{}
+	for _, pgid := range pgids {
+		from, to := before[pgid], after[pgid]
+		if len(from) != len(to) {
+			warnf("pg %s: up set would change from %v to %v, which can't be expressed as mappings; skipping", pgid, from, to)
+			continue
+		}
+		pool := pools.Pools[pgPoolID(pgid)]
+		ec := pool != nil && pool.ECProfile != ""
+		if !ec {
+			from, to = upSetDifference(from, to), upSetDifference(to, from)
+			n := min(len(from), len(to))
+			from, to = from[:n], to[:n]
+		}
+		for i := range from {
+			if from[i] == to[i] || from[i] == invalidOSD || to[i] == invalidOSD {
+				continue
+			}
+			if ec {
+				if _, ok := markedOut[from[i]]; !ok {
+					continue
+				}
+				if slices.Contains(before[pgid], to[i]) {
+					warnf("pg %s: shard %d would move from osd %d to osd %d, which already holds another shard (up set %v to %v); skipping", pgid, i, from[i], to[i], before[pgid], after[pgid])
+					continue
+				}
+			}
+			mappings = append(mappings, pgMapping{
+				PgID:    pgid,
+				Mapping: mapping{From: from[i], To: to[i]},
+			})
+		}
+	}
+	return mappings, nil
+}
+
+// upSetDifference returns the OSDs in a that aren't in b, in order.
+func upSetDifference(a, b []int) []int {
+	var diff []int
+	for _, osd := range a {
+		if osd != invalidOSD && !slices.Contains(b, osd) {
+			diff = append(diff, osd)
+		}
+	}
+	return diff
+}
+
+// testMapPgsDumpRegexp matches the per-PG lines of osdmaptool's
+// --test-map-pgs-dump output, e.g. "1.0	[3,7,8]	3".
+var testMapPgsDumpRegexp = regexp.MustCompile(`^([0-9]+\.[0-9a-f]+)\s+\[([0-9,\s]*)\]`)
+
+func parseTestMapPgsDump(in string) (map[string][]int, error) {
+	pgs := make(map[string][]int)
+	sc := bufio.NewScanner(strings.NewReader(in))
+	for sc.Scan() {
+		m := testMapPgsDumpRegexp.FindStringSubmatch(strings.TrimSpace(sc.Text()))
+		if m == nil {
+			continue
+		}
+
+		osds := []int{}
+		for _, f := range strings.FieldsFunc(m[2], func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+			osd, err := strconv.Atoi(f)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse PG mapping entry %q", sc.Text())
+			}
+			osds = append(osds, osd)
+		}
+		pgs[m[1]] = osds
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed scanning osdmaptool output")
+	}
+	return pgs, nil
+}
+
+type crushRuleBlock struct {
+	name string
+	id   int
+	// Line indices of the opening "rule <name> {" and closing "}".
+	start, end int
+}
+
+func parseCrushRuleBlocks(lines []string) ([]crushRuleBlock, error) {
+	var (
+		blocks []crushRuleBlock
+		cur    *crushRuleBlock
+	)
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if cur == nil {
+			if fields[0] == "rule" && len(fields) == 3 && fields[2] == "{" {
+				cur = &crushRuleBlock{name: fields[1], id: -1, start: i}
+			}
+			continue
+		}
+		switch fields[0] {
+		case "id":
+			if len(fields) != 2 {
+				return nil, errors.Errorf("rule %s: malformed id line '%s'", cur.name, line)
+			}
+			id, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "rule %s: malformed id line '%s'", cur.name, line)
+			}
+			cur.id = id
+		case "}":
+			cur.end = i
+			blocks = append(blocks, *cur)
+			cur = nil
+		}
+	}
+	if cur != nil {
+		return nil, errors.Errorf("rule %s: missing closing brace", cur.name)
+	}
+	return blocks, nil
+}
+
+// overrideCrushRule rewrites the given CRUSHmap text such that the rule with
+// the given ID has the steps of the named rule. Simulating the modified
+// CRUSHmap then shows where the PGs of pools using the former rule would go if
+// they were switched to the latter.
+func overrideCrushRule(crushText string, ruleID int, newRuleName string) (string, error) {
+	lines := strings.Split(crushText, "\n")
+	blocks, err := parseCrushRuleBlocks(lines)
+	if err != nil {
+		return "", err
+	}
+
+	var from, to *crushRuleBlock
+	for i := range blocks {
+		if blocks[i].id == ruleID {
+			from = &blocks[i]
+		}
+		if blocks[i].name == newRuleName {
+			to = &blocks[i]
+		}
+	}
+	if from == nil {
+		return "", errors.Errorf("no CRUSH rule with ID %d", ruleID)
+	}
+	if to == nil {
+		return "", errors.Errorf("no CRUSH rule named '%s'", newRuleName)
+	}
+	if from == to {
+		return "", errors.Errorf("CRUSH rule %s is already in use", newRuleName)
+	}
+
+	// Keep the existing rule's name and ID, taking everything else from
+	// the new rule.
+	out := append([]string{}, lines[:from.start+1]...)
+	for _, line := range lines[from.start+1 : from.end] {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "id" {
+			out = append(out, line)
+		}
+	}
+	for _, line := range lines[to.start+1 : to.end] {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "id" {
+			continue
+		}
+		out = append(out, line)
+	}
+	out = append(out, lines[from.end:]...)
+	return strings.Join(out, "\n"), nil
+}
+
 func parseCrushDiff(in string) ([]*pgUpmapItem, error) {
 	var (
 		sc     = bufio.NewScanner(strings.NewReader(in))
@@ -751,6 +1483,9 @@ func parseCephCommand(out string, err error, v interface{}) error {
 	}
 
 	sanitized := handleCephInf([]byte(out))
+	if err := cephErrorResponse(sanitized); err != nil {
+		return err
+	}
 	if err := json.Unmarshal(sanitized, v); err != nil {
 		return err
 	}
@@ -758,6 +1493,36 @@ func parseCephCommand(out string, err error, v interface{}) error {
 	return nil
 }
 
+// cephErrorResponse returns an error if the given output is an error object
+// rather than the expected response; some ceph commands report errors this way
+// while still exiting successfully. Such an object would otherwise unmarshal
+// into an empty struct, leaving us to operate on missing data.
+func cephErrorResponse(out []byte) error {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(out, &obj); err != nil {
+		// Not an object, so not an error object either.
+		return nil
+	}
+	rawMsg, ok := obj["error"]
+	if !ok {
+		return nil
+	}
+	for k := range obj {
+		if k != "error" && k != "errno" && k != "status" {
+			return nil
+		}
+	}
+
+	var msg string
+	if err := json.Unmarshal(rawMsg, &msg); err != nil {
+		msg = string(rawMsg)
+	}
+	if errno, ok := obj["errno"]; ok {
+		return errors.Errorf("ceph returned an error (errno %s): %s", errno, msg)
+	}
+	return errors.Errorf("ceph returned an error: %s", msg)
+}
+
 // Some Ceph commands can return "inf" as a float value; this is not allowed by
 // the json spec or the golang parser (though it is apparently allowed by the
 // Python parser), so we convert such cases to "null".
@@ -15,6 +15,8 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -174,3 +176,107 @@ osdmaptool: osdmap file '/tmp/tmp5ip_axby/osdmap'
 		})
 	}
 }
+
+func TestOverrideCrushRule(t *testing.T) {
+	crushIn := `# rules
+rule replicated_host {
+	id 0
+	type replicated
+	step take default
+	step chooseleaf firstn 0 type host
+	step emit
+}
+rule replicated_rack {
+	id 1
+	type replicated
+	step take default class hdd
+	step chooseleaf firstn 0 type rack
+	step emit
+}
+
+# end crush map
+`
+	expected := `# rules
+rule replicated_host {
+	id 0
+	type replicated
+	step take default class hdd
+	step chooseleaf firstn 0 type rack
+	step emit
+}
+rule replicated_rack {
+	id 1
+	type replicated
+	step take default class hdd
+	step chooseleaf firstn 0 type rack
+	step emit
+}
+
+# end crush map
+`
+	out, err := overrideCrushRule(crushIn, 0, "replicated_rack")
+	require.NoError(t, err)
+	require.Equal(t, expected, out)
+
+	_, err = overrideCrushRule(crushIn, 0, "replicated_host")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already in use")
+	_, err = overrideCrushRule(crushIn, 0, "nonexistent")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no CRUSH rule named")
+	_, err = overrideCrushRule(crushIn, 5, "replicated_rack")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no CRUSH rule with ID 5")
+}
+
+func TestParseCephCommandErrorResponse(t *testing.T) {
+	var out osdDumpOut
+
+	err := parseCephCommand(`{"error": "pool 'foo' does not exist"}`, nil, &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pool 'foo' does not exist")
+
+	err = parseCephCommand(`{"error": "no such pg", "errno": -2}`, nil, &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "errno -2")
+
+	// Responses that merely contain an error field are parsed as usual.
+	err = parseCephCommand(`{"epoch": 5, "error": "", "pg_upmap_items": [ { "pgid": "1.1", "mappings": [] } ]}`, nil, &out)
+	require.NoError(t, err)
+	require.Len(t, out.PgUpmapItems, 1)
+
+	var pgs []*pgBriefItem
+	require.NoError(t, parseCephCommand(`[ { "pgid": "1.1" } ]`, nil, &pgs))
+	require.Len(t, pgs, 1)
+}
+
+func TestUseInputDir(t *testing.T) {
+	defer teardownTest(t)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"osd-dump.json":          `{ "pg_upmap_items": [ { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] } ] }`,
+		"pg-dump-pgs-brief.json": `[ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 4 ] } ]`,
+		"pg-query-1.1.json":      `{ "acting": [ 1, 2, 4 ] }`,
+		"osd-pool-ls.json":       `[ { "pool_id": 1, "pool_name": "replicated", "erasure_code_profile": "" } ]`,
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	useInputDir(dir)
+
+	require.Equal(t, []mapping{{From: 3, To: 4}}, osdDump().PgUpmapItems[0].Mappings)
+	require.Len(t, pgDumpPgsBrief(), 1)
+	require.Equal(t, []int{1, 2, 4}, pgQuery("1.1").Acting)
+
+	_, err := runPgQuery("1.2")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pg-query-1.2.json")
+
+	// A missing config-key is reported like Ceph would, so that an empty
+	// denylist is assumed.
+	require.Empty(t, getDeniedOsds())
+
+	// Nothing is actually run.
+	_, err = runPgUpmapItems("1.1", "3", "5")
+	require.NoError(t, err)
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A journal records each upmap item as it is successfully applied, one line
+// per item, so that an apply that is interrupted partway can be re-run
+// without re-issuing the items that already succeeded. An item is only
+// skipped if the same PG was set to exactly the same mappings, so a PG whose
+// planned change differs from the journaled one is still applied.
+//
+// The first line is a header identifying the changes being applied. A journal
+// written for different changes is stale, e.g. left over from a previous
+// change, and is started afresh rather than used to skip items.
+type journal struct {
+	sync.Mutex
+	f    *os.File
+	done map[string]struct{}
+}
+
+func journalEntry(pui *pgUpmapItem) string {
+	if len(pui.Mappings) == 0 {
+		return fmt.Sprintf("%s removed", pui.PgID)
+	}
+	strs := make([]string, len(pui.Mappings))
+	for i, mp := range pui.Mappings {
+		strs[i] = fmt.Sprintf("%d->%d", mp.From, mp.To)
+	}
+	return fmt.Sprintf("%s %s", pui.PgID, strings.Join(strs, ","))
+}
+
+// journalHeader returns the header of a journal for applying the given upmap
+// items, which includes a hash of the items, independent of their order.
+func journalHeader(puis []*pgUpmapItem) string {
+	entries := make([]string, len(puis))
+	for i, pui := range puis {
+		entries[i] = journalEntry(pui)
+	}
+	sort.Strings(entries)
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintln(h, e)
+	}
+	return fmt.Sprintf("# pgremapper journal, plan sha256:%x", h.Sum(nil))
+}
+
+// mustOpenJournal opens the journal at the given path for applying the given
+// upmap items, starting it afresh if it doesn't exist or was written for
+// different items.
+func mustOpenJournal(path string, puis []*pgUpmapItem) *journal {
+	j := &journal{done: make(map[string]struct{})}
+	header := journalHeader(puis)
+
+	fresh := true
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		if scanner.Scan() && scanner.Text() == header {
+			fresh = false
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" {
+					j.done[line] = struct{}{}
+				}
+			}
+		} else if scanner.Err() == nil {
+			fmt.Printf("Journal %s was written for different changes; starting it afresh\n", path)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			panic(errors.Wrapf(err, "failed to read journal %s", path))
+		}
+	} else if !os.IsNotExist(err) {
+		panic(errors.WithStack(err))
+	}
+
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if fresh {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	j.f = f
+	if fresh {
+		if _, err := fmt.Fprintln(f, header); err != nil {
+			panic(errors.Wrapf(err, "failed to write to journal %s", path))
+		}
+		if err := f.Sync(); err != nil {
+			panic(errors.Wrapf(err, "failed to write to journal %s", path))
+		}
+	}
+	return j
+}
+
+// pending returns the given upmap items that haven't already been applied
+// according to the journal.
+func (j *journal) pending(puis []*pgUpmapItem) []*pgUpmapItem {
+	pending := make([]*pgUpmapItem, 0, len(puis))
+	for _, pui := range puis {
+		if _, ok := j.done[journalEntry(pui)]; !ok {
+			pending = append(pending, pui)
+		}
+	}
+	return pending
+}
+
+// mustRecord durably appends the given upmap item to the journal.
+func (j *journal) mustRecord(pui *pgUpmapItem) {
+	j.Lock()
+	defer j.Unlock()
+
+	if _, err := fmt.Fprintln(j.f, journalEntry(pui)); err != nil {
+		panic(errors.Wrapf(err, "failed to write to journal %s", j.f.Name()))
+	}
+	if err := j.f.Sync(); err != nil {
+		panic(errors.Wrapf(err, "failed to write to journal %s", j.f.Name()))
+	}
+	j.done[journalEntry(pui)] = struct{}{}
+}
+
+func (j *journal) Close() error {
+	return j.f.Close()
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyUpmapItemsJournal(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func(s string) { journalFile = s }(journalFile)
+	journalFile = filepath.Join(t.TempDir(), "journal")
+
+	puis := []*pgUpmapItem{
+		{PgID: "1.1", Mappings: []mapping{{From: 1, To: 11}}},
+		{PgID: "1.2", Mappings: []mapping{{From: 1, To: 12}, {From: 2, To: 22}}},
+		{PgID: "1.3", Mappings: []mapping{{From: 2, To: 12}}},
+		{PgID: "1.4"},
+	}
+	header := journalHeader(puis)
+
+	// 1.1 was applied by a previous, interrupted run of the same changes;
+	// 1.3 was applied with different mappings than are planned now.
+	require.NoError(t, os.WriteFile(journalFile, []byte(header+"\n1.1 1->11\n1.3 2->13\n"), 0644))
+
+	var l sync.Mutex
+	var cmds []string
+	runPgUpmapItems = func(args ...string) (string, error) {
+		l.Lock()
+		defer l.Unlock()
+		cmds = append(cmds, strings.Join(args, " "))
+		return "", nil
+	}
+	runRmPgUpmapItems = func(pgid string) (string, error) {
+		l.Lock()
+		defer l.Unlock()
+		cmds = append(cmds, "rm "+pgid)
+		return "", nil
+	}
+
+	_, err := applyUpmapItems(puis, nil)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.2 1 12 2 22", "1.3 2 12", "rm 1.4"}, cmds)
+
+	b, err := os.ReadFile(journalFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Equal(t, []string{header, "1.1 1->11", "1.3 2->13"}, lines[:3])
+	require.ElementsMatch(t, []string{"1.2 1->12,2->22", "1.3 2->12", "1.4 removed"}, lines[3:])
+
+	// Re-running the same changes, in any order, is a no-op.
+	cmds = nil
+	slices.Reverse(puis)
+	_, err = applyUpmapItems(puis, nil)
+	require.NoError(t, err)
+	require.Empty(t, cmds)
+
+	// A journal written for different changes is stale and started
+	// afresh, rather than used to skip 1.2.
+	_, err = applyUpmapItems([]*pgUpmapItem{
+		{PgID: "1.2", Mappings: []mapping{{From: 1, To: 12}, {From: 2, To: 22}}},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2 1 12 2 22"}, cmds)
+	b, err = os.ReadFile(journalFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), header)
+	require.Contains(t, string(b), "1.2 1->12,2->22")
+}
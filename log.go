@@ -0,0 +1,110 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// logLevel is the severity of a diagnostic message. Diagnostics go to
+// stderr, so that stdout only carries plans and other command output.
+type logLevel int
+
+const (
+	logDebug logLevel = iota
+	logInfo
+	logWarn
+)
+
+var (
+	logLevelNames = map[string]logLevel{
+		"debug": logDebug,
+		"info":  logInfo,
+		"warn":  logWarn,
+	}
+
+	// minLogLevel is the least severe level of message that is printed.
+	minLogLevel = logInfo
+	// logOutput receives all diagnostic messages.
+	logOutput io.Writer = os.Stderr
+	logL      sync.Mutex
+)
+
+func parseLogLevel(s string) (logLevel, error) {
+	level, ok := logLevelNames[s]
+	if !ok {
+		return 0, errors.Errorf("unknown --log-level '%s'; must be 'debug', 'info', or 'warn'", s)
+	}
+	return level, nil
+}
+
+// logf prints a diagnostic message of the given level, if that level is
+// enabled. Warnings are prefixed with "WARNING: ". It is safe to call
+// concurrently.
+func logf(level logLevel, format string, a ...interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	if level == logWarn {
+		format = "WARNING: " + format
+	}
+
+	logL.Lock()
+	defer logL.Unlock()
+	fmt.Fprintf(logOutput, format+"\n", a...)
+}
+
+func debugf(format string, a ...interface{}) { logf(logDebug, format, a...) }
+func infof(format string, a ...interface{})  { logf(logInfo, format, a...) }
+
+// progressf prints a progress line requested with --progress. Unlike logf,
+// it ignores --log-level, and it isn't suppressed by --quiet. It is safe to
+// call concurrently.
+func progressf(format string, a ...interface{}) {
+	logL.Lock()
+	defer logL.Unlock()
+	fmt.Fprintf(logOutput, format+"\n", a...)
+}
+
+var (
+	suppressedWarningsL sync.Mutex
+	suppressedWarnings  int
+)
+
+// warnf prints a per-PG warning, or with --quiet, only counts it so that the
+// total can be reported at the end of the command. It is safe to call
+// concurrently.
+func warnf(format string, a ...interface{}) {
+	if !quiet {
+		logf(logWarn, format, a...)
+		return
+	}
+	suppressedWarningsL.Lock()
+	defer suppressedWarningsL.Unlock()
+	suppressedWarnings++
+}
+
+func printSuppressedWarnings(w io.Writer) {
+	suppressedWarningsL.Lock()
+	defer suppressedWarningsL.Unlock()
+	if suppressedWarnings > 0 {
+		fmt.Fprintf(w, "WARNING: %d warning(s) suppressed by --quiet\n", suppressedWarnings)
+	}
+}
@@ -15,6 +15,10 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -22,20 +26,84 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
+	"github.com/fatih/color"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 )
 
 var (
-	concurrency int
-	yes         bool
-	verbose     bool
+	concurrency      int
+	yes              bool
+	verbose          bool
+	planThenApply    string
+	planOutput       string
+	jsonSummary      string
+	metricsFile      string
+	outputFormat     string
+	inputDir         string
+	rollbackFile     string
+	monHost          string
+	maxMovesPerPg    int
+	skipScrubbingPgs bool
+	assumeFlagsSet   bool
+	// reservationsFromCeph seeds per-OSD max backfill reservations from
+	// each OSD's osd_max_backfills setting.
+	reservationsFromCeph bool
+	// cephCommandTimeout bounds how long any single external command may
+	// run; zero means no limit.
+	cephCommandTimeout time.Duration
+	// cephRetries and cephRetryDelay control how external commands that
+	// fail with a transient error are retried.
+	cephRetries    int
+	cephRetryDelay time.Duration
+	// journalFile records each upmap item as it is applied, so that an
+	// interrupted apply can be resumed.
+	journalFile string
+	// maxTotalUpmaps is the number of upmap items in the cluster beyond
+	// which no changes that add items are applied; 0 means no limit.
+	maxTotalUpmaps int
+	// maxMisplacedRatio is the fraction of misplaced objects in the
+	// cluster beyond which no changes that add backfill are applied,
+	// unless ignoreMaxMisplacedRatio is set; 0 means no limit.
+	maxMisplacedRatio       float64
+	ignoreMaxMisplacedRatio bool
+	// dryRun prints planned changes without applying them, even with
+	// --yes.
+	dryRun bool
+	// applyOutput receives a record of the changes actually applied.
+	applyOutput string
+	// recordProvenance records when each applied mapping was created, for
+	// undo-upmaps --older-than.
+	recordProvenance bool
+	// stateCachePath and stateCacheTTL control reuse of slow Ceph query
+	// output across invocations.
+	stateCachePath string
+	stateCacheTTL  time.Duration
+	// noColor disables colored output even on a terminal.
+	noColor bool
+	// quiet suppresses per-PG warnings, only reporting how many there
+	// were.
+	quiet bool
+	// logLevelName is the least severe level of diagnostic message to
+	// print; --verbose implies debug.
+	logLevelName string
+	// applyBatchSize and applyBatchDelay pace applying changes: after
+	// each batch of applyBatchSize upmap items, wait applyBatchDelay. A
+	// batch size of 0 applies everything at once.
+	applyBatchSize  int
+	applyBatchDelay time.Duration
 	// M represents the state of upmap items, based on current state plus
 	// whatever modifications have been made.
 	M *mappingState
@@ -47,7 +115,12 @@ var (
 
 For any commands that take an osdspec, one of the following can be given:
 * An OSD ID (e.g. '54').
+* An inclusive range of OSD IDs (e.g. '100-115').
 * A CRUSH bucket (e.g. 'bucket:rack1' or 'bucket:host04').
+* All 'in' OSDs with a reweight below or above a value (e.g. 'reweight:<1' or
+  'reweight:>0.5').
+Several of these can be joined with commas in a single osdspec (e.g.
+'100-105,110').
 `,
 	}
 
@@ -73,14 +146,40 @@ or is undesirable. The given CRUSH bucket must directly contain OSDs.
 		},
 		Run: func(cmd *cobra.Command, args []string) {
 			M = mustGetCurrentMappingState()
+			M.noPrimaryOsds = mustGetOsdSpecSliceMap(cmd, "no-primary-osds")
 			deviceClass := mustGetString(cmd, "device-class")
 
 			osds := mustGetOsdsForBucket(args[0], deviceClass)
 
-			maxBackfills := mustGetInt(cmd, "max-backfills")
-			targetSpread := mustGetInt(cmd, "target-spread")
+			M.maxPgsPerPool = mustGetInt(cmd, "max-pgs-per-pool")
+			mustParseMaxPoolMoveFraction(cmd)
 
-			calcPgMappingsToBalanceOsds(osds, maxBackfills, targetSpread)
+			opts := balanceOptions{
+				maxBackfills:     mustGetInt(cmd, "max-backfills"),
+				targetSpread:     mustGetInt(cmd, "target-spread"),
+				pinBackfilling:   mustGetBool(cmd, "pin-backfilling"),
+				minPgsPerOsd:     mustGetInt(cmd, "min-pgs-per-osd"),
+				byBytes:          mustGetBool(cmd, "by-bytes"),
+				balancePrimaries: mustGetBool(cmd, "balance-primaries"),
+			}
+			if opts.balancePrimaries && opts.byBytes {
+				panic(errors.New("--balance-primaries can't be combined with --by-bytes"))
+			}
+			if opts.byBytes {
+				spread, percent, err := parseByteSpread(mustGetString(cmd, "target-byte-spread"))
+				if err != nil {
+					panic(err)
+				}
+				opts.byteSpread, opts.byteSpreadPercent = spread, percent
+			}
+			if matchBucket := mustGetString(cmd, "match-bucket"); matchBucket != "" {
+				if opts.byBytes || opts.balancePrimaries {
+					panic(errors.New("--match-bucket can't be combined with --by-bytes or --balance-primaries"))
+				}
+				opts.targetCounts = mustGetMatchBucketTargetCounts(osds, mustGetOsdsForBucket(matchBucket, deviceClass))
+			}
+
+			calcPgMappingsToBalanceOsds(M, osds, opts)
 			if !confirmProceed() {
 				return
 			}
@@ -90,7 +189,7 @@ or is undesirable. The given CRUSH bucket must directly contain OSDs.
 	}
 
 	cancelBackfillCmd = &cobra.Command{
-		Use:   "cancel-backfill",
+		Use:   "cancel-backfill [<pgid> ...]",
 		Short: "Add Ceph upmap entries to cancel out pending backfill",
 		Long: `Add Ceph upmap entries to cancel out pending backfill.
 
@@ -107,8 +206,20 @@ backfill (provided that complete copies exist for all indexes of that acting
 set), which can allow one to convert a 'degraded+backfill{ing,_wait}' into
 'degraded+recover{y,_wait}', at the cost of losing whatever backfill progress
 has been made so far.
+
+If PG IDs are given, only those PGs' backfill is canceled, which is much
+faster than considering every backfilling PG when they need to be queried.
 `,
-		Run: func(cmd *cobra.Command, _ []string) {
+		Args: func(cmd *cobra.Command, args []string) error {
+			for _, arg := range args {
+				if !pgIdRegexp.MatchString(arg) {
+					return errors.Errorf("'%s' is not a valid PG ID", arg)
+				}
+			}
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
 			excludeBackfilling, err := cmd.Flags().GetBool("exclude-backfilling")
 			if err != nil {
 				panic(errors.WithStack(err))
@@ -124,19 +235,64 @@ has been made so far.
 				panic(errors.WithStack(err))
 			}
 
-			excludedOsds := mustGetOsdSpecSliceMap(cmd, "exclude-osds")
-			includedOsds := mustGetOsdSpecSliceMap(cmd, "include-osds")
-			excludedPools := mustGetPoolSpecSliceMap(cmd, "exclude-pools")
-			includedPools := mustGetPoolSpecSliceMap(cmd, "include-pools")
-			pgsIncludingOsds := mustGetOsdSpecSliceMap(cmd, "pgs-including")
+			opts := undoBackfillOptions{
+				excludeBackfilling: excludeBackfilling,
+				source:             source,
+				target:             target,
+				excludedOsds:       mustGetOsdSpecSliceMap(cmd, "exclude-osds"),
+				includedOsds:       mustGetOsdSpecSliceMap(cmd, "include-osds"),
+				excludedPools:      mustGetPoolSpecSliceMap(cmd, "exclude-pools"),
+				includedPools:      mustGetPoolSpecSliceMap(cmd, "include-pools"),
+				pgsIncludingOsds:   mustGetOsdSpecSliceMap(cmd, "pgs-including"),
+				poolPriority:       mustGetPoolSpecSlice(cmd, "pool-priority"),
+				actingOverrides:    mustParseActingOverrides(mustGetStringSlice(cmd, "override-acting")),
+				actingFromQuery:    mustParsePgIDSet(mustGetStringSlice(cmd, "trust-acting-from-query")),
+				upmapCausedOnly:    mustGetBool(cmd, "upmap-caused-only"),
+				onlyDegraded:       mustGetBool(cmd, "only-degraded"),
+				maxBackfills:       mustGetInt(cmd, "max-backfills"),
+				resolveConflicts:   mustGetBool(cmd, "resolve-conflicts"),
+				states:             mustGetStringSlice(cmd, "states"),
+				queryConcurrency:   mustGetInt(cmd, "query-concurrency"),
+				progress:           mustGetBool(cmd, "progress"),
+			}
+			if cmd.Flags().Changed("query-concurrency") && opts.queryConcurrency < 1 {
+				panic(errors.New("--query-concurrency must be at least 1"))
+			}
+			switch statesMatch := mustGetString(cmd, "states-match"); statesMatch {
+			case "any":
+			case "all":
+				opts.statesMatchAll = true
+			default:
+				panic(errors.Errorf("unknown --states-match '%s'; must be 'any' or 'all'", statesMatch))
+			}
+			opts.pgids = args
+
+			thenEnableBalancer := mustGetBool(cmd, "then-enable-balancer")
+			thenUnsetFlags := mustGetBool(cmd, "then-unset-flags")
+			if thenUnsetFlags && !thenEnableBalancer {
+				panic(errors.New("--then-unset-flags requires --then-enable-balancer"))
+			}
 
 			M = mustGetCurrentMappingState()
-			calcPgMappingsToUndoBackfill(excludeBackfilling, source, target, excludedOsds, includedOsds, excludedPools, includedPools, pgsIncludingOsds)
+			before := M.bs.snapshotCounts()
+			calcPgMappingsToUndoBackfill(M, opts)
+			if mustGetBool(cmd, "output-osd-summary") {
+				printOsdBackfillSummary(os.Stdout, before, M.bs.snapshotCounts())
+			}
+			if M.changeState != NoChange {
+				if err := checkFreezeFlagsUnset(os.Stderr, mustGetBool(cmd, "i-know-flags-are-unset")); err != nil {
+					panic(err)
+				}
+			}
 			if !confirmProceed() {
 				return
 			}
 
 			M.apply()
+
+			if thenEnableBalancer && (yes || promptYesNo("Backfill has been canceled. Enable the balancer now?")) {
+				enableBalancer(os.Stdout, thenUnsetFlags)
+			}
 		},
 	}
 
@@ -145,9 +301,12 @@ has been made so far.
 		Short: "Drain PGs from one or more source OSDs to the target OSDs.",
 		Long: `Drain PGs from one or more source OSDs to the target OSDs.
 
-Remap PGs off of the given source OSD, up to the given maximum number of
-scheduled backfills. No attempt is made to balance the fullness of the target
-OSDs; rather, the least busy target OSDs and PGs will be selected.
+Remap PGs off of the given source OSDs, up to the given maximum number of
+scheduled backfills. When multiple source OSDs are given, they are drained in
+turn, one PG at a time, so that progress is balanced across them. No attempt
+is made to balance the fullness of the target OSDs; rather, target OSDs and
+PGs are selected by the target policy, which by default prefers the least
+busy.
 `,
 		Args: func(cmd *cobra.Command, args []string) error {
 			if len(args) == 0 {
@@ -160,6 +319,20 @@ OSDs; rather, the least busy target OSDs and PGs will be selected.
 				}
 			}
 
+			targetSources := 0
+			for _, set := range []bool{
+				len(mustGetStringSlice(cmd, "target-osds")) > 0,
+				mustGetBool(cmd, "auto-targets"),
+				mustGetString(cmd, "target-from-rule") != "",
+			} {
+				if set {
+					targetSources++
+				}
+			}
+			if targetSources > 1 {
+				return errors.New("--target-osds, --auto-targets, and --target-from-rule are mutually exclusive")
+			}
+
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
@@ -173,33 +346,62 @@ OSDs; rather, the least busy target OSDs and PGs will be selected.
 			allowMovementAcrossCrushType := mustGetString(cmd, "allow-movement-across")
 			mustParseMaxBackfillReservations(cmd)
 			mustParseMaxSourceBackfills(cmd)
-
-			targetOsds := mustGetOsdSpecSliceMap(cmd, "target-osds")
-			tree := osdTree()
-
-			for targetOsd := range targetOsds {
-				targetOsdNode, ok := tree.IDToNode[targetOsd]
-				if !ok || targetOsdNode.Type != "osd" {
-					panic(fmt.Errorf("target OSD %d doesn't exist", targetOsd))
+			mustParseMaxClusterBackfills(cmd)
+			mustParseTargetPolicy(cmd)
+			mustParseTargetWeightBy(cmd)
+			M.maxPgsPerPool = mustGetInt(cmd, "max-pgs-per-pool")
+			mustParseMaxPoolMoveFraction(cmd)
+			M.noPrimaryOsds = mustGetOsdSpecSliceMap(cmd, "no-primary-osds")
+
+			targetFullRatio := mustGetDrainTargetFullRatio(cmd)
+			var targetOsds map[int]struct{}
+			if mustGetBool(cmd, "auto-targets") {
+				targetOsds = getAutoTargetOsds(sourceOsds, targetFullRatio)
+				fmt.Printf("Auto-selected %d target OSDs\n", len(targetOsds))
+			} else if rule := mustGetString(cmd, "target-from-rule"); rule != "" {
+				var (
+					failureDomain string
+					ruleID        int
+				)
+				targetOsds, failureDomain, ruleID = mustGetCrushRuleCandidates(rule)
+				fmt.Printf("Selected %d target OSDs from CRUSH rule '%s' (failure domain '%s')\n", len(targetOsds), rule, failureDomain)
+				// Unless told otherwise, let PGs move across
+				// the rule's failure domain, which still keeps
+				// each of a PG's shards/replicas in a distinct
+				// bucket of that type.
+				if !cmd.Flags().Changed("allow-movement-across") && failureDomain != "osd" {
+					allowMovementAcrossCrushType = failureDomain
+					fmt.Printf("Allowing movement across %s buckets, per CRUSH rule '%s'; set --allow-movement-across to override\n", failureDomain, rule)
+				}
+				M.drainFilter = crushRuleMappingFilter(ruleID)
+				if n := countPgsNotUsingCrushRule(sourceOsds, ruleID); n > 0 {
+					logf(logWarn, "%d PG(s) on the source OSDs are in pools that don't use CRUSH rule '%s' and will be left alone", n, rule)
 				}
+			} else {
+				targetOsds = mustGetOsdSpecSliceMap(cmd, "target-osds")
 			}
+			mustPruneDrainTargets(targetOsds, sourceOsds, mustGetOsdSpecSliceMap(cmd, "exclude-target-osds"))
 
-			for _, osd := range sourceOsds {
-				sourceOsdNode, ok := tree.IDToNode[osd]
-				if !ok || sourceOsdNode.Type != "osd" {
-					panic(fmt.Errorf("source OSD %d doesn't exist", osd))
-				}
-				delete(targetOsds, osd)
+			allowColocation := mustGetBool(cmd, "force-allow-colocation")
+			if allowColocation {
+				fmt.Fprintf(os.Stderr, "%s\n", color.New(color.FgRed, color.Bold).Sprint(
+					"WARNING: --force-allow-colocation is set; PGs may be remapped such that multiple shards/replicas share a failure domain, VIOLATING your CRUSH rules. Only use this for emergency repair."))
 			}
 
 			calcPgMappingsToDrainOsd(
+				M,
 				allowMovementAcrossCrushType,
+				allowColocation,
 				sourceOsds,
 				targetOsds,
+				targetFullRatio,
 			)
 			if !confirmProceed() {
 				return
 			}
+			if allowColocation && !promptYesNo("These changes may place multiple shards/replicas of a PG in the same failure domain. Are you sure?") {
+				return
+			}
 
 			M.apply()
 		},
@@ -214,7 +416,11 @@ Given a list of OSDs, remove (or modify) upmap items such that the OSDs become
 the source (or target if --target is specified) of backfill operations (i.e.
 they are currently the "To" ("From") of the upmap items) up to the backfill
 limits specified. Backfill is spread across target and primary OSDs in a
-best-effort manor.
+best-effort manor. With --from and --to, only mappings from and to the given
+OSDs are undone, e.g. 'undo-upmaps 42 --from 100' undoes only the mappings
+100->42. With --older-than, only mappings that pgremapper recorded creating
+at least that long ago (see --record-provenance) are undone, letting recent
+operations settle; mappings without a record are left alone.
 
 This is useful for cases where the upmap rebalancer won't do this for us, e.g.,
 performing a swap-bucket where we want the source OSDs to totally drain (vs.
@@ -250,8 +456,112 @@ concurrency than the balancer generally will.
 			target := mustGetBool(cmd, "target")
 			mustParseMaxBackfillReservations(cmd)
 			mustParseMaxSourceBackfills(cmd)
+			mustParseMaxClusterBackfills(cmd)
+			mustParseTargetPolicy(cmd)
+
+			var filters []mappingFilter
+			if froms := mustGetOsdSpecSliceMap(cmd, "from"); len(froms) > 0 {
+				filters = append(filters, withAnyOsd(froms, withFrom))
+			}
+			if tos := mustGetOsdSpecSliceMap(cmd, "to"); len(tos) > 0 {
+				filters = append(filters, withAnyOsd(tos, withTo))
+			}
+			if olderThan := mustGetDuration(cmd, "older-than"); olderThan > 0 {
+				p, err := getUpmapProvenance(upmapItemPools(M.pgUpmapItems))
+				if err != nil {
+					panic(err)
+				}
+				filters = append(filters, withCreatedBefore(p, time.Now().Add(-olderThan)))
+			}
+			calcPgMappingsToUndoUpmaps(osds, target, mfAnd(filters...))
+			if !confirmProceed() {
+				return
+			}
+
+			M.apply()
+		},
+	}
+
+	undoAllUpmapsCmd = &cobra.Command{
+		Use:   "undo-all-upmaps",
+		Short: "Gradually remove all upmap entries within backfill limits",
+		Long: `Gradually remove all upmap entries within backfill limits.
+
+This is undo-upmaps applied to every OSD that is the "To" of an upmap item,
+e.g. to hand a cluster over to the native balancer after migrating away from
+managing upmaps by hand. Upmap items are removed (or modified) up to the
+backfill limits specified, and the number of mappings that remain is
+reported, so that the command can be re-run later to continue.
+`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return errors.New("extra args")
+			}
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			M = mustGetCurrentMappingState()
+
+			osds := upmapTargetOsds()
+			// Randomize OSD list for fairness across multiple
+			// runs.
+			rand.Shuffle(len(osds), func(i, j int) { osds[i], osds[j] = osds[j], osds[i] })
+
+			mustParseMaxBackfillReservations(cmd)
+			mustParseMaxSourceBackfills(cmd)
+			mustParseMaxClusterBackfills(cmd)
+			mustParseTargetPolicy(cmd)
+
+			calcPgMappingsToUndoUpmaps(osds, false, nil)
+			fmt.Printf("%d upmap mapping(s) will remain; re-run to continue removing them\n", len(allMappings()))
+			if !confirmProceed() {
+				return
+			}
+
+			M.apply()
+		},
+	}
+
+	swapBucketCmd = &cobra.Command{
+		Use:   "swap-bucket <source bucket> <target bucket>",
+		Short: "Move PGs from the OSDs of one CRUSH bucket to those of another.",
+		Long: `Move PGs from the OSDs of one CRUSH bucket to those of another.
+
+Remap PGs off of the OSDs in the source bucket onto OSDs of the same device
+class in the target bucket, e.g. to move data from old hardware to new, up to
+the backfill limits specified. The buckets must be of the same CRUSH type
+(e.g. both hosts) and share a parent, since moving PGs between buckets under
+different parents (e.g. racks) could break a CRUSH rule's placement across
+them, and a PG is never moved into the target bucket if another of its
+shards/replicas is already there. Target OSDs are
+selected by the target policy, which by default prefers the least busy. Re-run
+the command to continue until the source bucket is empty.
+`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return errors.New("a source and target bucket must be specified")
+			}
+
+			for _, arg := range args {
+				if _, err := getOsdsForBucket(arg, ""); err != nil {
+					return errors.Wrapf(err, "error validating '%s' as a bucket containing OSDs", arg)
+				}
+			}
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			M = mustGetCurrentMappingState()
+
+			mustParseMaxBackfillReservations(cmd)
+			mustParseMaxSourceBackfills(cmd)
+			mustParseMaxClusterBackfills(cmd)
+			mustParseTargetPolicy(cmd)
 
-			calcPgMappingsToUndoUpmaps(osds, target)
+			if err := calcPgMappingsToSwapBucket(args[0], args[1]); err != nil {
+				panic(err)
+			}
 			if !confirmProceed() {
 				return
 			}
@@ -261,33 +571,45 @@ concurrency than the balancer generally will.
 	}
 
 	remapCmd = &cobra.Command{
-		Use:   "remap <pg ID> <source osd ID> <target osd ID>",
+		Use:   "remap <pg ID> <source osd ID> <target osdspec>",
 		Short: "Remap the given PG from the source OSD to the target OSD.",
 		Long: `Remap the given PG from the source OSD to the target OSD.
 
 Modify the upmap exception table with the requested mapping. Like other
 subcommands, this takes into account any existing mappings for this PG, and is
 thus safer and more convenient to use than 'ceph osd pg-upmap-items' directly.
+
+If the target is an osdspec covering more than one OSD (e.g. 'bucket:host04'),
+the least-busy OSD in it that isn't already in the PG's up set is chosen.
 `,
 		Args: func(cmd *cobra.Command, args []string) error {
 			if len(args) != 3 {
 				return errors.New("missing or extra args")
 			}
 
-			for i := 1; i < 3; i++ {
-				if _, err := strconv.Atoi(args[i]); err != nil {
-					return err
-				}
+			if _, err := strconv.Atoi(args[1]); err != nil {
+				return err
+			}
+			if _, err := parseOsdSpec(args[2]); err != nil {
+				return err
 			}
 
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
 			M = mustGetCurrentMappingState()
+			M.noPrimaryOsds = mustGetOsdSpecSliceMap(cmd, "no-primary-osds")
 
 			pgID := args[0]
 			sourceOsd, _ := strconv.Atoi(args[1])
-			targetOsd, _ := strconv.Atoi(args[2])
+			targetOsd, err := strconv.Atoi(args[2])
+			if err != nil {
+				targetOsd, err = chooseRemapTarget(pgID, sourceOsd, mustParseOsdSpec(args[2]))
+				if err != nil {
+					panic(errors.Wrapf(err, "no target in %s", args[2]))
+				}
+				fmt.Printf("Chose osd.%d from %s as the target.\n", targetOsd, args[2])
+			}
 
 			M.mustRemap(pgID, sourceOsd, targetOsd)
 
@@ -311,7 +633,13 @@ upmap items to be cleaned up by the mons.
 
 Note that the mappings exported will be just the portions of the upmap items
 pertaining to the selected OSDs (i.e. if a given OSD is the From or To of the
-mapping), unless --whole-pg is specified.
+mapping), unless --whole-pg is specified. With --pool, only mappings for PGs in
+the given pools are exported.
+
+By default, only mappings that are currently in effect are exported; stale
+mappings (those that have no effect on the PG's up set but haven't been cleaned
+up by Ceph) are left out, so that restoring the export doesn't recreate them.
+Use --effective-only=false to export the raw contents of the exception table.
 `,
 		Args: func(cmd *cobra.Command, args []string) error {
 			if len(args) < 1 {
@@ -324,6 +652,13 @@ mapping), unless --whole-pg is specified.
 				}
 			}
 
+			if f := mustGetString(cmd, "output-format"); !slices.Contains(mappingsFormats, f) {
+				return errors.Errorf("unknown output format '%s'; must be one of: %s", f, strings.Join(mappingsFormats, ", "))
+			}
+			if by := mustGetString(cmd, "sort"); !slices.Contains(mappingsSortKeys, by) {
+				return errors.Errorf("unknown sort key '%s'; must be one of: %s", by, strings.Join(mappingsSortKeys, ", "))
+			}
+
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
@@ -350,7 +685,15 @@ mapping), unless --whole-pg is specified.
 			}
 
 			M = mustGetCurrentMappingState()
-			mappings := M.getMappings(mfOr(filters...))
+			getMappings := M.getMappings
+			if !mustGetBool(cmd, "effective-only") {
+				getMappings = M.getAllMappings
+			}
+			filter := mfOr(filters...)
+			if pools := mustGetPoolSpecSliceMap(cmd, "pool"); len(pools) > 0 {
+				filter = mfAnd(filter, withPools(pools))
+			}
+			mappings := getMappings(filter)
 
 			if mustGetBool(cmd, "whole-pg") {
 				// Using the list of mappings from above, query
@@ -360,10 +703,40 @@ mapping), unless --whole-pg is specified.
 				for _, mapping := range mappings {
 					filters = append(filters, withPgid(mapping.PgID))
 				}
-				mappings = M.getMappings(mfOr(filters...))
+				mappings = getMappings(mfOr(filters...))
 			}
+			sortMappings(mappings, mustGetString(cmd, "sort"))
 
-			if err := json.NewEncoder(writer).Encode(mappings); err != nil {
+			writeMappings(writer, mappings, mustGetString(cmd, "output-format"), mustGetBool(cmd, "annotate"))
+		},
+	}
+
+	exportPendingBackfillCmd = &cobra.Command{
+		Use:   "export-pending-backfill",
+		Short: "Export the backfill that Ceph currently has pending.",
+		Long: `Export the backfill that Ceph currently has pending.
+
+Export, as JSON, every PG whose up set differs from its acting set, along with
+the source and target OSD of each of its backfills. This is derived from the
+up and acting sets alone, independent of upmaps, and is useful as a baseline
+to compare before and after other pgremapper operations. No changes are made.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var writer io.Writer
+			output := mustGetString(cmd, "output")
+			if output == "" {
+				writer = os.Stdout
+			} else {
+				f, err := os.Create(output)
+				if err != nil {
+					panic(err)
+				}
+
+				defer f.Close()
+				writer = f
+			}
+
+			if err := json.NewEncoder(writer).Encode(pendingBackfills(mustGetCurrentBackfillState())); err != nil {
 				panic(err)
 			}
 		},
@@ -390,8 +763,26 @@ cluster undergoes some other major changes).
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 			var writer io.Writer
-			cm := mustGetString(cmd, "crushmap-text")
 			output := mustGetString(cmd, "output")
+			poolRule := mustGetString(cmd, "pool-rule")
+
+			dir, err := os.MkdirTemp("", "pgremapper")
+			if err != nil {
+				panic(errors.WithStack(err))
+			}
+			defer os.RemoveAll(dir)
+
+			cm, err := getCrushmapPath(
+				mustGetString(cmd, "crushmap-text"),
+				mustGetString(cmd, "crushmap-file"),
+				poolRule == "",
+				os.Stdin,
+				dir,
+			)
+			if err != nil {
+				panic(err)
+			}
+
 			if output == "" {
 				writer = os.Stdout
 			} else {
@@ -404,9 +795,14 @@ cluster undergoes some other major changes).
 				writer = f
 			}
 
-			mappings, err := crushCmp(cm)
-			if err != nil {
-				panic(err)
+			var mappings []pgMapping
+			if poolRule != "" {
+				mappings = mustGetPoolRuleChangeMappings(cm, poolRule)
+			} else {
+				mappings, err = crushCmp(cm)
+				if err != nil {
+					panic(err)
+				}
 			}
 
 			if err := json.NewEncoder(writer).Encode(mappings); err != nil {
@@ -415,13 +811,56 @@ cluster undergoes some other major changes).
 		},
 	}
 
+	prestageCrushCmd = &cobra.Command{
+		Use:   "prestage-crush",
+		Short: "Gradually remap PGs to where a CRUSHmap change would put them.",
+		Long: `Gradually remap PGs to where a CRUSHmap change would put them.
+
+This combines generate-crush-change-mappings and import-mappings: the mappings
+that the given CRUSHmap change would cause are computed, and then applied up to
+the given backfill limits, spreading backfill across OSDs according to the
+target policy. Run it repeatedly as backfill completes until no changes
+remain, at which point injecting the new CRUSHmap should cause little to no
+data movement.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			M = mustGetCurrentMappingState()
+
+			mustParseMaxBackfillReservations(cmd)
+			mustParseMaxSourceBackfills(cmd)
+			mustParseMaxClusterBackfills(cmd)
+			mustParseTargetPolicy(cmd)
+
+			mappings, err := crushCmp(mustGetString(cmd, "crushmap-text"))
+			if err != nil {
+				panic(err)
+			}
+
+			calcPgMappingsToPrestageCrush(mappings)
+			if !confirmProceed() {
+				return
+			}
+
+			M.apply()
+		},
+	}
+
 	importMappingsCommand = &cobra.Command{
-		Use:   "import-mappings [<file>]",
+		Use:   "import-mappings [<file> ...]",
 		Short: "Import and apply mappings.",
 		Long: `Import and apply mappings.
 
 Import all upmaps from the given JSON input (probably from export-mappings) to the
-cluster. Input is stdin unless a file path is provided.
+cluster. Input is stdin unless one or more file paths are provided.
+
+If multiple files are given, their mappings are merged. Mappings repeated
+across files are applied once, but if the files disagree about a PG (the same
+source OSD mapped to different targets, or different source OSDs mapped to the
+same target), the conflicts are reported and nothing is applied.
+
+With --reverse, the mappings are undone rather than applied, last first, as if
+the output of invert were imported, e.g. to roll back a plan using the same
+file.
 
 JSON format example, remapping PG 1.1 from OSD 100 to OSD 42:
 [
@@ -434,57 +873,41 @@ JSON format example, remapping PG 1.1 from OSD 100 to OSD 42:
   }
 ]
 `,
-		Args: func(cmd *cobra.Command, args []string) error {
-			if len(args) > 1 {
-				return errors.New("extra args")
-			}
-
-			return nil
-		},
 		Run: func(cmd *cobra.Command, args []string) {
-			// Read in either the file or from stdin
-			var reader io.Reader
+			// Read in either the files or from stdin
+			var files []mappingsFile
 			if len(args) == 0 {
-				reader = os.Stdin
-			} else {
-				f, err := os.Open(args[0])
+				files = append(files, mustReadMappingsFile("stdin", os.Stdin))
+			}
+			for _, path := range args {
+				f, err := os.Open(path)
 				if err != nil {
 					panic(err)
 				}
+				files = append(files, mustReadMappingsFile(path, f))
+				f.Close()
+			}
 
-				defer f.Close()
-				reader = f
+			mappings, conflicts := mergeMappings(files)
+			if len(conflicts) > 0 {
+				for _, c := range conflicts {
+					fmt.Fprintln(os.Stderr, c)
+				}
+				panic(errors.Errorf("%d conflicting mapping(s) across input files; nothing applied", len(conflicts)))
 			}
 
 			M = mustGetCurrentMappingState()
+			mustParseMaxPoolMoveFraction(cmd)
 
-			var mappings []pgMapping
-			if err := json.NewDecoder(reader).Decode(&mappings); err != nil {
-				panic(err)
+			if mustGetBool(cmd, "reverse") {
+				mappings = invertMappings(os.Stdout, mappings)
 			}
-
-			for _, m := range mappings {
-				// There are two cases to consider:
-				// 1. The mapping we want to create is simply
-				//    gone - in this case, we can re-issue the
-				//    remap in its original form.
-				// 2. There is now a different upmap item from
-				//    the source OSD. We need to find this one
-				//    and modify it.
-				//
-				// Look for case 2 first, falling back to case
-				// 1 if we don't find anything.
-				pui := M.findOrMakeUpmapItem(m.PgID)
-				found := false
-				for _, puiM := range pui.Mappings {
-					if puiM.From == m.Mapping.From {
-						M.mustRemap(m.PgID, puiM.To, m.Mapping.To)
-						found = true
-						break
-					}
-				}
-				if !found {
-					M.mustRemap(m.PgID, m.Mapping.From, m.Mapping.To)
+			applied, skipped, invalid := importMappings(mappings, mustGetBool(cmd, "skip-invalid"))
+			fmt.Printf("%d mapping(s) newly applied, %d already in desired state (skipped)\n", applied, skipped)
+			if len(invalid) > 0 {
+				fmt.Printf("%d mapping(s) invalid for the current cluster state (skipped):\n", len(invalid))
+				for _, msg := range invalid {
+					fmt.Printf("  %s\n", msg)
 				}
 			}
 
@@ -496,53 +919,427 @@ JSON format example, remapping PG 1.1 from OSD 100 to OSD 42:
 		},
 	}
 
-	versionCmd = &cobra.Command{
-		Use:   "version",
-		Short: "Print version information",
-		Long:  "Print version information",
+	remapFileCmd = &cobra.Command{
+		Use:   "remap-file <file>",
+		Short: "Remap the PGs listed in the given file.",
+		Long: `Remap the PGs listed in the given file.
+
+Each line of the file is of the form "<pg ID>,<source osd ID>,<target osd ID>",
+and is applied as by the remap subcommand. Blank lines and lines starting with
+'#' are ignored. This is a lower-friction alternative to import-mappings for
+hand-edited lists. If any of the remaps can't be made, all of the failures are
+reported and nothing is applied.
+`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("a remap file must be specified")
+			}
 
+			return nil
+		},
 		Run: func(cmd *cobra.Command, args []string) {
-			var gitCommitSha string
-			var lastCommit string
-			var dirtyBuild bool
+			f, err := os.Open(args[0])
+			if err != nil {
+				panic(errors.WithStack(err))
+			}
+			mappings, err := parseRemapFile(f)
+			f.Close()
+			if err != nil {
+				panic(errors.Wrapf(err, "failed to parse %s", args[0]))
+			}
 
-			info, _ := debug.ReadBuildInfo()
-			for _, kv := range info.Settings {
-				// Full buildinfo dump
-				//fmt.Printf("%s %s\n", kv.Key, kv.Value)
-				switch kv.Key {
-				case "vcs.revision":
-					gitCommitSha = kv.Value
-				case "vcs.time":
-					lastCommit = kv.Value
-				case "vcs.modified":
-					dirtyBuild = kv.Value == "true"
+			M = mustGetCurrentMappingState()
+			M.noPrimaryOsds = mustGetOsdSpecSliceMap(cmd, "no-primary-osds")
+
+			var failed int
+			for _, m := range mappings {
+				if err := M.tryRemap(m.PgID, m.Mapping.From, m.Mapping.To); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					failed++
 				}
 			}
+			if failed > 0 {
+				panic(errors.Errorf("%d of %d remap(s) failed; nothing applied", failed, len(mappings)))
+			}
 
-			fmt.Printf("git sha %s%s\n", gitCommitSha, If(dirtyBuild, "-dirty", ""))
-			fmt.Printf("git commit-time %s\n", lastCommit)
+			if !confirmProceed() {
+				return
+			}
+
+			M.apply()
 		},
 	}
-)
 
-func mustGetBool(cmd *cobra.Command, arg string) bool {
-	ret, err := cmd.Flags().GetBool(arg)
-	if err != nil {
-		panic(errors.WithStack(err))
-	}
-	return ret
-}
+	invertCmd = &cobra.Command{
+		Use:   "invert <file>",
+		Short: "Compute the mappings that undo a previously-applied mappings file.",
+		Long: `Compute the mappings that undo a previously-applied mappings file.
+
+Given a mappings file (in the format used by import-mappings) that was applied
+to the cluster, output the mappings that undo it when given to
+import-mappings. Each mapping of the file that is still in effect is reversed,
+so that the import removes it, and the mappings are output last first;
+mappings that are no longer in the upmap exception table, or have since been
+changed, are reported and left out.
+
+Since the file doesn't record what a PG's mappings were before it was
+applied, a mapping that replaced an earlier mapping from the same OSD is
+removed rather than restored. Use --rollback-file when applying to capture
+the exact prior state. No changes are made.
+`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("a mappings file must be specified")
+			}
 
-func mustGetInt(cmd *cobra.Command, arg string) int {
-	ret, err := cmd.Flags().GetInt(arg)
-	if err != nil {
-		panic(errors.WithStack(err))
-	}
-	return ret
-}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			f, err := os.Open(args[0])
+			if err != nil {
+				panic(err)
+			}
+			applied := mustReadMappingsFile(args[0], f)
+			f.Close()
 
-func mustGetString(cmd *cobra.Command, arg string) string {
+			var writer io.Writer
+			output := mustGetString(cmd, "output")
+			if output == "" {
+				writer = os.Stdout
+			} else {
+				f, err := os.Create(output)
+				if err != nil {
+					panic(err)
+				}
+
+				defer f.Close()
+				writer = f
+			}
+
+			M = mustGetCurrentMappingState()
+			if err := json.NewEncoder(writer).Encode(invertMappings(os.Stderr, applied.mappings)); err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	lintUpmapsCmd = &cobra.Command{
+		Use:   "lint-upmaps",
+		Short: "Report problematic entries in the upmap exception table.",
+		Long: `Report problematic entries in the upmap exception table.
+
+Scan all upmap items in the cluster and report:
+* Stale mappings, which have no effect on the PG's up set.
+* Mappings whose From and To are the same OSD.
+* Upmap items for PGs in pools that no longer exist, or that can't be found.
+* Transitive chains of mappings within an upmap item (e.g. 1->2, 2->3).
+* Upmap items with an unusually high number of mappings.
+
+With --fix, the clearly-bogus entries (stale mappings, mappings to the same
+OSD, and items for PGs of deleted pools) are removed. Chains and long upmap
+items are only reported, as fixing them requires judgement.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			M = mustGetCurrentMappingState()
+
+			issues := lintUpmaps(mustGetInt(cmd, "max-mappings"))
+			for _, issue := range issues {
+				fmt.Println(issue)
+			}
+			fmt.Printf("%d issue(s) found\n", len(issues))
+
+			if !mustGetBool(cmd, "fix") {
+				return
+			}
+
+			fixUpmapLintIssues(issues)
+			if !confirmProceed() {
+				return
+			}
+
+			M.apply()
+		},
+	}
+
+	listStaleUpmapsCmd = &cobra.Command{
+		Use:   "list-stale-upmaps",
+		Short: "Report upmap mappings that have no effect on their PGs.",
+		Long: `Report upmap mappings that have no effect on their PGs.
+
+Ceph leaves mappings behind that no longer affect their PGs' up sets, e.g.
+after CRUSH changes: the From OSD is in the up set anyway, or the To OSD isn't.
+Every such mapping is reported, along with the reason it is stale.
+
+With --clean, they are removed.
+`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return errors.New("extra args")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			M = mustGetCurrentMappingState()
+
+			pgids := listStaleUpmaps(os.Stdout)
+			if !mustGetBool(cmd, "clean") {
+				return
+			}
+
+			for _, pgid := range pgids {
+				M.cleanUpmapItem(pgid)
+			}
+			if !confirmProceed() {
+				return
+			}
+
+			M.apply()
+		},
+	}
+
+	checkColocationCmd = &cobra.Command{
+		Use:   "check-colocation",
+		Short: "Report PGs with more than one member in the same failure domain.",
+		Long: `Report PGs with more than one member in the same failure domain.
+
+Scan the up set of every PG against the OSD tree and report any PG with two or
+more OSDs in the same CRUSH bucket of the given failure-domain type, e.g. a
+replica placed on the same host as the primary by a buggy upmap. PGs with
+upmap items are flagged as such, since these are the most likely cause. No
+changes are made.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			M = mustGetCurrentMappingState()
+			checkColocation(os.Stdout, mustGetString(cmd, "failure-domain"))
+		},
+	}
+
+	verifyCmd = &cobra.Command{
+		Use:   "verify [<osdspec> ...]",
+		Short: "Check that no PGs remain remapped.",
+		Long: `Check that no PGs remain remapped.
+
+Report every PG whose up set differs from its acting set, i.e. that is still
+remapped (and would backfill once allowed to), optionally only considering PGs
+with a member among the given OSDs. Exit non-zero if any are found, so that
+this can be used to confirm that e.g. cancel-backfill has quiesced the cluster
+before proceeding. No changes are made.
+`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			for _, arg := range args {
+				if _, err := parseOsdSpec(arg); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var osds map[int]struct{}
+			if len(args) > 0 {
+				osds = make(map[int]struct{})
+				for _, arg := range args {
+					for _, osd := range mustParseOsdSpec(arg) {
+						osds[osd] = struct{}{}
+					}
+				}
+			}
+
+			if n := verifyNoRemappedPgs(os.Stdout, osds, mustGetBool(cmd, "allow-degraded")); n > 0 {
+				panic(errors.Errorf("%d PG(s) remain remapped", n))
+			}
+		},
+	}
+
+	statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Summarize the current backfill reservations of each OSD.",
+		Long: `Summarize the current backfill reservations of each OSD.
+
+Print, for each OSD involved in backfill, the number of local (primary) and
+remote (target) backfill reservations it holds and the number of backfills it
+is a source for, sorted by total reservations, busiest first. With --bucket,
+all OSDs under the given CRUSH bucket are shown, including idle ones. No
+changes are made.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var osds []int
+			if bucket := mustGetString(cmd, "bucket"); bucket != "" {
+				osds = mustGetOsdsForBucket(bucket, "")
+			}
+			printStatus(os.Stdout, mustGetCurrentBackfillState(), osds)
+		},
+	}
+
+	simulateFailureCmd = &cobra.Command{
+		Use:   "simulate-failure <osdspec> [<osdspec> ...]",
+		Short: "Report the effect that the failure of the given OSDs would have.",
+		Long: `Report the effect that the failure of the given OSDs would have.
+
+Mark the given OSDs as down in an in-memory copy of the cluster's state and
+report which PGs would become degraded and undersized, which would become
+inactive (fewer members than the pool's min_size) or unrecoverable, which
+in-flight backfills would be interrupted, and which OSDs would drive the
+resulting recovery as primaries. No changes are made.
+`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("one or more OSDs must be specified")
+			}
+
+			for _, arg := range args {
+				if _, err := parseOsdSpec(arg); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			failed := make(map[int]struct{})
+			for _, arg := range args {
+				for _, osd := range mustParseOsdSpec(arg) {
+					failed[osd] = struct{}{}
+				}
+			}
+			simulateFailure(os.Stdout, failed)
+		},
+	}
+
+	whatifOsdOutCmd = &cobra.Command{
+		Use:   "whatif-osd-out <osdspec> [<osdspec> ...]",
+		Short: "Generate the mappings that marking the given OSDs out would cause.",
+		Long: `Generate the mappings that marking the given OSDs out would cause.
+
+Using osdmaptool against a copy of the cluster's osdmap, compute where each PG
+would be placed if the given OSDs were marked out, and output the resulting
+changes as JSON mappings suitable for import-mappings, e.g. to pre-place the
+data gradually before running 'ceph osd out'. The number of PGs that would
+move and the number of backfills each OSD would become a target of are printed
+to stderr. No changes are made.
+`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("one or more OSDs must be specified")
+			}
+
+			for _, arg := range args {
+				if _, err := parseOsdSpec(arg); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var writer io.Writer = os.Stdout
+			if output := mustGetString(cmd, "output"); output != "" {
+				f, err := os.Create(output)
+				if err != nil {
+					panic(errors.WithStack(err))
+				}
+				defer f.Close()
+
+				writer = f
+			}
+
+			osdSet := make(map[int]struct{})
+			for _, arg := range args {
+				for _, osd := range mustParseOsdSpec(arg) {
+					osdSet[osd] = struct{}{}
+				}
+			}
+			osds := mapKeysInt(osdSet)
+			sort.Ints(osds)
+
+			mappings, err := osdOutMappings(osds)
+			if err != nil {
+				panic(err)
+			}
+			printOsdOutSummary(os.Stderr, mappings)
+
+			if err := json.NewEncoder(writer).Encode(mappings); err != nil {
+				panic(errors.WithStack(err))
+			}
+		},
+	}
+
+	previewUnfreezeCmd = &cobra.Command{
+		Use:   "preview-unfreeze",
+		Short: "Show the backfill Ceph will perform once backfill is allowed.",
+		Long: `Show the backfill Ceph will perform once backfill is allowed.
+
+Report, based on the current up and acting sets, which PGs will backfill once
+the nobackfill/norebalance flags are unset, along with the resulting backfill
+load on each OSD. No changes are made.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			previewUnfreeze(os.Stdout, mustGetCurrentBackfillState())
+		},
+	}
+
+	versionCmd = &cobra.Command{
+		Use:   "version",
+		Short: "Print version information",
+		Long:  "Print version information",
+
+		Run: func(cmd *cobra.Command, args []string) {
+			var gitCommitSha string
+			var lastCommit string
+			var dirtyBuild bool
+
+			info, _ := debug.ReadBuildInfo()
+			for _, kv := range info.Settings {
+				// Full buildinfo dump
+				//fmt.Printf("%s %s\n", kv.Key, kv.Value)
+				switch kv.Key {
+				case "vcs.revision":
+					gitCommitSha = kv.Value
+				case "vcs.time":
+					lastCommit = kv.Value
+				case "vcs.modified":
+					dirtyBuild = kv.Value == "true"
+				}
+			}
+
+			fmt.Printf("git sha %s%s\n", gitCommitSha, If(dirtyBuild, "-dirty", ""))
+			fmt.Printf("git commit-time %s\n", lastCommit)
+		},
+	}
+)
+
+func mustGetBool(cmd *cobra.Command, arg string) bool {
+	ret, err := cmd.Flags().GetBool(arg)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	return ret
+}
+
+func mustGetInt(cmd *cobra.Command, arg string) int {
+	ret, err := cmd.Flags().GetInt(arg)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	return ret
+}
+
+func mustGetFloat64(cmd *cobra.Command, arg string) float64 {
+	ret, err := cmd.Flags().GetFloat64(arg)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	return ret
+}
+
+func mustGetDuration(cmd *cobra.Command, arg string) time.Duration {
+	ret, err := cmd.Flags().GetDuration(arg)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	return ret
+}
+
+func mustGetString(cmd *cobra.Command, arg string) string {
 	ret, err := cmd.Flags().GetString(arg)
 	if err != nil {
 		panic(errors.WithStack(err))
@@ -588,21 +1385,71 @@ func mustParseOsdSpec(s string) []int {
 	return osds
 }
 
+// maxOsdRangeSize caps the number of OSDs an osdspec range may cover, so that
+// a typo such as 100-1000000 fails instead of expanding to a huge list.
+const maxOsdRangeSize = 10000
+
 func parseOsdSpec(s string) ([]int, error) {
 	errResponse := func(s string) ([]int, error) {
 		return nil, errors.New(fmt.Sprintf("'%s' is not a valid osdspec - see root command --help", s))
 	}
 
+	if strings.Contains(s, ",") {
+		var osds []int
+		seen := make(map[int]struct{})
+		for _, part := range strings.Split(s, ",") {
+			partOsds, err := parseOsdSpec(part)
+			if err != nil {
+				return nil, err
+			}
+			// Parts may overlap, e.g. 100-105,103.
+			for _, osd := range partOsds {
+				if _, ok := seen[osd]; !ok {
+					seen[osd] = struct{}{}
+					osds = append(osds, osd)
+				}
+			}
+		}
+		return osds, nil
+	}
+
 	osd, err := strconv.Atoi(s)
 	if err == nil {
 		return []int{osd}, nil
 	}
 
+	if m := osdRangeRegexp.FindStringSubmatch(s); m != nil {
+		first, err1 := strconv.Atoi(m[1])
+		last, err2 := strconv.Atoi(m[2])
+		if err1 != nil || err2 != nil || first > last {
+			return errResponse(s)
+		}
+		if last-first >= maxOsdRangeSize {
+			return nil, errors.Errorf("osdspec range '%s' covers more than %d OSDs", s, maxOsdRangeSize)
+		}
+		osds := make([]int, 0, last-first+1)
+		for osd := first; osd <= last; osd++ {
+			osds = append(osds, osd)
+		}
+		return osds, nil
+	}
+
 	spl := strings.SplitN(s, ":", 2)
 	if len(spl) != 2 {
 		return errResponse(s)
 	}
 
+	if spl[0] == "reweight" {
+		if len(spl[1]) < 2 || (spl[1][0] != '<' && spl[1][0] != '>') {
+			return errResponse(s)
+		}
+		threshold, err := strconv.ParseFloat(spl[1][1:], 64)
+		if err != nil {
+			return errResponse(s)
+		}
+		return getOsdsByReweight(spl[1][0], threshold), nil
+	}
+
 	if spl[0] != "bucket" {
 		return errResponse(s)
 	}
@@ -655,33 +1502,153 @@ func parsePoolSpec(s string) ([]int, error) {
 	return nil, errors.Errorf("'%s' is not a valid pool name or ID", s)
 }
 
-func mustParseMaxSourceBackfills(cmd *cobra.Command) {
-	max := mustGetInt(cmd, "max-source-backfills")
-	M.bs.maxBackfillsFrom = max
-}
-
-func mustParseMaxBackfillReservations(cmd *cobra.Command) {
-	strs := mustGetStringSlice(cmd, "max-backfill-reservations")
-
-	if len(strs) >= 1 {
-		max, err := strconv.Atoi(strs[0])
+func mustParseActingOverrides(strs []string) map[string][]int {
+	overrides := make(map[string][]int)
+	for _, s := range strs {
+		pgid, osds, err := parseActingOverride(s)
 		if err != nil {
 			panic(errors.WithStack(err))
 		}
-		M.bs.maxBackfillReservations = max
+		overrides[pgid] = osds
+	}
+	return overrides
+}
 
-		for _, s := range strs[1:] {
-			spl := strings.Split(s, ":")
-			if len(spl) < 2 {
-				panic(errors.WithStack(errors.New(fmt.Sprintf("'%s' is not a valid max-backfill-reservation specifier", s))))
-			}
+func mustParsePgIDSet(strs []string) map[string]struct{} {
+	pgids := make(map[string]struct{}, len(strs))
+	for _, s := range strs {
+		if !pgIdRegexp.MatchString(s) {
+			panic(errors.Errorf("'%s' is not a valid PG ID", s))
+		}
+		pgids[s] = struct{}{}
+	}
+	return pgids
+}
 
-			max, err := strconv.Atoi(spl[len(spl)-1])
-			if err != nil {
+// parseActingOverride parses an acting set override of the form
+// "<pgid>:<osd>/<osd>/...", e.g. "1.2f:3/7/12".
+func parseActingOverride(s string) (string, []int, error) {
+	spl := strings.SplitN(s, ":", 2)
+	if len(spl) != 2 || !pgIdRegexp.MatchString(spl[0]) || spl[1] == "" {
+		return "", nil, errors.Errorf("'%s' is not a valid acting set override", s)
+	}
+
+	var osds []int
+	for _, osdStr := range strings.Split(spl[1], "/") {
+		osd, err := strconv.Atoi(osdStr)
+		if err != nil || osd < 0 {
+			return "", nil, errors.Errorf("'%s' is not a valid acting set override: bad OSD ID '%s'", s, osdStr)
+		}
+		osds = append(osds, osd)
+	}
+	return spl[0], osds, nil
+}
+
+// parseByteSpread parses a --target-byte-spread value, either a percentage of
+// utilization ("5%") or a number of bytes with an optional binary unit suffix
+// ("500G"). It returns the spread and whether it is a percentage.
+func parseByteSpread(s string) (float64, bool, error) {
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		v, err := strconv.ParseFloat(pct, 64)
+		if err != nil || v < 0 {
+			return 0, false, errors.Errorf("'%s' is not a valid byte spread", s)
+		}
+		return v, true, nil
+	}
+
+	num, multiplier := s, 1.0
+	if n := len(s); n > 0 {
+		if i := strings.Index("KMGT", strings.ToUpper(s[n-1:])); i >= 0 {
+			num = s[:n-1]
+			multiplier = float64(int64(1) << (10 * (i + 1)))
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, false, errors.Errorf("'%s' is not a valid byte spread", s)
+	}
+	return v * multiplier, false, nil
+}
+
+func mustParseMaxSourceBackfills(cmd *cobra.Command) {
+	max := mustGetInt(cmd, "max-source-backfills")
+	M.bs.maxBackfillsFrom = max
+}
+
+func mustParseMaxPoolMoveFraction(cmd *cobra.Command) {
+	fraction := mustGetFloat64(cmd, "max-pool-move-fraction")
+	if fraction < 0 || fraction > 1 {
+		panic(errors.Errorf("--max-pool-move-fraction must be between 0 and 1, not %g", fraction))
+	}
+	if fraction > 0 {
+		M.setMaxPoolMoveFraction(fraction)
+	}
+}
+
+func mustParseTargetPolicy(cmd *cobra.Command) {
+	policy, err := newTargetPolicy(mustGetString(cmd, "target-policy"))
+	if err != nil {
+		panic(err)
+	}
+	M.targetPolicy = policy
+}
+
+func mustParseTargetWeightBy(cmd *cobra.Command) {
+	switch weightBy := mustGetString(cmd, "target-weight-by"); weightBy {
+	case "reservations":
+	case "capacity":
+		if err := weightByCapacity(M.targetPolicy, osdDf()); err != nil {
+			panic(err)
+		}
+	default:
+		panic(errors.Errorf("unknown --target-weight-by '%s'; must be one of: reservations, capacity", weightBy))
+	}
+}
+
+func mustParseMaxClusterBackfills(cmd *cobra.Command) {
+	if max := mustGetInt(cmd, "max-cluster-backfills"); max > 0 {
+		M.bs.maxClusterBackfills = max
+	}
+}
+
+func mustParseMaxBackfillReservations(cmd *cobra.Command) {
+	strs := mustGetStringSlice(cmd, "max-backfill-reservations")
+
+	if len(strs) >= 1 {
+		max, err := strconv.Atoi(strs[0])
+		if err != nil {
+			panic(errors.WithStack(err))
+		}
+		M.bs.maxBackfillReservations = max
+
+		for _, s := range strs[1:] {
+			spl := strings.Split(s, ":")
+			if len(spl) < 2 {
+				panic(errors.WithStack(errors.New(fmt.Sprintf("'%s' is not a valid max-backfill-reservation specifier", s))))
+			}
+
+			max, err := strconv.Atoi(spl[len(spl)-1])
+			if err != nil {
 				panic(errors.WithStack(err))
 			}
 
-			osds := mustParseOsdSpec(s[0:strings.LastIndex(s, ":")])
+			spec := s[0:strings.LastIndex(s, ":")]
+			if pool, ok := strings.CutPrefix(spec, "pool:"); ok {
+				if M.bs.poolMaxBackfillReservations == nil {
+					M.bs.poolMaxBackfillReservations = make(map[int]int)
+				}
+				for _, id := range mustParsePoolSpec(pool) {
+					M.bs.poolMaxBackfillReservations[id] = max
+				}
+				continue
+			}
+
+			var osds []int
+			if class, ok := strings.CutPrefix(spec, "class:"); ok {
+				osds = getOsdsForDeviceClass(class)
+			} else {
+				osds = mustParseOsdSpec(spec)
+			}
 			for _, osd := range osds {
 				M.bs.osd(osd).maxBackfillReservations = max
 			}
@@ -691,12 +1658,96 @@ func mustParseMaxBackfillReservations(cmd *cobra.Command) {
 
 func init() {
 	rootCmd.PersistentFlags().IntVar(&concurrency, "concurrency", 5, "number of commands to issue in parallel")
+	rootCmd.PersistentFlags().IntVar(&applyBatchSize, "apply-batch-size", 0, "apply changes in batches of this many PGs, waiting --apply-batch-delay between batches, to limit the load on the mons (0 means a single batch)")
+	rootCmd.PersistentFlags().DurationVar(&applyBatchDelay, "apply-batch-delay", 5*time.Second, "with --apply-batch-size, how long to wait between batches")
 	rootCmd.PersistentFlags().BoolVar(&yes, "yes", false, "skip confirmations and dry-run output")
-	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "display Ceph commands being run")
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "print planned changes (and write --plan-output) without applying them or prompting, even if --yes is given")
+	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "display Ceph commands being run; same as --log-level debug")
+	rootCmd.PersistentFlags().StringVar(&logLevelName, "log-level", "info", "least severe level of diagnostic message to print to stderr: 'debug', 'info', or 'warn'")
+	rootCmd.PersistentFlags().IntVar(&maxMovesPerPg, "max-moves-per-pg", 0, "refuse to add a mapping to a PG whose upmap item already has more than this many mappings (0 means no limit)")
+	rootCmd.PersistentFlags().BoolVar(&skipScrubbingPgs, "skip-scrubbing-pgs", false, "never remap a PG that is currently being scrubbed or deep-scrubbed")
+	rootCmd.PersistentFlags().StringVar(&monHost, "mon-host", "", "direct read-only Ceph queries at the given mon address; changes are still made through the normal path")
+	rootCmd.PersistentFlags().StringVar(&planThenApply, "plan-then-apply", "", "write planned changes to the given file, then (after confirmation, unless --yes is given) apply exactly that saved plan")
+	rootCmd.PersistentFlags().StringVar(&planOutput, "plan-output", "", "write the planned changes to the given file as JSON, with each mapping tagged as added, modified, removed, stale, or kept, before confirming or applying them")
+	rootCmd.PersistentFlags().StringVar(&rollbackFile, "rollback-file", "", "before applying changes, write mappings to the given file that will restore the affected PGs to their prior state when given to import-mappings")
+	rootCmd.PersistentFlags().StringVar(&applyOutput, "apply-output", "", "after applying changes, write a JSON record of each PG's upmap item that was set or removed, and the command used, to the given file, or to stdout if \"-\"")
+	rootCmd.PersistentFlags().BoolVar(&recordProvenance, "record-provenance", false, "after applying changes, record when each mapping was created in the mon config-key store (one key per pool under "+upmapProvenanceConfigKeyPrefix+"), for undo-upmaps --older-than")
+	rootCmd.PersistentFlags().StringVar(&journalFile, "journal", "", "append each PG's upmap item to the given file as it is applied, and skip those already recorded there, so that an interrupted apply can be resumed by re-running with the same journal")
+	rootCmd.PersistentFlags().Float64Var(&maxMisplacedRatio, "max-misplaced-ratio", 0, "refuse to apply changes that add backfill if more than this fraction (between 0 and 1) of the cluster's objects are already misplaced, per 'ceph status' (0 means no limit)")
+	rootCmd.PersistentFlags().BoolVar(&ignoreMaxMisplacedRatio, "ignore-max-misplaced-ratio", false, "apply changes even though --max-misplaced-ratio is exceeded")
+	rootCmd.PersistentFlags().IntVar(&maxTotalUpmaps, "max-total-upmaps", 0, "refuse to apply changes that would leave more than this many upmap items (PGs with pg-upmap-items entries) in the cluster, unless they reduce the count (0 means no limit)")
+	rootCmd.PersistentFlags().StringVar(&jsonSummary, "json-summary", "", "at the end of the command, write a JSON summary of its changes to the given file, or to stderr if \"-\"")
+	rootCmd.PersistentFlags().StringVar(&metricsFile, "metrics-file", "", "at the end of the command, write Prometheus metrics about its changes to the given file, for node_exporter's textfile collector")
+	rootCmd.PersistentFlags().StringVar(&inputDir, "input-dir", "", "read Ceph state from JSON files in the given directory (osd-dump.json, osd-tree.json, osd-pool-ls.json, pg-dump-pgs-brief.json, pg-query-<pgid>.json, ...) instead of querying the cluster; commands that would modify the cluster are printed instead of run")
+	rootCmd.PersistentFlags().BoolVar(&assumeFlagsSet, "assume-flags-set", false, "fail unless the norebalance and nobackfill flags are set, and record in the JSON summary that they were")
+	rootCmd.PersistentFlags().BoolVar(&reservationsFromCeph, "reservations-from-ceph", false, "use each OSD's osd_max_backfills setting, per 'ceph config dump', as its max backfill reservations, unless overridden by --max-backfill-reservations")
+	rootCmd.PersistentFlags().DurationVar(&cephCommandTimeout, "ceph-command-timeout", 0, "kill any Ceph command that runs longer than this (e.g. 30s) and treat it as failed; 0 means no timeout")
+	rootCmd.PersistentFlags().IntVar(&cephRetries, "ceph-retries", 3, "retry a Ceph command up to this many times if it fails with a transient error, e.g. during a mon election")
+	rootCmd.PersistentFlags().DurationVar(&cephRetryDelay, "ceph-retry-delay", time.Second, "delay before the first retry of a Ceph command; doubled for each subsequent retry, up to "+maxCephRetryDelay.String())
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "format", "diff", "how to print planned changes: 'diff' (colored, with a legend) or 'review' (a deterministic, uncolored before/after block per PG)")
+	rootCmd.PersistentFlags().StringVar(&stateCachePath, "state-cache", "", "save the output of the OSD tree and PG dump queries to the given file, and reuse it in later invocations while it's younger than --state-cache-ttl and the osdmap epoch is unchanged")
+	rootCmd.PersistentFlags().DurationVar(&stateCacheTTL, "state-cache-ttl", 5*time.Minute, "how long the --state-cache output may be reused")
+	rootCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "disable colored output; it is already disabled when stdout isn't a terminal")
+	rootCmd.PersistentFlags().BoolVar(&quiet, "quiet", false, "suppress per-PG warnings (e.g. PGs that are skipped or excluded), printing only their count to stderr")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if noColor {
+			color.NoColor = true
+		}
+		level, err := parseLogLevel(logLevelName)
+		if err != nil {
+			return err
+		}
+		if verbose {
+			level = logDebug
+		}
+		minLogLevel = level
+		if outputFormat != "diff" && outputFormat != "review" {
+			return errors.Errorf("unknown --format '%s'; must be 'diff' or 'review'", outputFormat)
+		}
+		if maxMisplacedRatio < 0 || maxMisplacedRatio > 1 {
+			return errors.Errorf("--max-misplaced-ratio %v must be between 0 and 1", maxMisplacedRatio)
+		}
+		if inputDir != "" {
+			useInputDir(inputDir)
+			// Print the commands that would be run in a
+			// deterministic order.
+			concurrency = 1
+		}
+		if stateCachePath != "" {
+			if inputDir != "" {
+				return errors.New("--state-cache and --input-dir are mutually exclusive")
+			}
+			if err := useStateCache(stateCachePath, stateCacheTTL); err != nil {
+				return err
+			}
+		}
+		if assumeFlagsSet {
+			return verifyFreezeFlags(os.Stderr)
+		}
+		return nil
+	}
+	rootCmd.PersistentPostRun = func(cmd *cobra.Command, args []string) {
+		printSuppressedWarnings(os.Stderr)
+		if jsonSummary != "" {
+			mustWriteSummaryFile(jsonSummary)
+		}
+		if metricsFile != "" {
+			mustWriteMetricsFile(metricsFile)
+		}
+	}
 
 	balanceBucketCmd.Flags().Int("max-backfills", 5, "max number of backfills to schedule for this bucket, including pre-existing ones")
 	balanceBucketCmd.Flags().Int("target-spread", 1, "target difference between the fullest and emptiest OSD in the bucket")
 	balanceBucketCmd.Flags().String("device-class", "", "device class filter, balance only OSDs with this device class")
+	balanceBucketCmd.Flags().Int("max-pgs-per-pool", 0, "max number of PGs per pool to move in this run (0 means no limit)")
+	balanceBucketCmd.Flags().Float64("max-pool-move-fraction", 0, "max fraction (0 to 1) of each pool's PGs to move in this run, e.g. 0.05 for 5% (0 means no limit)")
+	balanceBucketCmd.Flags().StringSlice("no-primary-osds", []string{}, "list of osdspecs that must not become the primary of any more PGs, though they may still receive non-primary shards/replicas")
+	balanceBucketCmd.Flags().Bool("pin-backfilling", false, "leave PGs that are currently backfilling where they are; they still count toward their OSDs' PG counts")
+	balanceBucketCmd.Flags().String("match-bucket", "", "instead of evening out PG counts, mirror the PG count distribution of this reference bucket, pairing OSDs by position in order of OSD ID")
+	balanceBucketCmd.Flags().Bool("by-bytes", false, "balance the estimated bytes stored on each OSD, per 'ceph osd df' and 'ceph pg dump', instead of PG counts")
+	balanceBucketCmd.Flags().Bool("balance-primaries", false, "balance the number of PGs each OSD is primary for, which drives read load, instead of PG counts; PGs in EC pools are skipped")
+	balanceBucketCmd.Flags().String("target-byte-spread", "5%", "with --by-bytes, target difference between the fullest and emptiest OSD, either in percentage points of utilization (e.g. 5%) or in bytes with an optional K, M, G, or T suffix (e.g. 500G)")
+	balanceBucketCmd.Flags().Int("min-pgs-per-osd", 0, "never remap PGs off of an OSD that would leave it with fewer than this many PGs (0 means no floor)")
 
 	rootCmd.AddCommand(balanceBucketCmd)
 
@@ -708,109 +1759,1209 @@ func init() {
 	cancelBackfillCmd.Flags().StringSlice("exclude-pools", []string{}, "list of pool names or IDs that will be excluded from backfill cancellation")
 	cancelBackfillCmd.Flags().StringSlice("include-pools", []string{}, "list of pool names or IDs that will be included in backfill cancellation")
 	cancelBackfillCmd.Flags().StringSlice("pgs-including", []string{}, "only PGs that include the given OSDs in their up or acting set will have their backfill canceled, whether or not the given OSDs are backfill sources or targets in those PGs")
+	cancelBackfillCmd.Flags().StringSlice("pool-priority", []string{}, "list of pool names or IDs whose PGs will have their backfill canceled first, in the given order, so that the most critical pools are handled first if the run is interrupted")
+	cancelBackfillCmd.Flags().StringSlice("override-acting", []string{}, "DANGEROUS: list of operator-supplied authoritative acting sets, of the form \"<pgid>:<osd>/<osd>/...\" (in shard order for EC pools), used in place of the PG's acting set; allows canceling backfill for PGs that are otherwise skipped, such as incomplete or down PGs")
+	cancelBackfillCmd.Flags().StringSlice("trust-acting-from-query", []string{}, "list of PG IDs whose acting sets are always reconstructed via 'ceph pg query' (slow) rather than taken from the PG dump, for PGs in unusual peering states where the dump is known to be misleading")
+	cancelBackfillCmd.Flags().Int("max-backfills", 0, "stop after remapping this many PGs, so that large clusters can be processed in chunks across repeated runs (0 means no limit)")
+	cancelBackfillCmd.Flags().Bool("output-osd-summary", false, "print per-OSD counts of backfills as source and target before and after cancellation")
+	cancelBackfillCmd.Flags().Bool("upmap-caused-only", false, "only cancel backfill caused by an existing upmap entry, leaving backfill caused by CRUSH changes or reweights alone")
+	cancelBackfillCmd.Flags().Bool("only-degraded", false, "only cancel backfill for degraded PGs, whose acting sets are reconstructed via 'ceph pg query' (slow), leaving all other PGs alone")
+	cancelBackfillCmd.Flags().Bool("resolve-conflicts", false, "when an existing mapping conflicts with canceling a backfill, undo it first and retry, where doing so is safe")
+	cancelBackfillCmd.Flags().StringSlice("states", []string{}, "only cancel backfill for PGs whose state contains the given substrings (e.g. degraded,backfill_wait); a substring prefixed with '!' must not be contained in the state")
+	cancelBackfillCmd.Flags().String("states-match", "any", "with --states, whether a PG's state must match 'any' or 'all' of the given substrings")
+	cancelBackfillCmd.Flags().Int("query-concurrency", 0, "number of PGs to process, and possibly 'ceph pg query', in parallel, at least 1 (default: the value of --concurrency, which still applies to applying the changes)")
+	cancelBackfillCmd.Flags().Bool("progress", false, "print the number of PGs examined and remapped, and the number of pending 'ceph pg query' calls, to stderr every 1000 PGs or 5 seconds while planning")
+	cancelBackfillCmd.Flags().Bool("i-know-flags-are-unset", false, "with --yes, proceed even though the norebalance or nobackfill flag isn't set")
+	cancelBackfillCmd.Flags().Bool("then-enable-balancer", false, "after successfully applying changes, and after confirmation (unless --yes is given), run 'ceph balancer on'")
+	cancelBackfillCmd.Flags().Bool("then-unset-flags", false, "with --then-enable-balancer, unset the norebalance and nobackfill flags before enabling the balancer")
 	rootCmd.AddCommand(cancelBackfillCmd)
 
-	drainCmd.Flags().String("allow-movement-across", "", "the lowest CRUSH bucket type across which shards/replicas of a PG may move; '' (empty) means that shards/replicas must stay within their current direct bucket (IMPORTANT: this is not validated against your CRUSH rules, so make sure you set it and the target OSDs correctly!)")
-	drainCmd.Flags().StringSlice("max-backfill-reservations", []string{}, "limit number of backfill reservations made; format: \"default max[,osdspec:max]\", e.g., \"5,bucket:data10:10\"")
-	drainCmd.Flags().Int("max-source-backfills", 1, "max number of backfills to schedule per source OSD, including pre-existing ones")
-	drainCmd.Flags().StringSlice("target-osds", []string{}, "list of OSDs that will be used as the target of remappings")
-	rootCmd.AddCommand(drainCmd)
+	drainCmd.Flags().String("allow-movement-across", "", "the lowest CRUSH bucket type across which shards/replicas of a PG may move; '' (empty) means that shards/replicas must stay within their current direct bucket (IMPORTANT: this is not validated against your CRUSH rules, so make sure you set it and the target OSDs correctly!)")
+	drainCmd.Flags().StringSlice("max-backfill-reservations", []string{}, "limit number of backfill reservations made; format: \"default max[,osdspec:max|class:<device class>:max|pool:<pool>:max]\", e.g., \"5,bucket:data10:10,class:nvme:8,pool:rbd:2\"")
+	drainCmd.Flags().Int("max-source-backfills", 1, "max number of backfills to schedule per source OSD, including pre-existing ones")
+	drainCmd.Flags().Int("max-cluster-backfills", 0, "max number of backfills in the whole cluster, including pre-existing ones; no new backfills are scheduled once this is reached (0 means no limit)")
+	drainCmd.Flags().String("target-policy", "least-busy", "how to choose among candidate target OSDs: "+strings.Join(targetPolicyNames, ", "))
+	drainCmd.Flags().String("target-weight-by", "reservations", "how the least-busy target policy scores targets: reservations, or capacity to also weight by free space")
+	drainCmd.Flags().Int("max-pgs-per-pool", 0, "max number of PGs per pool to move in this run (0 means no limit)")
+	drainCmd.Flags().Float64("max-pool-move-fraction", 0, "max fraction (0 to 1) of each pool's PGs to move in this run, e.g. 0.05 for 5% (0 means no limit)")
+	drainCmd.Flags().StringSlice("no-primary-osds", []string{}, "list of osdspecs that must not become the primary of any more PGs, though they may still receive non-primary shards/replicas")
+	drainCmd.Flags().StringSlice("target-osds", []string{}, "list of OSDs that will be used as the target of remappings")
+	drainCmd.Flags().StringSlice("exclude-target-osds", []string{}, "list of osdspecs that will be removed from the targets given by --target-osds, selected by --auto-targets, or taken from --target-from-rule")
+	drainCmd.Flags().String("target-from-rule", "", "instead of --target-osds, use all OSDs that the given CRUSH rule can place data on, only draining PGs of pools that use the rule, and unless --allow-movement-across is given, allow movement across the rule's failure domain")
+	drainCmd.Flags().Bool("auto-targets", false, "instead of --target-osds, use all OSDs sharing a device class with the source OSDs that are less full than --target-full-ratio")
+	drainCmd.Flags().Float64("target-full-ratio", 0.75, "with --auto-targets, only select OSDs whose utilization is below this ratio; with --auto-targets or if given, also skip targets whose projected utilization after receiving a PG would exceed it (0 to disable)")
+	drainCmd.Flags().Bool("force-allow-colocation", false, "DANGEROUS: with --allow-movement-across, allow moving shards/replicas into buckets that already hold another shard/replica of the same PG, violating CRUSH rules; intended for emergency repair only, and always requires interactive confirmation")
+	rootCmd.AddCommand(drainCmd)
+
+	undoUpmapsCmd.Flags().StringSlice("max-backfill-reservations", []string{}, "limit number of backfill reservations made; format: \"default max[,osdspec:max|class:<device class>:max|pool:<pool>:max]\", e.g., \"5,bucket:data10:10,class:nvme:8,pool:rbd:2\"")
+	undoUpmapsCmd.Flags().Int("max-source-backfills", 1, "max number of backfills to schedule per source OSD, including pre-existing ones")
+	undoUpmapsCmd.Flags().Int("max-cluster-backfills", 0, "max number of backfills in the whole cluster, including pre-existing ones; no new backfills are scheduled once this is reached (0 means no limit)")
+	undoUpmapsCmd.Flags().String("target-policy", "least-busy", "how to choose among candidate target OSDs: "+strings.Join(targetPolicyNames, ", "))
+	undoUpmapsCmd.Flags().Bool("target", false, "the given OSDs are backfill targets rather than sources")
+	undoUpmapsCmd.Flags().StringSlice("from", []string{}, "list of osdspecs; only undo mappings from one of these OSDs")
+	undoUpmapsCmd.Flags().StringSlice("to", []string{}, "list of osdspecs; only undo mappings to one of these OSDs")
+	undoUpmapsCmd.Flags().Duration("older-than", 0, "only undo mappings that pgremapper recorded creating, with --record-provenance, at least this long ago (e.g. 24h); 0 means no age limit")
+	rootCmd.AddCommand(undoUpmapsCmd)
+
+	undoAllUpmapsCmd.Flags().StringSlice("max-backfill-reservations", []string{}, "limit number of backfill reservations made; format: \"default max[,osdspec:max|class:<device class>:max|pool:<pool>:max]\", e.g., \"5,bucket:data10:10,class:nvme:8,pool:rbd:2\"")
+	undoAllUpmapsCmd.Flags().Int("max-source-backfills", 1, "max number of backfills to schedule per source OSD, including pre-existing ones")
+	undoAllUpmapsCmd.Flags().Int("max-cluster-backfills", 0, "max number of backfills in the whole cluster, including pre-existing ones; no new backfills are scheduled once this is reached (0 means no limit)")
+	undoAllUpmapsCmd.Flags().String("target-policy", "least-busy", "how to choose among candidate target OSDs: "+strings.Join(targetPolicyNames, ", "))
+	rootCmd.AddCommand(undoAllUpmapsCmd)
+
+	swapBucketCmd.Flags().StringSlice("max-backfill-reservations", []string{}, "limit number of backfill reservations made; format: \"default max[,osdspec:max|class:<device class>:max|pool:<pool>:max]\", e.g., \"5,bucket:data10:10,class:nvme:8,pool:rbd:2\"")
+	swapBucketCmd.Flags().Int("max-source-backfills", 1, "max number of backfills to schedule per source OSD, including pre-existing ones")
+	swapBucketCmd.Flags().Int("max-cluster-backfills", 0, "max number of backfills in the whole cluster, including pre-existing ones; no new backfills are scheduled once this is reached (0 means no limit)")
+	swapBucketCmd.Flags().String("target-policy", "least-busy", "how to choose among candidate target OSDs: "+strings.Join(targetPolicyNames, ", "))
+	rootCmd.AddCommand(swapBucketCmd)
+
+	remapCmd.Flags().StringSlice("no-primary-osds", []string{}, "list of osdspecs that must not become the primary of any more PGs, though they may still receive non-primary shards/replicas")
+	rootCmd.AddCommand(remapCmd)
+
+	remapFileCmd.Flags().StringSlice("no-primary-osds", []string{}, "list of osdspecs that must not become the primary of any more PGs, though they may still receive non-primary shards/replicas")
+	rootCmd.AddCommand(remapFileCmd)
+
+	exportMappingsCommand.Flags().String("output", "", "write output to the given file path instead of stdout")
+	exportMappingsCommand.Flags().Bool("whole-pg", false, "export all mappings for any PGs that include the given OSD(s), not just the portions pertaining to those OSDs")
+	exportMappingsCommand.Flags().StringSlice("pool", []string{}, "list of pool names or IDs; only mappings for PGs in these pools are exported")
+	exportMappingsCommand.Flags().Bool("effective-only", true, "export only mappings currently in effect, leaving out stale mappings; if false, the raw contents of the exception table are exported")
+	exportMappingsCommand.Flags().String("output-format", "json", "output format: "+strings.Join(mappingsFormats, ", ")+"; only json can be read by import-mappings")
+	exportMappingsCommand.Flags().String("sort", "pgid", "order of the exported mappings, by: "+strings.Join(mappingsSortKeys, ", ")+"; ties are broken by the remaining keys")
+	exportMappingsCommand.Flags().Bool("annotate", false, "include the PG's state, whether it is EC, and whether the mapping is in effect (rather than stale) with each mapping; the output remains importable")
+	rootCmd.AddCommand(exportMappingsCommand)
+
+	exportPendingBackfillCmd.Flags().String("output", "", "write output to the given file path instead of stdout")
+	rootCmd.AddCommand(exportPendingBackfillCmd)
+
+	generateCrushMappingsCommand.Flags().String("crushmap-text", "", "CRUSHmap, with changes, provided in the text format")
+	generateCrushMappingsCommand.Flags().String("crushmap-file", "", "CRUSHmap, with changes, provided as a file in the text or compiled format, or '-' to read it from stdin")
+	generateCrushMappingsCommand.Flags().String("output", "", "write output to the given file path instead of stdout")
+	generateCrushMappingsCommand.Flags().String("pool-rule", "", "instead of a CRUSHmap change, generate the mappings for switching a single pool to another CRUSH rule; format: \"<pool>:<rule name>\"; the CRUSHmap given by --crushmap-text or --crushmap-file (or the current one, if not given) is used as the starting point")
+	rootCmd.AddCommand(generateCrushMappingsCommand)
+
+	importMappingsCommand.Flags().Bool("skip-invalid", false, "skip, and summarize at the end, mappings that no longer apply to the cluster or conflict with its current state, rather than failing")
+	importMappingsCommand.Flags().Bool("reverse", false, "undo the given mappings, as previously applied, rather than applying them")
+	importMappingsCommand.Flags().Float64("max-pool-move-fraction", 0, "max fraction (0 to 1) of each pool's PGs to move in this run, e.g. 0.05 for 5% (0 means no limit)")
+	rootCmd.AddCommand(importMappingsCommand)
+
+	prestageCrushCmd.Flags().String("crushmap-text", "", "CRUSHmap, with changes, provided in the text format")
+	prestageCrushCmd.Flags().StringSlice("max-backfill-reservations", []string{}, "limit number of backfill reservations made; format: \"default max[,osdspec:max|class:<device class>:max|pool:<pool>:max]\", e.g., \"5,bucket:data10:10,class:nvme:8,pool:rbd:2\"")
+	prestageCrushCmd.Flags().Int("max-source-backfills", 1, "max number of backfills to schedule per source OSD, including pre-existing ones")
+	prestageCrushCmd.Flags().Int("max-cluster-backfills", 0, "max number of backfills in the whole cluster, including pre-existing ones; no new backfills are scheduled once this is reached (0 means no limit)")
+	prestageCrushCmd.Flags().String("target-policy", "least-busy", "how to choose among candidate target OSDs: "+strings.Join(targetPolicyNames, ", "))
+	rootCmd.AddCommand(prestageCrushCmd)
+
+	invertCmd.Flags().String("output", "", "write output to the given file path instead of stdout")
+	rootCmd.AddCommand(invertCmd)
+
+	lintUpmapsCmd.Flags().Bool("fix", false, "remove clearly-bogus entries (stale mappings, mappings to the same OSD, and items for PGs of deleted pools)")
+	lintUpmapsCmd.Flags().Int("max-mappings", 4, "report upmap items with more than this many mappings")
+	rootCmd.AddCommand(lintUpmapsCmd)
+
+	listStaleUpmapsCmd.Flags().Bool("clean", false, "remove the stale mappings")
+	rootCmd.AddCommand(listStaleUpmapsCmd)
+
+	checkColocationCmd.Flags().String("failure-domain", "host", "the CRUSH bucket type that no two members of a PG's up set should share")
+	rootCmd.AddCommand(checkColocationCmd)
+
+	rootCmd.AddCommand(previewUnfreezeCmd)
+
+	rootCmd.AddCommand(simulateFailureCmd)
+
+	whatifOsdOutCmd.Flags().String("output", "", "write the mappings to the given file path instead of stdout")
+	rootCmd.AddCommand(whatifOsdOutCmd)
+
+	verifyCmd.Flags().Bool("allow-degraded", false, "ignore differences due to missing (NONE) members of the up or acting set")
+	rootCmd.AddCommand(verifyCmd)
+
+	statusCmd.Flags().String("bucket", "", "only show OSDs under the given CRUSH bucket")
+	rootCmd.AddCommand(statusCmd)
+
+	rootCmd.AddCommand(versionCmd)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+}
+
+type upmapLintIssue struct {
+	pgid    string
+	problem string
+	fixable bool
+}
+
+func (i upmapLintIssue) String() string {
+	return fmt.Sprintf("pg %s: %s%s", i.pgid, i.problem, If(i.fixable, " (fixable)", ""))
+}
+
+func lintUpmaps(maxMappings int) []upmapLintIssue {
+	var issues []upmapLintIssue
+	add := func(pgid string, fixable bool, format string, a ...interface{}) {
+		issues = append(issues, upmapLintIssue{
+			pgid:    pgid,
+			problem: fmt.Sprintf(format, a...),
+			fixable: fixable,
+		})
+	}
+
+	pgBriefs := pgBriefMap()
+	pools := osdPoolDetails()
+
+	M.l.Lock()
+	defer M.l.Unlock()
+
+	for _, pui := range M.pgUpmapItems {
+		// Without the PG's up set, its mappings can't be safely fixed.
+		found := true
+		if _, ok := pgBriefs[pui.PgID]; !ok {
+			pool, err := parsePgPoolID(pui.PgID)
+			if _, exists := pools.Pools[pool]; err == nil && !exists {
+				add(pui.PgID, true, "pool %d no longer exists", pool)
+				continue
+			}
+			// The PG may have been merged away, or may have been
+			// excluded due to inconsistent up/acting sets.
+			add(pui.PgID, false, "PG not found in pg dump")
+			found = false
+		}
+
+		all := append(append([]mapping{}, pui.Mappings...), pui.staleMappings...)
+		// A self-mapping never has an effect, so it is usually among
+		// the stale mappings; report it as what it is.
+		for _, mp := range all {
+			if mp.From == mp.To {
+				add(pui.PgID, found, "mapping %s maps an OSD to itself", mp)
+			}
+		}
+		for _, mp := range pui.staleMappings {
+			if mp.From != mp.To {
+				add(pui.PgID, found, "stale mapping %s", mp)
+			}
+		}
+		for _, m1 := range all {
+			for _, m2 := range all {
+				if m1.From != m1.To && m1.To == m2.From && m2.From != m2.To {
+					add(pui.PgID, false, "transitive mapping chain %s, %s", m1, m2)
+				}
+			}
+		}
+		if len(all) > maxMappings {
+			add(pui.PgID, false, "upmap item has %d mappings", len(all))
+		}
+	}
+
+	return issues
+}
+
+func fixUpmapLintIssues(issues []upmapLintIssue) {
+	for _, issue := range issues {
+		if issue.fixable {
+			M.cleanUpmapItem(issue.pgid)
+		}
+	}
+}
+
+// listStaleUpmaps reports each stale mapping in the cluster and why it is
+// stale, returning the PGs that have them.
+func listStaleUpmaps(w io.Writer) []string {
+	pgBriefs := pgBriefMap()
+
+	M.l.Lock()
+	defer M.l.Unlock()
+
+	var (
+		pgids []string
+		count int
+	)
+	for _, pui := range M.pgUpmapItems {
+		if len(pui.staleMappings) == 0 {
+			continue
+		}
+		pgids = append(pgids, pui.PgID)
+		for _, mp := range pui.staleMappings {
+			fmt.Fprintf(w, "pg %s: stale mapping %s: %s\n", pui.PgID, mp, staleMappingReason(pgBriefs[pui.PgID].Up, mp))
+			count++
+		}
+	}
+	fmt.Fprintf(w, "%d stale mapping(s) found\n", count)
+	return pgids
+}
+
+// checkColocation reports PGs whose up sets contain more than one OSD in the
+// same bucket of the given type, returning the number of such PGs. The raw PG
+// dump is checked, since PGs with an OSD in their up set more than once are
+// the most colocated of all, yet are otherwise ignored.
+func checkColocation(w io.Writer, failureDomain string) int {
+	tree := osdTree()
+	pgBriefs := append([]*pgBriefItem(nil), rawPgDumpPgsBrief()...)
+	sort.Slice(pgBriefs, func(i, j int) bool { return pgBriefs[i].PgID < pgBriefs[j].PgID })
+
+	hasUpmapItem := make(map[string]bool)
+	M.iterateMappings(func(pgid string, _ mapping) {
+		hasUpmapItem[pgid] = true
+	}, func(*pgUpmapItem, mapping) bool { return true })
+
+	count := 0
+	for _, pgb := range pgBriefs {
+		var (
+			buckets   []string
+			bucketSet = make(map[string][]int)
+			seen      = make(map[int]bool)
+			colocated = false
+		)
+		for _, osd := range pgb.Up {
+			if osd != invalidOSD && seen[osd] {
+				fmt.Fprintf(w, "pg %s: osd %d appears more than once in the up set %s%s\n", pgb.PgID, osd, osdListString(pgb.Up), If(hasUpmapItem[pgb.PgID], " (has upmap item)", ""))
+				colocated = true
+				continue
+			}
+			seen[osd] = true
+			node, ok := tree.IDToNode[osd]
+			if osd == invalidOSD || !ok {
+				continue
+			}
+			bucket := node.getNearestParentOfType(failureDomain)
+			if bucket == nil {
+				continue
+			}
+			if _, ok := bucketSet[bucket.Name]; !ok {
+				buckets = append(buckets, bucket.Name)
+			}
+			bucketSet[bucket.Name] = append(bucketSet[bucket.Name], osd)
+		}
+
+		for _, bucket := range buckets {
+			osds := bucketSet[bucket]
+			if len(osds) < 2 {
+				continue
+			}
+			colocated = true
+			osdStrs := make([]string, len(osds))
+			for i, osd := range osds {
+				osdStrs[i] = strconv.Itoa(osd)
+			}
+			fmt.Fprintf(w, "pg %s: osds %s share %s %s%s\n", pgb.PgID, strings.Join(osdStrs, ", "), failureDomain, bucket, If(hasUpmapItem[pgb.PgID], " (has upmap item)", ""))
+		}
+		if colocated {
+			count++
+		}
+	}
+	fmt.Fprintf(w, "%d PG(s) with colocated members\n", count)
+	return count
+}
+
+// printOsdOutSummary prints the number of PGs that the given mappings would
+// move, and the number of backfills that each OSD would be the target of.
+func printOsdOutSummary(w io.Writer, mappings []pgMapping) {
+	pgs := make(map[string]struct{})
+	targets := make(map[int]int)
+	for _, pm := range mappings {
+		pgs[pm.PgID] = struct{}{}
+		targets[pm.Mapping.To]++
+	}
+
+	fmt.Fprintf(w, "%d PG(s) would move\n", len(pgs))
+	if len(targets) == 0 {
+		return
+	}
+
+	osds := mapKeysInt(targets)
+	sort.Ints(osds)
+	fmt.Fprintf(w, "%-8s %s\n", "OSD", "TARGET BACKFILLS")
+	for _, osd := range osds {
+		fmt.Fprintf(w, "%-8d %d\n", osd, targets[osd])
+	}
+}
+
+// verifyNoRemappedPgs reports each PG whose up set differs from its acting
+// set, considering only PGs with a member among the given OSDs if any are
+// given, and returns the number found. With allowDegraded, positions where
+// either set is missing a member are not considered a difference. PGs that
+// are otherwise ignored due to inconsistent up and acting sets can't be
+// verified, so they are counted too.
+func verifyNoRemappedPgs(w io.Writer, osds map[int]struct{}, allowDegraded bool) int {
+	sanitized := pgBriefMap()
+	pgBriefs := make([]*pgBriefItem, 0, len(rawPgDumpPgsBrief()))
+	for _, pgb := range rawPgDumpPgsBrief() {
+		if s, ok := sanitized[pgb.PgID]; ok {
+			pgb = s
+		}
+		pgBriefs = append(pgBriefs, pgb)
+	}
+	sort.Slice(pgBriefs, func(i, j int) bool { return pgBriefs[i].PgID < pgBriefs[j].PgID })
+
+	touches := func(pgb *pgBriefItem) bool {
+		if osds == nil {
+			return true
+		}
+		for _, osd := range append(append([]int(nil), pgb.Up...), pgb.Acting...) {
+			if _, ok := osds[osd]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	count := 0
+	for _, pgb := range pgBriefs {
+		if !touches(pgb) {
+			continue
+		}
+		if _, ok := sanitized[pgb.PgID]; !ok {
+			fmt.Fprintf(w, "pg %s: up %s, acting %s are inconsistent; can't verify\n", pgb.PgID, osdListString(pgb.Up), osdListString(pgb.Acting))
+			count++
+			continue
+		}
+
+		remapped := false
+		for i := range pgb.Up {
+			if allowDegraded && (pgb.Up[i] == invalidOSD || pgb.Acting[i] == invalidOSD) {
+				continue
+			}
+			if pgb.Up[i] != pgb.Acting[i] {
+				remapped = true
+				break
+			}
+		}
+		if remapped {
+			fmt.Fprintf(w, "pg %s: up %s, acting %s\n", pgb.PgID, osdListString(pgb.Up), osdListString(pgb.Acting))
+			count++
+		}
+	}
+	fmt.Fprintf(w, "%d PG(s) remapped\n", count)
+	return count
+}
+
+// simulateFailure reports the effect of the given OSDs going down on the
+// current PGs: the members each PG would lose, whether it would remain active
+// and recoverable, and the in-flight backfill that would be interrupted.
+func simulateFailure(w io.Writer, failed map[int]struct{}) {
+	isFailed := func(osd int) bool {
+		_, ok := failed[osd]
+		return ok
+	}
+	pools := osdPoolDetails()
+
+	pgBriefs := append([]*pgBriefItem(nil), pgDumpPgsBrief()...)
+	sort.Slice(pgBriefs, func(i, j int) bool { return pgBriefs[i].PgID < pgBriefs[j].PgID })
+
+	var (
+		degraded, inactive, unrecoverable int
+		recoveryPrimaries                 = make(map[int]int)
+	)
+	fmt.Fprintln(w, "PGs affected by the failure:")
+	for _, pgb := range pgBriefs {
+		acting := make([]int, len(pgb.Acting))
+		lost := false
+		remaining := 0
+		for i, osd := range pgb.Acting {
+			acting[i] = osd
+			if isFailed(osd) {
+				acting[i] = invalidOSD
+				lost = true
+			}
+			if acting[i] != invalidOSD {
+				remaining++
+			}
+		}
+		if !lost {
+			continue
+		}
+		degraded++
+
+		pool := pools.poolForPg(pgb.PgID)
+		state := "degraded+undersized"
+		if pool.MinSize > 0 && remaining < pool.MinSize {
+			state += "+inactive"
+			inactive++
+		}
+		if remaining == 0 || (pool.ECProfile != "" && remaining < pool.ECK) {
+			state += ", UNRECOVERABLE"
+			unrecoverable++
+		} else {
+			simulated := &pgBriefItem{PgID: pgb.PgID, Acting: acting}
+			recoveryPrimaries[simulated.primaryOsd()]++
+		}
+		fmt.Fprintf(w, "pg %s: acting %v -> %v: %s (%d/%d remaining)\n", pgb.PgID, osdListString(pgb.Acting), osdListString(acting), state, remaining, len(acting))
+
+		srcs, tgts := computeBackfillSrcsTgts(pgb)
+		for i := range tgts {
+			if isFailed(srcs[i]) || isFailed(tgts[i]) {
+				fmt.Fprintf(w, "  in-flight backfill %s would be interrupted\n", mapping{From: srcs[i], To: tgts[i]})
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d PG(s) degraded, %d inactive, %d unrecoverable\n\n", degraded, inactive, unrecoverable)
+
+	fmt.Fprintln(w, "Recovery primaries once the failed OSDs are marked out:")
+	fmt.Fprintf(w, "%-8s %s\n", "OSD", "PGS")
+	for _, osd := range mapKeysInt(recoveryPrimaries) {
+		fmt.Fprintf(w, "%-8d %d\n", osd, recoveryPrimaries[osd])
+	}
+}
+
+// osdListString formats a list of OSDs as Ceph does, with missing members
+// shown as NONE.
+func osdListString(osds []int) string {
+	strs := make([]string, len(osds))
+	for i, osd := range osds {
+		strs[i] = If(osd == invalidOSD, "NONE", strconv.Itoa(osd))
+	}
+	return "[" + strings.Join(strs, ",") + "]"
+}
+
+// printStatus prints the backfill reservations of the given OSDs, or of all
+// OSDs involved in backfill if none are given, busiest first.
+func printStatus(w io.Writer, bs *backfillState, osds []int) {
+	if osds == nil {
+		for osd, obs := range bs.osds {
+			if obs.backfillsFrom != 0 || obs.localReservations != 0 || obs.remoteReservations != 0 {
+				osds = append(osds, osd)
+			}
+		}
+	}
+	osds = append([]int{}, osds...)
+	total := func(osd int) int {
+		obs := bs.osd(osd)
+		return obs.localReservations + obs.remoteReservations
+	}
+	sort.Slice(osds, func(i, j int) bool {
+		if total(osds[i]) != total(osds[j]) {
+			return total(osds[i]) > total(osds[j])
+		}
+		return osds[i] < osds[j]
+	})
+
+	fmt.Fprintf(w, "%-8s %-8s %-8s %s\n", "OSD", "LOCAL", "REMOTE", "SOURCE")
+	for _, osd := range osds {
+		obs := bs.osd(osd)
+		fmt.Fprintf(w, "%-8d %-8d %-8d %d\n", osd, obs.localReservations, obs.remoteReservations, obs.backfillsFrom)
+	}
+}
+
+type pendingBackfill struct {
+	PgID      string    `json:"pgid"`
+	State     string    `json:"state"`
+	Backfills []mapping `json:"backfills"`
+}
+
+// pendingBackfills returns, sorted by PG ID, the backfills that the given
+// state's up and acting sets imply.
+func pendingBackfills(bs *backfillState) []pendingBackfill {
+	pgids := make([]string, 0, len(bs.pgbs))
+	for pgid := range bs.pgbs {
+		pgids = append(pgids, pgid)
+	}
+	sort.Strings(pgids)
+
+	pending := []pendingBackfill{}
+	for _, pgid := range pgids {
+		pgb := bs.pgbs[pgid]
+		srcs, tgts := computeBackfillSrcsTgts(pgb)
+		if len(tgts) == 0 {
+			continue
+		}
+
+		backfills := make([]mapping, len(tgts))
+		for i := range tgts {
+			backfills[i] = mapping{From: srcs[i], To: tgts[i]}
+		}
+		pending = append(pending, pendingBackfill{PgID: pgid, State: pgb.State, Backfills: backfills})
+	}
+	return pending
+}
+
+func previewUnfreeze(w io.Writer, bs *backfillState) {
+	pending := pendingBackfills(bs)
+
+	fmt.Fprintln(w, "PGs that will backfill:")
+	for _, pb := range pending {
+		moves := make([]string, len(pb.Backfills))
+		for i, m := range pb.Backfills {
+			moves[i] = m.String()
+		}
+		fmt.Fprintf(w, "pg %s (%s): %s\n", pb.PgID, pb.State, strings.Join(moves, ","))
+	}
+	fmt.Fprintf(w, "%d PG(s) will backfill\n\n", len(pending))
+
+	osds := make(map[int]struct{})
+	for osd, obs := range bs.osds {
+		if obs.backfillsFrom != 0 || obs.localReservations != 0 || obs.remoteReservations != 0 {
+			osds[osd] = struct{}{}
+		}
+	}
+
+	fmt.Fprintln(w, "Per-OSD backfill load:")
+	fmt.Fprintf(w, "%-8s %-8s %-8s %s\n", "OSD", "SOURCE", "LOCAL", "REMOTE")
+	for _, osd := range mapKeysInt(osds) {
+		obs := bs.osd(osd)
+		fmt.Fprintf(w, "%-8d %-8d %-8d %d\n", osd, obs.backfillsFrom, obs.localReservations, obs.remoteReservations)
+	}
+}
+
+// mappingsFile holds the mappings read from one import-mappings input.
+type mappingsFile struct {
+	name     string
+	mappings []pgMapping
+}
+
+func mustReadMappingsFile(name string, r io.Reader) mappingsFile {
+	var mappings []pgMapping
+	if err := json.NewDecoder(r).Decode(&mappings); err != nil {
+		panic(errors.Wrapf(err, "failed to parse mappings from %s", name))
+	}
+	return mappingsFile{name: name, mappings: mappings}
+}
+
+// parseRemapFile parses lines of the form "<pg ID>,<from>,<to>", ignoring
+// blank lines and comments starting with '#'.
+func parseRemapFile(r io.Reader) ([]pgMapping, error) {
+	var mappings []pgMapping
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, errors.Errorf("line %d: expected <pg ID>,<from>,<to>, got '%s'", n, line)
+		}
+		pgid := strings.TrimSpace(fields[0])
+		if !pgIdRegexp.MatchString(pgid) {
+			return nil, errors.Errorf("line %d: '%s' is not a valid PG ID", n, pgid)
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d: invalid source OSD", n)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(fields[2]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d: invalid target OSD", n)
+		}
+
+		mappings = append(mappings, pgMapping{PgID: pgid, Mapping: mapping{From: from, To: to}})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return mappings, nil
+}
+
+// mergeMappings combines the mappings from the given files in order, dropping
+// duplicates. It also returns a description of each conflict, where a mapping
+// maps a PG's source OSD to a different target than an earlier one, or maps a
+// different source OSD to the same target.
+func mergeMappings(files []mappingsFile) ([]pgMapping, []string) {
+	type origin struct {
+		osd  int
+		file string
+	}
+	var (
+		merged    []pgMapping
+		conflicts []string
+		byFrom    = make(map[string]map[int]origin)
+		byTo      = make(map[string]map[int]origin)
+	)
+	for _, f := range files {
+		for _, m := range f.mappings {
+			if byFrom[m.PgID] == nil {
+				byFrom[m.PgID] = make(map[int]origin)
+				byTo[m.PgID] = make(map[int]origin)
+			}
+
+			if o, ok := byFrom[m.PgID][m.Mapping.From]; ok {
+				if o.osd != m.Mapping.To {
+					conflicts = append(conflicts, fmt.Sprintf("pg %s: %s in %s conflicts with %s in %s",
+						m.PgID, m.Mapping, f.name, mapping{From: m.Mapping.From, To: o.osd}, o.file))
+				}
+				continue
+			}
+			if o, ok := byTo[m.PgID][m.Mapping.To]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("pg %s: %s in %s conflicts with %s in %s",
+					m.PgID, m.Mapping, f.name, mapping{From: o.osd, To: m.Mapping.To}, o.file))
+				continue
+			}
+
+			byFrom[m.PgID][m.Mapping.From] = origin{osd: m.Mapping.To, file: f.name}
+			byTo[m.PgID][m.Mapping.To] = origin{osd: m.Mapping.From, file: f.name}
+			merged = append(merged, m)
+		}
+	}
+	return merged, conflicts
+}
+
+// invertMappings returns the mappings that, when imported, undo the given
+// applied mappings, last applied first. Mappings that are no longer in effect
+// are reported to w and left out.
+func invertMappings(w io.Writer, applied []pgMapping) []pgMapping {
+	inverse := []pgMapping{}
+	for i := len(applied) - 1; i >= 0; i-- {
+		m := applied[i]
+		if isMappingInEffect(m) {
+			inverse = append(inverse, pgMapping{PgID: m.PgID, Mapping: mapping{From: m.Mapping.To, To: m.Mapping.From}})
+			continue
+		}
+
+		current := M.getAllMappings(mfAnd(withPgid(m.PgID), withFrom(m.Mapping.From)))
+		if len(current) > 0 {
+			fmt.Fprintf(w, "pg %s: %s: changed to %s since it was applied (skipped)\n", m.PgID, m.Mapping, current[0].Mapping)
+		} else {
+			fmt.Fprintf(w, "pg %s: %s: no longer in effect (skipped)\n", m.PgID, m.Mapping)
+		}
+	}
+	return inverse
+}
+
+// importMappings remaps PGs according to the given mappings, returning the
+// number of mappings that were applied and the number that were skipped
+// because they are already in effect. With skipInvalid, mappings that no
+// longer apply to the cluster or can't be made are skipped rather than
+// causing a panic, and are described in the returned list.
+func importMappings(mappings []pgMapping, skipInvalid bool) (int, int, []string) {
+	applied, skipped := 0, 0
+	var invalid []string
+	for _, m := range mappings {
+		if isMappingInEffect(m) {
+			fmt.Printf("pg %s: %s: already in desired state (skipped)\n", m.PgID, m.Mapping)
+			skipped++
+			continue
+		}
+
+		if M.isSkippedForScrub(m.PgID) {
+			fmt.Printf("pg %s: %s: currently scrubbing (skipped)\n", m.PgID, m.Mapping)
+			skipped++
+			continue
+		}
+
+		if M.isDeniedOsd(m.Mapping.From) || M.isDeniedOsd(m.Mapping.To) {
+			fmt.Printf("pg %s: %s: involves an OSD on the denylist (skipped)\n", m.PgID, m.Mapping)
+			skipped++
+			continue
+		}
+
+		if M.exceedsMaxPgsPerPool(m.PgID) {
+			fmt.Printf("pg %s: %s: pool move limit reached (skipped)\n", m.PgID, m.Mapping)
+			skipped++
+			continue
+		}
+
+		// There are two cases to consider:
+		// 1. The mapping we want to create is simply gone - in this
+		//    case, we can re-issue the remap in its original form.
+		// 2. There is now a different upmap item from the source OSD.
+		//    We need to find this one and modify it.
+		//
+		// Look for case 2 first, falling back to case 1 if we don't
+		// find anything.
+		from := m.Mapping.From
+		found := false
+		for _, puiM := range M.findOrMakeUpmapItem(m.PgID).Mappings {
+			if puiM.From == m.Mapping.From {
+				from = puiM.To
+				found = true
+				break
+			}
+		}
+		if !found && skipInvalid {
+			// In case 1, the source OSD must still hold the PG.
+			if pgb, ok := M.bs.pgbs[m.PgID]; !ok || !slices.Contains(pgb.Up, m.Mapping.From) {
+				invalid = append(invalid, fmt.Sprintf("pg %s: %s: no longer applicable", m.PgID, m.Mapping))
+				continue
+			}
+		}
+		if err := M.tryRemap(m.PgID, from, m.Mapping.To); err != nil {
+			if !skipInvalid {
+				panic(err)
+			}
+			invalid = append(invalid, fmt.Sprintf("pg %s: %s: %v", m.PgID, m.Mapping, err))
+			continue
+		}
+		fmt.Printf("pg %s: %s: newly applied\n", m.PgID, m.Mapping)
+		applied++
+	}
+	return applied, skipped, invalid
+}
+
+// calcPgMappingsToPrestageCrush applies the given mappings, one backfill at
+// a time on the OSDs preferred by the target policy, until no more can be
+// applied within the backfill limits. Mappings that are already in effect, or
+// whose source OSD is no longer in the PG's up set, are passed over.
+func calcPgMappingsToPrestageCrush(mappings []pgMapping) {
+	for {
+		var candidateMappings []pgMapping
+		for _, m := range mappings {
+			if isMappingInEffect(m) {
+				continue
+			}
+			pgb, ok := M.bs.pgbs[m.PgID]
+			if !ok || !slices.Contains(pgb.Up, m.Mapping.From) {
+				continue
+			}
+			candidateMappings = append(candidateMappings, m)
+		}
+
+		if _, ok := remapPgToPreferredTarget(M, candidateMappings); !ok {
+			return
+		}
+	}
+}
+
+// getCrushmapPath returns the path of the text CRUSHmap given by either
+// --crushmap-text or --crushmap-file, copying it into dir if it is read from
+// stdin ("-") and decompiling it if it is in the compiled format. An empty path
+// is returned if neither is given and a CRUSHmap isn't required.
+func getCrushmapPath(text, file string, required bool, stdin io.Reader, dir string) (string, error) {
+	switch {
+	case text != "" && file != "":
+		return "", errors.New("only one of --crushmap-text and --crushmap-file may be given")
+	case text != "":
+		return text, nil
+	case file == "":
+		if required {
+			return "", errors.New("a CRUSHmap must be given with --crushmap-text or --crushmap-file")
+		}
+		return "", nil
+	}
+
+	var (
+		crushmap []byte
+		err      error
+	)
+	if file == "-" {
+		crushmap, err = io.ReadAll(stdin)
+	} else {
+		crushmap, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the CRUSHmap")
+	}
+
+	if utf8.Valid(crushmap) && !bytes.ContainsRune(crushmap, 0) {
+		if file != "-" {
+			return file, nil
+		}
+		path := filepath.Join(dir, "crushmap.txt")
+		if err := os.WriteFile(path, crushmap, 0644); err != nil {
+			return "", errors.WithStack(err)
+		}
+		return path, nil
+	}
+
+	compiledPath := filepath.Join(dir, "crushmap.bin")
+	if err := os.WriteFile(compiledPath, crushmap, 0644); err != nil {
+		return "", errors.WithStack(err)
+	}
+	path := filepath.Join(dir, "crushmap.txt")
+	if _, err := runCrushDecompile(compiledPath, path); err != nil {
+		return "", errors.Wrap(err, "failed to decompile the CRUSHmap")
+	}
+	return path, nil
+}
+
+// mustGetPoolRuleChangeMappings returns the mappings that switching a pool to
+// another CRUSH rule would cause, given an override of the form
+// "<pool>:<rule name>". The given CRUSHmap text file is used as the starting
+// point, or the cluster's current CRUSHmap if none is given.
+func mustGetPoolRuleChangeMappings(crushmapPath, poolRule string) []pgMapping {
+	spl := strings.SplitN(poolRule, ":", 2)
+	if len(spl) != 2 || spl[1] == "" {
+		panic(errors.Errorf("'%s' is not a valid pool rule override; expected <pool>:<rule name>", poolRule))
+	}
+	pool := mustParsePoolSpec(spl[0])[0]
+	detail, ok := osdPoolDetails().Pools[pool]
+	if !ok {
+		panic(errors.Errorf("pool %d doesn't exist", pool))
+	}
+
+	dir, err := os.MkdirTemp("", "pgremapper")
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	defer os.RemoveAll(dir)
+
+	if crushmapPath == "" {
+		crushmapPath = filepath.Join(dir, "crushmap.txt")
+		if _, err := runCrushExport(crushmapPath); err != nil {
+			panic(err)
+		}
+	}
+	crushText, err := os.ReadFile(crushmapPath)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+
+	newCrushText, err := overrideCrushRule(string(crushText), detail.CrushRule, spl[1])
+	if err != nil {
+		panic(errors.Wrapf(err, "failed to apply pool rule override '%s'", poolRule))
+	}
+	newCrushmapPath := filepath.Join(dir, "crushmap-override.txt")
+	if err := os.WriteFile(newCrushmapPath, []byte(newCrushText), 0644); err != nil {
+		panic(errors.WithStack(err))
+	}
+
+	mappings, err := crushCmp(newCrushmapPath)
+	if err != nil {
+		panic(err)
+	}
+
+	// Other pools sharing the pool's current rule are affected by the
+	// override as well; leave them out.
+	poolMappings := []pgMapping{}
+	for _, m := range mappings {
+		if p, err := parsePgPoolID(m.PgID); err == nil && p == pool {
+			poolMappings = append(poolMappings, m)
+		}
+	}
+	return poolMappings
+}
+
+// annotatedPgMapping is a pgMapping along with context about its PG at export
+// time. It remains importable, since the extra fields are ignored on import.
+type annotatedPgMapping struct {
+	pgMapping `yaml:",inline"`
+	State     string `json:"state" yaml:"state"`
+	EC        bool   `json:"ec" yaml:"ec"`
+	Effective bool   `json:"effective" yaml:"effective"`
+}
+
+func annotateMappings(mappings []pgMapping) []annotatedPgMapping {
+	pools := osdPoolDetails()
+	annotated := make([]annotatedPgMapping, len(mappings))
+	for i, m := range mappings {
+		annotated[i] = annotatedPgMapping{
+			pgMapping: m,
+			Effective: isMappingInEffect(m),
+		}
+		if pgb, ok := M.bs.pgbs[m.PgID]; ok {
+			annotated[i].State = pgb.State
+		}
+		if pool, ok := pools.Pools[pgPoolID(m.PgID)]; ok {
+			annotated[i].EC = pool.ECProfile != ""
+		}
+	}
+	return annotated
+}
 
-	undoUpmapsCmd.Flags().StringSlice("max-backfill-reservations", []string{}, "limit number of backfill reservations made; format: \"default max[,osdspec:max]\", e.g., \"5,bucket:data10:10\"")
-	undoUpmapsCmd.Flags().Int("max-source-backfills", 1, "max number of backfills to schedule per source OSD, including pre-existing ones")
-	undoUpmapsCmd.Flags().Bool("target", false, "the given OSDs are backfill targets rather than sources")
-	rootCmd.AddCommand(undoUpmapsCmd)
+var mappingsFormats = []string{"json", "yaml", "table"}
 
-	rootCmd.AddCommand(remapCmd)
+var mappingsSortKeys = []string{"pgid", "from", "to"}
 
-	exportMappingsCommand.Flags().String("output", "", "write output to the given file path instead of stdout")
-	exportMappingsCommand.Flags().Bool("whole-pg", false, "export all mappings for any PGs that include the given OSD(s), not just the portions pertaining to those OSDs")
-	rootCmd.AddCommand(exportMappingsCommand)
+// sortMappings sorts mappings deterministically by the given key, one of
+// mappingsSortKeys, then by PG ID, From, and To.
+func sortMappings(mappings []pgMapping, by string) {
+	sort.Slice(mappings, func(i, j int) bool {
+		a, b := mappings[i], mappings[j]
+		switch by {
+		case "from":
+			if a.Mapping.From != b.Mapping.From {
+				return a.Mapping.From < b.Mapping.From
+			}
+		case "to":
+			if a.Mapping.To != b.Mapping.To {
+				return a.Mapping.To < b.Mapping.To
+			}
+		}
+		if a.PgID != b.PgID {
+			return a.PgID < b.PgID
+		}
+		if a.Mapping.From != b.Mapping.From {
+			return a.Mapping.From < b.Mapping.From
+		}
+		return a.Mapping.To < b.Mapping.To
+	})
+}
 
-	generateCrushMappingsCommand.Flags().String("crushmap-text", "", "CRUSHmap, with changes, provided in the text format")
-	generateCrushMappingsCommand.Flags().String("output", "", "write output to the given file path instead of stdout")
-	rootCmd.AddCommand(generateCrushMappingsCommand)
+// writeMappings writes mappings in the given format, one of mappingsFormats,
+// with the context added by annotateMappings if annotate is set.
+func writeMappings(w io.Writer, mappings []pgMapping, format string, annotate bool) {
+	var out interface{} = mappings
+	if annotate {
+		out = annotateMappings(mappings)
+	}
 
-	rootCmd.AddCommand(importMappingsCommand)
+	switch format {
+	case "json":
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			panic(errors.WithStack(err))
+		}
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(out); err != nil {
+			panic(errors.WithStack(err))
+		}
+		if err := enc.Close(); err != nil {
+			panic(errors.WithStack(err))
+		}
+	case "table":
+		if !annotate {
+			fmt.Fprintf(w, "%-10s %-8s %s\n", "PGID", "FROM", "TO")
+			for _, m := range mappings {
+				fmt.Fprintf(w, "%-10s %-8d %d\n", m.PgID, m.Mapping.From, m.Mapping.To)
+			}
+			return
+		}
+		fmt.Fprintf(w, "%-10s %-8s %-8s %-5s %-9s %s\n", "PGID", "FROM", "TO", "EC", "EFFECTIVE", "STATE")
+		for _, m := range out.([]annotatedPgMapping) {
+			fmt.Fprintf(w, "%-10s %-8d %-8d %-5t %-9t %s\n", m.PgID, m.Mapping.From, m.Mapping.To, m.EC, m.Effective, m.State)
+		}
+	default:
+		panic(errors.Errorf("unknown output format '%s'", format))
+	}
+}
 
-	rootCmd.AddCommand(versionCmd)
+// isMappingInEffect returns true if the given mapping is present (and not
+// stale) in the PG's upmap item.
+func isMappingInEffect(m pgMapping) bool {
+	found := false
+	M.iterateMappings(func(_ string, _ mapping) {
+		found = true
+	}, mfAnd(withPgid(m.PgID), withFrom(m.Mapping.From), withTo(m.Mapping.To)))
+	return found
 }
 
-func main() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "%+v\n", err)
-		os.Exit(1)
+// pgStateMatches returns whether the given PG state matches any (or, if all is
+// set, all) of the given substrings. A substring prefixed with '!' matches
+// states that don't contain it.
+func pgStateMatches(state string, substrs []string, all bool) bool {
+	for _, substr := range substrs {
+		matches := strings.Contains(state, substr)
+		if negated, ok := strings.CutPrefix(substr, "!"); ok {
+			matches = !strings.Contains(state, negated)
+		}
+		if matches != all {
+			return matches
+		}
 	}
+	return all
 }
 
-func calcPgMappingsToUndoBackfill(excludeBackfilling, source, target bool, excludedOsds, includedOsds, excludedPools, includedPools, pgsIncludingOsds map[int]struct{}) {
-	pgBriefs := pgDumpPgsBrief()
+type undoBackfillOptions struct {
+	excludeBackfilling bool
+	source             bool
+	target             bool
+	excludedOsds       map[int]struct{}
+	includedOsds       map[int]struct{}
+	excludedPools      map[int]struct{}
+	includedPools      map[int]struct{}
+	pgsIncludingOsds   map[int]struct{}
+	// Pools whose PGs are processed first, in the given order.
+	poolPriority []int
+	// Operator-supplied acting sets, by PG ID, used in place of the
+	// actual (or reconstructed) acting set.
+	actingOverrides map[string][]int
+	// PGs whose acting sets are always reconstructed via a PG query
+	// rather than taken from the brief PG dump.
+	actingFromQuery map[string]struct{}
+	// Only cancel backfill caused by an existing upmap entry.
+	upmapCausedOnly bool
+	// Only consider degraded PGs, whose acting sets must be reconstructed
+	// via a PG query.
+	onlyDegraded bool
+	// The maximum number of PGs to remap; 0 means no limit.
+	maxBackfills int
+	// If set, only these PGs are considered.
+	pgids []string
+	// Undo existing mappings that conflict with canceling a backfill,
+	// where it is safe to do so.
+	resolveConflicts bool
+	// If set, only PGs whose state matches these substrings, per
+	// pgStateMatches, are considered.
+	states         []string
+	statesMatchAll bool
+	// The number of PGs processed, and thus possibly queried, in
+	// parallel; 0 means --concurrency.
+	queryConcurrency int
+	// Periodically print the number of PGs examined and remapped, and
+	// the number of PG queries in flight, to stderr.
+	progress bool
+}
+
+// With --progress, calcPgMappingsToUndoBackfill prints its progress every
+// undoBackfillProgressPgs PGs examined, or every
+// undoBackfillProgressInterval, whichever comes first.
+const (
+	undoBackfillProgressPgs      = 1000
+	undoBackfillProgressInterval = 5 * time.Second
+)
+
+// calcPgMappingsToUndoBackfill remaps backfilling PGs in m back to their
+// acting sets, returning the upmap items changed in m.
+func calcPgMappingsToUndoBackfill(m *mappingState, opts undoBackfillOptions) []*pgUpmapItem {
+	// Planning is concurrent, so the changes must also be applied in pool
+	// priority order.
+	m.poolPriority = opts.poolPriority
+	pgBriefs := sortPgBriefsByPoolPriority(pgDumpPgsBrief(), opts.poolPriority)
+	if len(opts.pgids) > 0 {
+		pgBriefs = mustGetPgBriefs(pgBriefs, opts.pgids)
+	}
 
 	excluded := func(osd int) bool {
-		_, ok := excludedOsds[osd]
+		_, ok := opts.excludedOsds[osd]
 		return ok
 	}
 
 	// Included is true if the flag isn't supplied
 	// or if it is supplied and the OSD is in it
 	included := func(osd int) bool {
-		_, ok := includedOsds[osd]
-		return len(includedOsds) == 0 || ok
+		_, ok := opts.includedOsds[osd]
+		return len(opts.includedOsds) == 0 || ok
+	}
+
+	// Gather the targets of upmap items before we start making changes,
+	// so that we only consider the upmap entries that caused the current
+	// backfill.
+	upmapTargets := make(map[string]map[int]struct{})
+	if opts.upmapCausedOnly {
+		for _, pm := range m.getMappings(func(*pgUpmapItem, mapping) bool { return true }) {
+			if _, ok := upmapTargets[pm.PgID]; !ok {
+				upmapTargets[pm.PgID] = make(map[int]struct{})
+			}
+			upmapTargets[pm.PgID][pm.Mapping.To] = struct{}{}
+		}
+	}
+	causedByUpmap := func(pgid string, osd int) bool {
+		_, ok := upmapTargets[pgid][osd]
+		return ok
+	}
+
+	var (
+		capL                    sync.Mutex
+		remapped, skippedForCap int
+	)
+
+	// These are only used for --progress, and are updated without
+	// holding capL.
+	var examinedPgs, remappedPgs, pendingQueries atomic.Int64
+	printProgress := func() {
+		progressf("Progress: %d/%d PG(s) examined, %d remapped, %d pg query(s) pending", examinedPgs.Load(), len(pgBriefs), remappedPgs.Load(), pendingQueries.Load())
+	}
+	queryPg := func(pgid string) (*pgQueryOut, error) {
+		pendingQueries.Add(1)
+		defer pendingQueries.Add(-1)
+		return tryPgQuery(pgid)
+	}
+	if opts.progress {
+		ticker := time.NewTicker(undoBackfillProgressInterval)
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					printProgress()
+				case <-done:
+					return
+				}
+			}
+		}()
+		defer func() {
+			ticker.Stop()
+			close(done)
+			printProgress()
+		}()
 	}
 
 	// Run these concurrently in case they need to go to pgQuery, which is
 	// quite slow.
+	workers := concurrency
+	if opts.queryConcurrency > 0 {
+		workers = opts.queryConcurrency
+	}
 	wg := sync.WaitGroup{}
 	ch := make(chan *pgBriefItem)
 
-	for i := 0; i < concurrency; i++ {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
 			for pgb := range ch {
+				if n := examinedPgs.Add(1); opts.progress && n%undoBackfillProgressPgs == 0 {
+					printProgress()
+				}
+
 				id := pgb.PgID
 				up := pgb.Up
 				acting := pgb.Acting
-				pool, err := strconv.Atoi(strings.Split(id, ".")[0])
+				pool, err := parsePgPoolID(id)
 				if err != nil {
 					fmt.Printf("Could not parse pool ID from PG %s: %s\n", id, err)
 					continue
 				}
 
-				if _, ok := excludedPools[pool]; ok {
+				if _, ok := opts.excludedPools[pool]; ok {
 					continue
 				}
 
-				if _, ok := includedPools[pool]; len(includedPools) > 0 && !ok {
+				if _, ok := opts.includedPools[pool]; len(opts.includedPools) > 0 && !ok {
 					continue
 				}
 
-				if !strings.Contains(pgb.State, "backfill") {
-					continue
-				}
-				if excludeBackfilling && strings.Contains(pgb.State, "backfilling") {
-					continue
-				}
-				if len(up) != len(acting) {
-					continue
-				}
+				if override, ok := opts.actingOverrides[id]; ok {
+					// The operator has told us which OSDs
+					// hold the authoritative copies of this
+					// PG; this is the only way we handle
+					// PGs that are incomplete or down.
+					if len(override) != len(up) {
+						warnf("pg %s: acting set override %v doesn't match the length of the up set %v; skipping", id, override, up)
+						continue
+					}
+					logf(logWarn, "pg %s (%s): OVERRIDING acting set %v with operator-supplied %v; this PG will be remapped toward the given OSDs regardless of what Ceph considers authoritative", id, pgb.State, acting, override)
+					acting = append([]int(nil), override...)
+					reorderUpToMatchActing(pgb.PgID, up, acting, true)
+				} else {
+					if !strings.Contains(pgb.State, "backfill") {
+						continue
+					}
+					if opts.excludeBackfilling && strings.Contains(pgb.State, "backfilling") {
+						continue
+					}
+					if len(opts.states) > 0 && !pgStateMatches(pgb.State, opts.states, opts.statesMatchAll) {
+						continue
+					}
+					if len(up) != len(acting) {
+						continue
+					}
+					if opts.onlyDegraded && !slices.Contains(acting, invalidOSD) {
+						continue
+					}
 
-				// Check if we need to reconstruct the original
-				// acting set in the case of a degraded PG.
-				for _, osd := range acting {
-					if osd == invalidOSD {
-						// Reconstruct the original
-						// acting set via a PG query.
-						pqo := pgQuery(id)
+					// Check if we need to reconstruct the
+					// original acting set in the case of a
+					// degraded PG, or if the operator has
+					// told us not to trust the brief dump.
+					if _, ok := opts.actingFromQuery[id]; ok {
+						pqo, err := queryPg(id)
+						if err != nil {
+							warnf("pg %s: %s; skipping", id, err)
+							continue
+						}
+						acting = pqo.getCompletePeers()
+						if len(acting) != len(up) {
+							warnf("pg %s: acting set %v reconstructed via pg query doesn't match the length of the up set %v; skipping", id, acting, up)
+							continue
+						}
+						reorderUpToMatchActing(pgb.PgID, up, acting, true)
+					} else if slices.Contains(acting, invalidOSD) {
+						// Reconstruct the original acting set
+						// via a PG query.
+						pqo, err := queryPg(id)
+						if err != nil {
+							warnf("pg %s: %s; skipping", id, err)
+							continue
+						}
 						acting = pqo.getCompletePeers()
 						reorderUpToMatchActing(pgb.PgID, up, acting, true)
-						break
 					}
 				}
 
-				if len(pgsIncludingOsds) > 0 {
+				if len(opts.pgsIncludingOsds) > 0 {
 					include := false
 					for _, osd := range append(acting, up...) {
-						if _, ok := pgsIncludingOsds[osd]; ok {
+						if _, ok := opts.pgsIncludingOsds[osd]; ok {
 							include = true
 							break
 						}
@@ -820,15 +2971,33 @@ func calcPgMappingsToUndoBackfill(excludeBackfilling, source, target bool, exclu
 					}
 				}
 
+				// With a cap on the number of PGs remapped,
+				// handle one PG at a time so that the cap
+				// isn't overshot; the slow PG queries above
+				// still run concurrently.
+				if opts.maxBackfills > 0 {
+					capL.Lock()
+					if remapped >= opts.maxBackfills {
+						skippedForCap++
+						capL.Unlock()
+						continue
+					}
+				}
+
 				// Calculate acting set difference and remap to
 				// avoid any ensuing backfill.
+				pgRemapped := false
 				for i := range acting {
 					if up[i] != acting[i] {
 						if up[i] == invalidOSD || acting[i] == invalidOSD {
 							continue
 						}
 
-						if target == source {
+						if opts.upmapCausedOnly && !causedByUpmap(id, up[i]) {
+							continue
+						}
+
+						if opts.target == opts.source {
 							// We'll allow this OSD to be
 							// acted on if this PG is the
 							// source _or_ target
@@ -842,11 +3011,11 @@ func calcPgMappingsToUndoBackfill(excludeBackfilling, source, target bool, exclu
 						} else {
 							// If source/target flag is set we will act
 							// if the PG is in the source/target
-							if source && excluded(up[i]) || target && excluded(acting[i]) {
+							if opts.source && excluded(up[i]) || opts.target && excluded(acting[i]) {
 								continue
 							}
 
-							if !(source && included(up[i]) || target && included(acting[i])) {
+							if !(opts.source && included(up[i]) || opts.target && included(acting[i])) {
 								continue
 							}
 						}
@@ -869,11 +3038,27 @@ func calcPgMappingsToUndoBackfill(excludeBackfilling, source, target bool, exclu
 						// actually use the upmap
 						// exception table to cancel
 						// the backfill.
-						err := M.tryRemap(id, up[i], acting[i])
+						err := m.tryRemap(id, up[i], acting[i])
 						if err != nil {
-							fmt.Printf("WARNING: %v\n", err)
+							if opts.resolveConflicts && resolveUndoBackfillConflict(m, id, up, acting, i, excluded) {
+								pgRemapped = true
+								continue
+							}
+							warnf("%v", err)
+							continue
 						}
+						pgRemapped = true
+					}
+				}
+
+				if pgRemapped {
+					remappedPgs.Add(1)
+				}
+				if opts.maxBackfills > 0 {
+					if pgRemapped {
+						remapped++
 					}
+					capL.Unlock()
 				}
 			}
 
@@ -887,35 +3072,436 @@ func calcPgMappingsToUndoBackfill(excludeBackfilling, source, target bool, exclu
 
 	close(ch)
 	wg.Wait()
+
+	if opts.maxBackfills > 0 {
+		fmt.Printf("%d PG(s) remapped, %d skipped due to --max-backfills %d\n", remapped, skippedForCap, opts.maxBackfills)
+	}
+
+	return m.dirtyUpmapItems()
+}
+
+// chooseRemapTarget picks, from the given OSDs, the least-busy one that can
+// take the given PG's shard from the source OSD, i.e. one that isn't already
+// in the PG's up set.
+func chooseRemapTarget(pgid string, source int, osds []int) (int, error) {
+	pgb, ok := pgBriefMap()[pgid]
+	if !ok {
+		return 0, errors.Errorf("pg %s not found", pgid)
+	}
+
+	var candidates []pgMapping
+	for _, osd := range osds {
+		if osd == source || slices.Contains(pgb.Up, osd) {
+			continue
+		}
+		candidates = append(candidates, pgMapping{PgID: pgid, Mapping: mapping{From: source, To: osd}})
+	}
+	if len(candidates) == 0 {
+		return 0, errors.Errorf("every OSD is already in pg %s's up set %v", pgid, pgb.Up)
+	}
+
+	p := &leastBusyTargetPolicy{bs: M.bs}
+	return candidates[p.choose(candidates)].Mapping.To, nil
+}
+
+// resolveUndoBackfillConflict cancels the backfill of up[i] to acting[i] in
+// the given PG by first undoing the existing mapping that conflicts with it,
+// then retrying. This is only done if neither of the conflicting mapping's
+// OSDs is excluded, the retry can't conflict, and the resulting up set is
+// valid; nothing is changed otherwise, and if the retry fails, the undo is
+// reverted. up is updated to reflect the changes made.
+func resolveUndoBackfillConflict(m *mappingState, pgid string, up, acting []int, i int, excluded func(int) bool) bool {
+	mappings := m.currentMappings(pgid)
+	c, ok := findConflictingMapping(mappings, up[i], acting[i])
+	if !ok {
+		return false
+	}
+	if excluded(c.From) || excluded(c.To) {
+		fmt.Printf("pg %s: not undoing conflicting mapping %d->%d, which involves an excluded OSD\n", pgid, c.From, c.To)
+		return false
+	}
+
+	newUp := slices.Clone(up)
+	j := slices.Index(newUp, c.To)
+	if j < 0 {
+		return false
+	}
+	newUp[j] = c.From
+	from := newUp[i]
+	if from != acting[i] {
+		rest := slices.DeleteFunc(mappings, func(mp mapping) bool { return mp == c })
+		if mp, ok := findConflictingMapping(rest, from, acting[i]); ok {
+			fmt.Printf("pg %s: not undoing conflicting mapping %d->%d, since mapping %d->%d would still conflict\n", pgid, c.From, c.To, mp.From, mp.To)
+			return false
+		}
+		newUp[i] = acting[i]
+	}
+	seen := make(map[int]struct{}, len(newUp))
+	for _, osd := range newUp {
+		if _, ok := seen[osd]; ok && osd != invalidOSD {
+			fmt.Printf("pg %s: not undoing conflicting mapping %d->%d, since osd %d would appear twice in the up set %v\n", pgid, c.From, c.To, osd, newUp)
+			return false
+		}
+		seen[osd] = struct{}{}
+	}
+
+	snap := m.snapshotPg(pgid)
+	if err := m.tryRemap(pgid, c.To, c.From); err != nil {
+		warnf("%v", err)
+		return false
+	}
+	if from != acting[i] {
+		if err := m.tryRemap(pgid, from, acting[i]); err != nil {
+			m.restorePg(snap)
+			warnf("%v; restored conflicting mapping %d->%d", err, c.From, c.To)
+			return false
+		}
+	}
+	fmt.Printf("pg %s: undid conflicting mapping %d->%d to cancel backfill %d->%d\n", pgid, c.From, c.To, up[i], acting[i])
+	up[j] = c.From
+	up[i] = acting[i]
+	return true
+}
+
+// mustGetPgBriefs returns just the given PGs from pgBriefs, in the order of
+// pgBriefs, warning about any that aren't backfilling and thus will be left
+// alone.
+func mustGetPgBriefs(pgBriefs []*pgBriefItem, pgids []string) []*pgBriefItem {
+	wanted := make(map[string]struct{}, len(pgids))
+	for _, pgid := range pgids {
+		wanted[pgid] = struct{}{}
+	}
+
+	var selected []*pgBriefItem
+	for _, pgb := range pgBriefs {
+		if _, ok := wanted[pgb.PgID]; !ok {
+			continue
+		}
+		if !strings.Contains(pgb.State, "backfill") {
+			fmt.Printf("pg %s (%s) is not backfilling\n", pgb.PgID, pgb.State)
+		}
+		selected = append(selected, pgb)
+		delete(wanted, pgb.PgID)
+	}
+	if len(wanted) > 0 {
+		missing := slices.DeleteFunc(slices.Clone(pgids), func(pgid string) bool {
+			_, ok := wanted[pgid]
+			return !ok
+		})
+		panic(errors.Errorf("pg(s) %s not found", strings.Join(missing, ", ")))
+	}
+	return selected
+}
+
+// printOsdBackfillSummary prints the before and after backfill counts of each
+// OSD that is involved in backfill in either state.
+func printOsdBackfillSummary(w io.Writer, before, after map[int]osdBackfillCounts) {
+	osds := make(map[int]struct{})
+	for osd, c := range before {
+		if c.sources != 0 || c.targets != 0 {
+			osds[osd] = struct{}{}
+		}
+	}
+	for osd, c := range after {
+		if c.sources != 0 || c.targets != 0 {
+			osds[osd] = struct{}{}
+		}
+	}
+
+	fmt.Fprintf(w, "%-8s %-16s %s\n", "OSD", "SOURCE", "TARGET")
+	for _, osd := range mapKeysInt(osds) {
+		b, a := before[osd], after[osd]
+		fmt.Fprintf(w, "%-8d %-16s %s\n", osd,
+			fmt.Sprintf("%d -> %d", b.sources, a.sources),
+			fmt.Sprintf("%d -> %d", b.targets, a.targets))
+	}
+	fmt.Fprintln(w)
+}
+
+// sortPgBriefsByPoolPriority returns a copy of the given PGs with those in the
+// given pools first, in pool priority order. The order of PGs is otherwise
+// preserved.
+func sortPgBriefsByPoolPriority(pgBriefs []*pgBriefItem, poolPriority []int) []*pgBriefItem {
+	sorted := make([]*pgBriefItem, len(pgBriefs))
+	copy(sorted, pgBriefs)
+	if len(poolPriority) == 0 {
+		return sorted
+	}
+
+	poolRank := poolPriorityRank(poolPriority)
+	sort.SliceStable(sorted, func(i, j int) bool { return poolRank(sorted[i].PgID) < poolRank(sorted[j].PgID) })
+	return sorted
+}
+
+// poolPriorityRank returns a function giving the rank of a PG's pool in the
+// given pool priority order; PGs in other pools rank last.
+func poolPriorityRank(poolPriority []int) func(pgid string) int {
+	rank := make(map[int]int)
+	for i, pool := range poolPriority {
+		if _, ok := rank[pool]; !ok {
+			rank[pool] = i
+		}
+	}
+	return func(pgid string) int {
+		pool, err := parsePgPoolID(pgid)
+		if err != nil {
+			return len(poolPriority)
+		}
+		if r, ok := rank[pool]; ok {
+			return r
+		}
+		return len(poolPriority)
+	}
 }
 
+// calcPgMappingsToDrainOsd remaps PGs in m off of the source OSDs onto the
+// target OSDs, one PG from each source in turn, returning the upmap items
+// changed in m.
 func calcPgMappingsToDrainOsd(
+	m *mappingState,
 	allowMovementAcrossCrushType string,
+	allowColocation bool,
 	sourceOsds []int,
 	targetOsds map[int]struct{},
-) {
+	targetFullRatio float64,
+) []*pgUpmapItem {
+	var usage *projectedUsage
+	if targetFullRatio > 0 {
+		usage = newProjectedUsage(osdDf())
+	}
+
 	changed := true
 	for changed {
 		changed = false
 		for _, sourceOsd := range sourceOsds {
 			candidateMappings := getCandidateMappings(
 				allowMovementAcrossCrushType,
+				allowColocation,
 				sourceOsd,
 				mapKeysInt(targetOsds),
 			)
+			if m.drainFilter != nil {
+				candidateMappings = slices.DeleteFunc(candidateMappings, func(pm pgMapping) bool { return !m.drainFilter(pm) })
+			}
+			if usage != nil {
+				candidateMappings = slices.DeleteFunc(candidateMappings, func(pm pgMapping) bool {
+					return usage.exceeds(pm.PgID, pm.Mapping.From, pm.Mapping.To, targetFullRatio)
+				})
+			}
+
+			if len(candidateMappings) > 0 {
+				pm, ok := remapPgToPreferredTarget(m, candidateMappings)
+				if ok {
+					if usage != nil {
+						usage.add(pm.PgID, pm.Mapping.From, pm.Mapping.To)
+					}
+					changed = true
+				}
+			}
+		}
+	}
+
+	return m.dirtyUpmapItems()
+}
+
+// calcPgMappingsToSwapBucket drains the OSDs of the source bucket onto the
+// OSDs of the same device class in the target bucket. Movement is allowed
+// across buckets of the source's type, so CRUSH placement is respected as for
+// drain --allow-movement-across. That only allows movement between buckets
+// with the same parent, so buckets that don't share one are rejected rather
+// than finding no candidates; allowing movement further up the hierarchy
+// could break a CRUSH rule's placement across those higher buckets.
+func calcPgMappingsToSwapBucket(source, target string) error {
+	tree := osdTree()
+	sourceNode, targetNode := tree.NameToNode[source], tree.NameToNode[target]
+	if sourceNode == targetNode {
+		return errors.Errorf("the source and target buckets are both '%s'", source)
+	}
+	if sourceNode.Type != targetNode.Type {
+		return errors.Errorf("the source bucket '%s' is a %s, but the target bucket '%s' is a %s", source, sourceNode.Type, target, targetNode.Type)
+	}
+	if sourceNode.Parent != targetNode.Parent {
+		return errors.Errorf("the source bucket '%s' and target bucket '%s' don't share a parent", source, target)
+	}
+
+	sourceOsdsByClass := make(map[string][]int)
+	for _, osd := range mustGetOsdsForBucket(source, "") {
+		class := tree.IDToNode[osd].DeviceClass
+		sourceOsdsByClass[class] = append(sourceOsdsByClass[class], osd)
+	}
+	classes := make([]string, 0, len(sourceOsdsByClass))
+	for class := range sourceOsdsByClass {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	for _, class := range classes {
+		targetOsds := make(map[int]struct{})
+		for _, osd := range mustGetOsdsForBucket(target, class) {
+			targetOsds[osd] = struct{}{}
+		}
+		if len(targetOsds) == 0 {
+			logf(logWarn, "the target bucket '%s' has no OSDs of device class '%s'; skipping %d source OSD(s)", target, class, len(sourceOsdsByClass[class]))
+			continue
+		}
+		calcPgMappingsToDrainOsd(M, sourceNode.Type, false, sourceOsdsByClass[class], targetOsds, 0)
+	}
+	return nil
+}
+
+// projectedUsage tracks the utilization OSDs would reach as PGs are remapped
+// onto them. A PG's contribution to its target is the size of one of its
+// shards, per pgBytes, or if PG sizes aren't available, the average across
+// the PGs on its source OSD.
+type projectedUsage struct {
+	df      map[int]*osdDfNode
+	pgBytes map[string]int64
+	pools   *poolsDetails
+	added   map[int]int64
+}
+
+func newProjectedUsage(df map[int]*osdDfNode) *projectedUsage {
+	bytes, err := pgBytes()
+	if err != nil {
+		debugf("unable to get PG sizes; estimating them from OSD averages: %v", err)
+	}
+	return &projectedUsage{df: df, pgBytes: bytes, pools: osdPoolDetails(), added: make(map[int]int64)}
+}
+
+func (u *projectedUsage) pgKB(pgid string, from int) int64 {
+	if bytes, ok := u.pgBytes[pgid]; ok {
+		return int64(float64(bytes)*u.pools.PgShardFraction(pgid)) / 1024
+	}
+	n, ok := u.df[from]
+	if !ok || n.PGs == 0 {
+		return 0
+	}
+	return n.KBUsed / int64(n.PGs)
+}
+
+// exceeds returns whether moving a PG from one OSD to another would take the
+// target above the given full ratio. Targets not reported by 'ceph osd df'
+// are not limited.
+func (u *projectedUsage) exceeds(pgid string, from, to int, fullRatio float64) bool {
+	n, ok := u.df[to]
+	if !ok || n.KB == 0 {
+		return false
+	}
+	used := n.KBUsed + u.added[to] + u.pgKB(pgid, from)
+	return float64(used)/float64(n.KB) > fullRatio
+}
+
+func (u *projectedUsage) add(pgid string, from, to int) {
+	u.added[to] += u.pgKB(pgid, from)
+}
+
+// crushRuleMappingFilter accepts the mappings of PGs whose pool uses the
+// given CRUSH rule, and only to targets of the source's device class, so that
+// a PG is never remapped onto an OSD that its rule can't choose.
+func crushRuleMappingFilter(ruleID int) func(pgMapping) bool {
+	pools := osdPoolDetails().Pools
+	tree := osdTree()
+	return func(pm pgMapping) bool {
+		pool, ok := pools[pgPoolID(pm.PgID)]
+		if !ok || pool.CrushRule != ruleID {
+			return false
+		}
+		from, to := tree.IDToNode[pm.Mapping.From], tree.IDToNode[pm.Mapping.To]
+		return from != nil && to != nil && from.DeviceClass == to.DeviceClass
+	}
+}
+
+// countPgsNotUsingCrushRule returns the number of PGs up on the given OSDs
+// whose pool doesn't use the given CRUSH rule.
+func countPgsNotUsingCrushRule(osds []int, ruleID int) int {
+	pools := osdPoolDetails().Pools
+	n := 0
+	for _, pgbs := range getUpPGsForOsds(osds) {
+		for _, pgb := range pgbs {
+			if pool, ok := pools[pgPoolID(pgb.PgID)]; !ok || pool.CrushRule != ruleID {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// mustGetDrainTargetFullRatio returns the --target-full-ratio that drain
+// limits targets by, or 0 if it shouldn't, so that 'ceph osd df' and PG stats
+// are only queried when the ratio is given or --auto-targets needs it.
+func mustGetDrainTargetFullRatio(cmd *cobra.Command) float64 {
+	if !cmd.Flags().Changed("target-full-ratio") && !mustGetBool(cmd, "auto-targets") {
+		return 0
+	}
+	return mustGetFloat64(cmd, "target-full-ratio")
+}
+
+// mustPruneDrainTargets validates the drain source and target OSDs, then
+// removes the sources and any excluded OSDs from targetOsds so that they are
+// never considered as candidates. It fails if the exclusions leave no
+// targets.
+func mustPruneDrainTargets(targetOsds map[int]struct{}, sourceOsds []int, excludedTargetOsds map[int]struct{}) {
+	tree := osdTree()
+
+	for targetOsd := range targetOsds {
+		targetOsdNode, ok := tree.IDToNode[targetOsd]
+		if !ok || targetOsdNode.Type != "osd" {
+			panic(fmt.Errorf("target OSD %d doesn't exist", targetOsd))
+		}
+	}
+
+	for _, osd := range sourceOsds {
+		sourceOsdNode, ok := tree.IDToNode[osd]
+		if !ok || sourceOsdNode.Type != "osd" {
+			panic(fmt.Errorf("source OSD %d doesn't exist", osd))
+		}
+		delete(targetOsds, osd)
+	}
+	if len(targetOsds) == 0 {
+		return
+	}
+	for osd := range excludedTargetOsds {
+		delete(targetOsds, osd)
+	}
+	if len(targetOsds) == 0 {
+		panic(errors.New("--exclude-target-osds leaves no target OSDs"))
+	}
+}
+
+// getAutoTargetOsds returns all in OSDs that share a device class with one of
+// the source OSDs and are less full than the given ratio. CRUSH placement is
+// checked later on, during candidate mapping generation.
+func getAutoTargetOsds(sourceOsds []int, fullRatio float64) map[int]struct{} {
+	tree := osdTree()
+	df := osdDf()
 
-			if len(candidateMappings) > 0 {
-				_, ok := remapLeastBusyPg(candidateMappings)
-				if ok {
-					changed = true
-				}
-			}
+	deviceClasses := make(map[string]struct{})
+	for _, osd := range sourceOsds {
+		if node, ok := tree.IDToNode[osd]; ok {
+			deviceClasses[node.DeviceClass] = struct{}{}
+		}
+	}
+
+	targetOsds := make(map[int]struct{})
+	for id, node := range tree.IDToNode {
+		if node.Type != "osd" {
+			continue
+		}
+		if _, ok := deviceClasses[node.DeviceClass]; !ok {
+			continue
+		}
+		usage, ok := df[id]
+		if !ok || usage.Reweight == 0 || usage.Utilization/100 >= fullRatio {
+			continue
 		}
+		targetOsds[id] = struct{}{}
 	}
+	return targetOsds
 }
 
 func getCandidateMappings(
 	allowMovementAcrossCrushType string,
+	allowColocation bool,
 	sourceOsd int,
 	targetOsds []int,
 ) []pgMapping {
@@ -925,6 +3511,7 @@ func getCandidateMappings(
 		for _, targetOsd := range targetOsds {
 			if !isCandidateMapping(
 				allowMovementAcrossCrushType,
+				allowColocation,
 				sourceOsd,
 				targetOsd,
 				pg,
@@ -945,6 +3532,7 @@ func getCandidateMappings(
 
 func isCandidateMapping(
 	allowMovementAcrossCrushType string,
+	allowColocation bool,
 	sourceOsd int,
 	targetOsd int,
 	pg *pgBriefItem,
@@ -952,6 +3540,12 @@ func isCandidateMapping(
 	if targetOsd == sourceOsd {
 		return false
 	}
+	for _, pgUpOsd := range pg.Up {
+		if pgUpOsd == targetOsd {
+			// Never put two shards/replicas on the same OSD.
+			return false
+		}
+	}
 
 	tree := osdTree()
 	sourceOsdNode := tree.IDToNode[sourceOsd]
@@ -972,6 +3566,11 @@ func isCandidateMapping(
 	if sourceCrushParentBucket.Parent != targetCrushParentBucket.Parent {
 		return false
 	}
+	if allowColocation {
+		// The operator has explicitly asked us to ignore the
+		// failure domain of other shards/replicas.
+		return true
+	}
 	for _, pgUpOsd := range pg.Up {
 		if pgUpOsd == sourceOsd {
 			continue
@@ -988,7 +3587,10 @@ func isCandidateMapping(
 	return true
 }
 
-func calcPgMappingsToUndoUpmaps(osds []int, osdsAreTargets bool) {
+// calcPgMappingsToUndoUpmaps undoes the mappings whose To (or From, if
+// osdsAreTargets) is one of the given OSDs, limited to those that also match
+// filter, if it is non-nil.
+func calcPgMappingsToUndoUpmaps(osds []int, osdsAreTargets bool, filter mappingFilter) {
 	// For fairness, iterate the osds, adding one backfill at a time to
 	// each candidate, until we don't add any new backfills.
 	somethingChanged := true
@@ -996,12 +3598,14 @@ func calcPgMappingsToUndoUpmaps(osds []int, osdsAreTargets bool) {
 		somethingChanged = false
 
 		for _, osd := range osds {
-			var candidateMappings []pgMapping
+			f := withTo(osd)
 			if osdsAreTargets {
-				candidateMappings = M.getMappings(withFrom(osd))
-			} else {
-				candidateMappings = M.getMappings(withTo(osd))
+				f = withFrom(osd)
 			}
+			if filter != nil {
+				f = mfAnd(f, filter)
+			}
+			candidateMappings := M.getMappings(f)
 
 			// Since we pass these mappings in as candidates for
 			// action, reverse the From and To (since we want to
@@ -1011,7 +3615,7 @@ func calcPgMappingsToUndoUpmaps(osds []int, osdsAreTargets bool) {
 				mp.From, mp.To = mp.To, mp.From
 			}
 
-			_, ok := remapLeastBusyPg(candidateMappings)
+			_, ok := remapPgToPreferredTarget(M, candidateMappings)
 			if !ok {
 				continue
 			}
@@ -1020,41 +3624,78 @@ func calcPgMappingsToUndoUpmaps(osds []int, osdsAreTargets bool) {
 	}
 }
 
-func remapLeastBusyPg(candidateMappings []pgMapping) (string, bool) {
-	var (
-		found       bool
-		bestScore   = int(math.MaxInt32)
-		bestMapping pgMapping
-	)
-	// Look for a candidate OSD to remap to that has the lowest reservation
-	// score. We consider the remote reservation count (the count of
-	// backfills in which this OSD is the target) to be more important than
-	// the local reservation count (the count of backfills for which this
-	// OSD is primary), and thus apply a weight to it.
-	for _, m := range candidateMappings {
-		if !M.bs.hasRoomForRemap(m.PgID, m.Mapping.From, m.Mapping.To) {
-			M.changeState = updateChangeState(NoReservationAvailable)
+func allMappings() []pgMapping {
+	return M.getMappings(func(*pgUpmapItem, mapping) bool { return true })
+}
+
+// upmapTargetOsds returns, in order, every OSD that is the To of a mapping.
+func upmapTargetOsds() []int {
+	osds := make(map[int]struct{})
+	for _, m := range allMappings() {
+		osds[m.Mapping.To] = struct{}{}
+	}
+	return mapKeysInt(osds)
+}
+
+// remapPgToPreferredTarget makes the candidate remapping preferred by the
+// target policy, among those that fit within backfill limits.
+func remapPgToPreferredTarget(m *mappingState, candidateMappings []pgMapping) (pgMapping, bool) {
+	var viable []pgMapping
+	for _, pm := range candidateMappings {
+		if m.isDeniedOsd(pm.Mapping.From) || m.isDeniedOsd(pm.Mapping.To) {
 			continue
 		}
-
-		obs := M.bs.osd(m.Mapping.To)
-		score := obs.remoteReservations*10 + obs.localReservations
-		if score < bestScore {
-			found = true
-			bestScore = score
-			bestMapping = m
+		if m.makesNoPrimaryOsdPrimary(pm.PgID, pm.Mapping.From, pm.Mapping.To) {
+			continue
+		}
+		if !m.hasRoomForMapping(pm.PgID, pm.Mapping.From) {
+			continue
 		}
+		if !m.bs.hasRoomForRemap(pm.PgID, pm.Mapping.From, pm.Mapping.To) {
+			m.updateChangeState(NoReservationAvailable)
+			m.reservationBlocked++
+			continue
+		}
+		viable = append(viable, pm)
 	}
-	if !found {
-		return "", false
+	if len(viable) == 0 {
+		return pgMapping{}, false
 	}
 
-	M.mustRemap(bestMapping.PgID, bestMapping.Mapping.From, bestMapping.Mapping.To)
+	bestMapping := viable[m.targetPolicy.choose(viable)]
+
+	m.mustRemap(bestMapping.PgID, bestMapping.Mapping.From, bestMapping.Mapping.To)
+	m.targetPolicy.commit(bestMapping)
+
+	return bestMapping, true
+}
 
-	return bestMapping.PgID, true
+type balanceOptions struct {
+	maxBackfills int
+	targetSpread int
+	// Leave PGs that are currently backfilling where they are.
+	pinBackfilling bool
+	// Target PG counts by OSD; if nil, all OSDs are balanced toward the
+	// same count.
+	targetCounts map[int]float64
+	// Never take an OSD below this many PGs; 0 means no floor.
+	minPgsPerOsd int
+	// Balance estimated bytes stored rather than PG counts, stopping once
+	// the spread is within byteSpread: percentage points of utilization
+	// if byteSpreadPercent is set, or bytes otherwise.
+	byBytes           bool
+	byteSpread        float64
+	byteSpreadPercent bool
+	// Balance the number of PGs each OSD is primary for rather than PG
+	// counts. PGs in EC pools are left alone.
+	balancePrimaries bool
 }
 
-func calcPgMappingsToBalanceOsds(osds []int, maxBackfills, targetSpread int) {
+// calcPgMappingsToBalanceOsds remaps PGs from the fullest to the emptiest of
+// the given OSDs, or from the OSDs furthest above their target PG counts to
+// those furthest below if target counts are given. It returns the upmap items
+// changed in m.
+func calcPgMappingsToBalanceOsds(m *mappingState, osds []int, opts balanceOptions) []*pgUpmapItem {
 	sort.Slice(osds, func(i, j int) bool { return osds[i] < osds[j] })
 
 	osdUpPGs := getUpPGsForOsds(osds)
@@ -1070,54 +3711,346 @@ func calcPgMappingsToBalanceOsds(osds []int, maxBackfills, targetSpread int) {
 			continue
 		}
 	}
+	for osd := range osdUpPGs {
+		if m.isDeniedOsd(osd) {
+			// Leave OSDs on the denylist as they are.
+			delete(osdUpPGs, osd)
+		}
+	}
 
 	backfillsInSet := 0
 	for _, osd := range osds {
-		backfillsInSet += M.bs.osd(osd).backfillsFrom
+		backfillsInSet += m.bs.osd(osd).backfillsFrom
 	}
 
-	for backfillsInSet < maxBackfills {
-		var (
-			lowestOsd, highestOsd int
-			lowestLen, highestLen int
-		)
-		// Get the first 'in' osd.
-		for _, osd := range osds {
-			if _, ok := osdUpPGs[osd]; !ok {
-				continue
+	// The PGs that are candidates to be moved off of each OSD, and which
+	// count toward its balance.
+	osdPGs := osdUpPGs
+	if opts.balancePrimaries {
+		osdPGs = getPrimaryPGsForOsds(osdUpPGs)
+	}
+
+	// Each OSD's deviation from its target PG count; without target
+	// counts, all OSDs are balanced toward the same count. With byBytes,
+	// it is instead the OSD's estimated bytes stored or utilization.
+	deviation := func(osd int) float64 {
+		return float64(len(osdPGs[osd])) - opts.targetCounts[osd]
+	}
+	spread := float64(opts.targetSpread)
+	var load *osdByteLoad
+	if opts.byBytes {
+		load = mustGetOsdByteLoad(opts.byteSpreadPercent)
+		deviation = load.load
+		spread = opts.byteSpread
+	}
+
+	// When balancing PG counts, don't move a PG onto an OSD that is
+	// fuller by bytes than the OSD it's moving from, if we can tell. The
+	// df output is a snapshot, so the bytes of the PGs moved so far, per
+	// plannedBytes, are added to each OSD's utilization.
+	fuller := func(a, b int) bool { return false }
+	var (
+		plannedPgBytes map[string]int64
+		plannedBytes   = make(map[int]float64)
+	)
+	if !opts.byBytes {
+		if df, err := tryOsdDf(); err == nil {
+			if plannedPgBytes, err = pgBytes(); err != nil {
+				warnf("failed to get PG sizes (%v); PGs moved in this run won't count toward OSD utilization", err)
+			}
+			util := func(n *osdDfNode) float64 {
+				if n.KB == 0 {
+					return n.Utilization
+				}
+				return n.Utilization + plannedBytes[n.ID]/float64(n.KB*1024)*100
 			}
-			lowestOsd = osd
-			lowestLen = len(osdUpPGs[osd])
-			highestOsd = osd
-			highestLen = len(osdUpPGs[osd])
-			break
+			fuller = func(a, b int) bool {
+				na, aok := df[a]
+				nb, bok := df[b]
+				return aok && bok && util(na) > util(nb)
+			}
+		} else {
+			warnf("failed to get OSD utilization (%v); PGs may be moved onto OSDs that are fuller by bytes", err)
 		}
-		for _, osd := range osds {
-			pgs, ok := osdUpPGs[osd]
-			if !ok {
+	}
+
+	// Keep the 'in' OSDs in a pair of heaps so that the emptiest and
+	// fullest can be found quickly in large buckets. Ties go to the lowest
+	// OSD ID.
+	var inOsds []int
+	for _, osd := range osds {
+		if _, ok := osdUpPGs[osd]; ok {
+			inOsds = append(inOsds, osd)
+		}
+	}
+	if len(inOsds) == 0 {
+		return m.dirtyUpmapItems()
+	}
+	lowest := newOsdHeap(inOsds, func(a, b int) bool {
+		return deviation(a) < deviation(b) || (deviation(a) == deviation(b) && a < b)
+	})
+	highest := newOsdHeap(inOsds, func(a, b int) bool {
+		return deviation(a) > deviation(b) || (deviation(a) == deviation(b) && a < b)
+	})
+
+	for backfillsInSet < opts.maxBackfills {
+		lowestOsd, highestOsd := lowest.peek(), highest.peek()
+		lowestDev, highestDev := deviation(lowestOsd), deviation(highestOsd)
+		if highestDev-lowestDev <= spread {
+			// Balanced enough - all done.
+			return m.dirtyUpmapItems()
+		}
+		if fuller(lowestOsd, highestOsd) {
+			// Fall back to the fullest OSD, by PG count, that has
+			// an OSD to move to that isn't fuller by bytes and is
+			// still worth moving to, and the emptiest such OSD.
+			sources := slices.Clone(inOsds)
+			sort.Slice(sources, func(i, j int) bool { return highest.less(sources[i], sources[j]) })
+			targets := slices.Clone(inOsds)
+			sort.Slice(targets, func(i, j int) bool { return lowest.less(targets[i], targets[j]) })
+			lowestOsd = -1
+		sourceLoop:
+			for _, src := range sources {
+				if deviation(src)-lowestDev <= spread {
+					break
+				}
+				for _, tgt := range targets {
+					if deviation(src)-deviation(tgt) <= spread {
+						break
+					}
+					if !fuller(tgt, src) {
+						highestOsd, highestDev = src, deviation(src)
+						lowestOsd, lowestDev = tgt, deviation(tgt)
+						break sourceLoop
+					}
+				}
+				debugf("every OSD with room for PGs from osd %d is fuller by bytes; trying the next fullest OSD", src)
+			}
+			if lowestOsd == -1 {
+				logf(logWarn, "every OSD with room for PGs is fuller by bytes than the OSDs they would come from; stopping")
+				return m.dirtyUpmapItems()
+			}
+		}
+		highestLen := len(osdUpPGs[highestOsd])
+
+		// Take the last PG on the fullest OSD that can still be
+		// remapped. If backfilling PGs are pinned, they still count
+		// toward their OSDs' totals, but are left where they are.
+		pgIdx := -1
+		for i := len(osdPGs[highestOsd]) - 1; i >= 0; i-- {
+			pgb := osdPGs[highestOsd][i]
+			if opts.balancePrimaries && slices.Contains(pgb.Up, lowestOsd) {
+				// The emptiest OSD already holds a copy of this
+				// PG.
+				continue
+			}
+			if opts.pinBackfilling {
+				if _, tgts := computeBackfillSrcsTgts(pgb); len(tgts) > 0 {
+					continue
+				}
+			}
+			if m.makesNoPrimaryOsdPrimary(pgb.PgID, highestOsd, lowestOsd) {
 				continue
 			}
-			thisLen := len(pgs)
-			if thisLen < lowestLen {
-				lowestOsd = osd
-				lowestLen = thisLen
+			if load != nil && highestDev-load.delta(highestOsd, pgb.PgID) < lowestDev+load.delta(lowestOsd, pgb.PgID) {
+				// Moving this PG would overshoot, leaving the
+				// emptiest OSD fuller than the fullest.
+				continue
 			}
-			if thisLen > highestLen {
-				highestOsd = osd
-				highestLen = thisLen
+			if m.hasRoomForMapping(pgb.PgID, highestOsd) {
+				pgIdx = i
+				break
 			}
 		}
-		if highestLen-lowestLen <= targetSpread {
-			// Balanced enough - all done.
-			return
+		if pgIdx == -1 {
+			logf(logWarn, "no PGs on osd %d can be remapped within the limits of --max-moves-per-pg, --max-pgs-per-pool, --max-pool-move-fraction, --skip-scrubbing-pgs, --pin-backfilling, and --no-primary-osds%s", highestOsd, If(opts.byBytes, fmt.Sprintf(", without overshooting osd %d", lowestOsd), ""))
+			return m.dirtyUpmapItems()
 		}
 
-		pg := osdUpPGs[highestOsd][highestLen-1]
-		M.mustRemap(pg.PgID, highestOsd, lowestOsd)
-		osdUpPGs[lowestOsd] = append(osdUpPGs[lowestOsd], pg)
-		osdUpPGs[highestOsd] = osdUpPGs[highestOsd][:highestLen-1]
+		if highestLen-1 < opts.minPgsPerOsd {
+			logf(logWarn, "remapping a PG off of osd %d would take it below --min-pgs-per-osd %d; stopping", highestOsd, opts.minPgsPerOsd)
+			return m.dirtyUpmapItems()
+		}
+
+		pg := osdPGs[highestOsd][pgIdx]
+		if load != nil {
+			load.move(pg.PgID, highestOsd, lowestOsd)
+		}
+		if bytes := plannedPgBytes[pg.PgID]; bytes > 0 {
+			shard := float64(bytes) * osdPoolDetails().PgShardFraction(pg.PgID)
+			plannedBytes[highestOsd] -= shard
+			plannedBytes[lowestOsd] += shard
+		}
+		m.mustRemap(pg.PgID, highestOsd, lowestOsd)
+		osdPGs[lowestOsd] = append(osdPGs[lowestOsd], pg)
+		osdPGs[highestOsd] = append(osdPGs[highestOsd][:pgIdx], osdPGs[highestOsd][pgIdx+1:]...)
+		if opts.balancePrimaries {
+			// The PG's primary shard moves with it.
+			osdUpPGs[lowestOsd] = append(osdUpPGs[lowestOsd], pg)
+			osdUpPGs[highestOsd] = slices.DeleteFunc(osdUpPGs[highestOsd], func(pgb *pgBriefItem) bool { return pgb == pg })
+		}
+		for _, osd := range []int{lowestOsd, highestOsd} {
+			lowest.fix(osd)
+			highest.fix(osd)
+		}
 		backfillsInSet++
 	}
+
+	return m.dirtyUpmapItems()
+}
+
+// getPrimaryPGsForOsds returns, for each of the given OSDs, those of its PGs
+// that it is the primary of. Remapping such a PG from the OSD makes the
+// target the primary in replicated pools, but not in EC pools, whose PGs are
+// skipped.
+func getPrimaryPGsForOsds(osdUpPGs map[int][]*pgBriefItem) map[int][]*pgBriefItem {
+	pools := osdPoolDetails()
+	primaryPGs := make(map[int][]*pgBriefItem, len(osdUpPGs))
+	skippedEC := make(map[string]struct{})
+	for osd, pgbs := range osdUpPGs {
+		primaryPGs[osd] = []*pgBriefItem{}
+		for _, pgb := range pgbs {
+			if pools.PgUsesEC(pgb.PgID) {
+				skippedEC[pgb.PgID] = struct{}{}
+				continue
+			}
+			if pgb.Up[0] == osd && pgb.primaryOsd() == osd {
+				primaryPGs[osd] = append(primaryPGs[osd], pgb)
+			}
+		}
+	}
+	if len(skippedEC) > 0 {
+		logf(logWarn, "skipping %d PGs in EC pools, whose primaries can't be balanced by remapping", len(skippedEC))
+	}
+	return primaryPGs
+}
+
+// osdByteLoad tracks the estimated bytes stored on each OSD as PGs are
+// remapped, starting from the usage reported by 'ceph osd df'. A PG's
+// contribution to an OSD is the size of one of its shards.
+type osdByteLoad struct {
+	df      map[int]*osdDfNode
+	moved   map[int]float64
+	pgBytes map[string]int64
+	pools   *poolsDetails
+	// Measure load as utilization percentage rather than bytes.
+	percent bool
+}
+
+func mustGetOsdByteLoad(percent bool) *osdByteLoad {
+	bytes, err := pgBytes()
+	if err != nil {
+		panic(errors.Wrap(err, "failed to get PG sizes"))
+	}
+	return &osdByteLoad{
+		df:      osdDf(),
+		moved:   make(map[int]float64),
+		pgBytes: bytes,
+		pools:   osdPoolDetails(),
+		percent: percent,
+	}
+}
+
+func (l *osdByteLoad) node(osd int) *osdDfNode {
+	n, ok := l.df[osd]
+	if !ok || n.KB == 0 {
+		panic(errors.Errorf("osd %d has no capacity in 'ceph osd df' output", osd))
+	}
+	return n
+}
+
+func (l *osdByteLoad) scale(osd int, bytes float64) float64 {
+	if l.percent {
+		return bytes / float64(l.node(osd).KB*1024) * 100
+	}
+	return bytes
+}
+
+func (l *osdByteLoad) load(osd int) float64 {
+	return l.scale(osd, float64(l.node(osd).KBUsed*1024)+l.moved[osd])
+}
+
+// delta returns the amount by which the given PG contributes to an OSD's
+// load.
+func (l *osdByteLoad) delta(osd int, pgid string) float64 {
+	return l.scale(osd, float64(l.pgBytes[pgid])*l.pools.PgShardFraction(pgid))
+}
+
+func (l *osdByteLoad) move(pgid string, from, to int) {
+	bytes := float64(l.pgBytes[pgid]) * l.pools.PgShardFraction(pgid)
+	l.moved[from] -= bytes
+	l.moved[to] += bytes
+}
+
+// osdHeap is a heap of OSDs ordered by the given less function, which can be
+// re-sorted after an OSD's key changes.
+type osdHeap struct {
+	osds  []int
+	index map[int]int
+	less  func(a, b int) bool
+}
+
+func newOsdHeap(osds []int, less func(a, b int) bool) *osdHeap {
+	h := &osdHeap{
+		osds:  append([]int{}, osds...),
+		index: make(map[int]int, len(osds)),
+		less:  less,
+	}
+	for i, osd := range h.osds {
+		h.index[osd] = i
+	}
+	heap.Init(h)
+	return h
+}
+
+func (h *osdHeap) Len() int           { return len(h.osds) }
+func (h *osdHeap) Less(i, j int) bool { return h.less(h.osds[i], h.osds[j]) }
+func (h *osdHeap) Swap(i, j int) {
+	h.osds[i], h.osds[j] = h.osds[j], h.osds[i]
+	h.index[h.osds[i]] = i
+	h.index[h.osds[j]] = j
+}
+
+// Push and Pop are required by heap.Interface; OSDs are never added to or
+// removed from an osdHeap after it is built.
+func (h *osdHeap) Push(x interface{}) { panic("not supported") }
+func (h *osdHeap) Pop() interface{}   { panic("not supported") }
+
+func (h *osdHeap) peek() int { return h.osds[0] }
+
+func (h *osdHeap) fix(osd int) { heap.Fix(h, h.index[osd]) }
+
+// mustGetMatchBucketTargetCounts returns target PG counts for the given OSDs
+// that mirror the distribution of PGs across the reference OSDs. OSDs are
+// paired by position after sorting each list by OSD ID, i.e. the lowest OSD ID
+// in one bucket is paired with the lowest in the other, and so on. The
+// reference counts are scaled to the total number of PGs on the given OSDs.
+func mustGetMatchBucketTargetCounts(osds, refOsds []int) map[int]float64 {
+	if len(osds) != len(refOsds) {
+		panic(errors.Errorf("the bucket has %d OSDs but the reference bucket has %d; they must have the same number to be paired", len(osds), len(refOsds)))
+	}
+	osds = append([]int{}, osds...)
+	refOsds = append([]int{}, refOsds...)
+	sort.Ints(osds)
+	sort.Ints(refOsds)
+
+	osdUpPGs := getUpPGsForOsds(osds)
+	refUpPGs := getUpPGsForOsds(refOsds)
+	total, refTotal := 0, 0
+	for i := range osds {
+		total += len(osdUpPGs[osds[i]])
+		refTotal += len(refUpPGs[refOsds[i]])
+	}
+
+	targetCounts := make(map[int]float64, len(osds))
+	for i, osd := range osds {
+		if refTotal == 0 {
+			targetCounts[osd] = float64(total) / float64(len(osds))
+			continue
+		}
+		targetCounts[osd] = float64(len(refUpPGs[refOsds[i]])) * float64(total) / float64(refTotal)
+	}
+	return targetCounts
 }
 
 func getUpPGsForOsds(osds []int) map[int][]*pgBriefItem {
@@ -1138,14 +4071,79 @@ func getUpPGsForOsds(osds []int) map[int][]*pgBriefItem {
 	return osdPGs
 }
 
-func run(command ...string) (string, error) {
-	if verbose {
-		fmt.Fprintf(os.Stderr, "** executing: %s\n", strings.Join(command, " "))
+// maxCephRetryDelay bounds the backoff between retries of a Ceph command.
+const maxCephRetryDelay = 30 * time.Second
+
+// transientErrors are substrings of command errors that indicate a blip in
+// connectivity to the cluster (e.g. during a mon election), rather than a
+// genuine failure of the command.
+var transientErrors = []string{
+	"Connection reset",
+	"Connection refused",
+	"timed out",
+	"Error ENOTCONN",
+	"Error ETIMEDOUT",
+	"Error EINTR",
+}
+
+// commandTimeoutError is returned when an external command is killed for
+// exceeding --ceph-command-timeout. It is never retried: the timeout bounds
+// how long a command may take, and retrying would multiply that bound.
+type commandTimeoutError struct {
+	timeout time.Duration
+	command string
+}
+
+func (e *commandTimeoutError) Error() string {
+	return fmt.Sprintf("command timed out after %s: %s", e.timeout, e.command)
+}
+
+func isTransientError(err error) bool {
+	var te *commandTimeoutError
+	if errors.As(err, &te) {
+		return false
+	}
+	for _, s := range transientErrors {
+		if strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetries calls f, retrying up to --ceph-retries times with exponential
+// backoff as long as it fails with a transient error.
+func withRetries(command []string, f func() (string, error)) (string, error) {
+	delay := cephRetryDelay
+	for attempt := 1; ; attempt++ {
+		out, err := f()
+		if err == nil || attempt > cephRetries || !isTransientError(err) {
+			return out, err
+		}
+
+		logf(logWarn, "transient failure of '%s' (attempt %d of %d); retrying in %s: %v",
+			strings.Join(command, " "), attempt, cephRetries+1, delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, maxCephRetryDelay)
 	}
+}
 
-	cmd := exec.Command(command[0], command[1:]...)
+func run(command ...string) (string, error) {
+	return withRetries(command, func() (string, error) { return runOnce(command...) })
+}
+
+func runOnce(command ...string) (string, error) {
+	debugf("** executing: %s", strings.Join(command, " "))
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
 	stdout, err := cmd.Output()
 
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", errors.WithStack(&commandTimeoutError{cephCommandTimeout, strings.Join(command, " ")})
+	}
 	if err != nil {
 		stderr := ""
 		if ee, ok := err.(*exec.ExitError); ok {
@@ -1159,13 +4157,17 @@ func run(command ...string) (string, error) {
 }
 
 func runCombined(command ...string) (string, error) {
-	if verbose {
-		fmt.Fprintf(os.Stderr, "** executing: %s\n", strings.Join(command, " "))
-	}
+	debugf("** executing: %s", strings.Join(command, " "))
+
+	ctx, cancel := commandContext()
+	defer cancel()
 
-	cmd := exec.Command(command[0], command[1:]...)
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
 	out, err := cmd.CombinedOutput()
 
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", errors.WithStack(&commandTimeoutError{cephCommandTimeout, strconv.Quote(strings.Join(command, " "))})
+	}
 	if err != nil {
 		return "", errors.Wrapf(err, "failed to execute command: %q",
 			strings.Join(command, " "))
@@ -1174,6 +4176,15 @@ func runCombined(command ...string) (string, error) {
 	return string(out), nil
 }
 
+// commandContext returns the context for an external command, bounded by
+// --ceph-command-timeout if it is set.
+func commandContext() (context.Context, context.CancelFunc) {
+	if cephCommandTimeout > 0 {
+		return context.WithTimeout(context.Background(), cephCommandTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 func runOrDie(command ...string) string {
 	stdout, err := run(command...)
 	if err != nil {
@@ -1182,30 +4193,313 @@ func runOrDie(command ...string) string {
 	return stdout
 }
 
+// freezeFlags are the OSD flags commonly set to freeze data movement while
+// upmaps are manipulated.
+var freezeFlags = []string{"norebalance", "nobackfill"}
+
+// freezeFlagsVerified is recorded in the JSON summary once --assume-flags-set
+// has verified that the freeze flags are set.
+var freezeFlagsVerified bool
+
+// verifyFreezeFlags returns an error unless all of the freeze flags are set
+// in the cluster.
+func verifyFreezeFlags(w io.Writer) error {
+	if missing := missingFreezeFlags(); len(missing) > 0 {
+		return errors.Errorf("--assume-flags-set was given, but the %s flag(s) are not set", strings.Join(missing, " and "))
+	}
+	fmt.Fprintf(w, "Verified that the %s flags are set\n", strings.Join(freezeFlags, " and "))
+	freezeFlagsVerified = true
+	return nil
+}
+
+// checkMaxTotalUpmaps prints the projected number of upmap items in the
+// cluster if --max-total-upmaps is given, returning an error if the pending
+// changes would take the count above it.
+func checkMaxTotalUpmaps(w io.Writer) error {
+	if maxTotalUpmaps <= 0 {
+		return nil
+	}
+
+	current, projected := M.upmapItemCounts()
+	fmt.Fprintf(w, "Upmap items in the cluster: %d -> %d (--max-total-upmaps %d)\n", current, projected, maxTotalUpmaps)
+	if projected > maxTotalUpmaps && projected > current {
+		return errors.Errorf("the changes would leave %d upmap items in the cluster, more than --max-total-upmaps %d; nothing applied", projected, maxTotalUpmaps)
+	}
+	return nil
+}
+
+// checkMaxMisplacedRatio returns an error if --max-misplaced-ratio is given,
+// the pending changes add backfill, and the cluster already has more
+// misplaced objects than allowed, unless --ignore-max-misplaced-ratio is
+// given. Backfill the changes cancel doesn't offset backfill they add.
+func checkMaxMisplacedRatio(w io.Writer) error {
+	if maxMisplacedRatio == 0 || M.bs.addedBackfillTargets() == 0 {
+		return nil
+	}
+
+	ratio, err := misplacedRatio()
+	if err != nil {
+		return errors.Wrap(err, "failed to get the misplaced ratio for --max-misplaced-ratio")
+	}
+	fmt.Fprintf(w, "Misplaced objects in the cluster: %.2f%% (--max-misplaced-ratio %.2f%%)\n", ratio*100, maxMisplacedRatio*100)
+	if ratio <= maxMisplacedRatio {
+		return nil
+	}
+	if ignoreMaxMisplacedRatio {
+		fmt.Fprintf(w, "WARNING: proceeding despite --max-misplaced-ratio due to --ignore-max-misplaced-ratio\n")
+		return nil
+	}
+	return errors.Errorf("%.2f%% of objects are already misplaced, more than --max-misplaced-ratio %.2f%%, and the changes would add backfill; use --ignore-max-misplaced-ratio to proceed anyway; nothing applied", ratio*100, maxMisplacedRatio*100)
+}
+
+// missingFreezeFlags returns the freeze flags that aren't set in the cluster.
+func missingFreezeFlags() []string {
+	dump := osdDump()
+	var missing []string
+	for _, flag := range freezeFlags {
+		if !dump.hasFlag(flag) {
+			missing = append(missing, flag)
+		}
+	}
+	return missing
+}
+
+// checkFreezeFlagsUnset warns if any of the freeze flags aren't set, since
+// Ceph may then start backfills while they are being canceled. Since a
+// warning is easily missed with --yes, an error is returned in that case
+// unless the operator has acknowledged the risk.
+func checkFreezeFlagsUnset(w io.Writer, acknowledged bool) error {
+	missing := missingFreezeFlags()
+	if len(missing) == 0 {
+		return nil
+	}
+
+	warning := color.New(color.FgRed, color.Bold)
+	warning.Fprintf(w, "WARNING: the %s flag(s) are not set; Ceph may start backfills while they are being canceled, racing with these changes\n", strings.Join(missing, " and "))
+	if yes && !dryRun && !acknowledged {
+		return errors.Errorf("the %s flag(s) are not set; set them, or pass --i-know-flags-are-unset to proceed anyway", strings.Join(missing, " and "))
+	}
+	return nil
+}
+
+// enableBalancer turns on the balancer, first unsetting the flags commonly
+// used to freeze data movement if requested. Each command run is printed.
+func enableBalancer(w io.Writer, unsetFlags bool) {
+	if unsetFlags {
+		for _, flag := range freezeFlags {
+			fmt.Fprintf(w, "Running: ceph osd unset %s\n", flag)
+			if _, err := runOsdUnset(flag); err != nil {
+				panic(errors.WithStack(err))
+			}
+		}
+	}
+	fmt.Fprintf(w, "Running: ceph balancer on\n")
+	if _, err := runBalancerOn(); err != nil {
+		panic(errors.WithStack(err))
+	}
+}
+
+// printReservationBottlenecks reports the OSDs whose backfill limits are
+// preventing further changes from being made.
+func printReservationBottlenecks(w io.Writer, bs *backfillState) {
+	osdList := func(osds []int) string {
+		strs := make([]string, len(osds))
+		for i, osd := range osds {
+			strs[i] = strconv.Itoa(osd)
+		}
+		return strings.Join(strs, ", ")
+	}
+
+	if bs.backfills >= bs.maxClusterBackfills {
+		fmt.Fprintf(w, "cluster is at its backfill limit (%d backfills, --max-cluster-backfills %d)\n", bs.backfills, bs.maxClusterBackfills)
+	}
+	srcs, tgts, primaries := bs.saturatedOsds(-1)
+	if len(srcs) > 0 {
+		fmt.Fprintf(w, "OSDs at their source backfill limit (--max-source-backfills %d): %s\n", bs.maxBackfillsFrom, osdList(srcs))
+	}
+	if len(tgts) > 0 {
+		fmt.Fprintf(w, "OSDs at their backfill reservation limit as a target: %s\n", osdList(tgts))
+	}
+	if len(primaries) > 0 {
+		fmt.Fprintf(w, "OSDs at their backfill reservation limit as a primary: %s\n", osdList(primaries))
+	}
+
+	// Pools with a more restrictive limit may be blocked on OSDs that
+	// still have room for other pools.
+	pools := make([]int, 0, len(bs.poolMaxBackfillReservations))
+	for pool := range bs.poolMaxBackfillReservations {
+		pools = append(pools, pool)
+	}
+	sort.Ints(pools)
+	for _, pool := range pools {
+		_, poolTgts, poolPrimaries := bs.saturatedOsds(pool)
+		poolTgts = slices.DeleteFunc(poolTgts, func(osd int) bool { return slices.Contains(tgts, osd) })
+		poolPrimaries = slices.DeleteFunc(poolPrimaries, func(osd int) bool { return slices.Contains(primaries, osd) })
+		if len(poolTgts) > 0 {
+			fmt.Fprintf(w, "OSDs at pool %d's backfill reservation limit (%d) as a target: %s\n", pool, bs.poolMaxBackfillReservations[pool], osdList(poolTgts))
+		}
+		if len(poolPrimaries) > 0 {
+			fmt.Fprintf(w, "OSDs at pool %d's backfill reservation limit (%d) as a primary: %s\n", pool, bs.poolMaxBackfillReservations[pool], osdList(poolPrimaries))
+		}
+	}
+}
+
+// reservationImpactTopN is the number of OSDs listed by
+// printReservationImpact.
+const reservationImpactTopN = 10
+
+// printReservationImpact prints how the planned changes affect the backfill
+// reservations of the n most-impacted OSDs, e.g. to catch a plan that loads
+// up a single target.
+func printReservationImpact(w io.Writer, bs *backfillState, before map[int]osdBackfillCounts, n int) {
+	type impact struct {
+		osd           int
+		local, remote int
+	}
+	after := bs.snapshotCounts()
+	var impacts []impact
+	for osd, a := range after {
+		b := before[osd]
+		if a.locals != b.locals || a.targets != b.targets {
+			impacts = append(impacts, impact{osd, a.locals - b.locals, a.targets - b.targets})
+		}
+	}
+	for osd, b := range before {
+		if _, ok := after[osd]; !ok && (b.locals != 0 || b.targets != 0) {
+			impacts = append(impacts, impact{osd, -b.locals, -b.targets})
+		}
+	}
+	if len(impacts) == 0 {
+		return
+	}
+
+	abs := func(i int) int { return max(i, -i) }
+	sort.Slice(impacts, func(i, j int) bool {
+		a, b := impacts[i], impacts[j]
+		if ma, mb := max(abs(a.local), abs(a.remote)), max(abs(b.local), abs(b.remote)); ma != mb {
+			return ma > mb
+		}
+		return a.osd < b.osd
+	})
+
+	// Without a reservation limit, there's no meaningful denominator.
+	now := func(osd, count int) string {
+		limit := bs.getMaxBackfillReservations(osd)
+		if limit == math.MaxInt32 {
+			return fmt.Sprintf("now %d", count)
+		}
+		return fmt.Sprintf("now %d/%d", count, limit)
+	}
+
+	fmt.Fprintln(w, "Backfill reservation changes, most-impacted OSDs first:")
+	for _, im := range impacts[:min(n, len(impacts))] {
+		if im.remote != 0 {
+			fmt.Fprintf(w, "osd.%d: %+d remote reservation(s) (%s)\n", im.osd, im.remote, now(im.osd, after[im.osd].targets))
+		}
+		if im.local != 0 {
+			fmt.Fprintf(w, "osd.%d: %+d local reservation(s) (%s)\n", im.osd, im.local, now(im.osd, after[im.osd].locals))
+		}
+	}
+	if len(impacts) > n {
+		fmt.Fprintf(w, "(%d more OSDs affected)\n", len(impacts)-n)
+	}
+	fmt.Fprintln(w)
+}
+
 func confirmProceed() bool {
+	if planOutput != "" {
+		mustWritePlanOutputFile(planOutput, M.dirtyUpmapItems())
+	}
+
 	switch M.changeState {
 	case NoChange:
-		fmt.Fprintf(os.Stderr, "nothing to do\n")
+		infof("nothing to do")
 		return false
 	case NoReservationAvailable:
-		fmt.Fprintf(os.Stderr, "change possible but no backfill reservation available, try later\n")
+		infof("change possible but no backfill reservation available, try later")
+		printReservationBottlenecks(os.Stderr, M.bs)
 		return false
 	}
 
-	if yes {
+	if err := checkMaxTotalUpmaps(os.Stderr); err != nil {
+		panic(err)
+	}
+	if err := checkMaxMisplacedRatio(os.Stderr); err != nil {
+		panic(err)
+	}
+
+	pgTemps := pgTempMap()
+	for _, pgid := range M.pgTempConflicts() {
+		logf(logWarn, "pg %s has a pg_temp entry %v; its acting set may change as recovery progresses and interfere with this change", pgid, pgTemps[pgid].Osds)
+	}
+
+	if planThenApply != "" {
+		mustWritePlanFile(planThenApply, M.dirtyUpmapItems())
+		fmt.Printf("The following changes were saved to %s:\n", planThenApply)
+		fmt.Println(formatChanges())
+		fmt.Println()
+		printReservationImpact(os.Stdout, M.bs, M.initialCounts, reservationImpactTopN)
+		if dryRun {
+			fmt.Println("No changes made (--dry-run).")
+			return false
+		}
+		if yes {
+			return true
+		}
+		return promptYesNo("Apply the saved plan?")
+	}
+
+	if yes && !dryRun {
 		return true
 	}
 
 	fmt.Println("The following changes would be made to the upmap exception table:")
-	fmt.Println(M.String())
+	fmt.Println(formatChanges())
 	fmt.Println()
-	fmt.Println("No changes made - use --yes to apply changes.")
+	printBackfillEstimate()
+	printReservationImpact(os.Stdout, M.bs, M.initialCounts, reservationImpactTopN)
+	fmt.Println(If(dryRun, "No changes made (--dry-run).", "No changes made - use --yes to apply changes."))
 
 	return false
 }
 
-// mapKeysInt converts a map[int]struct{} into a sorted int slice
-func mapKeysInt(mm map[int]struct{}) []int {
+// formatChanges returns M's pending changes in the format given by --format.
+func formatChanges() string {
+	if outputFormat == "review" {
+		return M.reviewString()
+	}
+	return M.String()
+}
+
+func printBackfillEstimate() {
+	bytes, err := pgBytes()
+	if err != nil {
+		// This is purely informational; don't fail the command over it.
+		debugf("unable to estimate backfill size: %v", err)
+		return
+	}
+
+	var pgids []string
+	for _, pui := range M.dirtyUpmapItems() {
+		pgids = append(pgids, pui.PgID)
+	}
+	est := M.bs.estimateBackfillBytes(pgids, bytes)
+	fmt.Printf("Estimated backfill for affected PGs: %.2f GiB\n", est/(1<<30))
+	fmt.Println()
+}
+
+func promptYesNo(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		panic(errors.WithStack(err))
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// mapKeysInt returns the keys of an int-keyed map as a sorted slice
+func mapKeysInt[V any](mm map[int]V) []int {
 	ret := make([]int, 0, len(mm))
 	for k := range mm {
 		ret = append(ret, k)
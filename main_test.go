@@ -15,8 +15,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/require"
@@ -127,6 +137,8 @@ func TestCalcPgMappingsToUndoBackfill(t *testing.T) {
 		excludePools []int
 		includePools []int
 		pgsIncluding []int
+		upmapCaused  bool
+		onlyDegraded bool
 		expected     []expectedMapping
 	}{
 		{
@@ -302,6 +314,23 @@ func TestCalcPgMappingsToUndoBackfill(t *testing.T) {
 				{ID: "2.11", Mappings: []mapping{{From: 26, To: 28, dirty: true}}},
 			},
 		},
+		{
+			name:        "with upmap-caused-only specified",
+			upmapCaused: true,
+			expected: []expectedMapping{
+				{ID: "1.8f", Mappings: []mapping{}},
+				{ID: "1.90", Mappings: []mapping{}},
+				{ID: "1.93", Mappings: []mapping{}},
+			},
+		},
+		{
+			name:         "with only-degraded specified",
+			onlyDegraded: true,
+			expected: []expectedMapping{
+				{ID: "1.8c", Mappings: []mapping{{From: 6, To: 10, dirty: true}, {From: 0, To: 1, dirty: true}}},
+				{ID: "1.91", Mappings: []mapping{{From: 36, To: 37, dirty: true}, {From: 30, To: 38, dirty: true}}},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -315,284 +344,190 @@ func TestCalcPgMappingsToUndoBackfill(t *testing.T) {
 
 			M = mustGetCurrentMappingState()
 
-			source := tt.source
-			target := tt.target
-			excludeOsds := make(map[int]struct{})
-			includeOsds := make(map[int]struct{})
-			excludePools := make(map[int]struct{})
-			includePools := make(map[int]struct{})
-			pgsIncludingOsds := make(map[int]struct{})
-
-			for _, v := range tt.exclude {
-				excludeOsds[v] = struct{}{}
-			}
-
-			for _, v := range tt.include {
-				includeOsds[v] = struct{}{}
-			}
-
-			for _, v := range tt.excludePools {
-				excludePools[v] = struct{}{}
-			}
-
-			for _, v := range tt.includePools {
-				includePools[v] = struct{}{}
-			}
-
-			for _, v := range tt.pgsIncluding {
-				pgsIncludingOsds[v] = struct{}{}
-			}
-
-			calcPgMappingsToUndoBackfill(true, source, target, excludeOsds, includeOsds, excludePools, includePools, pgsIncludingOsds)
+			calcPgMappingsToUndoBackfill(M, undoBackfillOptions{
+				excludeBackfilling: true,
+				source:             tt.source,
+				target:             tt.target,
+				excludedOsds:       sliceToMap(tt.exclude),
+				includedOsds:       sliceToMap(tt.include),
+				excludedPools:      sliceToMap(tt.excludePools),
+				includedPools:      sliceToMap(tt.includePools),
+				pgsIncludingOsds:   sliceToMap(tt.pgsIncluding),
+				upmapCausedOnly:    tt.upmapCaused,
+				onlyDegraded:       tt.onlyDegraded,
+			})
 
 			validateDirtyMappings(t, tt.expected)
 		})
 	}
 }
 
-func TestCountCurrentBackfills(t *testing.T) {
+func TestCalcPgMappingsToUndoBackfillWithActingOverride(t *testing.T) {
 	setupTest(t)
 	defer teardownTest(t)
-	out := `
+	pgDumpOut := `
 [
- { "pgid": "1.32", "up": [ 7, 5, 9], "acting": [ 7, 5, 9 ] },
- { "pgid": "1.33", "up": [ 6, 0, 10], "acting": [ 6, 10, 2 ] },
- { "pgid": "1.45", "up": [ 6, 3, 2], "acting": [ 6, 3, 2 ] },
- { "pgid": "1.46", "up": [ 4, 6, 0], "acting": [ 4, 6, 1 ] },
- { "pgid": "1.47", "up": [ 0, 11, 4], "acting": [ 2, 11, 4 ] },
- { "pgid": "1.89", "up": [ 10, 2, 8], "acting": [ 10, 2, 8 ] },
- { "pgid": "1.8a", "up": [ 3, 7, 0], "acting": [ 3, 7, 1 ] },
- { "pgid": "1.8b", "up": [ 3, 6, 0], "acting": [ 3, 7, 1 ] },
- { "pgid": "1.8c", "up": [ 3, 6, 0], "acting": [ 3, 7, 1 ],
-   "state": "active+recovery_wait+degraded+remapped" }
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 4, 2147483647, 3 ], "state": "down+remapped" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 4, 2147483647, 3 ], "state": "incomplete+remapped" },
+ { "pgid": "1.3", "up": [ 1, 2, 3 ], "acting": [ 4, 2147483647, 3 ], "state": "down+remapped" }
 ]
 `
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
 
-	runPgDumpPgsBrief = func() (string, error) { return out, nil }
-
-	expectedSourceBackfillCounts := map[int]int{
-		1: 4,
-		2: 2,
-		7: 2,
-	}
-	expectedTargetBackfillCounts := map[int]int{
-		0: 6,
-		6: 2,
-	}
+	M = mustGetCurrentMappingState()
+	overrides := mustParseActingOverrides([]string{"1.1:4/5/3", "1.3:4/5"})
+	calcPgMappingsToUndoBackfill(M, undoBackfillOptions{actingOverrides: overrides})
 
-	sourceBackfillCounts, targetBackfillCounts := countCurrentBackfills()
-	testEqual := func(expected, actual map[int]int) {
-		require.Len(t, actual, len(expected))
-		for k, v := range expected {
-			require.Contains(t, actual, k)
-			require.Equal(t, v, actual[k])
-		}
-	}
-	testEqual(expectedSourceBackfillCounts, sourceBackfillCounts)
-	testEqual(expectedTargetBackfillCounts, targetBackfillCounts)
+	// 1.2 has no override and is skipped; 1.3's override is the wrong
+	// length and is skipped.
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 1, To: 4, dirty: true}, {From: 2, To: 5, dirty: true}}},
+	})
 }
 
-func TestCalcPgMappingsToUndoUpmaps(t *testing.T) {
-	// Need an entry for each PG that will have mappings affected. Other
-	// than that, we want to fake backfills such that:
-	// sourceBackfillCounts := map[int]int{
-	// 	1: 4,
-	// 	2: 1,
-	// 	3: 1,
-	// 	5: 2,
-	// }
-	// targetBackfillCounts := map[int]int{
-	// 	0: 6,
-	// 	6: 2,
-	// 	8: 2,
-	// }
+func TestCalcPgMappingsToUndoBackfillMaxBackfills(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
 	pgDumpOut := `
 [
- { "pgid": "1.33", "up": [ 100, 2, 3 ], "acting": [ 100, 2, 3 ] },
- { "pgid": "1.34", "up": [ 100, 2, 3 ], "acting": [ 100, 2, 3 ] },
- { "pgid": "1.46", "up": [ 100, 1, 3 ], "acting": [ 100, 1, 3 ] },
- { "pgid": "1.47", "up": [ 100, 2, 3 ], "acting": [ 100, 2, 3 ] },
- { "pgid": "1.48", "up": [ 101, 2, 3 ], "acting": [ 101, 2, 3 ] },
- { "pgid": "1.8a", "up": [ 102, 7, 1 ], "acting": [ 102, 7, 1 ] },
- { "pgid": "1.8b", "up": [ 102, 7, 9 ], "acting": [ 102, 7, 9 ] },
- { "pgid": "1.8c", "up": [ 102, 7, 5 ], "acting": [ 102, 7, 5 ] },
- { "pgid": "1.8d", "up": [ 103, 2, 5 ], "acting": [ 103, 2, 5 ] },
-
- { "pgid": "1.100", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 1 ] },
- { "pgid": "1.101", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 1 ] },
- { "pgid": "1.102", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 1 ] },
- { "pgid": "1.103", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 1 ] },
- { "pgid": "1.104", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 2 ] },
- { "pgid": "1.105", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 3 ] },
- { "pgid": "1.106", "up": [ 998, 999, 6 ], "acting": [ 998, 999, 5 ] },
- { "pgid": "1.107", "up": [ 998, 999, 6 ], "acting": [ 998, 999, 5 ] },
- { "pgid": "1.108", "up": [ 998, 999, 8 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.109", "up": [ 998, 999, 8 ], "acting": [ 998, 999, 1000 ] }
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfilling" },
+ { "pgid": "1.3", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "1.4", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" }
 ]
 `
-	osdDumpOut := `
-		{
-		  "pg_upmap_items": [
-		    { "pgid": "1.33", "mappings": [ { "from": 0, "to": 2 } ] },
-		    { "pgid": "1.34", "mappings": [ { "from": 0, "to": 3 } ] },
-		    { "pgid": "1.46", "mappings": [ { "from": 0, "to": 1 } ] },
-		    { "pgid": "1.47", "mappings": [ { "from": 0, "to": 2 } ] },
-		    { "pgid": "1.48", "mappings": [ { "from": 6, "to": 2 } ] },
-		    { "pgid": "1.8a", "mappings": [ { "from": 0, "to": 1 } ] },
-		    { "pgid": "1.8b", "mappings": [ { "from": 1, "to": 7 }, { "from": 0, "to": 9 } ] },
-		    { "pgid": "1.8c", "mappings": [ { "from": 6, "to": 5 } ] },
-		    { "pgid": "1.8d", "mappings": [ { "from": 8, "to": 5 } ] }
-		  ]
-		}
-		`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
 
-	t.Run("source OSDs specified", func(t *testing.T) {
-		setupTest(t)
-		defer teardownTest(t)
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToUndoBackfill(M, undoBackfillOptions{
+		excludeBackfilling: true,
+		maxBackfills:       2,
+	})
 
-		runOsdDump = func() (string, error) { return osdDumpOut, nil }
-		runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	// Which PGs are remapped depends on scheduling, but only 2 of the 3
+	// eligible ones (1.2 is excluded as backfilling) are.
+	puis := M.dirtyUpmapItems()
+	require.Len(t, puis, 2)
+	for _, pui := range puis {
+		require.NotEqual(t, "1.2", pui.PgID)
+	}
+}
 
-		maxSourceBackfills := 3
-		sourceOsds := []int{1, 2, 5, 7}
-		expected := []expectedMapping{
-			{ID: "1.33", Mappings: nil},
-			{ID: "1.48", Mappings: nil},
-			{ID: "1.8b", Mappings: []mapping{{From: 0, To: 9}}},
-			{ID: "1.8d", Mappings: nil},
-		}
+func TestCalcPgMappingsToUndoBackfillGivenPgs(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "1.3", "up": [ 1, 2, 5 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
 
-		M = mustGetCurrentMappingState()
-		M.bs.maxBackfillsFrom = maxSourceBackfills
-		calcPgMappingsToUndoUpmaps(sourceOsds, false)
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToUndoBackfill(M, undoBackfillOptions{pgids: []string{"1.2"}})
 
-		validateDirtyMappings(t, expected)
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.2", Mappings: []mapping{{From: 4, To: 3, dirty: true}}},
 	})
 
-	t.Run("target OSDs specified", func(t *testing.T) {
-		setupTest(t)
-		defer teardownTest(t)
-
-		runOsdDump = func() (string, error) { return osdDumpOut, nil }
-		runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
-
-		maxSourceBackfills := 2
-		targetOsds := []int{1, 6}
-		expected := []expectedMapping{
-			{ID: "1.48", Mappings: nil},
-			{ID: "1.8b", Mappings: []mapping{{From: 0, To: 9}}},
-		}
-
-		M = mustGetCurrentMappingState()
-		M.bs.maxBackfillsFrom = maxSourceBackfills
-		calcPgMappingsToUndoUpmaps(targetOsds, true)
+	calcPgMappingsToUndoBackfill(M, undoBackfillOptions{pgids: []string{"1.3", "1.2"}})
 
-		validateDirtyMappings(t, expected)
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.2", Mappings: []mapping{{From: 4, To: 3, dirty: true}}},
+		{ID: "1.3", Mappings: []mapping{{From: 5, To: 3, dirty: true}}},
 	})
 
-	t.Run("max-backfills specified", func(t *testing.T) {
-		setupTest(t)
-		defer teardownTest(t)
-
-		runOsdDump = func() (string, error) { return osdDumpOut, nil }
-		runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	require.PanicsWithError(t, "pg(s) 1.4, 1.5 not found", func() {
+		calcPgMappingsToUndoBackfill(M, undoBackfillOptions{pgids: []string{"1.4", "1.1", "1.5"}})
+	})
+}
 
-		targetOsds := []int{0}
-		expected := []expectedMapping{
-			{ID: "1.33", Mappings: nil},
-			{ID: "1.34", Mappings: nil},
-			{ID: "1.8a", Mappings: nil},
-		}
+func TestCalcPgMappingsToUndoBackfillTrustActingFromQuery(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// The brief dump claims 1.1 is backfilling from 4 to 1, but pg query
+	// says the authoritative copy is on 5.
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 4, 2, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 4, 2, 3 ], "state": "active+remapped+backfill_wait" }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	queried := []string{}
+	runPgQuery = func(pgid string) (string, error) {
+		queried = append(queried, pgid)
+		return `
+{
+  "acting": [ 5, 2, 3 ],
+  "info": { "pgid": "1.1" },
+  "peer_info": []
+}
+`, nil
+	}
 
-		M = mustGetCurrentMappingState()
-		M.bs.maxBackfillReservations = 9
-		M.bs.osd(100).maxBackfillReservations = 2
-		calcPgMappingsToUndoUpmaps(targetOsds, true)
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToUndoBackfill(M, undoBackfillOptions{actingFromQuery: mustParsePgIDSet([]string{"1.1"})})
 
-		validateDirtyMappings(t, expected)
+	require.Equal(t, []string{"1.1"}, queried)
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 1, To: 5, dirty: true}}},
+		{ID: "1.2", Mappings: []mapping{{From: 1, To: 4, dirty: true}}},
 	})
 }
 
-func TestCalcPgMappingsToBalanceHost(t *testing.T) {
-	// Initial state:
-	// 0: 1.1, 1.2, 1.3, 1.4 (-> 1), 1.5
-	// 1: 1.6, 1.7, 1.8 (plus 1.4 coming from 0)
-	// 2: 1.9, 1.10
-	// 3: 1.11, 1.12, 1.13, 1.14
-	// 4: 1.15
+func TestCalcPgMappingsToUndoBackfillResolveConflicts(t *testing.T) {
+	// Shard order matters in EC pools, which is where these conflicts
+	// arise. In 2.1, CRUSH maps to [4,5,3] and 5->1 is mapped, but the
+	// data is on [1,6,3]; mapping 4->1 conflicts with 5->1 until it's
+	// undone. In 2.2, CRUSH maps to [1,4,3] and 1->5 is mapped, but the
+	// data is on [5,1,3]; undoing 1->5 would put 1 in the up set twice.
+	osdPoolDetailOut := `
+[
+ { "pool_id": 2, "pool_name": "ec", "erasure_code_profile": "ec21" }
+]
+`
 	pgDumpOut := `
 [
- { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
- { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
- { "pgid": "1.3", "up": [ 0 ], "acting": [ 0 ] },
- { "pgid": "1.4", "up": [ 1 ], "acting": [ 0 ] },
- { "pgid": "1.5", "up": [ 0 ], "acting": [ 0 ] },
- { "pgid": "1.6", "up": [ 1 ], "acting": [ 1 ] },
- { "pgid": "1.7", "up": [ 1 ], "acting": [ 1 ] },
- { "pgid": "1.8", "up": [ 1 ], "acting": [ 1 ] },
- { "pgid": "1.9", "up": [ 2 ], "acting": [ 2 ] },
- { "pgid": "1.10", "up": [ 2 ], "acting": [ 2 ] },
- { "pgid": "1.11", "up": [ 3 ], "acting": [ 3 ] },
- { "pgid": "1.12", "up": [ 3 ], "acting": [ 3 ] },
- { "pgid": "1.13", "up": [ 3 ], "acting": [ 3 ] },
- { "pgid": "1.14", "up": [ 3 ], "acting": [ 3 ] },
- { "pgid": "1.15", "up": [ 4 ], "acting": [ 4 ] }
+ { "pgid": "2.1", "up": [ 4, 1, 3 ], "acting": [ 1, 6, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "2.2", "up": [ 5, 4, 3 ], "acting": [ 5, 1, 3 ], "state": "active+remapped+backfill_wait" }
 ]
 `
-
 	osdDumpOut := `
 {
-  "osds": [
-    { "osd": 0, "in": 1, "up": 1 },
-    { "osd": 1, "in": 1, "up": 1 },
-    { "osd": 2, "in": 1, "up": 1 },
-    { "osd": 3, "in": 1, "up": 1 },
-    { "osd": 4, "in": 1, "up": 1 },
-    { "osd": 5, "in": 0, "up": 1 }
-  ],
   "pg_upmap_items": [
-    { "pgid": "1.4", "mappings": [ { "from": 0, "to": 1 } ] },
-    { "pgid": "1.5", "mappings": [ { "from": 2, "to": 0 } ] }
+    { "pgid": "2.1", "mappings": [ { "from": 5, "to": 1 } ] },
+    { "pgid": "2.2", "mappings": [ { "from": 1, "to": 5 } ] }
   ]
 }
 `
-
 	tests := []struct {
-		name         string
-		maxBackfills int
-		targetSpread int
-		expected     []expectedMapping
+		name             string
+		resolveConflicts bool
+		exclude          []int
+		expected         []expectedMapping
 	}{
 		{
-			name:         "fully balance",
-			maxBackfills: 4,
-			targetSpread: 0,
+			name: "without resolve-conflicts",
 			expected: []expectedMapping{
-				{ID: "1.14", Mappings: []mapping{{From: 3, To: 4, dirty: true}}},
-				{ID: "1.5", Mappings: []mapping{{From: 2, To: 4, dirty: true}}},
-				{ID: "1.8", Mappings: []mapping{{From: 1, To: 2, dirty: true}}},
+				{ID: "2.1", Mappings: []mapping{{From: 5, To: 6, dirty: true}}},
 			},
 		},
 		{
-			name:         "no balance due to outstanding backfill",
-			maxBackfills: 1,
-			targetSpread: 0,
-			expected:     []expectedMapping{},
-		},
-		{
-			name:         "single movement",
-			maxBackfills: 2,
-			targetSpread: 0,
+			name:             "with resolve-conflicts",
+			resolveConflicts: true,
 			expected: []expectedMapping{
-				{ID: "1.5", Mappings: []mapping{{From: 2, To: 4, dirty: true}}},
+				{ID: "2.1", Mappings: []mapping{{From: 4, To: 1, dirty: true}, {From: 5, To: 6, dirty: true}}},
 			},
 		},
 		{
-			name:         "increased target spread",
-			maxBackfills: 4,
-			targetSpread: 2,
+			name:             "with the conflicting mapping excluded",
+			resolveConflicts: true,
+			exclude:          []int{5},
 			expected: []expectedMapping{
-				{ID: "1.5", Mappings: []mapping{{From: 2, To: 4, dirty: true}}},
+				{ID: "2.1", Mappings: []mapping{{From: 5, To: 6, dirty: true}}},
 			},
 		},
 	}
@@ -602,23 +537,1673 @@ func TestCalcPgMappingsToBalanceHost(t *testing.T) {
 			setupTest(t)
 			defer teardownTest(t)
 
+			runOsdPoolLs = func() (string, error) { return osdPoolDetailOut, nil }
+			runECProfileGet = func(string) (string, error) { return `{ "k": "2", "m": "1" }`, nil }
 			runOsdDump = func() (string, error) { return osdDumpOut, nil }
 			runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
 
 			M = mustGetCurrentMappingState()
-
-			calcPgMappingsToBalanceOsds(
-				[]int{0, 1, 2, 3, 4, 5},
-				tt.maxBackfills,
-				tt.targetSpread,
-			)
+			calcPgMappingsToUndoBackfill(M, undoBackfillOptions{
+				excludedOsds:     sliceToMap(tt.exclude),
+				resolveConflicts: tt.resolveConflicts,
+			})
 
 			validateDirtyMappings(t, tt.expected)
 		})
 	}
 }
 
-func TestCalcPgMappingsToDrainOsd(t *testing.T) {
+func TestResolveUndoBackfillConflictFailure(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// As in 2.1 above, 5->1 must be undone before mapping 4->1, but 4->1
+	// is refused since it would make osd 1 primary.
+	pgDumpOut := `
+[
+ { "pgid": "2.1", "up": [ 4, 1, 3 ], "acting": [ 1, 6, 3 ], "state": "active+remapped+backfill_wait" }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "2.1", "mappings": [ { "from": 5, "to": 1 } ] }
+  ]
+}
+`
+	runOsdPoolLs = func() (string, error) {
+		return `[ { "pool_id": 2, "pool_name": "ec", "erasure_code_profile": "ec21" } ]`, nil
+	}
+	runECProfileGet = func(string) (string, error) { return `{ "k": "2", "m": "1" }`, nil }
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.noPrimaryOsds = map[int]struct{}{1: {}}
+	before := M.bs.snapshotCounts()
+
+	up, acting := []int{4, 1, 3}, []int{1, 6, 3}
+	require.False(t, resolveUndoBackfillConflict(M, "2.1", up, acting, 0, func(int) bool { return false }))
+
+	// The undo of 5->1 is reverted.
+	require.Equal(t, []int{4, 1, 3}, up)
+	require.Equal(t, []mapping{{From: 5, To: 1}}, M.currentMappings("2.1"))
+	require.Equal(t, []int{4, 1, 3}, M.bs.pgbs["2.1"].Up)
+	after := M.bs.snapshotCounts()
+	maps.DeleteFunc(after, func(_ int, c osdBackfillCounts) bool { return c == osdBackfillCounts{} })
+	require.Equal(t, before, after)
+	require.Empty(t, M.dirtyUpmapItems())
+	require.Equal(t, NoChange, M.changeState)
+}
+
+func TestResolveUndoBackfillConflictFailureKeepsOtherChanges(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// As above, resolving 2.1 fails; meanwhile, 1.1's backfill is
+	// canceled by another worker.
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 4, 2, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "2.1", "up": [ 4, 1, 3 ], "acting": [ 1, 6, 3 ], "state": "active+remapped+backfill_wait" }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "2.1", "mappings": [ { "from": 5, "to": 1 } ] }
+  ]
+}
+`
+	runOsdPoolLs = func() (string, error) {
+		return `[ { "pool_id": 1, "pool_name": "replicated" }, { "pool_id": 2, "pool_name": "ec", "erasure_code_profile": "ec21" } ]`, nil
+	}
+	runECProfileGet = func(string) (string, error) { return `{ "k": "2", "m": "1" }`, nil }
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.noPrimaryOsds = map[int]struct{}{1: {}}
+
+	// The other worker's change lands between the snapshot of 2.1 and its
+	// restore.
+	snap := M.snapshotPg("2.1")
+	M.mustRemap("1.1", 1, 4)
+	require.NoError(t, M.tryRemap("2.1", 1, 5))
+	M.restorePg(snap)
+	require.Equal(t, ChangesPending, M.changeState)
+
+	up, acting := []int{4, 1, 3}, []int{1, 6, 3}
+	require.False(t, resolveUndoBackfillConflict(M, "2.1", up, acting, 0, func(int) bool { return false }))
+
+	require.Equal(t, ChangesPending, M.changeState)
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 1, To: 4, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToUndoBackfillPgQueryError(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// 1.1 is degraded and needs a pg query, which times out; 1.2 should
+	// still be handled.
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 2147483647, 2, 3 ], "state": "active+undersized+degraded+remapped+backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 4, 2, 3 ], "state": "active+remapped+backfill_wait" }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runPgQuery = func(pgid string) (string, error) {
+		return "", fmt.Errorf("command timed out after 1s: ceph pg %s query -f json", pgid)
+	}
+
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToUndoBackfill(M, undoBackfillOptions{})
+
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.2", Mappings: []mapping{{From: 1, To: 4, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToUndoBackfillQueryConcurrency(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	savedConcurrency := concurrency
+	defer func() { concurrency = savedConcurrency }()
+	concurrency = 8
+
+	// Every PG is degraded and needs a pg query; no more than
+	// --query-concurrency of them should be in flight at once.
+	var items []string
+	for i := 0; i < 8; i++ {
+		items = append(items, fmt.Sprintf(`{ "pgid": "1.%d", "up": [ 1, 2, 3 ], "acting": [ 2147483647, 2, 3 ], "state": "active+undersized+degraded+remapped+backfill_wait" }`, i))
+	}
+	pgDumpOut := "[" + strings.Join(items, ",") + "]"
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	var inFlight, maxInFlight atomic.Int32
+	runPgQuery = func(pgid string) (string, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return "", fmt.Errorf("command timed out after 1s: ceph pg %s query -f json", pgid)
+	}
+
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToUndoBackfill(M, undoBackfillOptions{queryConcurrency: 2})
+
+	require.LessOrEqual(t, maxInFlight.Load(), int32(2))
+	require.Positive(t, maxInFlight.Load())
+}
+
+func TestQueryConcurrencyValidation(t *testing.T) {
+	f := cancelBackfillCmd.Flags().Lookup("query-concurrency")
+	defer func() {
+		f.Value.Set(f.DefValue)
+		f.Changed = false
+	}()
+	require.NoError(t, cancelBackfillCmd.Flags().Set("query-concurrency", "0"))
+	require.PanicsWithError(t, "--query-concurrency must be at least 1", func() {
+		cancelBackfillCmd.Run(cancelBackfillCmd, nil)
+	})
+}
+
+func TestCalcPgMappingsToUndoBackfillProgress(t *testing.T) {
+	defer func(w io.Writer) { logOutput = w }(logOutput)
+	var items []string
+	for i := 0; i < undoBackfillProgressPgs; i++ {
+		items = append(items, fmt.Sprintf(`{ "pgid": "1.%x", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ], "state": "active+clean" }`, i+0x10))
+	}
+	items = append(items,
+		`{ "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 4, 2, 3 ], "state": "active+remapped+backfill_wait" }`,
+		// A duplicated up set produces a per-PG warning.
+		`{ "pgid": "1.2", "up": [ 1, 1, 3 ], "acting": [ 1, 2, 3 ], "state": "active+clean" }`,
+	)
+	pgDumpOut := "[" + strings.Join(items, ",") + "]"
+
+	tests := []struct {
+		name     string
+		quiet    bool
+		progress bool
+		expected []string
+	}{
+		{
+			name:     "progress",
+			progress: true,
+			expected: []string{
+				"WARNING: PG 1.2's up set has one or more duplicated OSD IDs; this PG will be excluded from operations and reservation calculations. Please check your CRUSH rules and map.",
+				"Progress: 1000/1001 PG(s) examined, ",
+				"Progress: 1001/1001 PG(s) examined, 1 remapped, 0 pg query(s) pending",
+			},
+		},
+		{
+			name:     "progress is not suppressed by --quiet",
+			quiet:    true,
+			progress: true,
+			expected: []string{
+				"Progress: 1000/1001 PG(s) examined, ",
+				"Progress: 1001/1001 PG(s) examined, 1 remapped, 0 pg query(s) pending",
+			},
+		},
+		{
+			name:     "no progress",
+			quiet:    true,
+			expected: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			defer teardownTest(t)
+			var buf bytes.Buffer
+			logOutput = &buf
+			quiet = tt.quiet
+			runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+			M = mustGetCurrentMappingState()
+			calcPgMappingsToUndoBackfill(M, undoBackfillOptions{progress: tt.progress})
+
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if buf.Len() == 0 {
+				lines = []string{}
+			}
+			require.Len(t, lines, len(tt.expected), buf.String())
+			for i, l := range lines {
+				require.True(t, strings.HasPrefix(l, tt.expected[i]), "got %q, want prefix %q", l, tt.expected[i])
+			}
+			require.Len(t, M.dirtyUpmapItems(), 1)
+		})
+	}
+}
+
+func TestPgStateMatches(t *testing.T) {
+	tests := []struct {
+		state    string
+		substrs  []string
+		all      bool
+		expected bool
+	}{
+		{"active+remapped+backfill_wait", []string{"degraded", "backfill_wait"}, false, true},
+		{"active+remapped+backfilling", []string{"degraded", "backfill_wait"}, false, false},
+		{"active+undersized+degraded+remapped+backfill_wait", []string{"degraded", "backfill_wait"}, true, true},
+		{"active+remapped+backfill_wait", []string{"degraded", "backfill_wait"}, true, false},
+		{"active+remapped+backfill_wait", []string{"!degraded"}, false, true},
+		{"active+undersized+degraded+remapped+backfill_wait", []string{"!degraded"}, false, false},
+		{"active+remapped+backfilling", []string{"!degraded", "backfill_wait"}, true, false},
+	}
+
+	for _, tt := range tests {
+		require.Equalf(t, tt.expected, pgStateMatches(tt.state, tt.substrs, tt.all), "%s %v all=%t", tt.state, tt.substrs, tt.all)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	defer func(d time.Duration, r int) { cephCommandTimeout, cephRetries = d, r }(cephCommandTimeout, cephRetries)
+	cephCommandTimeout = 50 * time.Millisecond
+	cephRetries = 0
+
+	_, err := run("sleep", "5")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "command timed out after 50ms: sleep 5")
+
+	_, err = runCombined("sleep", "5")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "command timed out after 50ms")
+
+	out, err := run("echo", "ok")
+	require.NoError(t, err)
+	require.Equal(t, "ok\n", out)
+}
+
+func TestRunRetries(t *testing.T) {
+	defer func(r int, d time.Duration) { cephRetries, cephRetryDelay = r, d }(cephRetries, cephRetryDelay)
+	cephRetries = 2
+	cephRetryDelay = time.Millisecond
+	attempts := filepath.Join(t.TempDir(), "attempts")
+
+	// Fails with a transient error until the third attempt.
+	script := `echo x >> ` + attempts + `; if [ $(wc -l < ` + attempts + `) -lt 3 ]; then echo "Error ENOTCONN" >&2; exit 1; fi; echo ok`
+	out, err := run("sh", "-c", script)
+	require.NoError(t, err)
+	require.Equal(t, "ok\n", out)
+
+	// Retries are exhausted.
+	require.NoError(t, os.Remove(attempts))
+	cephRetries = 1
+	_, err = run("sh", "-c", script)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Error ENOTCONN")
+
+	// Genuine errors aren't retried.
+	require.NoError(t, os.Remove(attempts))
+	_, err = run("sh", "-c", `echo x >> `+attempts+`; echo "Error EINVAL" >&2; exit 22`)
+	require.Error(t, err)
+	b, err := os.ReadFile(attempts)
+	require.NoError(t, err)
+	require.Equal(t, "x\n", string(b))
+
+	// Nor are commands killed by --ceph-command-timeout.
+	defer func(d time.Duration) { cephCommandTimeout = d }(cephCommandTimeout)
+	cephCommandTimeout = 50 * time.Millisecond
+	require.NoError(t, os.Remove(attempts))
+	_, err = run("sh", "-c", `echo x >> `+attempts+`; exec sleep 5`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "command timed out after 50ms")
+	b, err = os.ReadFile(attempts)
+	require.NoError(t, err)
+	require.Equal(t, "x\n", string(b))
+}
+
+func TestGetCrushmapPath(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	dir := t.TempDir()
+
+	_, err := getCrushmapPath("a.txt", "b.txt", true, nil, dir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "only one of")
+	_, err = getCrushmapPath("", "", true, nil, dir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "a CRUSHmap must be given")
+
+	path, err := getCrushmapPath("", "", false, nil, dir)
+	require.NoError(t, err)
+	require.Equal(t, "", path)
+	path, err = getCrushmapPath("a.txt", "", true, nil, dir)
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", path)
+
+	// A text CRUSHmap from stdin.
+	path, err = getCrushmapPath("", "-", true, strings.NewReader("# begin crush map\n"), dir)
+	require.NoError(t, err)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "# begin crush map\n", string(b))
+
+	// A compiled CRUSHmap is decompiled.
+	compiled := filepath.Join(dir, "compiled")
+	require.NoError(t, os.WriteFile(compiled, []byte{0x00, 0x00, 0x01, 0x00, 0xff}, 0644))
+	runCrushDecompile = func(in, out string) (string, error) {
+		return "", os.WriteFile(out, []byte("# decompiled\n"), 0644)
+	}
+	path, err = getCrushmapPath("", compiled, true, nil, dir)
+	require.NoError(t, err)
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "# decompiled\n", string(b))
+}
+
+func TestSortMappings(t *testing.T) {
+	mappings := func() []pgMapping {
+		return []pgMapping{
+			{PgID: "1.2", Mapping: mapping{From: 5, To: 1}},
+			{PgID: "1.1", Mapping: mapping{From: 7, To: 2}},
+			{PgID: "1.2", Mapping: mapping{From: 3, To: 4}},
+			{PgID: "1.3", Mapping: mapping{From: 3, To: 1}},
+		}
+	}
+
+	m := mappings()
+	sortMappings(m, "pgid")
+	require.Equal(t, []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 7, To: 2}},
+		{PgID: "1.2", Mapping: mapping{From: 3, To: 4}},
+		{PgID: "1.2", Mapping: mapping{From: 5, To: 1}},
+		{PgID: "1.3", Mapping: mapping{From: 3, To: 1}},
+	}, m)
+
+	m = mappings()
+	sortMappings(m, "from")
+	require.Equal(t, []pgMapping{
+		{PgID: "1.2", Mapping: mapping{From: 3, To: 4}},
+		{PgID: "1.3", Mapping: mapping{From: 3, To: 1}},
+		{PgID: "1.2", Mapping: mapping{From: 5, To: 1}},
+		{PgID: "1.1", Mapping: mapping{From: 7, To: 2}},
+	}, m)
+
+	m = mappings()
+	sortMappings(m, "to")
+	require.Equal(t, []pgMapping{
+		{PgID: "1.2", Mapping: mapping{From: 5, To: 1}},
+		{PgID: "1.3", Mapping: mapping{From: 3, To: 1}},
+		{PgID: "1.1", Mapping: mapping{From: 7, To: 2}},
+		{PgID: "1.2", Mapping: mapping{From: 3, To: 4}},
+	}, m)
+}
+
+func TestWhatifOsdOut(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+
+	// In replicated PG 1.4, CRUSH also reorders the remaining OSDs, which
+	// isn't a move. Only the shard of EC PG 2.0 that was on the out OSD is
+	// mapped; in 2.1, CRUSH shifts the shards, so the out OSD's shard would
+	// land on an OSD that already has one, which can't be mapped.
+	runOsdPoolLs = func() (string, error) {
+		return `[ { "pool_id": 1, "pool_name": "rbd" }, { "pool_id": 2, "pool_name": "ec", "erasure_code_profile": "ec21" } ]`, nil
+	}
+	runECProfileGet = func(string) (string, error) { return `{ "k": "2", "m": "1" }`, nil }
+	runOsdGetmap = func(path string) (string, error) { return "", nil }
+	runOsdmaptoolTestMapPgs = func(path string, markOut []int) (string, error) {
+		if len(markOut) == 0 {
+			return `
+pool 1 pg_num 5
+1.0	[3,7,8]	3
+1.1	[1,2,3]	1
+1.2	[0,5,3]	0
+1.3	[4,5,6]	4
+1.4	[3,5,6]	3
+pool 2 pg_num 2
+2.0	[3,5,6]	3
+2.1	[3,5,6]	3
+#osd	count	first	primary	c wt	wt
+`, nil
+		}
+		require.Equal(t, []int{3}, markOut)
+		return `
+pool 1 pg_num 5
+1.0	[2,7,8]	2
+1.1	[1,2,4]	1
+1.2	[0,5,2147483647]	0
+1.3	[4,5,6]	4
+1.4	[5,6,9]	5
+pool 2 pg_num 2
+2.0	[9,5,6]	9
+2.1	[5,6,9]	5
+#osd	count	first	primary	c wt	wt
+`, nil
+	}
+
+	mappings, err := osdOutMappings([]int{3})
+	require.NoError(t, err)
+	require.Equal(t, []pgMapping{
+		{PgID: "1.0", Mapping: mapping{From: 3, To: 2}},
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 4}},
+		{PgID: "1.4", Mapping: mapping{From: 3, To: 9}},
+		{PgID: "2.0", Mapping: mapping{From: 3, To: 9}},
+	}, mappings)
+
+	var buf bytes.Buffer
+	printOsdOutSummary(&buf, mappings)
+	require.Equal(t, `4 PG(s) would move
+OSD      TARGET BACKFILLS
+2        1
+4        1
+9        2
+`, buf.String())
+}
+
+func TestPrintReservationImpact(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 2, 3, 4 ], "acting": [ 2, 3, 4 ] },
+ { "pgid": "1.3", "up": [ 3, 1, 5 ], "acting": [ 3, 1, 6 ], "state": "active+remapped+backfill_wait" }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.bs.maxBackfillReservations = 5
+	M.mustRemap("1.1", 3, 7)
+	M.mustRemap("1.2", 4, 7)
+	M.mustRemap("1.3", 5, 6)
+
+	var buf bytes.Buffer
+	printReservationImpact(&buf, M.bs, M.initialCounts, 2)
+	require.Equal(t, `Backfill reservation changes, most-impacted OSDs first:
+osd.7: +2 remote reservation(s) (now 2/5)
+osd.1: +1 local reservation(s) (now 1/5)
+(3 more OSDs affected)
+
+`, buf.String())
+
+	// Without a limit, only the count is shown.
+	M.bs.maxBackfillReservations = math.MaxInt32
+	buf.Reset()
+	printReservationImpact(&buf, M.bs, M.initialCounts, 1)
+	require.Equal(t, `Backfill reservation changes, most-impacted OSDs first:
+osd.7: +2 remote reservation(s) (now 2)
+(4 more OSDs affected)
+
+`, buf.String())
+}
+
+func TestPrintOsdBackfillSummary(t *testing.T) {
+	before := map[int]osdBackfillCounts{
+		1: {sources: 2, targets: 0},
+		2: {sources: 0, targets: 1},
+		3: {sources: 0, targets: 0},
+	}
+	after := map[int]osdBackfillCounts{
+		1: {sources: 0, targets: 0},
+		2: {sources: 0, targets: 0},
+		3: {sources: 0, targets: 0},
+		4: {sources: 0, targets: 1},
+	}
+
+	var buf bytes.Buffer
+	printOsdBackfillSummary(&buf, before, after)
+	require.Equal(t, `OSD      SOURCE           TARGET
+1        2 -> 0           0 -> 0
+2        0 -> 0           1 -> 0
+4        0 -> 0           0 -> 1
+
+`, buf.String())
+}
+
+func TestParseActingOverride(t *testing.T) {
+	pgid, osds, err := parseActingOverride("1.2f:3/7/12")
+	require.NoError(t, err)
+	require.Equal(t, "1.2f", pgid)
+	require.Equal(t, []int{3, 7, 12}, osds)
+
+	for _, s := range []string{"1.2f", "1.2f:", "foo:1/2", "x1.2fy:1/2", "1.2f:1/x/3", "1.2f:1//3"} {
+		_, _, err := parseActingOverride(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseByteSpread(t *testing.T) {
+	tests := []struct {
+		in      string
+		spread  float64
+		percent bool
+	}{
+		{in: "5%", spread: 5, percent: true},
+		{in: "2.5%", spread: 2.5, percent: true},
+		{in: "1000", spread: 1000},
+		{in: "2k", spread: 2 << 10},
+		{in: "500G", spread: 500 << 30},
+		{in: "1.5T", spread: 1.5 * (1 << 40)},
+	}
+	for _, tt := range tests {
+		spread, percent, err := parseByteSpread(tt.in)
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.spread, spread, tt.in)
+		require.Equal(t, tt.percent, percent, tt.in)
+	}
+
+	for _, s := range []string{"", "%", "G", "-5%", "5P", "five"} {
+		_, _, err := parseByteSpread(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestPrintReservationBottlenecks(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 5, 4 ], "acting": [ 1, 6, 7 ] },
+ { "pgid": "1.3", "up": [ 8, 9, 10 ], "acting": [ 8, 9, 10 ] }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	bs := mustGetCurrentBackfillState()
+	bs.maxBackfillsFrom = 1
+	bs.maxBackfillReservations = 2
+	bs.osd(5).maxBackfillReservations = 1
+
+	var buf bytes.Buffer
+	printReservationBottlenecks(&buf, bs)
+	require.Equal(t, `OSDs at their source backfill limit (--max-source-backfills 1): 3, 6, 7
+OSDs at their backfill reservation limit as a target: 4, 5
+OSDs at their backfill reservation limit as a primary: 1
+`, buf.String())
+
+	// OSDs at a pool's more restrictive limit are reported for that pool.
+	bs.maxBackfillReservations = 3
+	bs.poolMaxBackfillReservations = map[int]int{1: 2, 2: 5}
+	buf.Reset()
+	printReservationBottlenecks(&buf, bs)
+	require.Equal(t, `OSDs at their source backfill limit (--max-source-backfills 1): 3, 6, 7
+OSDs at their backfill reservation limit as a target: 5
+OSDs at pool 1's backfill reservation limit (2) as a target: 4
+OSDs at pool 1's backfill reservation limit (2) as a primary: 1
+`, buf.String())
+
+	bs.maxClusterBackfills = 3
+	buf.Reset()
+	printReservationBottlenecks(&buf, bs)
+	require.Contains(t, buf.String(), "cluster is at its backfill limit (3 backfills, --max-cluster-backfills 3)\n")
+}
+
+func TestEnableBalancer(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+
+	var cmds []string
+	runOsdUnset = func(flag string) (string, error) {
+		cmds = append(cmds, "unset "+flag)
+		return "", nil
+	}
+	runBalancerOn = func() (string, error) {
+		cmds = append(cmds, "balancer on")
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	enableBalancer(&buf, false)
+	require.Equal(t, []string{"balancer on"}, cmds)
+	require.Equal(t, "Running: ceph balancer on\n", buf.String())
+
+	cmds = nil
+	buf.Reset()
+	enableBalancer(&buf, true)
+	require.Equal(t, []string{"unset norebalance", "unset nobackfill", "balancer on"}, cmds)
+	require.Equal(t, `Running: ceph osd unset norebalance
+Running: ceph osd unset nobackfill
+Running: ceph balancer on
+`, buf.String())
+}
+
+func TestVerifyFreezeFlags(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+
+	runOsdDump = func() (string, error) { return `{ "flags": "noout,norebalance,sortbitwise" }`, nil }
+	err := verifyFreezeFlags(io.Discard)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "nobackfill flag(s) are not set")
+	require.False(t, freezeFlagsVerified)
+
+	savedOsdDumpOut = nil
+	runOsdDump = func() (string, error) { return `{ "flags": "nobackfill,noout,norebalance,sortbitwise" }`, nil }
+	var buf bytes.Buffer
+	require.NoError(t, verifyFreezeFlags(&buf))
+	require.Equal(t, "Verified that the norebalance and nobackfill flags are set\n", buf.String())
+	require.True(t, freezeFlagsVerified)
+	require.True(t, summarize(nil).FreezeFlagsVerified)
+}
+
+func TestConfirmProceedDryRun(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func(y, d bool, p string) { yes, dryRun, planOutput = y, d, p }(yes, dryRun, planOutput)
+
+	runPgDumpPgsBrief = func() (string, error) {
+		return `[ { "pgid": "1.1", "up": [ 0, 1 ], "acting": [ 0, 1 ] } ]`, nil
+	}
+	runPgDumpPgs = func() (string, error) { return "[]", nil }
+	M = mustGetCurrentMappingState()
+	M.mustRemap("1.1", 1, 2)
+
+	yes = true
+	require.True(t, confirmProceed())
+
+	planOutput = filepath.Join(t.TempDir(), "plan.json")
+	dryRun = true
+	require.False(t, confirmProceed())
+	require.FileExists(t, planOutput)
+
+	runOsdDump = func() (string, error) { return `{ "flags": "noout" }`, nil }
+	savedOsdDumpOut = nil
+	require.NoError(t, checkFreezeFlagsUnset(io.Discard, false))
+}
+
+func TestCheckFreezeFlagsUnset(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func(y bool) { yes = y }(yes)
+
+	runOsdDump = func() (string, error) { return `{ "flags": "noout,sortbitwise" }`, nil }
+	var buf bytes.Buffer
+	yes = false
+	require.NoError(t, checkFreezeFlagsUnset(&buf, false))
+	require.Contains(t, buf.String(), "WARNING: the norebalance and nobackfill flag(s) are not set")
+
+	yes = true
+	err := checkFreezeFlagsUnset(io.Discard, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--i-know-flags-are-unset")
+	require.NoError(t, checkFreezeFlagsUnset(io.Discard, true))
+
+	savedOsdDumpOut = nil
+	runOsdDump = func() (string, error) { return `{ "flags": "nobackfill,norebalance" }`, nil }
+	buf.Reset()
+	require.NoError(t, checkFreezeFlagsUnset(&buf, false))
+	require.Empty(t, buf.String())
+}
+
+func TestCheckMaxTotalUpmaps(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func(n int) { maxTotalUpmaps = n }(maxTotalUpmaps)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 4 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 6 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.4", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] },
+    { "pgid": "1.2", "mappings": [ { "from": 5, "to": 6 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	// One item is added and one removed.
+	M.mustRemap("1.3", 3, 7)
+	M.mustRemap("1.1", 4, 3)
+	current, projected := M.upmapItemCounts()
+	require.Equal(t, 2, current)
+	require.Equal(t, 2, projected)
+
+	// No limit by default.
+	var buf bytes.Buffer
+	require.NoError(t, checkMaxTotalUpmaps(&buf))
+	require.Empty(t, buf.String())
+
+	// Changes that don't increase the count are allowed even when above
+	// the limit.
+	maxTotalUpmaps = 1
+	require.NoError(t, checkMaxTotalUpmaps(&buf))
+	require.Equal(t, "Upmap items in the cluster: 2 -> 2 (--max-total-upmaps 1)\n", buf.String())
+
+	M.mustRemap("1.4", 3, 8)
+	err := checkMaxTotalUpmaps(io.Discard)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "would leave 3 upmap items in the cluster, more than --max-total-upmaps 1")
+	maxTotalUpmaps = 3
+	require.NoError(t, checkMaxTotalUpmaps(io.Discard))
+}
+
+func TestCheckMaxMisplacedRatio(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func(r float64, i bool) { maxMisplacedRatio, ignoreMaxMisplacedRatio = r, i }(maxMisplacedRatio, ignoreMaxMisplacedRatio)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ], "state": "active+clean" },
+ { "pgid": "1.2", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" }
+]
+`
+	statusOut := `{ "pgmap": { "misplaced_ratio": 0.1 } }`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runStatus = func() (string, error) { return statusOut, nil }
+
+	// Canceling backfill is allowed even above the limit.
+	M = mustGetCurrentMappingState()
+	M.mustRemap("1.2", 4, 3)
+	maxMisplacedRatio = 0.05
+	var buf bytes.Buffer
+	require.NoError(t, checkMaxMisplacedRatio(&buf))
+	require.Empty(t, buf.String())
+
+	// Adding backfill isn't, unless forced.
+	M = mustGetCurrentMappingState()
+	M.mustRemap("1.1", 3, 5)
+	maxMisplacedRatio = 0
+	require.NoError(t, checkMaxMisplacedRatio(&buf))
+	require.Empty(t, buf.String())
+
+	maxMisplacedRatio = 0.05
+	err := checkMaxMisplacedRatio(&buf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "10.00% of objects are already misplaced, more than --max-misplaced-ratio 5.00%")
+	require.Equal(t, "Misplaced objects in the cluster: 10.00% (--max-misplaced-ratio 5.00%)\n", buf.String())
+
+	ignoreMaxMisplacedRatio = true
+	require.NoError(t, checkMaxMisplacedRatio(io.Discard))
+	ignoreMaxMisplacedRatio = false
+
+	maxMisplacedRatio = 0.2
+	require.NoError(t, checkMaxMisplacedRatio(io.Discard))
+
+	// Canceled backfill doesn't offset added backfill.
+	savedRawPgDumpPgsBrief, savedPgDumpPgsBrief = nil, nil
+	M = mustGetCurrentMappingState()
+	M.mustRemap("1.2", 4, 3)
+	M.mustRemap("1.1", 3, 5)
+	maxMisplacedRatio = 0.05
+	err = checkMaxMisplacedRatio(io.Discard)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the changes would add backfill")
+}
+
+func TestMaxMisplacedRatioValidation(t *testing.T) {
+	defer func(r float64) { maxMisplacedRatio = r }(maxMisplacedRatio)
+	for _, r := range []float64{-0.1, 1.5} {
+		maxMisplacedRatio = r
+		err := rootCmd.PersistentPreRunE(rootCmd, nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "must be between 0 and 1")
+	}
+}
+
+func TestSortPgBriefsByPoolPriority(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgBriefs := []*pgBriefItem{
+		{PgID: "1.1"}, {PgID: "2.1"}, {PgID: "3.1"}, {PgID: "1.2"}, {PgID: "3.2"}, {PgID: "2.2"},
+	}
+
+	pgids := func(pgbs []*pgBriefItem) []string {
+		ret := make([]string, 0, len(pgbs))
+		for _, pgb := range pgbs {
+			ret = append(ret, pgb.PgID)
+		}
+		return ret
+	}
+
+	require.Equal(t,
+		[]string{"1.1", "2.1", "3.1", "1.2", "3.2", "2.2"},
+		pgids(sortPgBriefsByPoolPriority(pgBriefs, nil)))
+	require.Equal(t,
+		[]string{"3.1", "3.2", "1.1", "1.2", "2.1", "2.2"},
+		pgids(sortPgBriefsByPoolPriority(pgBriefs, []int{3, 1})))
+	// The input isn't modified.
+	require.Equal(t,
+		[]string{"1.1", "2.1", "3.1", "1.2", "3.2", "2.2"},
+		pgids(pgBriefs))
+}
+
+func TestCountCurrentBackfills(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	out := `
+[
+ { "pgid": "1.32", "up": [ 7, 5, 9], "acting": [ 7, 5, 9 ] },
+ { "pgid": "1.33", "up": [ 6, 0, 10], "acting": [ 6, 10, 2 ] },
+ { "pgid": "1.45", "up": [ 6, 3, 2], "acting": [ 6, 3, 2 ] },
+ { "pgid": "1.46", "up": [ 4, 6, 0], "acting": [ 4, 6, 1 ] },
+ { "pgid": "1.47", "up": [ 0, 11, 4], "acting": [ 2, 11, 4 ] },
+ { "pgid": "1.89", "up": [ 10, 2, 8], "acting": [ 10, 2, 8 ] },
+ { "pgid": "1.8a", "up": [ 3, 7, 0], "acting": [ 3, 7, 1 ] },
+ { "pgid": "1.8b", "up": [ 3, 6, 0], "acting": [ 3, 7, 1 ] },
+ { "pgid": "1.8c", "up": [ 3, 6, 0], "acting": [ 3, 7, 1 ],
+   "state": "active+recovery_wait+degraded+remapped" }
+]
+`
+
+	runPgDumpPgsBrief = func() (string, error) { return out, nil }
+
+	expectedSourceBackfillCounts := map[int]int{
+		1: 4,
+		2: 2,
+		7: 2,
+	}
+	expectedTargetBackfillCounts := map[int]int{
+		0: 6,
+		6: 2,
+	}
+
+	sourceBackfillCounts, targetBackfillCounts := countCurrentBackfills()
+	testEqual := func(expected, actual map[int]int) {
+		require.Len(t, actual, len(expected))
+		for k, v := range expected {
+			require.Contains(t, actual, k)
+			require.Equal(t, v, actual[k])
+		}
+	}
+	testEqual(expectedSourceBackfillCounts, sourceBackfillCounts)
+	testEqual(expectedTargetBackfillCounts, targetBackfillCounts)
+}
+
+func TestCalcPgMappingsToUndoUpmaps(t *testing.T) {
+	// Need an entry for each PG that will have mappings affected. Other
+	// than that, we want to fake backfills such that:
+	// sourceBackfillCounts := map[int]int{
+	// 	1: 4,
+	// 	2: 1,
+	// 	3: 1,
+	// 	5: 2,
+	// }
+	// targetBackfillCounts := map[int]int{
+	// 	0: 6,
+	// 	6: 2,
+	// 	8: 2,
+	// }
+	pgDumpOut := `
+[
+ { "pgid": "1.33", "up": [ 100, 2, 3 ], "acting": [ 100, 2, 3 ] },
+ { "pgid": "1.34", "up": [ 100, 2, 3 ], "acting": [ 100, 2, 3 ] },
+ { "pgid": "1.46", "up": [ 100, 1, 3 ], "acting": [ 100, 1, 3 ] },
+ { "pgid": "1.47", "up": [ 100, 2, 3 ], "acting": [ 100, 2, 3 ] },
+ { "pgid": "1.48", "up": [ 101, 2, 3 ], "acting": [ 101, 2, 3 ] },
+ { "pgid": "1.8a", "up": [ 102, 7, 1 ], "acting": [ 102, 7, 1 ] },
+ { "pgid": "1.8b", "up": [ 102, 7, 9 ], "acting": [ 102, 7, 9 ] },
+ { "pgid": "1.8c", "up": [ 102, 7, 5 ], "acting": [ 102, 7, 5 ] },
+ { "pgid": "1.8d", "up": [ 103, 2, 5 ], "acting": [ 103, 2, 5 ] },
+
+ { "pgid": "1.100", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 1 ] },
+ { "pgid": "1.101", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 1 ] },
+ { "pgid": "1.102", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 1 ] },
+ { "pgid": "1.103", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 1 ] },
+ { "pgid": "1.104", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 2 ] },
+ { "pgid": "1.105", "up": [ 998, 999, 0 ], "acting": [ 998, 999, 3 ] },
+ { "pgid": "1.106", "up": [ 998, 999, 6 ], "acting": [ 998, 999, 5 ] },
+ { "pgid": "1.107", "up": [ 998, 999, 6 ], "acting": [ 998, 999, 5 ] },
+ { "pgid": "1.108", "up": [ 998, 999, 8 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.109", "up": [ 998, 999, 8 ], "acting": [ 998, 999, 1000 ] }
+]
+`
+	osdDumpOut := `
+		{
+		  "pg_upmap_items": [
+		    { "pgid": "1.33", "mappings": [ { "from": 0, "to": 2 } ] },
+		    { "pgid": "1.34", "mappings": [ { "from": 0, "to": 3 } ] },
+		    { "pgid": "1.46", "mappings": [ { "from": 0, "to": 1 } ] },
+		    { "pgid": "1.47", "mappings": [ { "from": 0, "to": 2 } ] },
+		    { "pgid": "1.48", "mappings": [ { "from": 6, "to": 2 } ] },
+		    { "pgid": "1.8a", "mappings": [ { "from": 0, "to": 1 } ] },
+		    { "pgid": "1.8b", "mappings": [ { "from": 1, "to": 7 }, { "from": 0, "to": 9 } ] },
+		    { "pgid": "1.8c", "mappings": [ { "from": 6, "to": 5 } ] },
+		    { "pgid": "1.8d", "mappings": [ { "from": 8, "to": 5 } ] }
+		  ]
+		}
+		`
+
+	t.Run("source OSDs specified", func(t *testing.T) {
+		setupTest(t)
+		defer teardownTest(t)
+
+		runOsdDump = func() (string, error) { return osdDumpOut, nil }
+		runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+		maxSourceBackfills := 3
+		sourceOsds := []int{1, 2, 5, 7}
+		expected := []expectedMapping{
+			{ID: "1.33", Mappings: nil},
+			{ID: "1.48", Mappings: nil},
+			{ID: "1.8b", Mappings: []mapping{{From: 0, To: 9}}},
+			{ID: "1.8d", Mappings: nil},
+		}
+
+		M = mustGetCurrentMappingState()
+		M.bs.maxBackfillsFrom = maxSourceBackfills
+		calcPgMappingsToUndoUpmaps(sourceOsds, false, nil)
+
+		validateDirtyMappings(t, expected)
+	})
+
+	t.Run("target OSDs specified", func(t *testing.T) {
+		setupTest(t)
+		defer teardownTest(t)
+
+		runOsdDump = func() (string, error) { return osdDumpOut, nil }
+		runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+		maxSourceBackfills := 2
+		targetOsds := []int{1, 6}
+		expected := []expectedMapping{
+			{ID: "1.48", Mappings: nil},
+			{ID: "1.8b", Mappings: []mapping{{From: 0, To: 9}}},
+		}
+
+		M = mustGetCurrentMappingState()
+		M.bs.maxBackfillsFrom = maxSourceBackfills
+		calcPgMappingsToUndoUpmaps(targetOsds, true, nil)
+
+		validateDirtyMappings(t, expected)
+	})
+
+	t.Run("from OSDs specified", func(t *testing.T) {
+		setupTest(t)
+		defer teardownTest(t)
+
+		runOsdDump = func() (string, error) { return osdDumpOut, nil }
+		runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+		// Only 6->2 is undone, not 0->2.
+		expected := []expectedMapping{
+			{ID: "1.48", Mappings: nil},
+		}
+
+		M = mustGetCurrentMappingState()
+		M.bs.maxBackfillsFrom = 3
+		calcPgMappingsToUndoUpmaps([]int{2}, false, withAnyOsd(sliceToMap([]int{6}), withFrom))
+
+		validateDirtyMappings(t, expected)
+	})
+
+	t.Run("max-backfills specified", func(t *testing.T) {
+		setupTest(t)
+		defer teardownTest(t)
+
+		runOsdDump = func() (string, error) { return osdDumpOut, nil }
+		runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+		targetOsds := []int{0}
+		expected := []expectedMapping{
+			{ID: "1.33", Mappings: nil},
+			{ID: "1.34", Mappings: nil},
+			{ID: "1.8a", Mappings: nil},
+		}
+
+		M = mustGetCurrentMappingState()
+		M.bs.maxBackfillReservations = 9
+		M.bs.osd(100).maxBackfillReservations = 2
+		calcPgMappingsToUndoUpmaps(targetOsds, true, nil)
+
+		validateDirtyMappings(t, expected)
+	})
+
+	t.Run("all upmaps", func(t *testing.T) {
+		setupTest(t)
+		defer teardownTest(t)
+
+		runOsdDump = func() (string, error) { return osdDumpOut, nil }
+		runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+		M = mustGetCurrentMappingState()
+		M.bs.maxBackfillsFrom = 3
+		osds := upmapTargetOsds()
+		require.Equal(t, []int{1, 2, 3, 5, 7, 9}, osds)
+		calcPgMappingsToUndoUpmaps(osds, false, nil)
+
+		validateDirtyMappings(t, []expectedMapping{
+			{ID: "1.33", Mappings: nil},
+			{ID: "1.34", Mappings: nil},
+			{ID: "1.48", Mappings: nil},
+			{ID: "1.8b", Mappings: nil},
+			{ID: "1.8d", Mappings: nil},
+		})
+		// The rest are held back by the source backfill limit.
+		require.Len(t, allMappings(), 4)
+	})
+}
+
+func TestCalcPgMappingsToBalanceHost(t *testing.T) {
+	// Initial state:
+	// 0: 1.1, 1.2, 1.3, 1.4 (-> 1), 1.5
+	// 1: 1.6, 1.7, 1.8 (plus 1.4 coming from 0)
+	// 2: 1.9, 1.10
+	// 3: 1.11, 1.12, 1.13, 1.14
+	// 4: 1.15
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.3", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.4", "up": [ 1 ], "acting": [ 0 ] },
+ { "pgid": "1.5", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.6", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.7", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.8", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.9", "up": [ 2 ], "acting": [ 2 ] },
+ { "pgid": "1.10", "up": [ 2 ], "acting": [ 2 ] },
+ { "pgid": "1.11", "up": [ 3 ], "acting": [ 3 ] },
+ { "pgid": "1.12", "up": [ 3 ], "acting": [ 3 ] },
+ { "pgid": "1.13", "up": [ 3 ], "acting": [ 3 ] },
+ { "pgid": "1.14", "up": [ 3 ], "acting": [ 3 ] },
+ { "pgid": "1.15", "up": [ 4 ], "acting": [ 4 ] }
+]
+`
+
+	osdDumpOut := `
+{
+  "osds": [
+    { "osd": 0, "in": 1, "up": 1 },
+    { "osd": 1, "in": 1, "up": 1 },
+    { "osd": 2, "in": 1, "up": 1 },
+    { "osd": 3, "in": 1, "up": 1 },
+    { "osd": 4, "in": 1, "up": 1 },
+    { "osd": 5, "in": 0, "up": 1 }
+  ],
+  "pg_upmap_items": [
+    { "pgid": "1.4", "mappings": [ { "from": 0, "to": 1 } ] },
+    { "pgid": "1.5", "mappings": [ { "from": 2, "to": 0 } ] }
+  ]
+}
+`
+
+	tests := []struct {
+		name         string
+		maxBackfills int
+		targetSpread int
+		minPgsPerOsd int
+		expected     []expectedMapping
+	}{
+		{
+			name:         "fully balance",
+			maxBackfills: 4,
+			targetSpread: 0,
+			expected: []expectedMapping{
+				{ID: "1.14", Mappings: []mapping{{From: 3, To: 4, dirty: true}}},
+				{ID: "1.5", Mappings: []mapping{{From: 2, To: 4, dirty: true}}},
+				{ID: "1.8", Mappings: []mapping{{From: 1, To: 2, dirty: true}}},
+			},
+		},
+		{
+			name:         "no balance due to outstanding backfill",
+			maxBackfills: 1,
+			targetSpread: 0,
+			expected:     []expectedMapping{},
+		},
+		{
+			name:         "single movement",
+			maxBackfills: 2,
+			targetSpread: 0,
+			expected: []expectedMapping{
+				{ID: "1.5", Mappings: []mapping{{From: 2, To: 4, dirty: true}}},
+			},
+		},
+		{
+			name:         "increased target spread",
+			maxBackfills: 4,
+			targetSpread: 2,
+			expected: []expectedMapping{
+				{ID: "1.5", Mappings: []mapping{{From: 2, To: 4, dirty: true}}},
+			},
+		},
+		{
+			name:         "min PGs per OSD",
+			maxBackfills: 4,
+			targetSpread: 0,
+			minPgsPerOsd: 4,
+			expected:     []expectedMapping{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			defer teardownTest(t)
+
+			runOsdDump = func() (string, error) { return osdDumpOut, nil }
+			runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+			M = mustGetCurrentMappingState()
+
+			calcPgMappingsToBalanceOsds(
+				M,
+				[]int{0, 1, 2, 3, 4, 5},
+				balanceOptions{
+					maxBackfills: tt.maxBackfills,
+					targetSpread: tt.targetSpread,
+					minPgsPerOsd: tt.minPgsPerOsd,
+				},
+			)
+
+			validateDirtyMappings(t, tt.expected)
+		})
+	}
+}
+
+func BenchmarkCalcPgMappingsToBalanceOsds(b *testing.B) {
+	// A large, unbalanced bucket: OSD i holds 20 + i%40 PGs.
+	const numOsds = 1000
+	osds := make([]int, numOsds)
+	var pgs []string
+	for osd := 0; osd < numOsds; osd++ {
+		osds[osd] = osd
+		for i := 0; i < 20+osd%40; i++ {
+			pgs = append(pgs, fmt.Sprintf(`{ "pgid": "1.%x", "up": [ %d ], "acting": [ %d ] }`, len(pgs), osd, osd))
+		}
+	}
+	pgDumpOut := "[" + strings.Join(pgs, ",") + "]"
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		setupTest(b)
+		runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+		M = mustGetCurrentMappingState()
+		b.StartTimer()
+
+		calcPgMappingsToBalanceOsds(M, append([]int{}, osds...), balanceOptions{maxBackfills: 2000, targetSpread: 1})
+
+		b.StopTimer()
+		teardownTest(b)
+	}
+}
+
+func TestCalcPgMappingsToBalanceHostPinBackfilling(t *testing.T) {
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.3", "up": [ 0 ], "acting": [ 2 ] }
+]
+`
+	osdDumpOut := `
+{
+  "osds": [
+    { "osd": 0, "in": 1, "up": 1 },
+    { "osd": 1, "in": 1, "up": 1 },
+    { "osd": 2, "in": 1, "up": 1 }
+  ]
+}
+`
+
+	tests := []struct {
+		name           string
+		pinBackfilling bool
+		expected       []expectedMapping
+	}{
+		{
+			name: "backfilling PGs may move",
+			expected: []expectedMapping{
+				{ID: "1.2", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+				{ID: "1.3", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+			},
+		},
+		{
+			name:           "backfilling PGs are pinned",
+			pinBackfilling: true,
+			expected: []expectedMapping{
+				{ID: "1.1", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+				{ID: "1.2", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			defer teardownTest(t)
+
+			runOsdDump = func() (string, error) { return osdDumpOut, nil }
+			runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+			M = mustGetCurrentMappingState()
+
+			calcPgMappingsToBalanceOsds(M, []int{0, 1, 2}, balanceOptions{
+				maxBackfills:   5,
+				pinBackfilling: tt.pinBackfilling,
+			})
+
+			validateDirtyMappings(t, tt.expected)
+		})
+	}
+}
+
+// The core planners must only change the mapping state they are given, so
+// that they can be driven without the commands' global state.
+func TestPlannersUseGivenMappingState(t *testing.T) {
+	tests := []struct {
+		name      string
+		pgDumpOut string
+		osdTree   string
+		osdDump   string
+		plan      func(m *mappingState) []*pgUpmapItem
+		expected  []expectedMapping
+	}{
+		{
+			name:      "undo backfill",
+			pgDumpOut: `[ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 4, 2, 3 ], "state": "active+remapped+backfill_wait" } ]`,
+			plan: func(m *mappingState) []*pgUpmapItem {
+				return calcPgMappingsToUndoBackfill(m, undoBackfillOptions{})
+			},
+			expected: []expectedMapping{
+				{ID: "1.1", Mappings: []mapping{{From: 1, To: 4, dirty: true}}},
+			},
+		},
+		{
+			name:      "drain",
+			pgDumpOut: `[ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] } ]`,
+			osdTree: `{ "nodes": [
+				{ "id": -1, "name": "host1", "type": "host", "children": [0, 1] },
+				{ "type": "osd", "name": "osd.0", "id": 0 },
+				{ "type": "osd", "name": "osd.1", "id": 1 }
+			] }`,
+			plan: func(m *mappingState) []*pgUpmapItem {
+				return calcPgMappingsToDrainOsd(m, "", false, []int{0}, sliceToMap([]int{1}), 0)
+			},
+			expected: []expectedMapping{
+				{ID: "1.1", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+			},
+		},
+		{
+			name:      "balance",
+			pgDumpOut: `[ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] }, { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] } ]`,
+			osdDump:   `{ "osds": [ { "osd": 0, "in": 1, "up": 1 }, { "osd": 1, "in": 1, "up": 1 } ] }`,
+			plan: func(m *mappingState) []*pgUpmapItem {
+				return calcPgMappingsToBalanceOsds(m, []int{0, 1}, balanceOptions{maxBackfills: 5})
+			},
+			expected: []expectedMapping{
+				{ID: "1.2", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			defer teardownTest(t)
+			defer func(saved *mappingState) { M = saved }(M)
+
+			runPgDumpPgsBrief = func() (string, error) { return tt.pgDumpOut, nil }
+			if tt.osdTree != "" {
+				runOsdTree = func() (string, error) { return tt.osdTree, nil }
+			}
+			if tt.osdDump != "" {
+				runOsdDump = func() (string, error) { return tt.osdDump, nil }
+			}
+
+			m := mustGetCurrentMappingState()
+			m.bs.maxBackfillsFrom = 10
+			m.bs.maxBackfillReservations = 10
+			M = nil
+			changed := tt.plan(m)
+
+			require.Nil(t, M)
+			require.Equal(t, m.dirtyUpmapItems(), changed)
+			M = m
+			validateDirtyMappings(t, tt.expected)
+		})
+	}
+}
+
+func TestCalcPgMappingsToBalanceHostBalancePrimaries(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// PG counts in the bucket are balanced within a spread of 1, but osd 0
+	// is the primary of every replicated PG, as well as of the EC PGs,
+	// which are left alone.
+	osdPoolDetailOut := `
+[
+ { "pool_id": 1, "pool_name": "replicated", "erasure_code_profile": "" },
+ { "pool_id": 2, "pool_name": "ec", "erasure_code_profile": "ec21" }
+]
+`
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0, 10, 11 ], "acting": [ 0, 10, 11 ] },
+ { "pgid": "1.2", "up": [ 0, 11, 12 ], "acting": [ 0, 11, 12 ] },
+ { "pgid": "1.3", "up": [ 0, 10, 12 ], "acting": [ 0, 10, 12 ] },
+ { "pgid": "1.4", "up": [ 10, 1, 11 ], "acting": [ 10, 1, 11 ] },
+ { "pgid": "1.5", "up": [ 11, 1, 12 ], "acting": [ 11, 1, 12 ] },
+ { "pgid": "1.6", "up": [ 12, 2, 10 ], "acting": [ 12, 2, 10 ] },
+ { "pgid": "1.7", "up": [ 10, 2, 11 ], "acting": [ 10, 2, 11 ] },
+ { "pgid": "2.1", "up": [ 0, 10, 11 ], "acting": [ 0, 10, 11 ] },
+ { "pgid": "2.2", "up": [ 0, 11, 12 ], "acting": [ 0, 11, 12 ] }
+]
+`
+	osdDumpOut := `
+{
+  "osds": [
+    { "osd": 0, "in": 1, "up": 1 },
+    { "osd": 1, "in": 1, "up": 1 },
+    { "osd": 2, "in": 1, "up": 1 }
+  ]
+}
+`
+	runOsdPoolLs = func() (string, error) { return osdPoolDetailOut, nil }
+	runECProfileGet = func(string) (string, error) { return `{ "k": "2", "m": "1" }`, nil }
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToBalanceOsds(M, []int{0, 1, 2}, balanceOptions{
+		maxBackfills:     5,
+		targetSpread:     1,
+		balancePrimaries: true,
+	})
+
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.2", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+		{ID: "1.3", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToBalanceHostMatchBucket(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// The reference OSDs 10, 11, and 12 have 4, 2, and 0 PGs.
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0, 10 ], "acting": [ 0, 10 ] },
+ { "pgid": "1.2", "up": [ 0, 10 ], "acting": [ 0, 10 ] },
+ { "pgid": "1.3", "up": [ 1, 10 ], "acting": [ 1, 10 ] },
+ { "pgid": "1.4", "up": [ 1, 10 ], "acting": [ 1, 10 ] },
+ { "pgid": "1.5", "up": [ 2, 11 ], "acting": [ 2, 11 ] },
+ { "pgid": "1.6", "up": [ 2, 11 ], "acting": [ 2, 11 ] }
+]
+`
+	osdDumpOut := `
+{
+  "osds": [
+    { "osd": 0, "in": 1, "up": 1 },
+    { "osd": 1, "in": 1, "up": 1 },
+    { "osd": 2, "in": 1, "up": 1 }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+
+	targetCounts := mustGetMatchBucketTargetCounts([]int{2, 1, 0}, []int{12, 11, 10})
+	require.Equal(t, map[int]float64{0: 4, 1: 2, 2: 0}, targetCounts)
+
+	calcPgMappingsToBalanceOsds(M, []int{0, 1, 2}, balanceOptions{
+		maxBackfills: 10,
+		targetCounts: targetCounts,
+	})
+
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.5", Mappings: []mapping{{From: 2, To: 0, dirty: true}}},
+		{ID: "1.6", Mappings: []mapping{{From: 2, To: 0, dirty: true}}},
+	})
+
+	require.Panics(t, func() { mustGetMatchBucketTargetCounts([]int{0, 1}, []int{10, 11, 12}) })
+}
+
+func TestCalcPgMappingsToBalanceHostByBytes(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// By PG count, osd 2 is the fullest, but by bytes, osd 0 is.
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.3", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.4", "up": [ 2 ], "acting": [ 2 ] },
+ { "pgid": "1.5", "up": [ 2 ], "acting": [ 2 ] },
+ { "pgid": "1.6", "up": [ 2 ], "acting": [ 2 ] },
+ { "pgid": "1.7", "up": [ 2 ], "acting": [ 2 ] }
+]
+`
+	pgDumpPgsOut := `
+[
+ { "pgid": "1.1", "stat_sum": { "num_bytes": 409600 } },
+ { "pgid": "1.2", "stat_sum": { "num_bytes": 102400 } },
+ { "pgid": "1.3", "stat_sum": { "num_bytes": 102400 } },
+ { "pgid": "1.4", "stat_sum": { "num_bytes": 153600 } },
+ { "pgid": "1.5", "stat_sum": { "num_bytes": 102400 } },
+ { "pgid": "1.6", "stat_sum": { "num_bytes": 102400 } },
+ { "pgid": "1.7", "stat_sum": { "num_bytes": 102400 } }
+]
+`
+	// Utilization is 50%, 10%, and 45%.
+	osdDfOut := `
+{
+  "nodes": [
+    { "id": 0, "reweight": 1, "kb": 1000, "kb_used": 500, "pgs": 2 },
+    { "id": 1, "reweight": 1, "kb": 1000, "kb_used": 100, "pgs": 1 },
+    { "id": 2, "reweight": 1, "kb": 1000, "kb_used": 450, "pgs": 4 }
+  ]
+}
+`
+	osdDumpOut := `
+{
+  "osds": [
+    { "osd": 0, "in": 1, "up": 1 },
+    { "osd": 1, "in": 1, "up": 1 },
+    { "osd": 2, "in": 1, "up": 1 }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runPgDumpPgs = func() (string, error) { return pgDumpPgsOut, nil }
+	runOsdDf = func() (string, error) { return osdDfOut, nil }
+
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToBalanceOsds(M, []int{0, 1, 2}, balanceOptions{
+		maxBackfills:      10,
+		byBytes:           true,
+		byteSpread:        5,
+		byteSpreadPercent: true,
+	})
+
+	// Once osd 0 is at 40%, its only PG (at 40%) would overshoot osd 1 (at
+	// 30%), so balancing stops.
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.2", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+		{ID: "1.7", Mappings: []mapping{{From: 2, To: 1, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToBalanceHostUtilizationGuard(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// By PG count, osd 1 is the emptiest, but by bytes, it's the fullest.
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.3", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.4", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.5", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.6", "up": [ 2 ], "acting": [ 2 ] },
+ { "pgid": "1.7", "up": [ 2 ], "acting": [ 2 ] }
+]
+`
+	osdDfOut := `
+{
+  "nodes": [
+    { "id": 0, "utilization": 50 },
+    { "id": 1, "utilization": 80 },
+    { "id": 2, "utilization": 30 }
+  ]
+}
+`
+	osdDumpOut := `
+{
+  "osds": [
+    { "osd": 0, "in": 1, "up": 1 },
+    { "osd": 1, "in": 1, "up": 1 },
+    { "osd": 2, "in": 1, "up": 1 }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runOsdDf = func() (string, error) { return osdDfOut, nil }
+
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToBalanceOsds(M, []int{0, 1, 2}, balanceOptions{maxBackfills: 10})
+
+	// osd 2 is used instead of osd 1 until it is no longer worth moving
+	// to, at which point balancing stops.
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.4", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToBalanceHostUtilizationGuardNextSource(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// osd 0 has the most PGs, but every OSD that could take them is fuller
+	// by bytes; osd 1 has the next most, and osd 2 is emptier than it.
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.3", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.4", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.5", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.6", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.7", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.8", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.9", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.a", "up": [ 2 ], "acting": [ 2 ] }
+]
+`
+	osdDfOut := `
+{
+  "nodes": [
+    { "id": 0, "utilization": 20 },
+    { "id": 1, "utilization": 70 },
+    { "id": 2, "utilization": 50 }
+  ]
+}
+`
+	osdDumpOut := `
+{
+  "osds": [
+    { "osd": 0, "in": 1, "up": 1 },
+    { "osd": 1, "in": 1, "up": 1 },
+    { "osd": 2, "in": 1, "up": 1 }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runOsdDf = func() (string, error) { return osdDfOut, nil }
+
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToBalanceOsds(M, []int{0, 1, 2}, balanceOptions{maxBackfills: 10, targetSpread: 1})
+
+	// Rather than stopping at osd 0, a PG is moved from osd 1 to osd 2,
+	// after which neither osd 0 nor osd 1 has anywhere to go.
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.9", Mappings: []mapping{{From: 1, To: 2, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToBalanceHostUtilizationGuardPlannedBytes(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.3", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.4", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.5", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.6", "up": [ 0 ], "acting": [ 0 ] }
+]
+`
+	// Each PG is 10% of an OSD.
+	pgDumpPgsOut := `
+[
+ { "pgid": "1.1", "stat_sum": { "num_bytes": 102400 } },
+ { "pgid": "1.2", "stat_sum": { "num_bytes": 102400 } },
+ { "pgid": "1.3", "stat_sum": { "num_bytes": 102400 } },
+ { "pgid": "1.4", "stat_sum": { "num_bytes": 102400 } },
+ { "pgid": "1.5", "stat_sum": { "num_bytes": 102400 } },
+ { "pgid": "1.6", "stat_sum": { "num_bytes": 102400 } }
+]
+`
+	osdDfOut := `
+{
+  "nodes": [
+    { "id": 0, "kb": 1000, "utilization": 50 },
+    { "id": 1, "kb": 1000, "utilization": 40 }
+  ]
+}
+`
+	osdDumpOut := `
+{
+  "osds": [
+    { "osd": 0, "in": 1, "up": 1 },
+    { "osd": 1, "in": 1, "up": 1 }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runPgDumpPgs = func() (string, error) { return pgDumpPgsOut, nil }
+	runOsdDf = func() (string, error) { return osdDfOut, nil }
+
+	M = mustGetCurrentMappingState()
+	calcPgMappingsToBalanceOsds(M, []int{0, 1}, balanceOptions{maxBackfills: 10})
+
+	// After one move, osd 1 is at 50% and osd 0 at 40%, so another move
+	// would put a PG onto a fuller OSD.
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.6", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+	})
+}
+
+func TestChooseRemapTarget(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ], "state": "active+clean" },
+ { "pgid": "1.2", "up": [ 5, 2, 3 ], "acting": [ 4, 2, 3 ], "state": "active+remapped+backfill_wait" }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	M = mustGetCurrentMappingState()
+
+	// osd 5 is already a backfill target.
+	osd, err := chooseRemapTarget("1.1", 1, []int{3, 5, 6})
+	require.NoError(t, err)
+	require.Equal(t, 6, osd)
+
+	_, err = chooseRemapTarget("1.1", 1, []int{1, 2, 3})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "every OSD is already in pg 1.1's up set [1 2 3]")
+
+	_, err = chooseRemapTarget("1.9", 1, []int{6})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pg 1.9 not found")
+}
+
+func TestCalcPgMappingsToDrainOsd(t *testing.T) {
 	osdDumpOut := `
 {
   "pg_upmap_items": [
@@ -630,218 +2215,1335 @@ func TestCalcPgMappingsToDrainOsd(t *testing.T) {
 	osdTreeOut := `
 {
   "nodes": [
-    {
-      "children": [ -1, -2, -3 ],
-      "type": "root",
-      "name": "root1",
-      "id": -999
-    },
-    {
-      "children": [ -4, -5 ],
-      "type": "rack",
-      "name": "rack1",
-      "id": -1
-    },
-    {
-      "children": [ 0, 1, 2, 3 ],
-      "type": "host",
-      "name": "host1",
-      "id": -4
-    },
-    { "type": "osd", "name": "osd.0", "id": 0 },
-    { "type": "osd", "name": "osd.1", "id": 1 },
-    { "type": "osd", "name": "osd.2", "id": 2 },
-    { "type": "osd", "name": "osd.3", "id": 3 },
-    {
-      "children": [ 4, 5, 6, 7 ],
-      "type": "host",
-      "name": "host2",
-      "id": -5
-    },
-    { "type": "osd", "name": "osd.4", "id": 4 },
-    { "type": "osd", "name": "osd.5", "id": 5 },
-    { "type": "osd", "name": "osd.6", "id": 6 },
-    { "type": "osd", "name": "osd.7", "id": 7 },
-    {
-      "children": [ -6, -7 ],
-      "type": "rack",
-      "name": "rack2",
-      "id": -2
-    },
-    {
-      "children": [ 8, 9, 10, 11 ],
-      "type": "host",
-      "name": "host3",
-      "id": -6
-    },
-    { "type": "osd", "name": "osd.8", "id": 8 },
-    { "type": "osd", "name": "osd.9", "id": 9 },
-    { "type": "osd", "name": "osd.10", "id": 10 },
-    { "type": "osd", "name": "osd.11", "id": 11 },
-    {
-      "children": [ 12, 13, 14, 15 ],
-      "type": "host",
-      "name": "host4",
-      "id": -7
-    },
-    { "type": "osd", "name": "osd.12", "id": 12 },
-    { "type": "osd", "name": "osd.13", "id": 13 },
-    { "type": "osd", "name": "osd.14", "id": 14 },
-    { "type": "osd", "name": "osd.15", "id": 15 },
-    {
-      "children": [ -8, -9 ],
-      "type": "rack",
-      "name": "rack3",
-      "id": -3
-    },
-    {
-      "children": [ 16, 17, 18, 19 ],
-      "type": "host",
-      "name": "host3",
-      "id": -8
-    },
-    { "type": "osd", "name": "osd.16", "id": 16 },
-    { "type": "osd", "name": "osd.17", "id": 17 },
-    { "type": "osd", "name": "osd.18", "id": 18 },
-    { "type": "osd", "name": "osd.19", "id": 19 },
-    {
-      "children": [ 20, 21, 22, 23 ],
-      "type": "host",
-      "name": "host4",
-      "id": -9
-    },
-    { "type": "osd", "name": "osd.20", "id": 20 },
-    { "type": "osd", "name": "osd.21", "id": 21 },
-    { "type": "osd", "name": "osd.22", "id": 22 },
-    { "type": "osd", "name": "osd.23", "id": 23 }
+    {
+      "children": [ -1, -2, -3 ],
+      "type": "root",
+      "name": "root1",
+      "id": -999
+    },
+    {
+      "children": [ -4, -5 ],
+      "type": "rack",
+      "name": "rack1",
+      "id": -1
+    },
+    {
+      "children": [ 0, 1, 2, 3 ],
+      "type": "host",
+      "name": "host1",
+      "id": -4
+    },
+    { "type": "osd", "name": "osd.0", "id": 0 },
+    { "type": "osd", "name": "osd.1", "id": 1 },
+    { "type": "osd", "name": "osd.2", "id": 2 },
+    { "type": "osd", "name": "osd.3", "id": 3 },
+    {
+      "children": [ 4, 5, 6, 7 ],
+      "type": "host",
+      "name": "host2",
+      "id": -5
+    },
+    { "type": "osd", "name": "osd.4", "id": 4 },
+    { "type": "osd", "name": "osd.5", "id": 5 },
+    { "type": "osd", "name": "osd.6", "id": 6 },
+    { "type": "osd", "name": "osd.7", "id": 7 },
+    {
+      "children": [ -6, -7 ],
+      "type": "rack",
+      "name": "rack2",
+      "id": -2
+    },
+    {
+      "children": [ 8, 9, 10, 11 ],
+      "type": "host",
+      "name": "host3",
+      "id": -6
+    },
+    { "type": "osd", "name": "osd.8", "id": 8 },
+    { "type": "osd", "name": "osd.9", "id": 9 },
+    { "type": "osd", "name": "osd.10", "id": 10 },
+    { "type": "osd", "name": "osd.11", "id": 11 },
+    {
+      "children": [ 12, 13, 14, 15 ],
+      "type": "host",
+      "name": "host4",
+      "id": -7
+    },
+    { "type": "osd", "name": "osd.12", "id": 12 },
+    { "type": "osd", "name": "osd.13", "id": 13 },
+    { "type": "osd", "name": "osd.14", "id": 14 },
+    { "type": "osd", "name": "osd.15", "id": 15 },
+    {
+      "children": [ -8, -9 ],
+      "type": "rack",
+      "name": "rack3",
+      "id": -3
+    },
+    {
+      "children": [ 16, 17, 18, 19 ],
+      "type": "host",
+      "name": "host3",
+      "id": -8
+    },
+    { "type": "osd", "name": "osd.16", "id": 16 },
+    { "type": "osd", "name": "osd.17", "id": 17 },
+    { "type": "osd", "name": "osd.18", "id": 18 },
+    { "type": "osd", "name": "osd.19", "id": 19 },
+    {
+      "children": [ 20, 21, 22, 23 ],
+      "type": "host",
+      "name": "host4",
+      "id": -9
+    },
+    { "type": "osd", "name": "osd.20", "id": 20 },
+    { "type": "osd", "name": "osd.21", "id": 21 },
+    { "type": "osd", "name": "osd.22", "id": 22 },
+    { "type": "osd", "name": "osd.23", "id": 23 }
+  ]
+}
+`
+
+	// Need an entry for each PG that will have mappings affected. Other
+	// than that, we want to fake backfills such that:
+	// sourceBackfillCounts := map[int]int{
+	// 	0: 2,
+	// }
+	// targetBackfillCounts := map[int]int{
+	// 	1: 6,
+	// 	2: 2,
+	// 	3: 3,
+	// 	5: 2,
+
+	// 	// Leave these at 0 so that they would be
+	// 	// preferred if allowMovementAcrossCrushType
+	// 	// and targetOsds allows.
+	// 	4:  0,
+	// 	8:  0,
+	// 	12: 0,
+	// 	16: 0,
+	// }
+	pgDumpOut := `
+[
+ { "pgid": "1.32", "up": [ 0, 8, 16 ], "acting": [ 0, 8, 16 ] },
+ { "pgid": "1.33", "up": [ 0, 5, 16 ], "acting": [ 0, 5, 16 ] },
+ { "pgid": "1.34", "up": [ 0, 5, 16 ], "acting": [ 0, 5, 16 ] },
+ { "pgid": "1.35", "up": [ 0, 8, 16 ], "acting": [ 0, 8, 16 ] },
+
+ { "pgid": "1.100", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 0 ] },
+ { "pgid": "1.101", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 0 ] },
+ { "pgid": "1.102", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.103", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.104", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.105", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.106", "up": [ 998, 999, 2 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.107", "up": [ 998, 999, 2 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.108", "up": [ 998, 999, 3 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.109", "up": [ 998, 999, 3 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.110", "up": [ 998, 999, 3 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.111", "up": [ 998, 999, 5 ], "acting": [ 998, 999, 1000 ] },
+ { "pgid": "1.112", "up": [ 998, 999, 5 ], "acting": [ 998, 999, 1000 ] }
+]
+`
+
+	sourceOsd := 0
+	maxSourceBackfills := 5
+
+	tests := []struct {
+		name                         string
+		allowMovementAcrossCrushType string
+		allowColocation              bool
+		targetOsds                   []int
+		expected                     []expectedMapping
+	}{
+		{
+			name:                         "movements stay in host (default)",
+			allowMovementAcrossCrushType: "",
+			targetOsds:                   []int{1, 2, 3, 4, 8, 12, 16},
+			expected: []expectedMapping{
+				{ID: "1.32", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+				{ID: "1.33", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+				{ID: "1.34", Mappings: []mapping{{From: 0, To: 3, dirty: true}}},
+			},
+		},
+		{
+			name:                         "movement allowed across hosts",
+			allowMovementAcrossCrushType: "host",
+			targetOsds:                   []int{1, 2, 3, 5, 8, 12, 16},
+			expected: []expectedMapping{
+				{ID: "1.32", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+				{ID: "1.33", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+				{ID: "1.35", Mappings: []mapping{{From: 0, To: 5, dirty: true}}},
+			},
+		},
+		// Movements allowed across racks - weird case enabled by PGs
+		// 33 and 34 having two copies in the same rack currently.
+		{
+			name:                         "movement allowed across racks",
+			allowMovementAcrossCrushType: "rack",
+			targetOsds:                   []int{1, 2, 3, 5, 8, 12, 16},
+			expected: []expectedMapping{
+				{ID: "1.32", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+				{ID: "1.33", Mappings: []mapping{{From: 0, To: 8, dirty: true}}},
+				{ID: "1.34", Mappings: []mapping{{From: 0, To: 12, dirty: true}}},
+			},
+		},
+
+		{
+			name:                         "movements stay in host - no candidates",
+			allowMovementAcrossCrushType: "",
+			targetOsds:                   []int{4, 8, 12, 16},
+			expected:                     []expectedMapping{},
+		},
+		{
+			name:                         "movement allowed across hosts - no candidates",
+			allowMovementAcrossCrushType: "host",
+			targetOsds:                   []int{8, 12, 16},
+			expected:                     []expectedMapping{},
+		},
+		{
+			name:                         "movement allowed across racks - no candidates",
+			allowMovementAcrossCrushType: "rack",
+			targetOsds:                   []int{16},
+			expected:                     []expectedMapping{},
+		},
+		{
+			name:                         "movement allowed across racks with colocation",
+			allowMovementAcrossCrushType: "rack",
+			allowColocation:              true,
+			targetOsds:                   []int{16, 17},
+			expected: []expectedMapping{
+				{ID: "1.32", Mappings: []mapping{{From: 0, To: 17, dirty: true}}},
+				{ID: "1.33", Mappings: []mapping{{From: 0, To: 17, dirty: true}}},
+				{ID: "1.34", Mappings: []mapping{{From: 0, To: 17, dirty: true}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			defer teardownTest(t)
+
+			runOsdDump = func() (string, error) { return osdDumpOut, nil }
+			runOsdTree = func() (string, error) { return osdTreeOut, nil }
+			runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+			M = mustGetCurrentMappingState()
+			M.bs.maxBackfillsFrom = maxSourceBackfills
+			calcPgMappingsToDrainOsd(
+				M,
+				tt.allowMovementAcrossCrushType,
+				tt.allowColocation,
+				[]int{sourceOsd},
+				sliceToMap(tt.targetOsds),
+				0,
+			)
+
+			validateDirtyMappings(t, tt.expected)
+		})
+	}
+}
+
+func TestDrainTargetFullRatio(t *testing.T) {
+	defer func() {
+		for _, name := range []string{"target-full-ratio", "auto-targets"} {
+			f := drainCmd.Flags().Lookup(name)
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}()
+
+	// Off unless given or needed by --auto-targets.
+	require.Equal(t, 0.0, mustGetDrainTargetFullRatio(drainCmd))
+	require.NoError(t, drainCmd.Flags().Set("auto-targets", "true"))
+	require.Equal(t, 0.75, mustGetDrainTargetFullRatio(drainCmd))
+	require.NoError(t, drainCmd.Flags().Set("auto-targets", "false"))
+	require.NoError(t, drainCmd.Flags().Set("target-full-ratio", "0.9"))
+	require.Equal(t, 0.9, mustGetDrainTargetFullRatio(drainCmd))
+}
+
+func TestCalcPgMappingsToDrainOsdExcludeTargetOsds(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    { "id": -1, "name": "host1", "type": "host", "children": [0, 1, 2, 3] },
+    { "type": "osd", "name": "osd.0", "id": 0, "reweight": 1 },
+    { "type": "osd", "name": "osd.1", "id": 1, "reweight": 1 },
+    { "type": "osd", "name": "osd.2", "id": 2, "reweight": 1 },
+    { "type": "osd", "name": "osd.3", "id": 3, "reweight": 1 }
+  ]
+}
+`
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.3", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.4", "up": [ 0 ], "acting": [ 0 ] }
+]
+`
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.bs.maxBackfillsFrom = 10
+	M.bs.maxBackfillReservations = 10
+
+	// Drain to everything in host1 except osd.1; the source is pruned too.
+	targetOsds := sliceToMap(mustParseOsdSpec("bucket:host1"))
+	mustPruneDrainTargets(targetOsds, []int{0}, sliceToMap([]int{1}))
+	require.Equal(t, sliceToMap([]int{2, 3}), targetOsds)
+	require.PanicsWithError(t, "--exclude-target-osds leaves no target OSDs", func() {
+		mustPruneDrainTargets(sliceToMap([]int{0, 1}), []int{0}, sliceToMap([]int{1}))
+	})
+
+	calcPgMappingsToDrainOsd(M, "", false, []int{0}, targetOsds, 0)
+
+	dirty := M.dirtyUpmapItems()
+	require.Len(t, dirty, 4)
+	for _, pui := range dirty {
+		for _, m := range pui.Mappings {
+			require.NotEqual(t, 1, m.To, "pg %s mapped to excluded osd.1", pui.PgID)
+			require.Contains(t, []int{2, 3}, m.To)
+		}
+	}
+}
+
+func TestCalcPgMappingsToDrainOsdTargetFullRatio(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    { "id": -1, "name": "host1", "type": "host", "children": [0, 1, 2] },
+    { "type": "osd", "name": "osd.0", "id": 0 },
+    { "type": "osd", "name": "osd.1", "id": 1 },
+    { "type": "osd", "name": "osd.2", "id": 2 }
+  ]
+}
+`
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.3", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.4", "up": [ 0 ], "acting": [ 0 ] }
+]
+`
+	// PGs on osd.0 are estimated at 100KB each. osd.1 has room for two of
+	// them below a 0.85 full ratio; osd.2 has room for none.
+	osdDfOut := `
+{
+  "nodes": [
+    { "id": 0, "reweight": 1, "kb": 1000, "kb_used": 400, "pgs": 4 },
+    { "id": 1, "reweight": 1, "kb": 1000, "kb_used": 600, "pgs": 6 },
+    { "id": 2, "reweight": 1, "kb": 1000, "kb_used": 800, "pgs": 8 }
+  ]
+}
+`
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runOsdDf = func() (string, error) { return osdDfOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.bs.maxBackfillsFrom = 10
+	M.bs.maxBackfillReservations = 10
+	calcPgMappingsToDrainOsd(M, "", false, []int{0}, sliceToMap([]int{1, 2}), 0.85)
+
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+		{ID: "1.2", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToDrainOsdTargetFullRatioECShards(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    { "id": -1, "name": "host1", "type": "host", "children": [0, 1] },
+    { "type": "osd", "name": "osd.0", "id": 0 },
+    { "type": "osd", "name": "osd.1", "id": 1 }
+  ]
+}
+`
+	pgDumpOut := `
+[
+ { "pgid": "3.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "3.2", "up": [ 0 ], "acting": [ 0 ] }
+]
+`
+	// Each PG is 400KB, but as a 2+1 EC PG, only a 200KB shard moves.
+	// osd.1 has room for one shard below a 0.85 full ratio.
+	pgDumpPgsOut := `
+[
+ { "pgid": "3.1", "stat_sum": { "num_bytes": 409600 } },
+ { "pgid": "3.2", "stat_sum": { "num_bytes": 409600 } }
+]
+`
+	osdDfOut := `
+{
+  "nodes": [
+    { "id": 0, "reweight": 1, "kb": 1000, "kb_used": 400, "pgs": 4 },
+    { "id": 1, "reweight": 1, "kb": 1000, "kb_used": 600, "pgs": 6 }
+  ]
+}
+`
+	runOsdPoolLs = func() (string, error) {
+		return `[ { "pool_id": 3, "pool_name": "ec", "erasure_code_profile": "ec21" } ]`, nil
+	}
+	runECProfileGet = func(string) (string, error) { return `{ "k": "2", "m": "1" }`, nil }
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runPgDumpPgs = func() (string, error) { return pgDumpPgsOut, nil }
+	runOsdDf = func() (string, error) { return osdDfOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.bs.maxBackfillsFrom = 10
+	M.bs.maxBackfillReservations = 10
+	calcPgMappingsToDrainOsd(M, "", false, []int{0}, sliceToMap([]int{1}), 0.85)
+
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "3.1", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToDrainOsdMultipleSources(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    { "id": -1, "name": "host1", "type": "host", "children": [0, 1, 2] },
+    { "type": "osd", "name": "osd.0", "id": 0 },
+    { "type": "osd", "name": "osd.1", "id": 1 },
+    { "type": "osd", "name": "osd.2", "id": 2 }
+  ]
+}
+`
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.2", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.3", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "1.4", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.5", "up": [ 1 ], "acting": [ 1 ] },
+ { "pgid": "1.6", "up": [ 1 ], "acting": [ 1 ] }
+]
+`
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	// The target only has room for two backfills; the sources should be
+	// drained in turn rather than the first source taking both.
+	M = mustGetCurrentMappingState()
+	M.bs.maxBackfillsFrom = 10
+	M.bs.maxBackfillReservations = 2
+	puis := calcPgMappingsToDrainOsd(M, "", false, []int{0, 1}, sliceToMap([]int{2}), 0)
+	require.Len(t, puis, 2)
+
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
+		{ID: "1.4", Mappings: []mapping{{From: 1, To: 2, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToSwapBucket(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    { "id": -1, "name": "root1", "type": "root", "children": [-2, -5] },
+    { "id": -2, "name": "rack1", "type": "rack", "children": [-3, -4] },
+    { "id": -3, "name": "host1", "type": "host", "children": [0, 1] },
+    { "type": "osd", "name": "osd.0", "id": 0, "reweight": 1 },
+    { "type": "osd", "name": "osd.1", "id": 1, "reweight": 1 },
+    { "id": -4, "name": "host2", "type": "host", "children": [4, 5] },
+    { "type": "osd", "name": "osd.4", "id": 4, "reweight": 1 },
+    { "type": "osd", "name": "osd.5", "id": 5, "reweight": 1 },
+    { "id": -5, "name": "rack2", "type": "rack", "children": [-6] },
+    { "id": -6, "name": "host3", "type": "host", "children": [8] },
+    { "type": "osd", "name": "osd.8", "id": 8, "reweight": 1 }
+  ]
+}
+`
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0, 8 ], "acting": [ 0, 8 ] },
+ { "pgid": "1.2", "up": [ 1, 4 ], "acting": [ 1, 4 ] },
+ { "pgid": "2.1", "up": [ 8, 4 ], "acting": [ 8, 5 ], "state": "active+remapped+backfill_wait" }
+]
+`
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	// osd 4 is already a backfill target, so osd 5 is less busy.
+	M = mustGetCurrentMappingState()
+	M.bs.maxBackfillsFrom = 10
+	M.bs.maxBackfillReservations = 10
+
+	err := calcPgMappingsToSwapBucket("host1", "rack2")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is a host, but")
+	err = calcPgMappingsToSwapBucket("host1", "host3")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "don't share a parent")
+
+	// 1.2 already has a replica in host2, so it can't move there.
+	require.NoError(t, calcPgMappingsToSwapBucket("host1", "host2"))
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 0, To: 5, dirty: true}}},
+	})
+}
+
+func TestImportMappings(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 6 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] },
+    { "pgid": "1.3", "mappings": [ { "from": 5, "to": 6 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	applied, skipped, _ := importMappings([]pgMapping{
+		// Already in effect.
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 4}},
+		// New mapping.
+		{PgID: "1.2", Mapping: mapping{From: 3, To: 7}},
+		// Existing mapping from 5 that must be modified.
+		{PgID: "1.3", Mapping: mapping{From: 5, To: 8}},
+	}, false)
+
+	require.Equal(t, 2, applied)
+	require.Equal(t, 1, skipped)
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.2", Mappings: []mapping{{From: 3, To: 7, dirty: true}}},
+		{ID: "1.3", Mappings: []mapping{{From: 5, To: 8, dirty: true}}},
+	})
+}
+
+func TestImportMappingsSkipInvalid(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 8 ], "acting": [ 1, 2, 8 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.3", "mappings": [ { "from": 3, "to": 8 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	// The PG has drifted such that it now has a mapping to the target
+	// from another OSD.
+	conflicting := pgMapping{PgID: "1.3", Mapping: mapping{From: 1, To: 8}}
+
+	M = mustGetCurrentMappingState()
+	applied, skipped, invalid := importMappings([]pgMapping{
+		// Valid.
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 7}},
+		// The source OSD no longer holds the PG.
+		{PgID: "1.2", Mapping: mapping{From: 5, To: 7}},
+		conflicting,
+		// The PG no longer exists.
+		{PgID: "1.4", Mapping: mapping{From: 3, To: 7}},
+	}, true)
+
+	require.Equal(t, 1, applied)
+	require.Equal(t, 0, skipped)
+	require.Equal(t, []string{
+		"pg 1.2: 5->7: no longer applicable",
+		"pg 1.3: 1->8: pg 1.3: conflicting mapping 3->8 found when trying to map 1->8",
+		"pg 1.4: 3->7: no longer applicable",
+	}, invalid)
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 3, To: 7, dirty: true}}},
+	})
+
+	// Without skipInvalid, the conflict is fatal.
+	require.Panics(t, func() { importMappings([]pgMapping{conflicting}, false) })
+}
+
+func TestMergeMappings(t *testing.T) {
+	merged, conflicts := mergeMappings([]mappingsFile{
+		{name: "a.json", mappings: []pgMapping{
+			{PgID: "1.1", Mapping: mapping{From: 1, To: 2}},
+			{PgID: "1.2", Mapping: mapping{From: 3, To: 4}},
+		}},
+		{name: "b.json", mappings: []pgMapping{
+			// Duplicate of a.json.
+			{PgID: "1.1", Mapping: mapping{From: 1, To: 2}},
+			// Same source, different target.
+			{PgID: "1.2", Mapping: mapping{From: 3, To: 5}},
+			// Different source, same target.
+			{PgID: "1.1", Mapping: mapping{From: 6, To: 2}},
+			{PgID: "1.3", Mapping: mapping{From: 1, To: 2}},
+		}},
+	})
+
+	require.Equal(t, []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 1, To: 2}},
+		{PgID: "1.2", Mapping: mapping{From: 3, To: 4}},
+		{PgID: "1.3", Mapping: mapping{From: 1, To: 2}},
+	}, merged)
+	require.Equal(t, []string{
+		fmt.Sprintf("pg 1.2: %s in b.json conflicts with %s in a.json", mapping{From: 3, To: 5}, mapping{From: 3, To: 4}),
+		fmt.Sprintf("pg 1.1: %s in b.json conflicts with %s in a.json", mapping{From: 6, To: 2}, mapping{From: 1, To: 2}),
+	}, conflicts)
+}
+
+func TestParseRemapFile(t *testing.T) {
+	mappings, err := parseRemapFile(strings.NewReader(`
+# Move data off of osd.3.
+1.1,3,7
+ 1.2f, 3 , 8
+
+`))
+	require.NoError(t, err)
+	require.Equal(t, []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 7}},
+		{PgID: "1.2f", Mapping: mapping{From: 3, To: 8}},
+	}, mappings)
+
+	_, err = parseRemapFile(strings.NewReader("1.1,3,7\n1.2,3\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 2: expected <pg ID>,<from>,<to>")
+
+	_, err = parseRemapFile(strings.NewReader("1.1,3,x\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 1: invalid target OSD")
+
+	_, err = parseRemapFile(strings.NewReader("pg,3,7\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 1: 'pg' is not a valid PG ID")
+}
+
+func TestInvertMappings(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 4 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 6 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] },
+    { "pgid": "1.2", "mappings": [ { "from": 5, "to": 6 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	var buf bytes.Buffer
+	inverse := invertMappings(&buf, []pgMapping{
+		// Still in effect.
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 4}},
+		// Changed since.
+		{PgID: "1.2", Mapping: mapping{From: 5, To: 7}},
+		// Removed since.
+		{PgID: "1.3", Mapping: mapping{From: 3, To: 8}},
+	})
+
+	require.Equal(t, []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 4, To: 3}},
+	}, inverse)
+	require.Equal(t, `pg 1.3: 3->8: no longer in effect (skipped)
+pg 1.2: 5->7: changed to 5->6 since it was applied (skipped)
+`, buf.String())
+
+	// Importing the inverse removes the mapping.
+	applied, skipped, _ := importMappings(inverse, false)
+	require.Equal(t, 1, applied)
+	require.Equal(t, 0, skipped)
+	require.Empty(t, M.getMappings(withPgid("1.1")))
+}
+
+func TestInvertMappingsReverseOrder(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 4 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 6 ] },
+ { "pgid": "1.3", "up": [ 1, 7, 3 ], "acting": [ 1, 7, 3 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] },
+    { "pgid": "1.2", "mappings": [ { "from": 5, "to": 6 } ] },
+    { "pgid": "1.3", "mappings": [ { "from": 2, "to": 7 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	// With --reverse, the last mapping applied is the first undone.
+	M = mustGetCurrentMappingState()
+	var buf bytes.Buffer
+	require.Equal(t, []pgMapping{
+		{PgID: "1.3", Mapping: mapping{From: 7, To: 2}},
+		{PgID: "1.2", Mapping: mapping{From: 6, To: 5}},
+		{PgID: "1.1", Mapping: mapping{From: 4, To: 3}},
+	}, invertMappings(&buf, []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 4}},
+		{PgID: "1.2", Mapping: mapping{From: 5, To: 6}},
+		{PgID: "1.3", Mapping: mapping{From: 2, To: 7}},
+	}))
+	require.Empty(t, buf.String())
+}
+
+func TestWriteMappings(t *testing.T) {
+	mappings := []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 4}},
+		{PgID: "1.2a", Mapping: mapping{From: 10, To: 12}},
+	}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format:   "json",
+			expected: `[{"pgid":"1.1","mapping":{"from":3,"to":4}},{"pgid":"1.2a","mapping":{"from":10,"to":12}}]` + "\n",
+		},
+		{
+			format: "yaml",
+			expected: `- pgid: "1.1"
+  mapping:
+    from: 3
+    to: 4
+- pgid: 1.2a
+  mapping:
+    from: 10
+    to: 12
+`,
+		},
+		{
+			format: "table",
+			expected: `PGID       FROM     TO
+1.1        3        4
+1.2a       10       12
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeMappings(&buf, mappings, tt.format, false)
+			require.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
+
+func TestRollbackMappings(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 4 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 6 ] },
+ { "pgid": "1.4", "up": [ 1, 2, 9 ], "acting": [ 1, 2, 9 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] },
+    { "pgid": "1.3", "mappings": [ { "from": 5, "to": 6 } ] },
+    { "pgid": "1.4", "mappings": [ { "from": 3, "to": 9 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	// Remove, add, and modify a mapping.
+	M.mustRemap("1.1", 4, 3)
+	M.mustRemap("1.2", 3, 7)
+	M.mustRemap("1.3", 6, 8)
+
+	rollback := M.rollbackMappings(M.dirtyUpmapItems())
+	require.Equal(t, []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 4}},
+		{PgID: "1.2", Mapping: mapping{From: 7, To: 3}},
+		{PgID: "1.3", Mapping: mapping{From: 5, To: 6}},
+	}, rollback)
+
+	// Importing the rollback mappings against the changed state restores
+	// the original state.
+	pgDumpOut = `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 7 ], "acting": [ 1, 2, 7 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 8 ], "acting": [ 1, 2, 8 ] },
+ { "pgid": "1.4", "up": [ 1, 2, 9 ], "acting": [ 1, 2, 9 ] }
+]
+`
+	osdDumpOut = `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.2", "mappings": [ { "from": 3, "to": 7 } ] },
+    { "pgid": "1.3", "mappings": [ { "from": 5, "to": 8 } ] },
+    { "pgid": "1.4", "mappings": [ { "from": 3, "to": 9 } ] }
+  ]
+}
+`
+	savedOsdDumpOut = nil
+	savedRawPgDumpPgsBrief = nil
+	savedPgDumpPgsBrief = nil
+
+	M = mustGetCurrentMappingState()
+	importMappings(rollback, false)
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 3, To: 4, dirty: true}}},
+		{ID: "1.2", Mappings: []mapping{}},
+		{ID: "1.3", Mappings: []mapping{{From: 5, To: 6, dirty: true}}},
+	})
+}
+
+func TestCalcPgMappingsToPrestageCrush(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.3", "up": [ 4, 5, 6 ], "acting": [ 4, 5, 6 ] },
+ { "pgid": "1.4", "up": [ 4, 5, 7 ], "acting": [ 4, 5, 7 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.4", "mappings": [ { "from": 6, "to": 7 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.bs.maxBackfillsFrom = 1
+
+	calcPgMappingsToPrestageCrush([]pgMapping{
+		// Only one of these may be applied due to the source limit.
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 7}},
+		{PgID: "1.2", Mapping: mapping{From: 3, To: 8}},
+		{PgID: "1.3", Mapping: mapping{From: 6, To: 9}},
+		// Source not in the up set.
+		{PgID: "1.3", Mapping: mapping{From: 10, To: 11}},
+		// Already in effect.
+		{PgID: "1.4", Mapping: mapping{From: 6, To: 7}},
+	})
+
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 3, To: 7, dirty: true}}},
+		{ID: "1.3", Mappings: []mapping{{From: 6, To: 9, dirty: true}}},
+	})
+}
+
+func TestGetPoolRuleChangeMappings(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdPoolDetailOut := `
+[
+ { "pool_id": 1, "pool_name": "replicated", "crush_rule": 0 },
+ { "pool_id": 2, "pool_name": "rbd", "crush_rule": 0 }
+]
+`
+	crushmap := `rule replicated_host {
+	id 0
+	step chooseleaf firstn 0 type host
+}
+rule replicated_rack {
+	id 1
+	step chooseleaf firstn 0 type rack
+}
+`
+	crushDiffOut := `
+1.0	[3, 7, 8] -> [3, 7, 2]
+2.0	[1, 4, 5] -> [1, 4, 6]
+2.1	[0, 2, 4] -> [0, 2, 4]
+`
+	runOsdPoolLs = func() (string, error) { return osdPoolDetailOut, nil }
+	runCrushExport = func(path string) (string, error) {
+		return "", os.WriteFile(path, []byte(crushmap), 0644)
+	}
+	runCrushCmp = func(path string) (string, error) {
+		out, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Contains(t, string(out), "rule replicated_host {\n\tid 0\n\tstep chooseleaf firstn 0 type rack\n}")
+		return crushDiffOut, nil
+	}
+
+	// Only mappings for the given pool are returned.
+	require.Equal(t, []pgMapping{
+		{PgID: "2.0", Mapping: mapping{From: 5, To: 6}},
+	}, mustGetPoolRuleChangeMappings("", "rbd:replicated_rack"))
+}
+
+func TestLintUpmaps(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 4 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 6 ] },
+ { "pgid": "1.3", "up": [ 7, 8, 9 ], "acting": [ 7, 8, 9 ] },
+ { "pgid": "1.4", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 }, { "from": 2, "to": 5 } ] },
+    { "pgid": "1.2", "mappings": [ { "from": 3, "to": 5 }, { "from": 5, "to": 6 } ] },
+    { "pgid": "1.3", "mappings": [ { "from": 1, "to": 7 }, { "from": 2, "to": 8 }, { "from": 3, "to": 9 } ] },
+    { "pgid": "1.4", "mappings": [ { "from": 4, "to": 3 }, { "from": 1, "to": 1 } ] },
+    { "pgid": "1.5", "mappings": [ { "from": 2, "to": 2 }, { "from": 3, "to": 4 } ] },
+    { "pgid": "9.1", "mappings": [ { "from": 1, "to": 2 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	// 1.4's self-mapping is reported as such, not as a stale mapping. 1.5 is in an existing pool but missing from the PG dump, so its
+	// mappings are reported but left alone.
+	M = mustGetCurrentMappingState()
+	issues := lintUpmaps(2)
+
+	strs := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		strs = append(strs, issue.String())
+	}
+	require.Equal(t, []string{
+		"pg 1.1: stale mapping 2->5 (fixable)",
+		"pg 1.2: stale mapping 3->5 (fixable)",
+		"pg 1.2: transitive mapping chain 3->5, 5->6",
+		"pg 1.3: upmap item has 3 mappings",
+		"pg 1.4: mapping 1->1 maps an OSD to itself (fixable)",
+		"pg 1.5: PG not found in pg dump",
+		"pg 1.5: mapping 2->2 maps an OSD to itself",
+		"pg 9.1: pool 9 no longer exists (fixable)",
+	}, strs)
+
+	fixUpmapLintIssues(issues)
+	M.cleanUpmapItem("1.5")
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 3, To: 4}}},
+		{ID: "1.2", Mappings: []mapping{{From: 5, To: 6}}},
+		{ID: "1.4", Mappings: []mapping{{From: 4, To: 3}}},
+		{ID: "9.1", Mappings: []mapping{}},
+	})
+}
+
+func TestListStaleUpmaps(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 4 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 6 ] },
+ { "pgid": "1.3", "up": [ 7, 8, 9 ], "acting": [ 7, 8, 9 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 }, { "from": 2, "to": 5 } ] },
+    { "pgid": "1.2", "mappings": [ { "from": 3, "to": 5 } ] },
+    { "pgid": "1.3", "mappings": [ { "from": 1, "to": 7 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	var buf bytes.Buffer
+	pgids := listStaleUpmaps(&buf)
+	require.Equal(t, []string{"1.1", "1.2"}, pgids)
+	require.Equal(t, `pg 1.1: stale mapping 2->5: from osd 2 is still in the up set [1 2 4]
+pg 1.2: stale mapping 3->5: to osd 5 is not in the up set [1 2 6]
+2 stale mapping(s) found
+`, buf.String())
+
+	for _, pgid := range pgids {
+		M.cleanUpmapItem(pgid)
+	}
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 3, To: 4}}},
+		{ID: "1.2", Mappings: []mapping{}},
+	})
+}
+
+func TestPreviewUnfreeze(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ], "state": "active+clean" },
+ { "pgid": "1.3", "up": [ 5, 6, 7 ], "acting": [ 2, 6, 8 ], "state": "active+remapped" }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	var buf bytes.Buffer
+	previewUnfreeze(&buf, mustGetCurrentBackfillState())
+	require.Equal(t, `PGs that will backfill:
+pg 1.1 (active+remapped+backfill_wait): 3->4
+pg 1.3 (active+remapped): 2->5,8->7
+2 PG(s) will backfill
+
+Per-OSD backfill load:
+OSD      SOURCE   LOCAL    REMOTE
+1        0        1        0
+2        1        1        0
+3        1        0        0
+4        0        0        1
+5        0        0        1
+7        0        0        1
+8        1        0        0
+`, buf.String())
+}
+
+func TestParseOsdSpecReweight(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    { "children": [ 0, 1, 2, 3 ], "type": "host", "name": "host1", "id": -1 },
+    { "type": "osd", "name": "osd.0", "id": 0, "reweight": 1 },
+    { "type": "osd", "name": "osd.1", "id": 1, "reweight": 0.4 },
+    { "type": "osd", "name": "osd.2", "id": 2, "reweight": 0.8 },
+    { "type": "osd", "name": "osd.3", "id": 3, "reweight": 0 }
+  ]
+}
+`
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+
+	osds, err := parseOsdSpec("reweight:<1")
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, osds)
+
+	osds, err = parseOsdSpec("reweight:>0.5")
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 2}, osds)
+
+	for _, s := range []string{"reweight:", "reweight:<", "reweight:=1", "reweight:<x"} {
+		_, err = parseOsdSpec(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseOsdSpecRangesAndLists(t *testing.T) {
+	osds, err := parseOsdSpec("100-103")
+	require.NoError(t, err)
+	require.Equal(t, []int{100, 101, 102, 103}, osds)
+
+	osds, err = parseOsdSpec("100-102,110,7-7")
+	require.NoError(t, err)
+	require.Equal(t, []int{100, 101, 102, 110, 7}, osds)
+
+	// Overlapping parts list each OSD once.
+	osds, err = parseOsdSpec("100-105,103,104-106")
+	require.NoError(t, err)
+	require.Equal(t, []int{100, 101, 102, 103, 104, 105, 106}, osds)
+
+	osds, err = parseOsdSpec("0-9999")
+	require.NoError(t, err)
+	require.Len(t, osds, maxOsdRangeSize)
+	_, err = parseOsdSpec("0-10000")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "covers more than 10000 OSDs")
+
+	for _, s := range []string{"5-3", "1-", "-", "1-2-3", "1,", ",1", "1,x", "a-b"} {
+		_, err = parseOsdSpec(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestCheckColocation(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    { "children": [ -2, -3 ], "type": "rack", "name": "rack1", "id": -1 },
+    { "children": [ 0, 1 ], "type": "host", "name": "host1", "id": -2 },
+    { "children": [ 2, 3 ], "type": "host", "name": "host2", "id": -3 },
+    { "children": [ -5 ], "type": "rack", "name": "rack2", "id": -4 },
+    { "children": [ 4, 5 ], "type": "host", "name": "host3", "id": -5 },
+    { "type": "osd", "name": "osd.0", "id": 0 },
+    { "type": "osd", "name": "osd.1", "id": 1 },
+    { "type": "osd", "name": "osd.2", "id": 2 },
+    { "type": "osd", "name": "osd.3", "id": 3 },
+    { "type": "osd", "name": "osd.4", "id": 4 },
+    { "type": "osd", "name": "osd.5", "id": 5 }
+  ]
+}
+`
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0, 2, 4 ], "acting": [ 0, 2, 4 ] },
+ { "pgid": "1.2", "up": [ 0, 1, 4 ], "acting": [ 0, 1, 4 ] },
+ { "pgid": "1.3", "up": [ 2, 4, 5 ], "acting": [ 2, 4, 3 ] },
+ { "pgid": "1.4", "up": [ 2, 2, 4 ], "acting": [ 2, 3, 4 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.3", "mappings": [ { "from": 3, "to": 5 } ] }
   ]
 }
 `
+	// 1.4 is excluded from the sanitized PG dump, but must be reported.
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
 
-	// Need an entry for each PG that will have mappings affected. Other
-	// than that, we want to fake backfills such that:
-	// sourceBackfillCounts := map[int]int{
-	// 	0: 2,
-	// }
-	// targetBackfillCounts := map[int]int{
-	// 	1: 6,
-	// 	2: 2,
-	// 	3: 3,
-	// 	5: 2,
+	M = mustGetCurrentMappingState()
 
-	// 	// Leave these at 0 so that they would be
-	// 	// preferred if allowMovementAcrossCrushType
-	// 	// and targetOsds allows.
-	// 	4:  0,
-	// 	8:  0,
-	// 	12: 0,
-	// 	16: 0,
-	// }
+	var buf bytes.Buffer
+	require.Equal(t, 3, checkColocation(&buf, "host"))
+	require.Equal(t, `pg 1.2: osds 0, 1 share host host1
+pg 1.3: osds 4, 5 share host host3 (has upmap item)
+pg 1.4: osd 2 appears more than once in the up set [2,2,4]
+3 PG(s) with colocated members
+`, buf.String())
+
+	buf.Reset()
+	require.Equal(t, 4, checkColocation(&buf, "rack"))
+	require.Equal(t, `pg 1.1: osds 0, 2 share rack rack1
+pg 1.2: osds 0, 1 share rack rack1
+pg 1.3: osds 4, 5 share rack rack2 (has upmap item)
+pg 1.4: osd 2 appears more than once in the up set [2,2,4]
+4 PG(s) with colocated members
+`, buf.String())
+}
+
+func TestVerifyNoRemappedPgs(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
 	pgDumpOut := `
 [
- { "pgid": "1.32", "up": [ 0, 8, 16 ], "acting": [ 0, 8, 16 ] },
- { "pgid": "1.33", "up": [ 0, 5, 16 ], "acting": [ 0, 5, 16 ] },
- { "pgid": "1.34", "up": [ 0, 5, 16 ], "acting": [ 0, 5, 16 ] },
- { "pgid": "1.35", "up": [ 0, 8, 16 ], "acting": [ 0, 8, 16 ] },
-
- { "pgid": "1.100", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 0 ] },
- { "pgid": "1.101", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 0 ] },
- { "pgid": "1.102", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.103", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.104", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.105", "up": [ 998, 999, 1 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.106", "up": [ 998, 999, 2 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.107", "up": [ 998, 999, 2 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.108", "up": [ 998, 999, 3 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.109", "up": [ 998, 999, 3 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.110", "up": [ 998, 999, 3 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.111", "up": [ 998, 999, 5 ], "acting": [ 998, 999, 1000 ] },
- { "pgid": "1.112", "up": [ 998, 999, 5 ], "acting": [ 998, 999, 1000 ] }
+ { "pgid": "1.1", "up": [ 0, 1, 2 ], "acting": [ 0, 1, 2 ] },
+ { "pgid": "1.2", "up": [ 1, 0, 2 ], "acting": [ 0, 1, 2 ] },
+ { "pgid": "1.3", "up": [ 0, 1, 3 ], "acting": [ 0, 1, 2 ] },
+ { "pgid": "1.4", "up": [ 3, 4, 5 ], "acting": [ 3, 4, 2147483647 ] },
+ { "pgid": "1.5", "up": [ 6, 6, 7 ], "acting": [ 6, 7, 8 ] }
 ]
 `
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	// 1.5 is otherwise ignored due to its duplicate up set, so it's
+	// always a failure.
+	var buf bytes.Buffer
+	require.Equal(t, 3, verifyNoRemappedPgs(&buf, nil, false))
+	require.Equal(t, `pg 1.3: up [0,1,3], acting [0,1,2]
+pg 1.4: up [3,4,5], acting [3,4,NONE]
+pg 1.5: up [6,6,7], acting [6,7,8] are inconsistent; can't verify
+3 PG(s) remapped
+`, buf.String())
+
+	buf.Reset()
+	require.Equal(t, 2, verifyNoRemappedPgs(&buf, nil, true))
+	require.Equal(t, `pg 1.3: up [0,1,3], acting [0,1,2]
+pg 1.5: up [6,6,7], acting [6,7,8] are inconsistent; can't verify
+2 PG(s) remapped
+`, buf.String())
+
+	buf.Reset()
+	require.Equal(t, 0, verifyNoRemappedPgs(&buf, sliceToMap([]int{4, 5}), true))
+	require.Equal(t, "0 PG(s) remapped\n", buf.String())
+}
 
-	sourceOsd := 0
-	maxSourceBackfills := 5
+func TestQuietWarnings(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0, 1, 2 ], "acting": [ 0, 1, 2 ] },
+ { "pgid": "1.2", "up": [ 0, 1 ], "acting": [ 0, 1, 2 ] },
+ { "pgid": "1.3", "up": [ 0, 0, 2 ], "acting": [ 0, 1, 2 ] }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	quiet = true
 
-	tests := []struct {
-		name                         string
-		allowMovementAcrossCrushType string
-		targetOsds                   []int
-		expected                     []expectedMapping
-	}{
-		{
-			name:                         "movements stay in host (default)",
-			allowMovementAcrossCrushType: "",
-			targetOsds:                   []int{1, 2, 3, 4, 8, 12, 16},
-			expected: []expectedMapping{
-				{ID: "1.32", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
-				{ID: "1.33", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
-				{ID: "1.34", Mappings: []mapping{{From: 0, To: 3, dirty: true}}},
-			},
-		},
-		{
-			name:                         "movement allowed across hosts",
-			allowMovementAcrossCrushType: "host",
-			targetOsds:                   []int{1, 2, 3, 5, 8, 12, 16},
-			expected: []expectedMapping{
-				{ID: "1.32", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
-				{ID: "1.33", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
-				{ID: "1.35", Mappings: []mapping{{From: 0, To: 5, dirty: true}}},
-			},
-		},
-		// Movements allowed across racks - weird case enabled by PGs
-		// 33 and 34 having two copies in the same rack currently.
-		{
-			name:                         "movement allowed across racks",
-			allowMovementAcrossCrushType: "rack",
-			targetOsds:                   []int{1, 2, 3, 5, 8, 12, 16},
-			expected: []expectedMapping{
-				{ID: "1.32", Mappings: []mapping{{From: 0, To: 2, dirty: true}}},
-				{ID: "1.33", Mappings: []mapping{{From: 0, To: 8, dirty: true}}},
-				{ID: "1.34", Mappings: []mapping{{From: 0, To: 12, dirty: true}}},
-			},
-		},
+	require.Len(t, pgDumpPgsBrief(), 1)
 
-		{
-			name:                         "movements stay in host - no candidates",
-			allowMovementAcrossCrushType: "",
-			targetOsds:                   []int{4, 8, 12, 16},
-			expected:                     []expectedMapping{},
-		},
-		{
-			name:                         "movement allowed across hosts - no candidates",
-			allowMovementAcrossCrushType: "host",
-			targetOsds:                   []int{8, 12, 16},
-			expected:                     []expectedMapping{},
-		},
-		{
-			name:                         "movement allowed across racks - no candidates",
-			allowMovementAcrossCrushType: "rack",
-			targetOsds:                   []int{16},
-			expected:                     []expectedMapping{},
-		},
-	}
+	var buf bytes.Buffer
+	printSuppressedWarnings(&buf)
+	require.Equal(t, "WARNING: 2 warning(s) suppressed by --quiet\n", buf.String())
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			setupTest(t)
-			defer teardownTest(t)
+func TestLogLevels(t *testing.T) {
+	defer func(l logLevel, w io.Writer) { minLogLevel, logOutput = l, w }(minLogLevel, logOutput)
+	var buf bytes.Buffer
+	logOutput = &buf
+
+	level, err := parseLogLevel("warn")
+	require.NoError(t, err)
+	minLogLevel = level
+	debugf("debug %d", 1)
+	infof("info %d", 2)
+	warnf("warn %d", 3)
+	require.Equal(t, "WARNING: warn 3\n", buf.String())
+
+	buf.Reset()
+	minLogLevel = logDebug
+	debugf("debug %d", 1)
+	infof("info %d", 2)
+	require.Equal(t, "debug 1\ninfo 2\n", buf.String())
+
+	_, err = parseLogLevel("trace")
+	require.Error(t, err)
+}
 
-			runOsdDump = func() (string, error) { return osdDumpOut, nil }
-			runOsdTree = func() (string, error) { return osdTreeOut, nil }
-			runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+func TestPrintStatus(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 5, 6 ], "acting": [ 1, 5, 7 ], "state": "active+remapped+backfilling" },
+ { "pgid": "1.3", "up": [ 2, 6, 8 ], "acting": [ 2, 6, 8 ], "state": "active+clean" }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	bs := mustGetCurrentBackfillState()
+
+	var buf bytes.Buffer
+	printStatus(&buf, bs, nil)
+	require.Equal(t, `OSD      LOCAL    REMOTE   SOURCE
+1        2        0        0
+4        0        1        0
+6        0        1        0
+3        0        0        1
+7        0        0        1
+`, buf.String())
+
+	// With explicit OSDs, idle ones are shown too.
+	buf.Reset()
+	printStatus(&buf, bs, []int{8, 6})
+	require.Equal(t, `OSD      LOCAL    REMOTE   SOURCE
+6        0        1        0
+8        0        0        0
+`, buf.String())
+}
 
-			M = mustGetCurrentMappingState()
-			M.bs.maxBackfillsFrom = maxSourceBackfills
-			calcPgMappingsToDrainOsd(
-				tt.allowMovementAcrossCrushType,
-				[]int{sourceOsd},
-				sliceToMap(tt.targetOsds),
-			)
+func TestSimulateFailure(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdPoolDetailOut := `
+[
+ { "pool_id": 1, "pool_name": "replicated", "erasure_code_profile": "", "min_size": 2 },
+ { "pool_id": 2, "pool_name": "ec", "erasure_code_profile": "ec21", "min_size": 3 }
+]
+`
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 4, 5, 6 ], "acting": [ 4, 5, 6 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 5 ], "acting": [ 1, 2, 6 ] },
+ { "pgid": "1.4", "up": [ 2, 3, 1 ], "acting": [ 2, 3, 1 ] },
+ { "pgid": "2.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 4 ] }
+]
+`
+	runOsdPoolLs = func() (string, error) { return osdPoolDetailOut, nil }
+	runECProfileGet = func(string) (string, error) { return `{ "k": "2", "m": "1" }`, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	var buf bytes.Buffer
+	simulateFailure(&buf, sliceToMap([]int{1, 2}))
+	require.Equal(t, `PGs affected by the failure:
+pg 1.1: acting [1,2,3] -> [NONE,NONE,3]: degraded+undersized+inactive (1/3 remaining)
+pg 1.3: acting [1,2,6] -> [NONE,NONE,6]: degraded+undersized+inactive (1/3 remaining)
+pg 1.4: acting [2,3,1] -> [NONE,3,NONE]: degraded+undersized+inactive (1/3 remaining)
+pg 2.1: acting [1,2,4] -> [NONE,NONE,4]: degraded+undersized+inactive, UNRECOVERABLE (1/3 remaining)
+4 PG(s) degraded, 4 inactive, 1 unrecoverable
+
+Recovery primaries once the failed OSDs are marked out:
+OSD      PGS
+3        2
+6        1
+`, buf.String())
+
+	buf.Reset()
+	simulateFailure(&buf, sliceToMap([]int{6}))
+	require.Equal(t, `PGs affected by the failure:
+pg 1.2: acting [4,5,6] -> [4,5,NONE]: degraded+undersized (2/3 remaining)
+pg 1.3: acting [1,2,6] -> [1,2,NONE]: degraded+undersized (2/3 remaining)
+  in-flight backfill 6->5 would be interrupted
+2 PG(s) degraded, 0 inactive, 0 unrecoverable
+
+Recovery primaries once the failed OSDs are marked out:
+OSD      PGS
+1        1
+4        1
+`, buf.String())
+}
 
-			validateDirtyMappings(t, tt.expected)
-		})
-	}
+func TestPendingBackfills(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "active+remapped+backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ], "state": "active+clean" },
+ { "pgid": "1.3", "up": [ 5, 6, 7 ], "acting": [ 2, 6, 8 ], "state": "active+remapped" }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	var buf bytes.Buffer
+	require.NoError(t, json.NewEncoder(&buf).Encode(pendingBackfills(mustGetCurrentBackfillState())))
+	require.JSONEq(t, `[
+ { "pgid": "1.1", "state": "active+remapped+backfill_wait", "backfills": [ { "from": 3, "to": 4 } ] },
+ { "pgid": "1.3", "state": "active+remapped", "backfills": [ { "from": 2, "to": 5 }, { "from": 8, "to": 7 } ] }
+]`, buf.String())
 }
 
 func sliceToMap(slice []int) map[int]struct{} {
@@ -889,7 +3591,7 @@ func TestParseMaxBackfillReservations(t *testing.T) {
 	runPgDumpPgsBrief = func() (string, error) { return "{}", nil }
 
 	cmd := &cobra.Command{}
-	cmd.Flags().StringSlice("max-backfill-reservations", []string{"4", "bucket:host1:10", "133:6"}, "")
+	cmd.Flags().StringSlice("max-backfill-reservations", []string{"4", "bucket:host1:10", "133:6", "pool:rbd:2"}, "")
 
 	M = mustGetCurrentMappingState()
 	mustParseMaxBackfillReservations(cmd)
@@ -898,6 +3600,186 @@ func TestParseMaxBackfillReservations(t *testing.T) {
 	// 'out' OSDs are excluded from osdspecs.
 	require.Equal(t, 4, M.bs.getMaxBackfillReservations(2))
 	require.Equal(t, 6, M.bs.getMaxBackfillReservations(133))
+	require.Equal(t, map[int]int{2: 2}, M.bs.poolMaxBackfillReservations)
+}
+
+func TestParseMaxBackfillReservationsDeviceClass(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    {
+      "children": [ 0, 1, 2 ],
+      "type": "host",
+      "name": "host1",
+      "id": -4
+    },
+    { "type": "osd", "name": "osd.0", "id": 0, "reweight": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.1", "id": 1, "reweight": 1, "device_class": "nvme" },
+    { "type": "osd", "name": "osd.2", "id": 2, "reweight": 1, "device_class": "hdd" }
+  ]
+}
+`
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return "{}", nil }
+
+	cmd := &cobra.Command{}
+	cmd.Flags().StringSlice("max-backfill-reservations", []string{"4", "class:hdd:2", "class:nvme:8", "2:3"}, "")
+
+	M = mustGetCurrentMappingState()
+	mustParseMaxBackfillReservations(cmd)
+
+	require.Equal(t, 2, M.bs.getMaxBackfillReservations(0))
+	require.Equal(t, 8, M.bs.getMaxBackfillReservations(1))
+	// Later specifiers override earlier ones.
+	require.Equal(t, 3, M.bs.getMaxBackfillReservations(2))
+	require.Equal(t, 4, M.bs.getMaxBackfillReservations(3))
+}
+
+func TestGetAutoTargetOsds(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    {
+      "children": [ 0, 1, 2, 3, 4, 5 ],
+      "type": "host",
+      "name": "host1",
+      "id": -4
+    },
+    { "type": "osd", "name": "osd.0", "id": 0, "reweight": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.1", "id": 1, "reweight": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.2", "id": 2, "reweight": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.3", "id": 3, "reweight": 0, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.4", "id": 4, "reweight": 1, "device_class": "nvme" },
+    { "type": "osd", "name": "osd.5", "id": 5, "reweight": 1, "device_class": "hdd" }
+  ]
+}
+`
+	osdDfOut := `
+{
+  "nodes": [
+    { "id": 0, "reweight": 1, "utilization": 85.2 },
+    { "id": 1, "reweight": 1, "utilization": 40.1 },
+    { "id": 2, "reweight": 1, "utilization": 80.0 },
+    { "id": 3, "reweight": 0, "utilization": 0 },
+    { "id": 4, "reweight": 1, "utilization": 10.5 },
+    { "id": 5, "reweight": 1, "utilization": 79.9 }
+  ]
+}
+`
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runOsdDf = func() (string, error) { return osdDfOut, nil }
+
+	// osd.2 is at the threshold, osd.3 is out, and osd.4 is of another
+	// device class. The source OSD is too full to be selected.
+	require.Equal(t, map[int]struct{}{1: {}, 5: {}}, getAutoTargetOsds([]int{0}, 0.8))
+	require.Equal(t, map[int]struct{}{1: {}}, getAutoTargetOsds([]int{0}, 0.5))
+}
+
+func TestGetCrushRuleCandidates(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdTreeOut := `
+{
+  "nodes": [
+    { "id": -1, "name": "default", "type": "root", "children": [ -2, -3 ] },
+    { "id": -2, "name": "host1", "type": "host", "children": [ 0, 1, 2 ] },
+    { "id": -3, "name": "host2", "type": "host", "children": [ 3, 4 ] },
+    { "id": -4, "name": "other", "type": "root", "children": [ -5 ] },
+    { "id": -5, "name": "host3", "type": "host", "children": [ 5 ] },
+    { "type": "osd", "name": "osd.0", "id": 0, "reweight": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.1", "id": 1, "reweight": 1, "device_class": "nvme" },
+    { "type": "osd", "name": "osd.2", "id": 2, "reweight": 0, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.3", "id": 3, "reweight": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.4", "id": 4, "reweight": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.5", "id": 5, "reweight": 1, "device_class": "hdd" }
+  ]
+}
+`
+	rules := map[string]string{
+		"replicated_hdd": `
+{
+  "rule_id": 1,
+  "rule_name": "replicated_hdd",
+  "steps": [
+    { "op": "take", "item": -6, "item_name": "default~hdd" },
+    { "op": "chooseleaf_firstn", "num": 0, "type": "host" },
+    { "op": "emit" }
+  ]
+}
+`,
+		"ec_osd": `
+{
+  "rule_id": 2,
+  "rule_name": "ec_osd",
+  "steps": [
+    { "op": "set_chooseleaf_tries", "num": 5 },
+    { "op": "take", "item": -1, "item_name": "default" },
+    { "op": "choose_indep", "num": 0, "type": "osd" },
+    { "op": "emit" }
+  ]
+}
+`,
+	}
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runCrushRuleDump = func(rule string) (string, error) { return rules[rule], nil }
+
+	// osd.1 is of another device class, osd.2 is out, and osd.5 is under
+	// another root.
+	osds, failureDomain, ruleID := mustGetCrushRuleCandidates("replicated_hdd")
+	require.Equal(t, map[int]struct{}{0: {}, 3: {}, 4: {}}, osds)
+	require.Equal(t, "host", failureDomain)
+	require.Equal(t, 1, ruleID)
+
+	osds, failureDomain, ruleID = mustGetCrushRuleCandidates("ec_osd")
+	require.Equal(t, map[int]struct{}{0: {}, 1: {}, 3: {}, 4: {}}, osds)
+	require.Equal(t, "osd", failureDomain)
+	require.Equal(t, 2, ruleID)
+}
+
+func TestCalcPgMappingsToDrainOsdCrushRuleFilter(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	// The rule takes the whole host, regardless of device class.
+	osdTreeOut := `
+{
+  "nodes": [
+    { "id": -1, "name": "host1", "type": "host", "children": [ 0, 1, 2 ] },
+    { "type": "osd", "name": "osd.0", "id": 0, "reweight": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.1", "id": 1, "reweight": 1, "device_class": "hdd" },
+    { "type": "osd", "name": "osd.2", "id": 2, "reweight": 1, "device_class": "ssd" }
+  ]
+}
+`
+	// 2.1's pool uses another rule, so it must not be drained onto this
+	// rule's OSDs.
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 0 ], "acting": [ 0 ] },
+ { "pgid": "2.1", "up": [ 0 ], "acting": [ 0 ] }
+]
+`
+	runOsdPoolLs = func() (string, error) {
+		return `[ { "pool_id": 1, "pool_name": "a", "crush_rule": 0 }, { "pool_id": 2, "pool_name": "b", "crush_rule": 1 } ]`, nil
+	}
+	runOsdTree = func() (string, error) { return osdTreeOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	require.Equal(t, 1, countPgsNotUsingCrushRule([]int{0}, 0))
+
+	M = mustGetCurrentMappingState()
+	M.bs.maxBackfillsFrom = 10
+	M.bs.maxBackfillReservations = 10
+	M.drainFilter = crushRuleMappingFilter(0)
+	calcPgMappingsToDrainOsd(M, "", false, []int{0}, sliceToMap([]int{1, 2}), 0)
+
+	// osd.2 is of another device class than the source.
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 0, To: 1, dirty: true}}},
+	})
 }
 
 func TestDeviceClassFilter(t *testing.T) {
@@ -940,7 +3822,7 @@ func TestDeviceClassFilter(t *testing.T) {
 		[]int{9, 10, 11})
 }
 
-func setupTest(t *testing.T) {
+func setupTest(t testing.TB) {
 	// By default, report all pools we use as replicated; if there are EC
 	// tests, they can override this implementation.
 	osdPoolDetailout := `
@@ -954,17 +3836,53 @@ func setupTest(t *testing.T) {
 
 	// We only need the upmap items from this; default to empty.
 	runOsdDump = func() (string, error) { return "{}", nil }
+
+	// No OSD usage by default.
+	runOsdDf = func() (string, error) { return `{ "nodes": [] }`, nil }
+
+	// No PG sizes by default.
+	runPgDumpPgs = func() (string, error) { return "[]", nil }
+
+	// No OSD denylist or upmap provenance by default, and provenance
+	// updates are discarded.
+	runConfigKeyGet = func(key string) (string, error) {
+		return "", fmt.Errorf("Error ENOENT: error obtaining '%s': (2) No such file or directory", key)
+	}
+	runConfigKeySet = func(key, value string) (string, error) { return "", nil }
 }
 
-func teardownTest(t *testing.T) {
+func teardownTest(t testing.TB) {
+	freezeFlagsVerified = false
+	quiet = false
+	suppressedWarnings = 0
 	savedOsdDumpOut = nil
 	savedOsdPoolsDetails = nil
 	savedParsedOsdTree = nil
+	savedRawPgDumpPgsBrief = nil
 	savedPgDumpPgsBrief = nil
+	savedPgBytes = nil
+	savedOsdDf = nil
 
 	runOsdDump = nil
 	runOsdPoolLs = nil
 	runOsdTree = nil
 	runPgDumpPgsBrief = nil
 	runPgQuery = nil
+	runPgDumpPgs = nil
+	runCrushCmp = nil
+	runCrushExport = nil
+	runCrushDecompile = nil
+	runConfigKeyGet = nil
+	runConfigKeySet = nil
+	runConfigDump = nil
+	runOsdGetmap = nil
+	runOsdmaptoolTestMapPgs = nil
+	runOsdDf = nil
+	runStatus = nil
+	runCrushRuleDump = nil
+	runECProfileGet = nil
+	runPgUpmapItems = nil
+	runRmPgUpmapItems = nil
+	runOsdUnset = nil
+	runBalancerOn = nil
 }
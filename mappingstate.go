@@ -16,11 +16,15 @@ package main
 
 import (
 	"fmt"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fatih/color"
+	"github.com/pkg/errors"
 )
 
 // changeStateType determines if changes can and should happen
@@ -35,19 +39,67 @@ const (
 	ChangesPending
 )
 
+func (c changeStateType) String() string {
+	switch c {
+	case NoChange:
+		return "no_change"
+	case NoReservationAvailable:
+		return "no_reservation_available"
+	case ChangesPending:
+		return "changes_pending"
+	}
+	return fmt.Sprintf("unknown(%d)", int(c))
+}
+
 type mappingState struct {
 	pgUpmapItems []*pgUpmapItem // This is always sorted for predictability and repeatability.
 	bs           *backfillState
 	changeState  changeStateType
+	// The number of backfills in the cluster before any changes were
+	// made, and whether the changes have been applied.
+	initialBackfills int
+	applied          bool
+	// Per-OSD backfill counts before any changes were made.
+	initialCounts map[int]osdBackfillCounts
+	// The effective mappings of each PG before any changes were made.
+	originalMappings map[string][]mapping
+	// The maximum number of mappings allowed in a PG's upmap item when
+	// adding a new mapping; 0 means no limit.
+	maxMappingsPerPg int
+	// If set, refuse to remap PGs that are being scrubbed.
+	skipScrubbingPgs bool
+	// OSDs that must never be the source or target of a remap, from the
+	// cluster-wide denylist.
+	deniedOsds map[int]struct{}
+	// The maximum number of PGs per pool to move in this run; 0 means no
+	// limit. The PGs moved so far are tracked by pool.
+	maxPgsPerPool  int
+	pgsMovedByPool map[int]map[string]struct{}
+	// The maximum fraction of each pool's PGs to move in this run; 0
+	// means no limit. Pool PG counts are taken from the PG dump.
+	maxPoolMoveFraction float64
+	poolPgCounts        map[int]int
+	// OSDs that must not become the primary of any more PGs, though they
+	// may still be remapped to as non-primaries.
+	noPrimaryOsds map[int]struct{}
+	// If set, drain only considers the candidate mappings this accepts,
+	// e.g. those allowed by the CRUSH rule given with --target-from-rule.
+	drainFilter func(pgMapping) bool
+	// How to choose among candidate targets when remapping.
+	targetPolicy targetPolicy
+	// The number of candidate remaps passed over because no backfill
+	// reservation was available.
+	reservationBlocked int
+	// Pools whose changes are applied first, in the given order.
+	poolPriority []int
 
 	l sync.Mutex
 }
 
-func updateChangeState(wantedState changeStateType) changeStateType {
-	if wantedState > M.changeState {
-		return wantedState
+func (m *mappingState) updateChangeState(wantedState changeStateType) {
+	if wantedState > m.changeState {
+		m.changeState = wantedState
 	}
-	return M.changeState
 }
 
 func mustGetCurrentMappingState() *mappingState {
@@ -55,24 +107,28 @@ func mustGetCurrentMappingState() *mappingState {
 	items := osdDumpOut.PgUpmapItems
 	sort.Slice(items, func(i, j int) bool { return items[i].PgID < items[j].PgID })
 	sanitizeStaleUpmaps(items)
+	originalMappings := make(map[string][]mapping, len(items))
+	for _, pui := range items {
+		originalMappings[pui.PgID] = append([]mapping{}, pui.Mappings...)
+	}
+	bs := mustGetCurrentBackfillState()
 	return &mappingState{
-		pgUpmapItems: osdDumpOut.PgUpmapItems,
-		bs:           mustGetCurrentBackfillState(),
+		pgUpmapItems:     osdDumpOut.PgUpmapItems,
+		bs:               bs,
+		initialBackfills: bs.backfills,
+		initialCounts:    bs.snapshotCounts(),
+		originalMappings: originalMappings,
+		maxMappingsPerPg: maxMovesPerPg,
+		skipScrubbingPgs: skipScrubbingPgs,
+		deniedOsds:       getDeniedOsds(),
+		pgsMovedByPool:   make(map[int]map[string]struct{}),
+		targetPolicy:     &leastBusyTargetPolicy{bs: bs},
 	}
 }
 
 func sanitizeStaleUpmaps(puis []*pgUpmapItem) {
 	pgBriefs := pgBriefMap()
 
-	hasOSD := func(osdids []int, osdid int) bool {
-		for _, otherOSDID := range osdids {
-			if osdid == otherOSDID {
-				return true
-			}
-		}
-		return false
-	}
-
 	for _, pui := range puis {
 		pgBrief, ok := pgBriefs[pui.PgID]
 		if !ok {
@@ -81,7 +137,7 @@ func sanitizeStaleUpmaps(puis []*pgUpmapItem) {
 
 		finalMappings := []mapping{}
 		for _, m := range pui.Mappings {
-			if hasOSD(pgBrief.Up, m.From) || !hasOSD(pgBrief.Up, m.To) {
+			if staleMappingReason(pgBrief.Up, m) != "" {
 				// This mapping has no effect on the PG and is
 				// thus stale, but Ceph hasn't cleaned it up.
 				// It will get in the way of our own decision
@@ -99,10 +155,38 @@ func sanitizeStaleUpmaps(puis []*pgUpmapItem) {
 	}
 }
 
+// staleMappingReason returns why the given mapping has no effect on a PG with
+// the given up set, or "" if it isn't stale.
+func staleMappingReason(up []int, mp mapping) string {
+	if mp.From == mp.To {
+		return fmt.Sprintf("it maps osd %d to itself", mp.From)
+	}
+	if slices.Contains(up, mp.From) {
+		return fmt.Sprintf("from osd %d is still in the up set %v", mp.From, up)
+	}
+	if !slices.Contains(up, mp.To) {
+		return fmt.Sprintf("to osd %d is not in the up set %v", mp.To, up)
+	}
+	return ""
+}
+
 func (m *mappingState) tryRemap(pgid string, from, to int) error {
 	m.l.Lock()
 	defer m.l.Unlock()
 
+	if m.isSkippedForScrub(pgid) {
+		return fmt.Errorf("pg %s: currently scrubbing; refusing to remap %d->%d", pgid, from, to)
+	}
+	for _, osd := range []int{from, to} {
+		if m.isDeniedOsd(osd) {
+			return fmt.Errorf("pg %s: osd %d is on the denylist (config-key %s); refusing to remap %d->%d", pgid, osd, deniedOsdsConfigKey, from, to)
+		}
+	}
+
+	if m.makesNoPrimaryOsdPrimary(pgid, from, to) {
+		return fmt.Errorf("pg %s: osd %d must not become a primary (--no-primary-osds); refusing to remap %d->%d", pgid, to, from, to)
+	}
+
 	pui := m.findOrMakeUpmapItem(pgid)
 	for _, m := range pui.Mappings {
 		if m.From == from && m.To == to {
@@ -111,8 +195,22 @@ func (m *mappingState) tryRemap(pgid string, from, to int) error {
 		}
 	}
 
+	if m.exceedsMaxMappings(pui, from) {
+		return fmt.Errorf("pg %s: upmap item already has %d mappings (more than %d); refusing to add mapping %d->%d", pgid, len(pui.Mappings), m.maxMappingsPerPg, from, to)
+	}
+
+	// Check for conflicts before making any changes, so that a failed
+	// remap leaves no trace.
+	if mp, ok := findConflictingMapping(pui.Mappings, from, to); ok {
+		return fmt.Errorf("pg %s: conflicting mapping %d->%d found when trying to map %d->%d", pgid, mp.From, mp.To, from, to)
+	}
+	if err := m.checkECShardOrder(pui, from, to); err != nil {
+		return err
+	}
+
 	pui.dirty = true
 	m.changeState = ChangesPending
+	m.recordPgMoved(pgid)
 
 	for i, mp := range pui.Mappings {
 		if mp.From == to && mp.To == from {
@@ -132,9 +230,6 @@ func (m *mappingState) tryRemap(pgid string, from, to int) error {
 			m.bs.accountForRemap(pgid, from, to)
 			return nil
 		}
-		if mp.From == to || mp.From == from || mp.To == to {
-			return fmt.Errorf("pg %s: conflicting mapping %d->%d found when trying to map %d->%d", pgid, mp.From, mp.To, from, to)
-		}
 	}
 
 	// No existing mapping was found; add a new one.
@@ -143,6 +238,250 @@ func (m *mappingState) tryRemap(pgid string, from, to int) error {
 	return nil
 }
 
+// checkECShardOrder returns an error if remapping from -> to in the given
+// upmap item's PG, if it is in an EC pool, would move a shard onto an OSD that
+// already holds a different shard of the PG. Shard order matters in EC pools,
+// so such a mapping would either be rejected by Ceph or cause unintended
+// backfill. Removing an existing mapping is always allowed, since it restores
+// CRUSH's placement.
+func (m *mappingState) checkECShardOrder(pui *pgUpmapItem, from, to int) error {
+	pool, ok := osdPoolDetails().Pools[pgPoolID(pui.PgID)]
+	if !ok || pool.ECProfile == "" {
+		return nil
+	}
+	for _, mp := range pui.Mappings {
+		if mp.From == to && mp.To == from {
+			return nil
+		}
+	}
+	pgb, ok := m.bs.pgbs[pui.PgID]
+	if !ok {
+		return nil
+	}
+
+	fromIdx, toIdx := slices.Index(pgb.Up, from), slices.Index(pgb.Up, to)
+	if toIdx >= 0 && toIdx != fromIdx {
+		return fmt.Errorf("pg %s: osd %d already holds shard %d of this EC PG; refusing to remap %d->%d, which would reorder its shards", pui.PgID, to, toIdx, from, to)
+	}
+	return nil
+}
+
+// findConflictingMapping returns the mapping, if any, that prevents the given
+// mappings from being changed to map from -> to.
+func findConflictingMapping(mappings []mapping, from, to int) (mapping, bool) {
+	for _, mp := range mappings {
+		if mp.To == from {
+			// Handled by removal or modification.
+			break
+		}
+		if mp.From == to || mp.From == from || mp.To == to {
+			return mp, true
+		}
+	}
+	return mapping{}, false
+}
+
+// currentMappings returns a copy of the given PG's current mappings.
+func (m *mappingState) currentMappings(pgid string) []mapping {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	return append([]mapping(nil), m.findOrMakeUpmapItem(pgid).Mappings...)
+}
+
+// exceedsMaxMappings returns true if remapping the given upmap item from the
+// given OSD would require adding a new mapping to an upmap item that already
+// has more than the maximum number of mappings. Modifying or removing an
+// existing mapping is always allowed.
+func (m *mappingState) exceedsMaxMappings(pui *pgUpmapItem, from int) bool {
+	if m.maxMappingsPerPg <= 0 || len(pui.Mappings) <= m.maxMappingsPerPg {
+		return false
+	}
+	for _, mp := range pui.Mappings {
+		if mp.To == from {
+			return false
+		}
+	}
+	return true
+}
+
+// isDeniedOsd returns true if the given OSD is on the cluster-wide denylist.
+func (m *mappingState) isDeniedOsd(osd int) bool {
+	_, ok := m.deniedOsds[osd]
+	return ok
+}
+
+// makesNoPrimaryOsdPrimary returns true if remapping the given PG would put
+// an OSD that must not become a primary at the head of the PG's up set, i.e.
+// make it the PG's primary once backfill completes.
+func (m *mappingState) makesNoPrimaryOsdPrimary(pgid string, from, to int) bool {
+	if _, ok := m.noPrimaryOsds[to]; !ok {
+		return false
+	}
+	pgb, ok := m.bs.pgbs[pgid]
+	if !ok {
+		return false
+	}
+	for _, osd := range pgb.Up {
+		if osd != invalidOSD {
+			return osd == from
+		}
+	}
+	return false
+}
+
+// isSkippedForScrub returns true if the PG is being scrubbed and we've been
+// asked to leave such PGs alone.
+func (m *mappingState) isSkippedForScrub(pgid string) bool {
+	if !m.skipScrubbingPgs {
+		return false
+	}
+	pgb, ok := m.bs.pgbs[pgid]
+	return ok && pgb.isScrubbing()
+}
+
+// pgPoolID returns the ID of the pool the given PG belongs to, panicking if
+// the PGID can't be parsed.
+func pgPoolID(pgid string) int {
+	pool, err := parsePgPoolID(pgid)
+	if err != nil {
+		panic(err.Error())
+	}
+	return pool
+}
+
+// parsePgPoolID is pgPoolID for PGIDs that may not be valid.
+func parsePgPoolID(pgid string) (int, error) {
+	match := pgIdRegexp.FindStringSubmatch(pgid)
+	if len(match) != 3 {
+		return 0, fmt.Errorf("can't parse PGID %s", pgid)
+	}
+	pool, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, fmt.Errorf("can't parse pool in PGID %s", pgid)
+	}
+	return pool, nil
+}
+
+func (m *mappingState) recordPgMoved(pgid string) {
+	pool := pgPoolID(pgid)
+	if _, ok := m.pgsMovedByPool[pool]; !ok {
+		m.pgsMovedByPool[pool] = make(map[string]struct{})
+	}
+	m.pgsMovedByPool[pool][pgid] = struct{}{}
+}
+
+func (m *mappingState) setMaxPoolMoveFraction(fraction float64) {
+	m.maxPoolMoveFraction = fraction
+	m.poolPgCounts = make(map[int]int)
+	for pgid := range m.bs.pgbs {
+		m.poolPgCounts[pgPoolID(pgid)]++
+	}
+}
+
+// poolMoveLimit returns the number of PGs allowed to be moved in the given
+// pool, per --max-pgs-per-pool and --max-pool-move-fraction, or -1 if there
+// is no limit.
+func (m *mappingState) poolMoveLimit(pool int) int {
+	limit := -1
+	if m.maxPgsPerPool > 0 {
+		limit = m.maxPgsPerPool
+	}
+	if m.maxPoolMoveFraction > 0 {
+		fractionLimit := int(m.maxPoolMoveFraction * float64(m.poolPgCounts[pool]))
+		if limit < 0 || fractionLimit < limit {
+			limit = fractionLimit
+		}
+	}
+	return limit
+}
+
+// exceedsMaxPgsPerPool returns true if moving the given PG would exceed the
+// number of PGs allowed to be moved in its pool. PGs that have already been
+// moved may be moved further.
+func (m *mappingState) exceedsMaxPgsPerPool(pgid string) bool {
+	pool := pgPoolID(pgid)
+	limit := m.poolMoveLimit(pool)
+	if limit < 0 {
+		return false
+	}
+	moved := m.pgsMovedByPool[pool]
+	if _, ok := moved[pgid]; ok {
+		return false
+	}
+	return len(moved) >= limit
+}
+
+// hasRoomForMapping returns true if the given remap wouldn't exceed the
+// maximum number of mappings allowed for the PG or the maximum number of PGs
+// to move in its pool, and the PG isn't excluded due to an ongoing scrub.
+func (m *mappingState) hasRoomForMapping(pgid string, from int) bool {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	if m.isSkippedForScrub(pgid) || m.exceedsMaxPgsPerPool(pgid) {
+		return false
+	}
+
+	puis := m.pgUpmapItems
+	i := sort.Search(len(puis), func(i int) bool { return puis[i].PgID >= pgid })
+	if i < len(puis) && puis[i].PgID == pgid {
+		return !m.exceedsMaxMappings(puis[i], from)
+	}
+	return true
+}
+
+// pgSnapshot is the state of a PG's upmap item and of its effect on backfill,
+// saved so that a sequence of remaps can be reverted if a later one fails.
+type pgSnapshot struct {
+	pui   pgUpmapItem
+	up    []int
+	moved bool
+}
+
+func (m *mappingState) snapshotPg(pgid string) pgSnapshot {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	pui := m.findOrMakeUpmapItem(pgid)
+	s := pgSnapshot{
+		pui: pgUpmapItem{
+			PgID:            pgid,
+			Mappings:        slices.Clone(pui.Mappings),
+			removedMappings: slices.Clone(pui.removedMappings),
+			staleMappings:   slices.Clone(pui.staleMappings),
+			dirty:           pui.dirty,
+		},
+	}
+	if pgb, ok := m.bs.pgbs[pgid]; ok {
+		s.up = slices.Clone(pgb.Up)
+	}
+	_, s.moved = m.pgsMovedByPool[pgPoolID(pgid)][pgid]
+	return s
+}
+
+// restorePg reverts the given PG to a snapshot taken by snapshotPg.
+func (m *mappingState) restorePg(s pgSnapshot) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	pgid := s.pui.PgID
+	*m.findOrMakeUpmapItem(pgid) = s.pui
+	if pgb, ok := m.bs.pgbs[pgid]; ok {
+		m.bs.removeReservations(pgb)
+		pgb.Up = slices.Clone(s.up)
+		m.bs.addReservations(pgb)
+	}
+	if !s.moved {
+		delete(m.pgsMovedByPool[pgPoolID(pgid)], pgid)
+	}
+	// Other PGs may have been changed concurrently since the snapshot, so
+	// the change state is only lowered if nothing is left to apply.
+	if m.changeState == ChangesPending && !slices.ContainsFunc(m.pgUpmapItems, func(pui *pgUpmapItem) bool { return pui.dirty }) {
+		m.changeState = NoChange
+	}
+}
+
 func (m *mappingState) mustRemap(pgid string, from, to int) {
 	err := m.tryRemap(pgid, from, to)
 	if err != nil {
@@ -169,6 +508,45 @@ func (m *mappingState) findOrMakeUpmapItem(pgid string) *pgUpmapItem {
 	return pui
 }
 
+// cleanUpmapItem removes stale mappings and mappings from an OSD to itself
+// from the given PG's upmap item. If the PG's pool no longer exists, the whole
+// upmap item is removed. A PG that exists but is missing from the backfill
+// state, e.g. because its up and acting sets were inconsistent, is left alone,
+// since nothing can be said about its mappings.
+func (m *mappingState) cleanUpmapItem(pgid string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	pui := m.findOrMakeUpmapItem(pgid)
+	if _, ok := m.bs.pgbs[pgid]; !ok {
+		if _, ok := osdPoolDetails().Pools[pgPoolID(pgid)]; ok {
+			return
+		}
+		for _, mp := range pui.Mappings {
+			mp.dirty = true
+			pui.removedMappings = append(pui.removedMappings, mp)
+		}
+		pui.Mappings = nil
+	}
+
+	finalMappings := []mapping{}
+	for _, mp := range pui.Mappings {
+		if mp.From == mp.To {
+			mp.dirty = true
+			pui.removedMappings = append(pui.removedMappings, mp)
+			continue
+		}
+		finalMappings = append(finalMappings, mp)
+	}
+	pui.Mappings = finalMappings
+
+	// Stale mappings are already excluded from pui.Mappings; marking the
+	// item dirty is enough to have them removed.
+	pui.dirty = true
+	m.changeState = ChangesPending
+	m.recordPgMoved(pgid)
+}
+
 type mappingFilter func(*pgUpmapItem, mapping) bool
 
 func withPgid(pgid string) mappingFilter {
@@ -177,6 +555,13 @@ func withPgid(pgid string) mappingFilter {
 	}
 }
 
+func withPools(pools map[int]struct{}) mappingFilter {
+	return func(pui *pgUpmapItem, _ mapping) bool {
+		_, ok := pools[pgPoolID(pui.PgID)]
+		return ok
+	}
+}
+
 func withFrom(from int) mappingFilter {
 	return func(_ *pgUpmapItem, m mapping) bool {
 		return m.From == from
@@ -189,6 +574,16 @@ func withTo(to int) mappingFilter {
 	}
 }
 
+// withAnyOsd matches mappings that match f for any of the given OSDs, e.g.
+// withAnyOsd(osds, withFrom).
+func withAnyOsd(osds map[int]struct{}, f func(int) mappingFilter) mappingFilter {
+	filters := make([]mappingFilter, 0, len(osds))
+	for osd := range osds {
+		filters = append(filters, f(osd))
+	}
+	return mfOr(filters...)
+}
+
 func mfAnd(filters ...mappingFilter) mappingFilter {
 	return func(pui *pgUpmapItem, m mapping) bool {
 		for _, f := range filters {
@@ -225,8 +620,8 @@ func (m *mappingState) iterateMappings(f func(pgid string, mp mapping), filter m
 }
 
 type pgMapping struct {
-	PgID    string  `json:"pgid"`
-	Mapping mapping `json:"mapping"`
+	PgID    string  `json:"pgid" yaml:"pgid"`
+	Mapping mapping `json:"mapping" yaml:"mapping"`
 }
 
 func (m *mappingState) getMappings(filter mappingFilter) []pgMapping {
@@ -244,6 +639,47 @@ func (m *mappingState) getMappings(filter mappingFilter) []pgMapping {
 	return mappings
 }
 
+// getAllMappings is like getMappings, but also includes stale mappings, i.e.
+// it reflects the raw contents of the exception table.
+func (m *mappingState) getAllMappings(filter mappingFilter) []pgMapping {
+	mappings := m.getMappings(filter)
+
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	for _, pui := range m.pgUpmapItems {
+		for _, mp := range pui.staleMappings {
+			if filter(pui, mp) {
+				mp.dirty = false
+				mappings = append(mappings, pgMapping{
+					PgID:    pui.PgID,
+					Mapping: mp,
+				})
+			}
+		}
+	}
+
+	return mappings
+}
+
+// upmapItemCounts returns the number of upmap items in the cluster before any
+// changes were made, and the number there would be once the pending changes
+// are applied.
+func (m *mappingState) upmapItemCounts() (int, int) {
+	current := len(m.originalMappings)
+	projected := current
+	for _, pui := range m.dirtyUpmapItems() {
+		_, existed := m.originalMappings[pui.PgID]
+		switch {
+		case !existed && len(pui.Mappings) > 0:
+			projected++
+		case existed && len(pui.Mappings) == 0:
+			projected--
+		}
+	}
+	return current, projected
+}
+
 func (m *mappingState) dirtyUpmapItems() []*pgUpmapItem {
 	m.l.Lock()
 	defer m.l.Unlock()
@@ -258,27 +694,208 @@ func (m *mappingState) dirtyUpmapItems() []*pgUpmapItem {
 	return items
 }
 
+// pgTempConflicts returns the PG IDs of changed upmap items for PGs that have
+// a pg_temp entry. The acting set reported for such PGs is a temporary one
+// that may change out from under us as recovery progresses.
+func (m *mappingState) pgTempConflicts() []string {
+	pgTemps := pgTempMap()
+
+	var pgids []string
+	for _, pui := range m.dirtyUpmapItems() {
+		if _, ok := pgTemps[pui.PgID]; ok {
+			pgids = append(pgids, pui.PgID)
+		}
+	}
+	return pgids
+}
+
 func (m *mappingState) apply() {
+	puis := m.dirtyUpmapItems()
+	if planThenApply != "" {
+		// Apply exactly what was saved for review rather than what we
+		// have in memory.
+		puis = mustReadPlanFile(planThenApply)
+	}
+	if rollbackFile != "" {
+		mustWriteRollbackFile(rollbackFile, m.rollbackMappings(puis))
+	}
+	applied, err := applyUpmapItems(puis, m.poolPriority)
+	// With --input-dir, the commands were only printed.
+	m.applied = inputDir == ""
+	// Even if applying failed partway, record what was done.
+	if recordProvenance && m.applied && len(applied) > 0 {
+		m.recordUpmapProvenance(applied, time.Now())
+	}
+	if applyOutput != "" {
+		mustWriteApplyOutput(applyOutput, applied, m.applied)
+	}
+	if err != nil {
+		panic(errors.Wrapf(err, "applied %d of %d PG(s) before failing", len(applied), len(puis)))
+	}
+}
+
+// rollbackMappings returns the mappings that, when imported with
+// import-mappings, restore the given upmap items' PGs to their original state:
+// each PG's original mappings, followed by the reverse of any mappings that
+// were newly added, so that the import removes them.
+func (m *mappingState) rollbackMappings(puis []*pgUpmapItem) []pgMapping {
+	mappings := []pgMapping{}
+	for _, pui := range puis {
+		original := m.originalMappings[pui.PgID]
+		originalFroms := make(map[int]struct{}, len(original))
+		for _, mp := range original {
+			originalFroms[mp.From] = struct{}{}
+			mappings = append(mappings, pgMapping{PgID: pui.PgID, Mapping: mapping{From: mp.From, To: mp.To}})
+		}
+		for _, mp := range pui.Mappings {
+			if _, ok := originalFroms[mp.From]; !ok {
+				mappings = append(mappings, pgMapping{PgID: pui.PgID, Mapping: mapping{From: mp.To, To: mp.From}})
+			}
+		}
+	}
+	return mappings
+}
+
+// applyUpmapItems sets the given upmap items in the exception table, those in
+// the given pools first, in pool priority order, and returns those that were
+// applied, i.e. not skipped per the journal. If an item fails to apply, no
+// more are started, and those applied so far are returned with the error.
+func applyUpmapItems(puis []*pgUpmapItem, poolPriority []int) ([]*pgUpmapItem, error) {
+	// Each PG's mappings must be set in a single command; if a PG were to
+	// appear more than once, concurrent commands could race and leave a
+	// partial update in place.
+	seen := make(map[string]struct{}, len(puis))
+	for _, pui := range puis {
+		if _, ok := seen[pui.PgID]; ok {
+			panic(fmt.Sprintf("pg %s: appears more than once in the changes to apply", pui.PgID))
+		}
+		seen[pui.PgID] = struct{}{}
+	}
+
+	if len(poolPriority) > 0 {
+		poolRank := poolPriorityRank(poolPriority)
+		puis = slices.Clone(puis)
+		sort.SliceStable(puis, func(i, j int) bool { return poolRank(puis[i].PgID) < poolRank(puis[j].PgID) })
+	}
+
+	// With --input-dir, the commands are only printed, so there's nothing
+	// to journal.
+	var j *journal
+	if journalFile != "" && inputDir == "" {
+		j = mustOpenJournal(journalFile, puis)
+		defer j.Close()
+
+		pending := j.pending(puis)
+		if skipped := len(puis) - len(pending); skipped > 0 {
+			fmt.Printf("Skipping %d PG(s) already applied per journal %s\n", skipped, journalFile)
+		}
+		puis = pending
+	}
+
+	batchSize := len(puis)
+	if applyBatchSize > 0 {
+		batchSize = applyBatchSize
+	}
+	applied := make([]*pgUpmapItem, 0, len(puis))
+	for start := 0; start < len(puis); start += batchSize {
+		if start > 0 {
+			infof("Applied %d of %d PG(s); waiting %s before the next batch", start, len(puis), applyBatchDelay)
+			time.Sleep(applyBatchDelay)
+		}
+		batchApplied, err := applyUpmapItemsBatch(puis[start:min(start+batchSize, len(puis))], j)
+		applied = append(applied, batchApplied...)
+		if err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
+
+// applyUpmapItemsBatch applies the given upmap items with up to --concurrency
+// commands in flight, recording each in the given journal, if any. It returns
+// those applied, in order, and the first error, after which no more items are
+// started.
+func applyUpmapItemsBatch(puis []*pgUpmapItem, j *journal) ([]*pgUpmapItem, error) {
+	var (
+		l        sync.Mutex
+		firstErr error
+		done     = make([]bool, len(puis))
+	)
 	wg := sync.WaitGroup{}
-	ch := make(chan *pgUpmapItem)
+	ch := make(chan int)
 
 	for i := 0; i < concurrency; i++ {
 		wg.Add(1)
 		go func() {
-			for pui := range ch {
-				pui.do()
+			for i := range ch {
+				l.Lock()
+				failed := firstErr != nil
+				l.Unlock()
+				if failed {
+					continue
+				}
+
+				if err := puis[i].do(); err != nil {
+					l.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					l.Unlock()
+					continue
+				}
+				if j != nil {
+					j.mustRecord(puis[i])
+				}
+				done[i] = true
 			}
 
 			wg.Done()
 		}()
 	}
 
-	for _, pui := range m.dirtyUpmapItems() {
-		ch <- pui
+	for i := range puis {
+		ch <- i
 	}
 	close(ch)
 
 	wg.Wait()
+
+	applied := make([]*pgUpmapItem, 0, len(puis))
+	for i, pui := range puis {
+		if done[i] {
+			applied = append(applied, pui)
+		}
+	}
+	return applied, firstErr
+}
+
+// reviewString returns the pending changes as a deterministic, uncolored
+// block per PG showing its full upmap item before and after the changes,
+// suitable for checking into a ticket or reviewing as a diff.
+func (m *mappingState) reviewString() string {
+	fmtMappings := func(list []mapping) string {
+		list = append([]mapping{}, list...)
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].From != list[j].From {
+				return list[i].From < list[j].From
+			}
+			return list[i].To < list[j].To
+		})
+		strs := make([]string, len(list))
+		for i, mp := range list {
+			strs[i] = mp.String()
+		}
+		return "[" + strings.Join(strs, ",") + "]"
+	}
+
+	var b strings.Builder
+	for _, pui := range m.dirtyUpmapItems() {
+		before := append(append([]mapping{}, m.originalMappings[pui.PgID]...), pui.staleMappings...)
+		fmt.Fprintf(&b, "--- pg %s\n", pui.PgID)
+		fmt.Fprintf(&b, "before: %s\n", fmtMappings(before))
+		fmt.Fprintf(&b, "after:  %s\n", fmtMappings(pui.Mappings))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
 }
 
 func (m *mappingState) String() string {
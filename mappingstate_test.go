@@ -15,7 +15,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -26,7 +31,8 @@ func TestGetMappings(t *testing.T) {
 	pgDumpOut := `
 [
  { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" },
- { "pgid": "1.2", "up": [ 4, 5, 3 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" }
+ { "pgid": "1.2", "up": [ 4, 5, 3 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" },
+ { "pgid": "2.1", "up": [ 4, 7, 8 ], "acting": [ 4, 6, 8 ], "state": "backfill_wait" }
 ]
 `
 
@@ -34,7 +40,8 @@ func TestGetMappings(t *testing.T) {
 {
   "pg_upmap_items": [
     { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] },
-    { "pgid": "1.2", "mappings": [ { "from": 1, "to": 4 }, { "from": 2, "to": 5 } ] }
+    { "pgid": "1.2", "mappings": [ { "from": 1, "to": 4 }, { "from": 2, "to": 5 } ] },
+    { "pgid": "2.1", "mappings": [ { "from": 6, "to": 7 } ] }
   ]
 }
 `
@@ -90,6 +97,20 @@ func TestGetMappings(t *testing.T) {
 				{PgID: "1.2", Mapping: mapping{From: 2, To: 5}},
 			},
 		},
+		{
+			name:   "pools",
+			filter: withPools(map[int]struct{}{2: {}}),
+			expected: []pgMapping{
+				{PgID: "2.1", Mapping: mapping{From: 6, To: 7}},
+			},
+		},
+		{
+			name:   "and with pools",
+			filter: mfAnd(mfOr(withFrom(3), withTo(7)), withPools(map[int]struct{}{1: {}})),
+			expected: []pgMapping{
+				{PgID: "1.1", Mapping: mapping{From: 3, To: 4}},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -100,3 +121,504 @@ func TestGetMappings(t *testing.T) {
 		})
 	}
 }
+
+func TestGetAllMappings(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" }
+]
+`
+
+	// 5->6 is stale, since 6 isn't in the up set.
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 }, { "from": 5, "to": 6 } ] }
+  ]
+}
+`
+
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	require.ElementsMatch(t,
+		[]pgMapping{{PgID: "1.1", Mapping: mapping{From: 3, To: 4}}},
+		M.getMappings(withPgid("1.1")))
+	require.ElementsMatch(t,
+		[]pgMapping{
+			{PgID: "1.1", Mapping: mapping{From: 3, To: 4}},
+			{PgID: "1.1", Mapping: mapping{From: 5, To: 6}},
+		},
+		M.getAllMappings(withPgid("1.1")))
+}
+
+func TestAnnotateMappings(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 }, { "from": 5, "to": 6 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	out, err := json.Marshal(annotateMappings(M.getAllMappings(withPgid("1.1"))))
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+  { "pgid": "1.1", "mapping": { "from": 3, "to": 4 }, "state": "backfill_wait", "ec": false, "effective": true },
+  { "pgid": "1.1", "mapping": { "from": 5, "to": 6 }, "state": "backfill_wait", "ec": false, "effective": false }
+]`, string(out))
+
+	// Annotated output remains importable.
+	var mappings []pgMapping
+	require.NoError(t, json.Unmarshal(out, &mappings))
+	require.Equal(t, []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 3, To: 4}},
+		{PgID: "1.1", Mapping: mapping{From: 5, To: 6}},
+	}, mappings)
+}
+
+func TestPgTempConflicts(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" }
+]
+`
+
+	osdDumpOut := `
+{
+  "pg_upmap_items": [],
+  "pg_temp": [
+    { "pgid": "1.1", "osds": [ 1, 2, 3 ] },
+    { "pgid": "1.3", "osds": [ 5, 6, 7 ] }
+  ]
+}
+`
+
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	require.Empty(t, M.pgTempConflicts())
+
+	M.mustRemap("1.1", 4, 3)
+	M.mustRemap("1.2", 4, 3)
+	require.Equal(t, []string{"1.1"}, M.pgTempConflicts())
+}
+
+func TestMaxMappingsPerPg(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 4, 5, 3 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] }
+]
+`
+
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 1, "to": 4 }, { "from": 2, "to": 5 } ] }
+  ]
+}
+`
+
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.maxMappingsPerPg = 1
+
+	// An upmap item with more than the maximum may not grow.
+	require.False(t, M.hasRoomForMapping("1.1", 3))
+	require.Error(t, M.tryRemap("1.1", 3, 6))
+	// Modifying an existing mapping is fine.
+	require.True(t, M.hasRoomForMapping("1.1", 4))
+	require.NoError(t, M.tryRemap("1.1", 4, 7))
+
+	// An upmap item at exactly the maximum may still grow by one.
+	M.maxMappingsPerPg = 2
+	require.True(t, M.hasRoomForMapping("1.1", 3))
+	require.NoError(t, M.tryRemap("1.1", 3, 6))
+	require.False(t, M.hasRoomForMapping("1.1", 9))
+	require.Error(t, M.tryRemap("1.1", 9, 10))
+	// PGs with room are unaffected.
+	require.True(t, M.hasRoomForMapping("1.2", 3))
+	require.NoError(t, M.tryRemap("1.2", 3, 6))
+}
+
+func TestSkipScrubbingPgs(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ], "state": "active+clean+scrubbing+deep" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ], "state": "active+clean" }
+]
+`
+	runOsdDump = func() (string, error) { return "{}", nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	// Scrubbing PGs may be remapped by default.
+	M = mustGetCurrentMappingState()
+	require.True(t, M.hasRoomForMapping("1.1", 3))
+	require.NoError(t, M.tryRemap("1.1", 3, 6))
+
+	M = mustGetCurrentMappingState()
+	M.skipScrubbingPgs = true
+	require.False(t, M.hasRoomForMapping("1.1", 3))
+	require.Error(t, M.tryRemap("1.1", 3, 6))
+	require.True(t, M.hasRoomForMapping("1.2", 3))
+	require.NoError(t, M.tryRemap("1.2", 3, 6))
+}
+
+func TestDeniedOsds(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 4, 5, 6 ], "acting": [ 4, 5, 6 ] }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runConfigKeyGet = func(key string) (string, error) {
+		require.Equal(t, "pgremapper/denied-osds", key)
+		return "3,7\n9", nil
+	}
+
+	M = mustGetCurrentMappingState()
+	require.Equal(t, map[int]struct{}{3: {}, 7: {}, 9: {}}, M.deniedOsds)
+
+	// Denied OSDs may be neither the source nor the target of a remap.
+	require.Error(t, M.tryRemap("1.1", 3, 8))
+	require.Error(t, M.tryRemap("1.2", 6, 7))
+	require.NoError(t, M.tryRemap("1.2", 6, 8))
+
+	// Candidates involving denied OSDs are passed over.
+	m, ok := remapPgToPreferredTarget(M, []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 2, To: 9}},
+		{PgID: "1.1", Mapping: mapping{From: 2, To: 10}},
+	})
+	require.True(t, ok)
+	require.Equal(t, "1.1", m.PgID)
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 2, To: 10, dirty: true}}},
+		{ID: "1.2", Mappings: []mapping{{From: 6, To: 8, dirty: true}}},
+	})
+}
+
+func TestNoPrimaryOsds(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 4, 5, 6 ], "acting": [ 4, 5, 6 ] }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.noPrimaryOsds = map[int]struct{}{7: {}}
+
+	// 7 may not replace a primary, but may replace any other member.
+	require.Error(t, M.tryRemap("1.1", 1, 7))
+	require.NoError(t, M.tryRemap("1.1", 2, 7))
+
+	// Candidates that would make 7 a primary are passed over.
+	m, ok := remapPgToPreferredTarget(M, []pgMapping{
+		{PgID: "1.2", Mapping: mapping{From: 4, To: 7}},
+		{PgID: "1.2", Mapping: mapping{From: 4, To: 8}},
+	})
+	require.True(t, ok)
+	require.Equal(t, "1.2", m.PgID)
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: []mapping{{From: 2, To: 7, dirty: true}}},
+		{ID: "1.2", Mappings: []mapping{{From: 4, To: 8, dirty: true}}},
+	})
+}
+
+func TestReviewString(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 5 ], "acting": [ 1, 2, 5 ] },
+ { "pgid": "1.2", "up": [ 4, 5, 6 ], "acting": [ 4, 5, 6 ] },
+ { "pgid": "1.3", "up": [ 7, 8, 9 ], "acting": [ 7, 8, 9 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 5 }, { "from": 0, "to": 10 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.mustRemap("1.2", 6, 3)
+	M.mustRemap("1.1", 2, 0)
+
+	require.Equal(t, `--- pg 1.1
+before: [0->10,3->5]
+after:  [2->0,3->5]
+--- pg 1.2
+before: []
+after:  [6->3]`, M.reviewString())
+}
+
+func TestMaxPgsPerPool(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "2.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.maxPgsPerPool = 2
+
+	M.mustRemap("1.1", 3, 4)
+	require.True(t, M.hasRoomForMapping("1.2", 3))
+	M.mustRemap("1.2", 3, 4)
+	// Pool 1 is now at its limit, though PGs already moved may move
+	// further.
+	require.False(t, M.hasRoomForMapping("1.3", 3))
+	require.True(t, M.hasRoomForMapping("1.1", 2))
+	// Other pools are unaffected.
+	require.True(t, M.hasRoomForMapping("2.1", 3))
+}
+
+func TestMaxPoolMoveFraction(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.4", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "2.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.setMaxPoolMoveFraction(0.5)
+
+	M.mustRemap("1.1", 3, 4)
+	require.True(t, M.hasRoomForMapping("1.2", 3))
+	M.mustRemap("1.2", 3, 4)
+	// Half of pool 1's PGs have moved.
+	require.False(t, M.hasRoomForMapping("1.3", 3))
+	require.True(t, M.hasRoomForMapping("1.1", 2))
+	// Pool 2 has a single PG, half of which rounds down to none.
+	require.False(t, M.hasRoomForMapping("2.1", 3))
+
+	// The lower of the two limits applies.
+	M.maxPgsPerPool = 1
+	require.Equal(t, 1, M.poolMoveLimit(1))
+}
+
+func TestApplyGroupsMappingsByPg(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3, 4, 5, 6 ], "acting": [ 1, 2, 3, 4, 5, 6 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 3, 4, 5, 6 ], "acting": [ 1, 2, 3, 4, 5, 6 ] }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	var l sync.Mutex
+	var cmds []string
+	runPgUpmapItems = func(args ...string) (string, error) {
+		l.Lock()
+		defer l.Unlock()
+		cmds = append(cmds, strings.Join(args, " "))
+		return "", nil
+	}
+
+	M = mustGetCurrentMappingState()
+
+	// Build the plan concurrently.
+	wg := sync.WaitGroup{}
+	for _, pgid := range []string{"1.1", "1.2"} {
+		for from := 1; from <= 6; from++ {
+			wg.Add(1)
+			go func(pgid string, from int) {
+				defer wg.Done()
+				M.mustRemap(pgid, from, from+10)
+			}(pgid, from)
+		}
+	}
+	wg.Wait()
+
+	M.apply()
+
+	// Exactly one command per PG, containing all of its mappings.
+	require.Len(t, cmds, 2)
+	for _, cmd := range cmds {
+		require.Len(t, strings.Fields(cmd), 13)
+	}
+
+	// Duplicate PGs are refused.
+	pui := &pgUpmapItem{PgID: "1.1", Mappings: []mapping{{From: 1, To: 11}}}
+	require.Panics(t, func() { applyUpmapItems([]*pgUpmapItem{pui, pui}, nil) })
+}
+
+func TestECShardOrder(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	osdPoolDetailout := `
+[
+ { "pool_id": 1, "pool_name": "replicated", "erasure_code_profile": "" },
+ { "pool_id": 2, "pool_name": "ec", "erasure_code_profile": "ec21" }
+]
+`
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "2.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "2.2", "up": [ 4, 2, 3 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" }
+]
+`
+
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "2.2", "mappings": [ { "from": 1, "to": 4 } ] }
+  ]
+}
+`
+
+	runOsdPoolLs = func() (string, error) { return osdPoolDetailout, nil }
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runECProfileGet = func(string) (string, error) { return `{ "k": "2", "m": "1" }`, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+
+	// Moving a shard onto an OSD that holds another shard is refused.
+	err := M.tryRemap("2.1", 1, 2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already holds shard 1")
+	// Moving it to an OSD outside the up set is fine.
+	require.NoError(t, M.tryRemap("2.1", 1, 5))
+	// Removing an existing mapping is fine.
+	require.NoError(t, M.tryRemap("2.2", 4, 1))
+	// Replicated pools are unaffected.
+	require.NoError(t, M.tryRemap("1.1", 1, 2))
+}
+
+func TestApplyBatches(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func(n, c int, d time.Duration) { applyBatchSize, concurrency, applyBatchDelay = n, c, d }(applyBatchSize, concurrency, applyBatchDelay)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.4", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.5", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	var l sync.Mutex
+	var applied []string
+	runPgUpmapItems = func(args ...string) (string, error) {
+		l.Lock()
+		defer l.Unlock()
+		applied = append(applied, args[0])
+		return "", nil
+	}
+
+	M = mustGetCurrentMappingState()
+	var puis []*pgUpmapItem
+	for i := 1; i <= 5; i++ {
+		puis = append(puis, &pgUpmapItem{PgID: fmt.Sprintf("1.%d", i), Mappings: []mapping{{From: 3, To: 4}}})
+	}
+
+	applyBatchSize, concurrency, applyBatchDelay = 2, 4, time.Millisecond
+	done, err := applyUpmapItems(puis, nil)
+	require.NoError(t, err)
+	require.Len(t, done, 5)
+
+	// Every PG in a batch is applied before any PG in the next.
+	require.Len(t, applied, 5)
+	batch := map[string]int{"1.1": 0, "1.2": 0, "1.3": 1, "1.4": 1, "1.5": 2}
+	for i := 1; i < len(applied); i++ {
+		require.LessOrEqual(t, batch[applied[i-1]], batch[applied[i]], applied)
+	}
+}
+
+func TestApplyPoolPriority(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func(c int) { concurrency = c }(concurrency)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "2.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "2.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] }
+]
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	var applied []string
+	runPgUpmapItems = func(args ...string) (string, error) {
+		applied = append(applied, args[0])
+		return "", nil
+	}
+
+	M = mustGetCurrentMappingState()
+	for _, pgid := range []string{"1.1", "1.2", "2.1", "2.2"} {
+		M.mustRemap(pgid, 3, 4)
+	}
+	M.poolPriority = []int{2}
+
+	// With a single command in flight, the commands are issued in pool
+	// priority order, then in PG ID order.
+	concurrency = 1
+	M.apply()
+	require.Equal(t, []string{"2.1", "2.2", "1.1", "1.2"}, applied)
+}
+
+func TestPgPoolID(t *testing.T) {
+	require.Equal(t, 12, pgPoolID("12.1a"))
+
+	for _, pgid := range []string{"", "12", "x.1", "12.1g"} {
+		_, err := parsePgPoolID(pgid)
+		require.Error(t, err, pgid)
+	}
+	require.PanicsWithValue(t, "can't parse PGID 12", func() { pgPoolID("12") })
+}
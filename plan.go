@@ -0,0 +1,198 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// A plan is the list of upmap items that will be set in the exception table,
+// each containing the complete set of mappings for its PG. An item with no
+// mappings means that the PG's upmap item is to be removed.
+
+func writePlan(w io.Writer, puis []*pgUpmapItem) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(puis)
+}
+
+func readPlan(r io.Reader) ([]*pgUpmapItem, error) {
+	var puis []*pgUpmapItem
+	if err := json.NewDecoder(r).Decode(&puis); err != nil {
+		return nil, err
+	}
+	return puis, nil
+}
+
+func mustWritePlanFile(path string, puis []*pgUpmapItem) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	defer f.Close()
+
+	if err := writePlan(f, puis); err != nil {
+		panic(errors.Wrapf(err, "failed to write plan to %s", path))
+	}
+}
+
+func mustReadPlanFile(path string) []*pgUpmapItem {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	defer f.Close()
+
+	puis, err := readPlan(f)
+	if err != nil {
+		panic(errors.Wrapf(err, "failed to read plan from %s", path))
+	}
+	return puis
+}
+
+// A plan output describes pending changes for automation, e.g. to compare
+// against an approved plan before running with --yes. Unlike a plan, each
+// mapping is tagged with the change made to it.
+type planOutputItem struct {
+	PgID     string              `json:"pgid"`
+	Mappings []planOutputMapping `json:"mappings"`
+}
+
+type planOutputMapping struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+	// For a modified mapping, the OSD it mapped to before.
+	PreviousTo *int `json:"previous_to,omitempty"`
+	// One of added, modified, removed, stale (removed because it had no
+	// effect), or kept.
+	Action string `json:"action"`
+}
+
+func describePlan(puis []*pgUpmapItem) []planOutputItem {
+	items := []planOutputItem{}
+	for _, pui := range puis {
+		item := planOutputItem{PgID: pui.PgID, Mappings: []planOutputMapping{}}
+
+		// A modified mapping keeps its From, and its prior form is
+		// recorded among the removed mappings.
+		removedTo := make(map[int]int, len(pui.removedMappings))
+		for _, mp := range pui.removedMappings {
+			removedTo[mp.From] = mp.To
+		}
+
+		for _, mp := range pui.Mappings {
+			pm := planOutputMapping{From: mp.From, To: mp.To, Action: "kept"}
+			if mp.dirty {
+				pm.Action = "added"
+				if prev, ok := removedTo[mp.From]; ok {
+					pm.Action = "modified"
+					pm.PreviousTo = &prev
+					delete(removedTo, mp.From)
+				}
+			}
+			item.Mappings = append(item.Mappings, pm)
+		}
+		for _, mp := range pui.removedMappings {
+			if _, ok := removedTo[mp.From]; ok {
+				item.Mappings = append(item.Mappings, planOutputMapping{From: mp.From, To: mp.To, Action: "removed"})
+			}
+		}
+		for _, mp := range pui.staleMappings {
+			item.Mappings = append(item.Mappings, planOutputMapping{From: mp.From, To: mp.To, Action: "stale"})
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func mustWritePlanOutputFile(path string, puis []*pgUpmapItem) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(describePlan(puis)); err != nil {
+		panic(errors.Wrapf(err, "failed to write plan output to %s", path))
+	}
+}
+
+// mustWriteRollbackFile writes mappings in the format used by export-mappings
+// and import-mappings.
+func mustWriteRollbackFile(path string, mappings []pgMapping) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(mappings); err != nil {
+		panic(errors.Wrapf(err, "failed to write rollback mappings to %s", path))
+	}
+}
+
+// An apply output records what was actually done to the upmap exception
+// table, for change management: each PG whose upmap item was set or removed,
+// the command used, and the PG's resulting mappings.
+type applyOutputItem struct {
+	PgID string `json:"pgid"`
+	// Either pg-upmap-items or rm-pg-upmap-items.
+	Command  string    `json:"command"`
+	Mappings []mapping `json:"mappings"`
+	// False if the command was only printed, with --input-dir.
+	Applied bool `json:"applied"`
+}
+
+func describeApplied(puis []*pgUpmapItem, applied bool) []applyOutputItem {
+	items := []applyOutputItem{}
+	for _, pui := range puis {
+		item := applyOutputItem{PgID: pui.PgID, Command: "pg-upmap-items", Mappings: pui.Mappings, Applied: applied}
+		if len(pui.Mappings) == 0 {
+			item.Command = "rm-pg-upmap-items"
+			item.Mappings = []mapping{}
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].PgID < items[j].PgID })
+	return items
+}
+
+// mustWriteApplyOutput writes the apply output for the given upmap items to
+// the given path, or to stdout if the path is "-". If applied is false, the
+// items' commands were only printed.
+func mustWriteApplyOutput(path string, puis []*pgUpmapItem, applied bool) {
+	w := io.Writer(os.Stdout)
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			panic(errors.WithStack(err))
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(describeApplied(puis, applied)); err != nil {
+		panic(errors.Wrapf(err, "failed to write apply output to %s", path))
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanRoundTrip(t *testing.T) {
+	puis := []*pgUpmapItem{
+		{PgID: "1.1", Mappings: []mapping{{From: 3, To: 4}}},
+		{PgID: "1.2", Mappings: []mapping{{From: 1, To: 4}, {From: 2, To: 5}}},
+		// An item with no mappings means the upmap item is removed.
+		{PgID: "1.3", Mappings: []mapping{}},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, writePlan(&buf, puis))
+
+	got, err := readPlan(&buf)
+	require.NoError(t, err)
+	require.Len(t, got, len(puis))
+	for i := range puis {
+		require.Equal(t, puis[i].PgID, got[i].PgID)
+		require.ElementsMatch(t, puis[i].Mappings, got[i].Mappings)
+	}
+}
+
+func TestDescribePlan(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 4 ] },
+ { "pgid": "1.2", "up": [ 1, 6, 10 ], "acting": [ 1, 6, 10 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] },
+    { "pgid": "1.2", "mappings": [ { "from": 5, "to": 6 }, { "from": 7, "to": 8 }, { "from": 9, "to": 10 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	M = mustGetCurrentMappingState()
+	M.mustRemap("1.1", 4, 11)
+	M.mustRemap("1.2", 6, 5)
+	M.mustRemap("1.3", 3, 12)
+
+	previous := 4
+	require.Equal(t, []planOutputItem{
+		{PgID: "1.1", Mappings: []planOutputMapping{
+			{From: 3, To: 11, PreviousTo: &previous, Action: "modified"},
+		}},
+		{PgID: "1.2", Mappings: []planOutputMapping{
+			{From: 9, To: 10, Action: "kept"},
+			{From: 5, To: 6, Action: "removed"},
+			{From: 7, To: 8, Action: "stale"},
+		}},
+		{PgID: "1.3", Mappings: []planOutputMapping{
+			{From: 3, To: 12, Action: "added"},
+		}},
+	}, describePlan(M.dirtyUpmapItems()))
+}
+
+func TestApplyOutput(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	path := filepath.Join(t.TempDir(), "applied.json")
+
+	runPgUpmapItems = func(args ...string) (string, error) { return "", nil }
+	runRmPgUpmapItems = func(pgid string) (string, error) { return "", nil }
+
+	applied, err := applyUpmapItems([]*pgUpmapItem{
+		{PgID: "1.2"},
+		{PgID: "1.1", Mappings: []mapping{{From: 1, To: 11}, {From: 2, To: 12}}},
+	}, nil)
+	require.NoError(t, err)
+	mustWriteApplyOutput(path, applied, true)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+  { "pgid": "1.1", "command": "pg-upmap-items", "mappings": [ { "from": 1, "to": 11 }, { "from": 2, "to": 12 } ], "applied": true },
+  { "pgid": "1.2", "command": "rm-pg-upmap-items", "mappings": [], "applied": true }
+]`, string(b))
+
+	// Commands only printed with --input-dir are marked as such.
+	mustWriteApplyOutput(path, applied[:1], false)
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+  { "pgid": "1.2", "command": "rm-pg-upmap-items", "mappings": [], "applied": false }
+]`, string(b))
+}
+
+func TestApplyOutputPartialApply(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func(s string, c int) { applyOutput, concurrency = s, c }(applyOutput, concurrency)
+	applyOutput = filepath.Join(t.TempDir(), "applied.json")
+	concurrency = 1
+
+	runPgUpmapItems = func(args ...string) (string, error) {
+		if args[0] == "1.2" {
+			return "", errors.New("Error ETIMEDOUT")
+		}
+		return "", nil
+	}
+
+	// The PGs applied before the failure are still recorded.
+	m := &mappingState{pgUpmapItems: []*pgUpmapItem{
+		{PgID: "1.1", Mappings: []mapping{{From: 1, To: 11}}, dirty: true},
+		{PgID: "1.2", Mappings: []mapping{{From: 1, To: 12}}, dirty: true},
+		{PgID: "1.3", Mappings: []mapping{{From: 1, To: 13}}, dirty: true},
+	}}
+	require.PanicsWithError(t, "applied 1 of 3 PG(s) before failing: pg 1.2: failed to set upmap item: Error ETIMEDOUT", m.apply)
+
+	b, err := os.ReadFile(applyOutput)
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+  { "pgid": "1.1", "command": "pg-upmap-items", "mappings": [ { "from": 1, "to": 11 } ], "applied": true }
+]`, string(b))
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// upmapProvenanceConfigKeyPrefix is followed by a pool ID: the record is
+// sharded by pool, so that each entry stays well below the mon's config-key
+// size limit and runs that touch different pools don't contend.
+const upmapProvenanceConfigKeyPrefix = "pgremapper/upmap-provenance/"
+
+func upmapProvenanceConfigKey(pool int) string {
+	return fmt.Sprintf("%s%d", upmapProvenanceConfigKeyPrefix, pool)
+}
+
+// upmapProvenance records, per PG, when each of its upmap mappings was
+// created by pgremapper, so that undo-upmaps --older-than can leave recent
+// mappings alone. Ceph's exception table carries no creation time, so this
+// is kept in the mon config-key store where every pgremapper run can find
+// it, if enabled with --record-provenance. Mappings created by other tools
+// (e.g. the balancer) have no entry.
+type upmapProvenance map[string][]provenanceMapping
+
+type provenanceMapping struct {
+	From    int   `json:"from"`
+	To      int   `json:"to"`
+	Created int64 `json:"created"`
+}
+
+// getUpmapProvenance reads the upmap provenance record of the given pools. A
+// missing key means that nothing has been recorded for that pool yet.
+func getUpmapProvenance(pools []int) (upmapProvenance, error) {
+	p := upmapProvenance{}
+	for _, pool := range pools {
+		key := upmapProvenanceConfigKey(pool)
+		out, err := runConfigKeyGet(key)
+		if err != nil {
+			if strings.Contains(err.Error(), "ENOENT") {
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to get config-key %s", key)
+		}
+
+		var shard upmapProvenance
+		if err := json.Unmarshal([]byte(out), &shard); err != nil {
+			return nil, errors.Wrapf(err, "invalid config-key %s", key)
+		}
+		for pgid, pms := range shard {
+			if pgPoolID(pgid) == pool {
+				p[pgid] = pms
+			}
+		}
+	}
+	return p, nil
+}
+
+// putUpmapProvenance writes the upmap provenance record of the given pools,
+// via a file rather than the command line, since it may be large.
+func putUpmapProvenance(p upmapProvenance, pools []int) error {
+	shards := make(map[int]upmapProvenance, len(pools))
+	for _, pool := range pools {
+		shards[pool] = upmapProvenance{}
+	}
+	for pgid, pms := range p {
+		if shard, ok := shards[pgPoolID(pgid)]; ok {
+			shard[pgid] = pms
+		}
+	}
+
+	for _, pool := range pools {
+		key := upmapProvenanceConfigKey(pool)
+		b, err := json.Marshal(shards[pool])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		f, err := os.CreateTemp("", "pgremapper-provenance-*.json")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = f.Write(b)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			_, err = runConfigKeySet(key, f.Name())
+		}
+		os.Remove(f.Name())
+		if err != nil {
+			return errors.Wrapf(err, "failed to set config-key %s", key)
+		}
+	}
+	return nil
+}
+
+// created returns when the given mapping of the given PG was created, if
+// that was recorded.
+func (p upmapProvenance) created(pgid string, mp mapping) (time.Time, bool) {
+	for _, pm := range p[pgid] {
+		if pm.From == mp.From && pm.To == mp.To {
+			return time.Unix(pm.Created, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// updated returns the provenance record after the given upmap items were
+// applied at the given time, on top of the given original mappings. Mappings
+// that were kept as-is keep their creation time, new ones are stamped with
+// now, and entries for mappings that no longer exist are dropped.
+func (p upmapProvenance) updated(applied []*pgUpmapItem, original map[string][]mapping, now time.Time) upmapProvenance {
+	current := make(map[string][]mapping, len(original))
+	for pgid, mappings := range original {
+		current[pgid] = mappings
+	}
+	stamp := make(map[string]struct{}, len(applied))
+	for _, pui := range applied {
+		current[pui.PgID] = pui.Mappings
+		stamp[pui.PgID] = struct{}{}
+	}
+
+	next := upmapProvenance{}
+	for pgid, mappings := range current {
+		_, isApplied := stamp[pgid]
+		for _, mp := range mappings {
+			created, ok := p.created(pgid, mp)
+			switch {
+			case ok:
+			case isApplied:
+				created = now
+			default:
+				// Not created by pgremapper.
+				continue
+			}
+			next[pgid] = append(next[pgid], provenanceMapping{From: mp.From, To: mp.To, Created: created.Unix()})
+		}
+	}
+	return next
+}
+
+// withCreatedBefore matches mappings that pgremapper is recorded to have
+// created before the given time. Mappings without a record never match.
+func withCreatedBefore(p upmapProvenance, t time.Time) mappingFilter {
+	return func(pui *pgUpmapItem, mp mapping) bool {
+		created, ok := p.created(pui.PgID, mp)
+		return ok && created.Before(t)
+	}
+}
+
+// upmapItemPools returns the IDs of the pools of the given upmap items, in
+// ascending order.
+func upmapItemPools(puis []*pgUpmapItem) []int {
+	seen := make(map[int]struct{})
+	for _, pui := range puis {
+		seen[pgPoolID(pui.PgID)] = struct{}{}
+	}
+	pools := make([]int, 0, len(seen))
+	for pool := range seen {
+		pools = append(pools, pool)
+	}
+	sort.Ints(pools)
+	return pools
+}
+
+// recordUpmapProvenance updates the upmap provenance record of the pools of
+// the given applied upmap items, dropping the entries of those pools'
+// mappings that no longer exist. Concurrent runs that apply changes to the
+// same pool may lose each other's updates. The changes have already been
+// made by now, so a failure is only warned about.
+func (m *mappingState) recordUpmapProvenance(applied []*pgUpmapItem, now time.Time) {
+	pools := upmapItemPools(applied)
+	p, err := getUpmapProvenance(pools)
+	if err == nil {
+		err = putUpmapProvenance(p.updated(applied, m.originalMappings, now), pools)
+	}
+	if err != nil {
+		logf(logWarn, "failed to record upmap provenance; undo-upmaps --older-than will treat these mappings as not created by pgremapper: %v", err)
+	}
+}
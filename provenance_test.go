@@ -0,0 +1,190 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUpmapProvenance(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+
+	// A missing key means nothing has been recorded yet.
+	p, err := getUpmapProvenance([]int{1})
+	require.NoError(t, err)
+	require.Empty(t, p)
+
+	// Each pool is read from its own key, and entries of other pools are
+	// ignored.
+	shards := map[string]string{
+		"pgremapper/upmap-provenance/1": `{ "1.1": [ { "from": 1, "to": 2, "created": 100 } ], "2.1": [ { "from": 1, "to": 2, "created": 100 } ] }`,
+		"pgremapper/upmap-provenance/2": `{ "2.2": [ { "from": 3, "to": 4, "created": 200 } ] }`,
+	}
+	runConfigKeyGet = func(key string) (string, error) { return shards[key], nil }
+	p, err = getUpmapProvenance([]int{1, 2})
+	require.NoError(t, err)
+	require.Equal(t, upmapProvenance{
+		"1.1": {{From: 1, To: 2, Created: 100}},
+		"2.2": {{From: 3, To: 4, Created: 200}},
+	}, p)
+	created, ok := p.created("1.1", mapping{From: 1, To: 2})
+	require.True(t, ok)
+	require.Equal(t, time.Unix(100, 0), created)
+	_, ok = p.created("1.1", mapping{From: 1, To: 3})
+	require.False(t, ok)
+
+	runConfigKeyGet = func(string) (string, error) { return "not json", nil }
+	_, err = getUpmapProvenance([]int{1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid config-key pgremapper/upmap-provenance/1")
+
+	runConfigKeyGet = func(string) (string, error) { return "", fmt.Errorf("Error EACCES: access denied") }
+	_, err = getUpmapProvenance([]int{1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to get config-key pgremapper/upmap-provenance/1")
+}
+
+func TestUpmapProvenanceUpdated(t *testing.T) {
+	p := upmapProvenance{
+		"1.1": {{From: 1, To: 2, Created: 100}},
+		"1.2": {{From: 3, To: 4, Created: 200}},
+		// No longer in the exception table.
+		"1.9": {{From: 5, To: 6, Created: 50}},
+	}
+	original := map[string][]mapping{
+		"1.1": {{From: 1, To: 2}},
+		"1.2": {{From: 3, To: 4}},
+		// Created by something else.
+		"1.3": {{From: 5, To: 6}},
+	}
+	applied := []*pgUpmapItem{
+		{PgID: "1.1", Mappings: []mapping{{From: 1, To: 2}, {From: 7, To: 8}}},
+		{PgID: "1.2", Mappings: []mapping{}},
+		{PgID: "1.4", Mappings: []mapping{{From: 9, To: 10}}},
+	}
+
+	require.Equal(t, upmapProvenance{
+		"1.1": {{From: 1, To: 2, Created: 100}, {From: 7, To: 8, Created: 1000}},
+		"1.4": {{From: 9, To: 10, Created: 1000}},
+	}, p.updated(applied, original, time.Unix(1000, 0)))
+}
+
+func TestApplyRecordsUpmapProvenance(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	defer func(r bool) { recordProvenance = r }(recordProvenance)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.2", "up": [ 1, 2, 5 ], "acting": [ 1, 2, 5 ] },
+ { "pgid": "2.1", "up": [ 1, 2, 5 ], "acting": [ 1, 2, 5 ] }
+]
+`
+	osdDumpOut := `{ "pg_upmap_items": [ { "pgid": "1.2", "mappings": [ { "from": 3, "to": 5 } ] } ] }`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	getConfigKey := runConfigKeyGet
+	runConfigKeyGet = func(key string) (string, error) {
+		if key != "pgremapper/upmap-provenance/1" {
+			return getConfigKey(key)
+		}
+		// 1.3's mapping no longer exists, so its entry is pruned.
+		return `{ "1.2": [ { "from": 3, "to": 5, "created": 100 } ], "1.3": [ { "from": 7, "to": 8, "created": 50 } ] }`, nil
+	}
+	runPgUpmapItems = func(...string) (string, error) { return "", nil }
+	written := map[string]string{}
+	runConfigKeySet = func(key, path string) (string, error) {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		written[key] = string(b)
+		return "", nil
+	}
+
+	// Nothing is recorded unless asked for.
+	M = mustGetCurrentMappingState()
+	M.mustRemap("1.1", 3, 4)
+	M.apply()
+	require.Empty(t, written)
+
+	recordProvenance = true
+	M = mustGetCurrentMappingState()
+	M.mustRemap("1.1", 3, 4)
+	before := time.Now()
+	M.apply()
+
+	// Only the pool that was changed is written.
+	require.Len(t, written, 1)
+	var p upmapProvenance
+	require.NoError(t, json.Unmarshal([]byte(written["pgremapper/upmap-provenance/1"]), &p))
+	require.Len(t, p, 2)
+	created, ok := p.created("1.1", mapping{From: 3, To: 4})
+	require.True(t, ok)
+	require.False(t, created.Before(before.Truncate(time.Second)))
+	created, ok = p.created("1.2", mapping{From: 3, To: 5})
+	require.True(t, ok)
+	require.Equal(t, time.Unix(100, 0), created)
+
+	// Failing to record provenance doesn't fail the apply.
+	runConfigKeySet = func(string, string) (string, error) { return "", fmt.Errorf("Error EINVAL: value too big") }
+	M = mustGetCurrentMappingState()
+	M.mustRemap("1.1", 3, 6)
+	require.NotPanics(t, M.apply)
+}
+
+func TestCalcPgMappingsToUndoUpmapsOlderThan(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 2, 3, 4 ], "acting": [ 2, 3, 4 ] },
+ { "pgid": "1.2", "up": [ 2, 3, 4 ], "acting": [ 2, 3, 4 ] },
+ { "pgid": "1.3", "up": [ 2, 3, 4 ], "acting": [ 2, 3, 4 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 1, "to": 2 } ] },
+    { "pgid": "1.2", "mappings": [ { "from": 1, "to": 2 } ] },
+    { "pgid": "1.3", "mappings": [ { "from": 1, "to": 2 } ] }
+  ]
+}
+`
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+
+	// 1.1 is old, 1.2 is recent, and 1.3 wasn't created by pgremapper.
+	now := time.Now()
+	p := upmapProvenance{
+		"1.1": {{From: 1, To: 2, Created: now.Add(-48 * time.Hour).Unix()}},
+		"1.2": {{From: 1, To: 2, Created: now.Add(-time.Hour).Unix()}},
+	}
+
+	M = mustGetCurrentMappingState()
+	M.bs.maxBackfillsFrom = 10
+	M.bs.maxBackfillReservations = 10
+	calcPgMappingsToUndoUpmaps([]int{2}, false, withCreatedBefore(p, now.Add(-24*time.Hour)))
+
+	validateDirtyMappings(t, []expectedMapping{
+		{ID: "1.1", Mappings: nil},
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// stateCache is the on-disk form of a --state-cache file: the raw output of
+// the slow Ceph queries, along with the osdmap epoch they were made at and
+// when the first of them was made.
+type stateCache struct {
+	Epoch   int               `json:"epoch"`
+	Time    time.Time         `json:"time"`
+	Outputs map[string]string `json:"outputs"`
+}
+
+// useStateCache makes the OSD tree and PG dump queries reuse the output saved
+// in the given file by a previous invocation, as long as it is younger than
+// the given TTL and the osdmap epoch, per a fresh 'ceph osd dump', hasn't
+// changed since. Output that isn't reused is saved to the file for the next
+// invocation.
+func useStateCache(path string, ttl time.Duration) error {
+	osdDumpOut, err := runOsdDump()
+	if err != nil {
+		return err
+	}
+	var epoch struct {
+		Epoch int `json:"epoch"`
+	}
+	if err := json.Unmarshal([]byte(osdDumpOut), &epoch); err != nil {
+		return errors.Wrap(err, "failed to parse osdmap epoch")
+	}
+	// There's no need to query the osd dump again.
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+
+	var cache stateCache
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &cache); err != nil {
+			logf(logWarn, "ignoring unreadable state cache %s: %v", path, err)
+			cache = stateCache{}
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if cache.Epoch != epoch.Epoch || time.Since(cache.Time) >= ttl || cache.Outputs == nil {
+		cache = stateCache{Epoch: epoch.Epoch, Time: time.Now(), Outputs: make(map[string]string)}
+	}
+
+	var l sync.Mutex
+	cached := func(key string, f func() (string, error)) func() (string, error) {
+		return func() (string, error) {
+			l.Lock()
+			defer l.Unlock()
+
+			if out, ok := cache.Outputs[key]; ok {
+				debugf("Using %s from state cache %s (epoch %d, age %s)", key, path, cache.Epoch, time.Since(cache.Time).Round(time.Second))
+				return out, nil
+			}
+
+			out, err := f()
+			if err != nil {
+				return "", err
+			}
+			cache.Outputs[key] = out
+			if err := writeStateCache(path, &cache); err != nil {
+				logf(logWarn, "failed to write state cache %s: %v", path, err)
+			}
+			return out, nil
+		}
+	}
+	runOsdTree = cached("osd-tree", runOsdTree)
+	runPgDumpPgsBrief = cached("pg-dump-pgs-brief", runPgDumpPgsBrief)
+	return nil
+}
+
+// writeStateCache replaces the given state cache file, such that a
+// concurrent reader never sees a partial file.
+func writeStateCache(path string, cache *stateCache) error {
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, path))
+}
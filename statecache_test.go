@@ -0,0 +1,80 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUseStateCache(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	path := filepath.Join(t.TempDir(), "state")
+
+	var treeQueries, pgDumpQueries int
+	epoch := 10
+	// Each invocation starts from the uncached queries.
+	invoke := func(ttl time.Duration) {
+		runOsdDump = func() (string, error) { return fmt.Sprintf(`{ "epoch": %d }`, epoch), nil }
+		runOsdTree = func() (string, error) {
+			treeQueries++
+			return fmt.Sprintf("tree %d", treeQueries), nil
+		}
+		runPgDumpPgsBrief = func() (string, error) {
+			pgDumpQueries++
+			return fmt.Sprintf("pgs %d", pgDumpQueries), nil
+		}
+		require.NoError(t, useStateCache(path, ttl))
+	}
+	query := func() (string, string) {
+		tree, err := runOsdTree()
+		require.NoError(t, err)
+		pgs, err := runPgDumpPgsBrief()
+		require.NoError(t, err)
+		return tree, pgs
+	}
+
+	invoke(time.Minute)
+	tree, pgs := query()
+	require.Equal(t, "tree 1", tree)
+	require.Equal(t, "pgs 1", pgs)
+	out, err := runOsdDump()
+	require.NoError(t, err)
+	require.Equal(t, `{ "epoch": 10 }`, out)
+
+	// Reused within the TTL at the same epoch.
+	invoke(time.Minute)
+	tree, pgs = query()
+	require.Equal(t, "tree 1", tree)
+	require.Equal(t, "pgs 1", pgs)
+
+	// Not reused once the epoch changes...
+	epoch = 11
+	invoke(time.Minute)
+	tree, pgs = query()
+	require.Equal(t, "tree 2", tree)
+	require.Equal(t, "pgs 2", pgs)
+
+	// ...or once the TTL has passed.
+	invoke(0)
+	tree, pgs = query()
+	require.Equal(t, "tree 3", tree)
+	require.Equal(t, "pgs 3", pgs)
+}
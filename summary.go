@@ -0,0 +1,186 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runSummary is the machine-readable result of a command, written when
+// --json-summary is given. Its fields are part of pgremapper's interface;
+// don't rename or remove them.
+type runSummary struct {
+	// Whether changes were applied to the cluster (false for dry runs).
+	ChangesMade     bool `json:"changes_made"`
+	PgsAffected     int  `json:"pgs_affected"`
+	MappingsAdded   int  `json:"mappings_added"`
+	MappingsRemoved int  `json:"mappings_removed"`
+	StaleCleaned    int  `json:"stale_cleaned"`
+	// The net change in the number of backfills in the cluster; negative
+	// when backfill has been canceled.
+	NewBackfills int    `json:"new_backfills"`
+	ChangeState  string `json:"change_state"`
+	// Whether --assume-flags-set verified that the norebalance and
+	// nobackfill flags were set when the command ran.
+	FreezeFlagsVerified bool `json:"freeze_flags_verified"`
+}
+
+func summarize(m *mappingState) *runSummary {
+	if m == nil {
+		// The command doesn't make changes to the upmap exception
+		// table.
+		return &runSummary{
+			ChangeState:         NoChange.String(),
+			FreezeFlagsVerified: freezeFlagsVerified,
+		}
+	}
+
+	s := &runSummary{
+		ChangesMade:         m.applied,
+		NewBackfills:        m.bs.backfills - m.initialBackfills,
+		ChangeState:         m.changeState.String(),
+		FreezeFlagsVerified: freezeFlagsVerified,
+	}
+	for _, pui := range m.dirtyUpmapItems() {
+		s.PgsAffected++
+		for _, mp := range pui.Mappings {
+			if mp.dirty {
+				s.MappingsAdded++
+			}
+		}
+		s.MappingsRemoved += len(pui.removedMappings)
+		s.StaleCleaned += len(pui.staleMappings)
+	}
+	return s
+}
+
+func writeSummary(w io.Writer, s *runSummary) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+// mustWriteSummaryFile writes the summary of the command's changes to the
+// given path, or to stderr if the path is "-".
+func mustWriteSummaryFile(path string) {
+	s := summarize(M)
+	if path == "-" {
+		if err := writeSummary(os.Stderr, s); err != nil {
+			panic(errors.WithStack(err))
+		}
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	defer f.Close()
+
+	if err := writeSummary(f, s); err != nil {
+		panic(errors.Wrapf(err, "failed to write summary to %s", path))
+	}
+}
+
+// runMetrics are the per-run counts written in the Prometheus text format
+// when --metrics-file is given, for node_exporter's textfile collector.
+type runMetrics struct {
+	upmapsAdded         int
+	upmapsModified      int
+	upmapsRemoved       int
+	reservationBlocked  int
+	changesApplied      bool
+	lastRunTimestampSec int64
+}
+
+func collectMetrics(m *mappingState, now time.Time) *runMetrics {
+	rm := &runMetrics{lastRunTimestampSec: now.Unix()}
+	if m == nil {
+		return rm
+	}
+
+	rm.changesApplied = m.applied
+	rm.reservationBlocked = m.reservationBlocked
+	for _, pui := range m.dirtyUpmapItems() {
+		original := make(map[int]int)
+		for _, mp := range m.originalMappings[pui.PgID] {
+			original[mp.From] = mp.To
+		}
+		current := make(map[int]struct{})
+		for _, mp := range pui.Mappings {
+			current[mp.From] = struct{}{}
+			if to, ok := original[mp.From]; !ok {
+				rm.upmapsAdded++
+			} else if to != mp.To {
+				rm.upmapsModified++
+			}
+		}
+		for from := range original {
+			if _, ok := current[from]; !ok {
+				rm.upmapsRemoved++
+			}
+		}
+		// Stale mappings are removed from the cluster along with
+		// the changes.
+		rm.upmapsRemoved += len(pui.staleMappings)
+	}
+	return rm
+}
+
+func writeMetrics(w io.Writer, rm *runMetrics) error {
+	metrics := []struct {
+		name, help string
+		value      int64
+	}{
+		{"pgremapper_upmaps_added", "Upmap mappings added in the last run.", int64(rm.upmapsAdded)},
+		{"pgremapper_upmaps_modified", "Upmap mappings whose target was changed in the last run.", int64(rm.upmapsModified)},
+		{"pgremapper_upmaps_removed", "Upmap mappings removed in the last run, including stale ones.", int64(rm.upmapsRemoved)},
+		{"pgremapper_reservation_blocked", "Candidate remaps passed over for lack of a backfill reservation in the last run.", int64(rm.reservationBlocked)},
+		{"pgremapper_changes_applied", "Whether the last run applied its changes to the cluster.", int64(If(rm.changesApplied, 1, 0))},
+		{"pgremapper_last_run_timestamp_seconds", "When the last run finished, in seconds since the epoch.", rm.lastRunTimestampSec},
+	}
+	for _, mt := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", mt.name, mt.help, mt.name, mt.name, mt.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mustWriteMetricsFile writes the metrics of the command's changes to the
+// given path. The file is renamed into place so that the textfile collector
+// never reads a partial file.
+func mustWriteMetricsFile(path string) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+
+	if err := writeMetrics(f, collectMetrics(M, time.Now())); err != nil {
+		f.Close()
+		panic(errors.Wrapf(err, "failed to write metrics to %s", tmp))
+	}
+	if err := f.Close(); err != nil {
+		panic(errors.WithStack(err))
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		panic(errors.WithStack(err))
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 6 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] },
+    { "pgid": "1.3", "mappings": [ { "from": 5, "to": 6 }, { "from": 7, "to": 8 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	var buf bytes.Buffer
+	require.NoError(t, writeSummary(&buf, summarize(nil)))
+	require.JSONEq(t, `{"changes_made": false, "pgs_affected": 0, "mappings_added": 0, "mappings_removed": 0, "stale_cleaned": 0, "new_backfills": 0, "change_state": "no_change", "freeze_flags_verified": false}`, buf.String())
+
+	M = mustGetCurrentMappingState()
+	// Cancel a backfill, and add two more, one of which cleans up a
+	// stale mapping.
+	M.mustRemap("1.1", 4, 3)
+	M.mustRemap("1.2", 3, 5)
+	M.mustRemap("1.3", 2, 9)
+
+	require.Equal(t, &runSummary{
+		ChangesMade:     false,
+		PgsAffected:     3,
+		MappingsAdded:   2,
+		MappingsRemoved: 1,
+		StaleCleaned:    1,
+		NewBackfills:    1,
+		ChangeState:     "changes_pending",
+	}, summarize(M))
+}
+
+func TestCollectMetrics(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	pgDumpOut := `
+[
+ { "pgid": "1.1", "up": [ 1, 2, 4 ], "acting": [ 1, 2, 3 ], "state": "backfill_wait" },
+ { "pgid": "1.2", "up": [ 1, 2, 3 ], "acting": [ 1, 2, 3 ] },
+ { "pgid": "1.3", "up": [ 1, 2, 6 ], "acting": [ 1, 2, 6 ] },
+ { "pgid": "1.4", "up": [ 1, 2, 8 ], "acting": [ 1, 2, 8 ] }
+]
+`
+	osdDumpOut := `
+{
+  "pg_upmap_items": [
+    { "pgid": "1.1", "mappings": [ { "from": 3, "to": 4 } ] },
+    { "pgid": "1.3", "mappings": [ { "from": 5, "to": 6 }, { "from": 7, "to": 8 } ] },
+    { "pgid": "1.4", "mappings": [ { "from": 7, "to": 8 } ] }
+  ]
+}
+`
+	runOsdDump = func() (string, error) { return osdDumpOut, nil }
+	runPgDumpPgsBrief = func() (string, error) { return pgDumpOut, nil }
+
+	now := time.Unix(1700000000, 0)
+	require.Equal(t, &runMetrics{lastRunTimestampSec: 1700000000}, collectMetrics(nil, now))
+
+	M = mustGetCurrentMappingState()
+	// Remove a mapping, add one, add one that cleans up a stale mapping,
+	// and modify one.
+	M.mustRemap("1.1", 4, 3)
+	M.mustRemap("1.2", 3, 5)
+	M.mustRemap("1.3", 2, 9)
+	M.mustRemap("1.4", 8, 9)
+	M.reservationBlocked = 2
+
+	rm := collectMetrics(M, now)
+	require.Equal(t, &runMetrics{
+		upmapsAdded:         2,
+		upmapsModified:      1,
+		upmapsRemoved:       2,
+		reservationBlocked:  2,
+		lastRunTimestampSec: 1700000000,
+	}, rm)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeMetrics(&buf, rm))
+	require.Contains(t, buf.String(), `# HELP pgremapper_upmaps_added Upmap mappings added in the last run.
+# TYPE pgremapper_upmaps_added gauge
+pgremapper_upmaps_added 2
+`)
+	require.Contains(t, buf.String(), "\npgremapper_upmaps_modified 1\n")
+	require.Contains(t, buf.String(), "\npgremapper_upmaps_removed 2\n")
+	require.Contains(t, buf.String(), "\npgremapper_reservation_blocked 2\n")
+	require.Contains(t, buf.String(), "\npgremapper_changes_applied 0\n")
+	require.Contains(t, buf.String(), "\npgremapper_last_run_timestamp_seconds 1700000000\n")
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// targetPolicy decides which of a set of candidate remappings to make. Every
+// candidate passed to choose has already been checked against backfill
+// limits, so a policy only expresses a preference.
+type targetPolicy interface {
+	// choose returns the index of the preferred candidate; candidates is
+	// never empty. It doesn't change the policy's state, since the
+	// candidate may not be used.
+	choose(candidates []pgMapping) int
+	// commit tells the policy that the given remapping was made, for
+	// policies whose preference depends on earlier choices.
+	commit(pm pgMapping)
+}
+
+var targetPolicyNames = []string{"least-busy", "emptiest-by-bytes", "same-host-preferred", "round-robin"}
+
+func newTargetPolicy(name string) (targetPolicy, error) {
+	switch name {
+	case "least-busy":
+		return &leastBusyTargetPolicy{bs: M.bs}, nil
+	case "emptiest-by-bytes":
+		bytes, err := pgBytes()
+		if err != nil {
+			logf(logWarn, "failed to get PG sizes; emptiest-by-bytes won't account for PGs remapped in this run: %v", err)
+		}
+		return &emptiestByBytesTargetPolicy{df: osdDf(), pgBytes: bytes}, nil
+	case "same-host-preferred":
+		return &sameHostPreferredTargetPolicy{
+			tree:     osdTree(),
+			fallback: &leastBusyTargetPolicy{bs: M.bs},
+		}, nil
+	case "round-robin":
+		return &roundRobinTargetPolicy{chosen: make(map[int]int)}, nil
+	}
+	return nil, errors.Errorf("unknown target policy '%s'; must be one of: %s", name, strings.Join(targetPolicyNames, ", "))
+}
+
+// leastBusyTargetPolicy prefers the target with the lowest reservation score.
+// We consider the remote reservation count (the count of backfills in which
+// this OSD is the target) to be more important than the local reservation
+// count (the count of backfills for which this OSD is primary), and thus
+// apply a weight to it.
+//
+// If df is set, the score is additionally divided by the target's free space
+// relative to the emptiest candidate, so that among equally-busy targets the
+// emptiest is preferred, and emptier targets take proportionally more PGs.
+// Targets missing from the df output are considered full.
+type leastBusyTargetPolicy struct {
+	bs *backfillState
+	df map[int]*osdDfNode
+}
+
+func (p *leastBusyTargetPolicy) choose(candidates []pgMapping) int {
+	free := func(osd int) int64 {
+		if n, ok := p.df[osd]; ok && n.KB > n.KBUsed {
+			return n.KB - n.KBUsed
+		}
+		return 0
+	}
+	var maxFree int64
+	for _, m := range candidates {
+		maxFree = max(maxFree, free(m.Mapping.To))
+	}
+
+	best, bestScore := 0, math.Inf(1)
+	for i, m := range candidates {
+		obs := p.bs.osd(m.Mapping.To)
+		score := float64(obs.remoteReservations*10 + obs.localReservations)
+		if p.df != nil {
+			if f := free(m.Mapping.To); f > 0 {
+				score = (score + 1) * float64(maxFree) / float64(f)
+			} else {
+				score = math.Inf(1)
+			}
+		}
+		if score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// commit is a no-op; the backfill state already accounts for the remapping.
+func (p *leastBusyTargetPolicy) commit(pm pgMapping) {}
+
+// weightByCapacity makes the given target policy, which must be or fall back
+// to least-busy, weight its reservation scores by free capacity.
+func weightByCapacity(policy targetPolicy, df map[int]*osdDfNode) error {
+	var lb *leastBusyTargetPolicy
+	switch p := policy.(type) {
+	case *leastBusyTargetPolicy:
+		lb = p
+	case *sameHostPreferredTargetPolicy:
+		lb, _ = p.fallback.(*leastBusyTargetPolicy)
+	}
+	if lb == nil {
+		return errors.New("weighting targets by capacity requires the least-busy or same-host-preferred target policy")
+	}
+	lb.df = df
+	return nil
+}
+
+// emptiestByBytesTargetPolicy prefers the target with the lowest utilization,
+// as reported by 'ceph osd df'. Targets missing from the df output are
+// considered full. The df output is a snapshot, so the bytes of the PGs (or
+// EC shards) chosen so far, per pgBytes, are added to each target's
+// utilization; otherwise, the emptiest target would take every PG.
+type emptiestByBytesTargetPolicy struct {
+	df      map[int]*osdDfNode
+	pgBytes map[string]int64
+	planned map[int]float64
+}
+
+func (p *emptiestByBytesTargetPolicy) choose(candidates []pgMapping) int {
+	best, bestUtil := 0, math.Inf(1)
+	for i, m := range candidates {
+		util := 100.0
+		if n, ok := p.df[m.Mapping.To]; ok {
+			util = n.Utilization
+			if n.KB > 0 {
+				util += p.planned[m.Mapping.To] / float64(n.KB*1024) * 100
+			}
+		}
+		if util < bestUtil {
+			best, bestUtil = i, util
+		}
+	}
+	return best
+}
+
+func (p *emptiestByBytesTargetPolicy) commit(pm pgMapping) {
+	if bytes := p.pgBytes[pm.PgID]; bytes > 0 {
+		if p.planned == nil {
+			p.planned = make(map[int]float64)
+		}
+		p.planned[pm.Mapping.To] += float64(bytes) * osdPoolDetails().PgShardFraction(pm.PgID)
+	}
+}
+
+// sameHostPreferredTargetPolicy prefers targets on the same host as the
+// source, which keeps backfill traffic off the network where CRUSH allows
+// it. The fallback policy chooses among the preferred candidates, or among
+// all candidates if none share a host with their source.
+type sameHostPreferredTargetPolicy struct {
+	tree     *parsedOsdTree
+	fallback targetPolicy
+}
+
+func (p *sameHostPreferredTargetPolicy) choose(candidates []pgMapping) int {
+	host := func(osd int) *osdTreeNode {
+		n, ok := p.tree.IDToNode[osd]
+		if !ok {
+			return nil
+		}
+		return n.getNearestParentOfType("host")
+	}
+
+	var (
+		sameHost []pgMapping
+		indices  []int
+	)
+	for i, m := range candidates {
+		if h := host(m.Mapping.From); h != nil && h == host(m.Mapping.To) {
+			sameHost = append(sameHost, m)
+			indices = append(indices, i)
+		}
+	}
+	if len(sameHost) == 0 {
+		return p.fallback.choose(candidates)
+	}
+	return indices[p.fallback.choose(sameHost)]
+}
+
+func (p *sameHostPreferredTargetPolicy) commit(pm pgMapping) {
+	p.fallback.commit(pm)
+}
+
+// roundRobinTargetPolicy spreads remappings evenly across targets by
+// preferring the target it has chosen the fewest times so far, breaking
+// ties by lowest OSD ID.
+type roundRobinTargetPolicy struct {
+	chosen map[int]int
+}
+
+func (p *roundRobinTargetPolicy) choose(candidates []pgMapping) int {
+	best := 0
+	for i, m := range candidates {
+		to, bestTo := m.Mapping.To, candidates[best].Mapping.To
+		if p.chosen[to] < p.chosen[bestTo] || (p.chosen[to] == p.chosen[bestTo] && to < bestTo) {
+			best = i
+		}
+	}
+	return best
+}
+
+func (p *roundRobinTargetPolicy) commit(pm pgMapping) {
+	p.chosen[pm.Mapping.To]++
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetPolicies(t *testing.T) {
+	candidates := []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 0, To: 10}},
+		{PgID: "1.1", Mapping: mapping{From: 0, To: 11}},
+		{PgID: "1.1", Mapping: mapping{From: 0, To: 20}},
+	}
+
+	bs := makeBackfillState()
+	bs.osd(10).remoteReservations = 1
+	bs.osd(11).localReservations = 2
+	bs.osd(20).localReservations = 1
+	require.Equal(t, 2, (&leastBusyTargetPolicy{bs: bs}).choose(candidates))
+
+	df := map[int]*osdDfNode{
+		10: {ID: 10, Utilization: 40},
+		11: {ID: 11, Utilization: 30},
+	}
+	require.Equal(t, 1, (&emptiestByBytesTargetPolicy{df: df}).choose(candidates))
+
+	// 0, 10, and 11 are on host a; 20 is on host b.
+	hostA := &osdTreeNode{Name: "a", Type: "host"}
+	hostB := &osdTreeNode{Name: "b", Type: "host"}
+	tree := &parsedOsdTree{IDToNode: map[int]*osdTreeNode{
+		0:  {ID: 0, Type: "osd", Parent: hostA},
+		10: {ID: 10, Type: "osd", Parent: hostA},
+		11: {ID: 11, Type: "osd", Parent: hostA},
+		20: {ID: 20, Type: "osd", Parent: hostB},
+	}}
+	sameHost := &sameHostPreferredTargetPolicy{tree: tree, fallback: &leastBusyTargetPolicy{bs: bs}}
+	require.Equal(t, 1, sameHost.choose(candidates))
+	require.Equal(t, 0, sameHost.choose(candidates[2:]))
+
+	// Choosing alone doesn't advance the round-robin; only commit does.
+	rr := &roundRobinTargetPolicy{chosen: make(map[int]int)}
+	require.Equal(t, 0, rr.choose(candidates))
+	require.Equal(t, 0, rr.choose(candidates))
+	var chosen []int
+	for i := 0; i < 4; i++ {
+		pm := candidates[rr.choose(candidates)]
+		rr.commit(pm)
+		chosen = append(chosen, pm.Mapping.To)
+	}
+	require.Equal(t, []int{10, 11, 20, 10}, chosen)
+}
+
+func TestEmptiestByBytesTargetPolicyPlannedBytes(t *testing.T) {
+	setupTest(t)
+	defer teardownTest(t)
+	candidates := []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 0, To: 10}},
+		{PgID: "1.1", Mapping: mapping{From: 0, To: 11}},
+	}
+	df := map[int]*osdDfNode{
+		10: {ID: 10, KB: 1000, Utilization: 30},
+		11: {ID: 11, KB: 1000, Utilization: 40},
+	}
+
+	// Each PG is 20% of an OSD, so once osd 10 takes one, osd 11 is
+	// emptier. Candidates that are chosen but not committed, e.g. because
+	// they were rejected, aren't counted.
+	p := &emptiestByBytesTargetPolicy{df: df, pgBytes: map[string]int64{"1.1": 200 * 1024}}
+	require.Equal(t, 0, p.choose(candidates))
+	require.Equal(t, 0, p.choose(candidates))
+	var chosen []int
+	for i := 0; i < 3; i++ {
+		pm := candidates[p.choose(candidates)]
+		p.commit(pm)
+		chosen = append(chosen, pm.Mapping.To)
+	}
+	require.Equal(t, []int{10, 11, 10}, chosen)
+}
+
+func TestLeastBusyTargetPolicyWeightByCapacity(t *testing.T) {
+	candidates := []pgMapping{
+		{PgID: "1.1", Mapping: mapping{From: 0, To: 10}},
+		{PgID: "1.1", Mapping: mapping{From: 0, To: 11}},
+		{PgID: "1.1", Mapping: mapping{From: 0, To: 20}},
+	}
+	df := map[int]*osdDfNode{
+		10: {ID: 10, KB: 1000, KBUsed: 900},
+		11: {ID: 11, KB: 1000, KBUsed: 600},
+	}
+
+	// Equally busy, so the emptiest wins; 20 is missing from df and is
+	// never preferred.
+	bs := makeBackfillState()
+	p := &leastBusyTargetPolicy{bs: bs}
+	require.NoError(t, weightByCapacity(p, df))
+	require.Equal(t, 1, p.choose(candidates))
+
+	// 11 has four times the free space of 10, but is now busier.
+	bs.osd(11).remoteReservations = 1
+	require.Equal(t, 0, p.choose(candidates))
+
+	sameHost := &sameHostPreferredTargetPolicy{tree: &parsedOsdTree{}, fallback: &leastBusyTargetPolicy{bs: bs}}
+	require.NoError(t, weightByCapacity(sameHost, df))
+
+	err := weightByCapacity(&roundRobinTargetPolicy{chosen: make(map[int]int)}, df)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "requires the least-busy")
+}